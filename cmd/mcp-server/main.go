@@ -1,5 +1,13 @@
 package main
 
+import (
+	"os"
+
+	"github.com/mrlm-net/tracer/internal/mcp"
+)
+
 func main() {
-	// TODO: Implement MCP server logic
+	os.Exit(
+		mcp.Run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr),
+	)
 }
@@ -1,3 +1,13 @@
 package main
 
-func main() {}
+import (
+	"os"
+
+	"github.com/mrlm-net/tracer/internal/web"
+)
+
+func main() {
+	os.Exit(
+		web.Run(os.Args[1:], os.Stderr),
+	)
+}
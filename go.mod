@@ -1,3 +1,22 @@
 module github.com/mrlm-net/tracer
 
-go 1.25
\ No newline at end of file
+go 1.25.0
+
+require github.com/google/uuid v1.6.0
+
+require github.com/andybalholm/brotli v1.2.0
+
+require (
+	github.com/quic-go/quic-go v0.59.1
+	golang.org/x/net v0.58.0
+	google.golang.org/grpc v1.82.1
+	google.golang.org/protobuf v1.36.11
+)
+
+require (
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/crypto v0.55.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.41.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260414002931-afd174a4e478 // indirect
+)
@@ -2,105 +2,144 @@ package console
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 
-	httppkg "github.com/mrlm-net/tracer/pkg/http"
-	tcpkg "github.com/mrlm-net/tracer/pkg/tcp"
-	udppkg "github.com/mrlm-net/tracer/pkg/udp"
+	"github.com/mrlm-net/tracer/pkg/bench"
+	"github.com/mrlm-net/tracer/pkg/dns"
+	eventpkg "github.com/mrlm-net/tracer/pkg/event"
+	"github.com/mrlm-net/tracer/pkg/grpc"
+	httptracer "github.com/mrlm-net/tracer/pkg/http"
+	"github.com/mrlm-net/tracer/pkg/http2"
+	"github.com/mrlm-net/tracer/pkg/http3"
+	"github.com/mrlm-net/tracer/pkg/monitor"
+	"github.com/mrlm-net/tracer/pkg/tcp"
+	"github.com/mrlm-net/tracer/pkg/tracer"
+	_ "github.com/mrlm-net/tracer/pkg/tracer/builtin"
+	"github.com/mrlm-net/tracer/pkg/udp"
 )
 
 // dispatchTrace runs the appropriate tracer based on cfg and returns an exit code.
 func dispatchTrace(ctx context.Context, cfg consoleConfig, stdout, stderr *os.File) int {
-	switch cfg.Tracer {
-	case "udp":
-		addr, err := targetToAddr(cfg.Target, "udp")
-		if err != nil {
-			fmt.Fprintf(stderr, "%v\n", err)
-			return 1
-		}
-		emitter, be := makeEmitter(cfg.Output, stdout)
-		opts := []udppkg.Option{udppkg.WithEmitter(emitter), udppkg.WithDryRun(cfg.DryRun), udppkg.WithIPPreference(cfg.PreferIP)}
-		if cfg.Data != "" {
-			opts = append(opts, udppkg.WithDataString(cfg.Data))
-		}
-		if err := udppkg.TraceAddr(ctx, addr, opts...); err != nil {
-			fmt.Fprintf(stderr, "udp tracer failed: %v\n", err)
+	run, code := buildRunner(cfg, stderr)
+	if run == nil {
+		return code
+	}
+
+	emitter, be := makeEmitter(cfg.Output, stdout)
+	if cfg.Watch > 0 {
+		err := monitor.Watch(ctx, run, monitor.WithEmitter(emitter), monitor.WithInterval(cfg.Watch), monitor.WithThresholds(cfg.Thresholds...), monitor.WithMaxFailures(cfg.MaxFailures), monitor.WithChecks(cfg.Checks))
+		// an interrupted watch (SIGINT/SIGTERM) is a normal shutdown
+		if err != nil && !errors.Is(err, context.Canceled) {
+			fmt.Fprintf(stderr, "%s watch failed: %v\n", cfg.Tracer, err)
 			return 1
 		}
-		if be != nil {
-			if err := writeHTMLReport(cfg.OutFile, be.Events(), stdout, stderr); err != nil {
-				fmt.Fprintf(stderr, "%v\n", err)
-				return 1
-			}
-		}
-		return 0
-	case "tcp":
-		addr, err := targetToAddr(cfg.Target, "tcp")
+	} else if cfg.Count > 1 || cfg.Concurrency > 1 {
+		res, err := bench.Run(ctx, run, bench.WithEmitter(emitter), bench.WithCount(cfg.Count), bench.WithConcurrency(cfg.Concurrency), bench.WithInterval(cfg.Interval), bench.WithIterationEvents(true))
 		if err != nil {
-			fmt.Fprintf(stderr, "%v\n", err)
+			fmt.Fprintf(stderr, "%s benchmark interrupted: %v\n", cfg.Tracer, err)
 			return 1
 		}
-		emitter, be := makeEmitter(cfg.Output, stdout)
-		opts := []tcpkg.Option{tcpkg.WithEmitter(emitter), tcpkg.WithDryRun(cfg.DryRun), tcpkg.WithIPPreference(cfg.PreferIP)}
-		if cfg.Data != "" {
-			opts = append(opts, tcpkg.WithDataString(cfg.Data))
+		if res.Errors == res.Iterations {
+			fmt.Fprintf(stderr, "%s tracer failed: all %d iterations failed\n", cfg.Tracer, res.Iterations)
+			return 1
 		}
-		if err := tcpkg.TraceAddr(ctx, addr, opts...); err != nil {
-			fmt.Fprintf(stderr, "tcp tracer failed: %v\n", err)
+	} else if err := run(ctx, emitter); err != nil {
+		fmt.Fprintf(stderr, "%s tracer failed: %v\n", cfg.Tracer, err)
+		return 1
+	}
+
+	if be != nil {
+		if err := writeHTMLReport(cfg.OutFile, be.Events(), stdout, stderr); err != nil {
+			fmt.Fprintf(stderr, "%v\n", err)
 			return 1
 		}
-		if be != nil {
-			if err := writeHTMLReport(cfg.OutFile, be.Events(), stdout, stderr); err != nil {
-				fmt.Fprintf(stderr, "%v\n", err)
-				return 1
-			}
+	}
+	return 0
+}
+
+// buildRunner validates cfg and returns a function running the selected tracer
+// once against the given emitter. On failure it returns nil and an exit code.
+func buildRunner(cfg consoleConfig, stderr *os.File) (bench.RunFunc, int) {
+	h := make(http.Header)
+	for _, hv := range cfg.HeaderFlags {
+		parts := splitHeader(hv)
+		if parts == nil {
+			fmt.Fprintf(stderr, "invalid header %q, expected 'Name: value'\n", hv)
+			return nil, 2
+		}
+		h.Add(parts[0], parts[1])
+	}
+	if cfg.Probe != "" {
+		if cfg.Tracer != "tcp" && cfg.Tracer != "tls" {
+			fmt.Fprintf(stderr, "-probe needs -tracer tcp or tls\n")
+			return nil, 2
 		}
-		return 0
-	case "http":
-		emitter, be := makeEmitter(cfg.Output, stdout)
-		opts := []httppkg.Option{httppkg.WithEmitter(emitter), httppkg.WithDryRun(cfg.DryRun), httppkg.WithInjectTraceHeader(cfg.InjectTraceHeader), httppkg.WithIPPreference(cfg.PreferIP)}
-		if cfg.Method != "" && cfg.Method != "GET" {
-			opts = append(opts, httppkg.WithMethod(cfg.Method))
+		if cfg.Data != "" || cfg.Script != nil || cfg.TCPStream || cfg.Interactive {
+			fmt.Fprintf(stderr, "-probe cannot be combined with -data, -script, -tcp-stream or -interactive\n")
+			return nil, 2
 		}
-		if cfg.Data != "" {
-			opts = append(opts, httppkg.WithBodyString(cfg.Data))
-			h := make(http.Header)
-			h.Set("Content-Type", "application/json")
-			opts = append(opts, httppkg.WithHeaders(h))
+	}
+	if cfg.Interactive {
+		if cfg.Tracer != "tcp" && cfg.Tracer != "tls" {
+			fmt.Fprintf(stderr, "-interactive needs -tracer tcp or tls\n")
+			return nil, 2
 		}
-		if len(cfg.HeaderFlags) > 0 {
-			h := make(http.Header)
-			for _, hv := range cfg.HeaderFlags {
-				parts := splitHeader(hv)
-				if parts == nil {
-					fmt.Fprintf(stderr, "invalid header %q, expected 'Name: value'\n", hv)
-					return 2
-				}
-				h.Add(parts[0], parts[1])
-			}
-			opts = append(opts, httppkg.WithHeaders(h))
+		if cfg.Watch > 0 || cfg.Count > 1 || cfg.Concurrency > 1 || cfg.Script != nil {
+			fmt.Fprintf(stderr, "-interactive cannot be combined with -watch, -count, -concurrency or -script\n")
+			return nil, 2
 		}
-		// Wire redaction options from CLI to the http tracer. Apply coarse-grained
-		// option first then fine-grained options so specific flags override.
-		opts = append(opts, httppkg.WithRedact(cfg.Redact), httppkg.WithRedactRequests(cfg.RedactRequests), httppkg.WithRedactResponses(cfg.RedactResponses))
+	}
+	// ws sends -data as a message and grpc as a protobuf message, not as
+	// a JSON request body
+	if cfg.Data != "" && cfg.Tracer != "ws" && cfg.Tracer != "grpc" && h.Get("Content-Type") == "" {
+		h.Set("Content-Type", "application/json")
+	}
 
-		if err := httppkg.TraceURL(ctx, cfg.Target, opts...); err != nil {
-			fmt.Fprintf(stderr, "http tracer failed: %v\n", err)
-			return 1
-		}
-		if be != nil {
-			if err := writeHTMLReport(cfg.OutFile, be.Events(), stdout, stderr); err != nil {
-				fmt.Fprintf(stderr, "%v\n", err)
-				return 1
-			}
-		}
-		return 0
-	default:
-		fmt.Fprintf(stderr, "Unknown tracer type: %s\n", cfg.Tracer)
-		return 1
+	opts := []tracer.Option{
+		tracer.WithDryRun(cfg.DryRun),
+		tracer.WithIPPreference(cfg.PreferIP),
+		tracer.WithData(cfg.Data),
+		tracer.WithHeaders(h),
+		tracer.WithInjectTraceHeader(cfg.InjectTraceHeader),
+		tracer.WithCaptureBody(cfg.CaptureBody),
+		tracer.WithTLS(cfg.TLS),
+		tracer.WithResolver(cfg.Resolver),
+		tracer.WithProxy(cfg.Proxy, cfg.NoProxy),
+		dns.Settings.With(dns.TracerSettings{QueryType: cfg.QueryType, Trace: cfg.DNSTrace, Roots: cfg.DNSRoots}),
+		http2.Settings.With(http2.TracerSettings{Upgrade: cfg.H2CUpgrade, Window: uint32(cfg.H2Window)}),
+		http3.Settings.With(http3.TracerSettings{AltSvc: cfg.H3AltSvc, ZeroRTT: cfg.H3ZeroRTT, Migrate: cfg.H3Migrate, Versions: cfg.QUICVersions}),
+		httptracer.WebSocket.With(httptracer.WebSocketSettings{Messages: cfg.WSMessages, Binary: cfg.WSBinary, Pings: cfg.WSPings, Listen: cfg.WSListen}),
+		grpc.Settings.With(grpc.TracerSettings{Descriptors: cfg.GRPCDescriptors, Health: cfg.GRPCHealth}),
+		udp.Settings.With(udp.TracerSettings{Script: cfg.Script}),
+		// Apply coarse-grained redaction first then fine-grained options so
+		// specific flags override.
+		tracer.WithRedact(cfg.Redact), tracer.WithRedactRequests(cfg.RedactRequests), tracer.WithRedactResponses(cfg.RedactResponses),
+	}
+	if cfg.Method != "" && cfg.Method != "GET" {
+		opts = append(opts, tracer.WithMethod(cfg.Method))
 	}
+	tcpSettings := tcp.TracerSettings{Stream: cfg.TCPStream, Idle: cfg.TCPIdle, MaxBytes: cfg.TCPMaxBytes, HalfClose: cfg.TCPHalfClose, Script: cfg.Script, Probe: cfg.Probe}
+	// stdout carries the events, so the conversation goes to stderr
+	if cfg.Interactive {
+		tcpSettings.Input, tcpSettings.Output = os.Stdin, stderr
+	}
+	opts = append(opts, tcp.Settings.With(tcpSettings))
+
+	// construct once up front so unknown tracers fail before any output
+	if _, err := tracer.New(cfg.Tracer, opts...); err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return nil, 1
+	}
+	return func(ctx context.Context, emitter eventpkg.Emitter) error {
+		t, err := tracer.New(cfg.Tracer, append(opts, tracer.WithEmitter(emitter))...)
+		if err != nil {
+			return err
+		}
+		return t.Trace(ctx, cfg.Target)
+	}, 0
 }
 
 // splitHeader parses "Name: value" into [name, value] or returns nil.
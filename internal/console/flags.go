@@ -6,13 +6,23 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/mrlm-net/tracer/pkg/expect"
+	"github.com/mrlm-net/tracer/pkg/http2"
+	"github.com/mrlm-net/tracer/pkg/monitor"
+	"github.com/mrlm-net/tracer/pkg/netutil"
+	"github.com/mrlm-net/tracer/pkg/probe"
+	"github.com/mrlm-net/tracer/pkg/tlsinfo"
+	"github.com/mrlm-net/tracer/pkg/tracer"
 )
 
-type headerFlags []string
+// stringsFlag collects the values of a repeatable flag.
+type stringsFlag []string
 
-func (h *headerFlags) String() string { return strings.Join(*h, ", ") }
+func (h *stringsFlag) String() string { return strings.Join(*h, ", ") }
 
-func (h *headerFlags) Set(v string) error {
+func (h *stringsFlag) Set(v string) error {
 	*h = append(*h, v)
 	return nil
 }
@@ -27,12 +37,67 @@ type consoleConfig struct {
 	PreferIP          string
 	Output            string
 	OutFile           string
-	HeaderFlags       headerFlags
+	HeaderFlags       stringsFlag
 	Target            string
 	// Redaction controls
 	Redact          bool
 	RedactRequests  bool
 	RedactResponses bool
+	// CaptureBody is the HTTP response body capture limit in bytes (0: off).
+	CaptureBody int64
+	// Benchmark controls; Count or Concurrency above 1 enables repeat mode.
+	Count       int
+	Concurrency int
+	Interval    time.Duration
+	// Watch mode; a non-zero Watch interval enables it.
+	Watch       time.Duration
+	Thresholds  []monitor.Threshold
+	MaxFailures int
+	Checks      int
+	// TLS is the client TLS configuration for the http and tls tracers.
+	TLS tlsinfo.Config
+	// Proxy and NoProxy configure the proxy of the http, tcp, tls and udp
+	// tracers.
+	Proxy   string
+	NoProxy string
+	// Resolver is set when -dns-server or -resolve is given.
+	Resolver *netutil.Resolver
+	// QueryType is the record type queried by the dns tracer.
+	QueryType string
+	// DNSTrace walks the delegation from DNSRoots (default the IANA roots).
+	DNSTrace bool
+	DNSRoots []string
+	// H2CUpgrade and H2Window configure the http2 tracer.
+	H2CUpgrade bool
+	H2Window   uint
+	// H3AltSvc, H3ZeroRTT, H3Migrate and QUICVersions configure the http3
+	// tracer.
+	H3AltSvc     bool
+	H3ZeroRTT    bool
+	H3Migrate    bool
+	QUICVersions []string
+	// WSMessages, WSBinary, WSPings and WSListen configure the ws tracer.
+	WSMessages stringsFlag
+	WSBinary   bool
+	WSPings    int
+	WSListen   time.Duration
+	// GRPCDescriptors (read from -grpc-descriptor-set) and GRPCHealth
+	// configure the grpc tracer.
+	GRPCDescriptors []byte
+	GRPCHealth      bool
+	// TCPStream, TCPIdle, TCPMaxBytes and TCPHalfClose configure the
+	// streaming read of the tcp and tls tracers.
+	TCPStream    bool
+	TCPIdle      time.Duration
+	TCPMaxBytes  int64
+	TCPHalfClose bool
+	// Script is the send/expect script read from -script.
+	Script *expect.Script
+	// Interactive pipes stdin to the tcp or tls connection and the data
+	// received to stderr.
+	Interactive bool
+	// Probe names the protocol handshake run by the tcp and tls tracers.
+	Probe string
 }
 
 // parseFlags parses CLI args and returns a consoleConfig or error.
@@ -40,7 +105,7 @@ func parseFlags(args []string, stdout, stderr *os.File) (consoleConfig, error) {
 	fs := flag.NewFlagSet("console", flag.ContinueOnError)
 	fs.SetOutput(stderr)
 
-	tracerFlag := fs.String("tracer", "http", "Type of tracer to use: udp, tcp, http, noop")
+	tracerFlag := fs.String("tracer", "http", "Type of tracer to use: "+strings.Join(tracer.Names(), ", "))
 	dryRun := fs.Bool("dry-run", false, "If true, don't perform network requests; only show what would run")
 	injectTraceHeader := fs.Bool("inject-trace-id", false, "If true, add X-Trace-Id header to outgoing requests")
 	methodFlag := fs.String("method", "GET", "HTTP method to use for http tracer")
@@ -53,9 +118,78 @@ func parseFlags(args []string, stdout, stderr *os.File) (consoleConfig, error) {
 	// redaction flags (default: enabled)
 	redactFlag := fs.Bool("redact", true, "If true, redact sensitive headers in emitted events (Authorization, Cookie, Set-Cookie)")
 	redactReqFlag := fs.Bool("redact-requests", true, "Redact request headers (Authorization, Cookie)")
-	redactRespFlag := fs.Bool("redact-responses", true, "Redact response headers (Set-Cookie)")
+	redactRespFlag := fs.Bool("redact-responses", true, "Redact response headers (Set-Cookie) and script step data")
+
+	captureBodyFlag := fs.Int64("capture-body", 0, "Capture up to N decoded bytes of the HTTP response body (also reports full size, transfer time and SHA-256; 0 disables)")
+
+	// repeat/benchmark flags
+	countFlag := fs.Int("count", 1, "Run the trace N times and report per-stage latency percentiles")
+	concurrencyFlag := fs.Int("concurrency", 1, "Number of iterations to run in parallel when -count > 1")
+	intervalFlag := fs.Duration("interval", 0, "Minimum delay between iteration starts when -count > 1 (e.g. 100ms)")
+
+	// watch/probe flags
+	watchFlag := fs.Duration("watch", 0, "Re-run the trace every interval (e.g. 10s) and evaluate thresholds; 0 disables watch mode")
+	var thresholdFlags stringsFlag
+	fs.Var(&thresholdFlags, "threshold", "Watch failure rule '<stage><op><value>', e.g. 'tls_handshake_done>200ms' or 'status!=200' (repeatable)")
+	maxFailuresFlag := fs.Int("max-failures", 3, "Exit non-zero after N consecutive failed watch checks (0: never)")
+	checksFlag := fs.Int("checks", 0, "Stop watch mode after N checks (0: run until interrupted)")
+
+	// resolver flags
+	dnsServerFlag := fs.String("dns-server", "", "Resolve hostnames (and send dns tracer queries) with this DNS server instead of the system resolver: 1.1.1.1, tcp://1.1.1.1:53, tls://1.1.1.1 (DoT) or https://dns.google/dns-query (DoH)")
+	var resolveFlags stringsFlag
+	fs.Var(&resolveFlags, "resolve", "Static address for a host, curl style 'host:port:addr[,addr]' (port may be '*'; repeatable)")
+	dnsTraceFlag := fs.Bool("dns-trace", false, "With -tracer dns, resolve iteratively from the root servers like dig +trace, reporting each referral, lame servers and inconsistent authoritative answers")
+	var dnsRootFlags stringsFlag
+	fs.Var(&dnsRootFlags, "dns-root", "Root server IP[:port] for -dns-trace instead of the IANA roots; all roots must use the same port, on which referrals are queried (repeatable)")
+	qtypeFlag := fs.String("qtype", "A", "Record type queried by the dns tracer: A|AAAA|CNAME|MX|TXT|SRV|NS|SOA|PTR|CAA|ANY or TYPEnnn")
+
+	// proxy flags
+	proxyFlag := fs.String("proxy", "", "Proxy: http://[user:pass@]host:port, https://..., socks5://... (target resolved locally) or socks5h://... (resolved by the proxy); tcp/tls tunnel through it, udp needs SOCKS5; 'direct' ignores HTTP_PROXY/HTTPS_PROXY")
+	noProxyFlag := fs.String("no-proxy", "", "Comma-separated hosts, domains (.example.com) or CIDRs that bypass the proxy; overrides NO_PROXY")
+
+	// HTTP/2 flags
+	h2cUpgradeFlag := fs.Bool("h2c-upgrade", false, "With -tracer http2 and an http:// URL, negotiate h2c with an HTTP/1.1 'Upgrade: h2c' request instead of prior knowledge")
+	h2WindowFlag := fs.Uint("h2-window", 0, "Receive window the http2 tracer advertises for the stream and connection in bytes (default 4194304, max 2147483647); small values expose WINDOW_UPDATE pacing")
+
+	// HTTP/3 flags
+	h3AltSvcFlag := fs.Bool("h3-alt-svc", false, "With -tracer http3, discover the HTTP/3 endpoint from the Alt-Svc header of an HTTP/1.1 or HTTP/2 response first")
+	h3ZeroRTTFlag := fs.Bool("h3-0rtt", false, "With -tracer http3, make a warm-up connection for a session ticket and send the request as 0-RTT early data on a second connection")
+	h3MigrateFlag := fs.Bool("h3-migrate", false, "With -tracer http3, migrate the connection to a new local UDP socket after the handshake and before the request")
+	quicVersionsFlag := fs.String("quic-versions", "", "Comma-separated QUIC versions the http3 tracer offers, in order: v1 or v2, by name or in hex (e.g. 0x6b3343cf)")
 
-	var header headerFlags
+	// WebSocket flags
+	var wsMessageFlags stringsFlag
+	fs.Var(&wsMessageFlags, "ws-message", "With -tracer ws, a message to send after the upgrade (repeatable; -data is sent first). Each waits up to -ws-listen for a reply")
+	wsBinaryFlag := fs.Bool("ws-binary", false, "With -tracer ws, send the messages as binary instead of text frames")
+	wsPingsFlag := fs.Int("ws-pings", 1, "With -tracer ws, number of pings sent after the messages to measure the round trip")
+	wsListenFlag := fs.Duration("ws-listen", time.Second, "With -tracer ws, how long to wait for each reply and pong, for further messages before closing, and for the closing handshake")
+
+	// gRPC flags
+	grpcDescFlag := fs.String("grpc-descriptor-set", "", "With -tracer grpc, a FileDescriptorSet file (protoc --descriptor_set_out --include_imports) describing the method instead of server reflection")
+	grpcHealthFlag := fs.Bool("grpc-health", false, "With -tracer grpc, call grpc.health.v1.Health/Check for the service named by the target path (grpc://host:port[/service])")
+
+	// TCP flags
+	tcpStreamFlag := fs.Bool("tcp-stream", false, "With -tracer tcp or tls, keep reading after -data until the peer closes the connection, -tcp-idle passes without data or -tcp-max-bytes are read, reporting every chunk with its timing")
+	tcpIdleFlag := fs.Duration("tcp-idle", 5*time.Second, "How long -tcp-stream and -interactive wait for more data before ending the session")
+	tcpMaxBytesFlag := fs.Int64("tcp-max-bytes", 0, "With -tcp-stream, stop after reading N bytes (0: no limit); with -script, fail a step after N bytes without a match (0: 1 MiB)")
+	tcpHalfCloseFlag := fs.Bool("tcp-half-close", false, "With -tracer tcp or tls, shut down the write side of the connection (FIN, or close_notify over TLS) after sending -data")
+	scriptFlag := fs.String("script", "", "With -tracer tcp, tls or udp, a send/expect script file run after -data (send, sendline, expect <regexp>, timeout <duration>); each exchange is a step event and an unmet expectation fails the trace")
+	interactiveFlag := fs.Bool("interactive", false, "With -tracer tcp or tls, send stdin to the connection as it is typed and print the data received to stderr, like a traced netcat; EOF (Ctrl-D) half-closes the connection and Ctrl-C ends the session")
+	probeFlag := fs.String("probe", "", "Run a protocol handshake and report the server's version and auth methods: "+strings.Join(probe.Names(), ", ")+"; implies -tracer tcp unless -tracer tls is given, and the target port defaults to the service's")
+
+	// TLS flags
+	sniFlag := fs.String("sni", "", "TLS server name (SNI) to send and verify instead of the target host")
+	alpnFlag := fs.String("alpn", "", "Comma-separated ALPN protocols to offer in the TLS handshake (e.g. h2,http/1.1)")
+	tlsMinFlag := fs.String("tls-min", "", "Minimum TLS version: 1.0|1.1|1.2|1.3")
+	tlsMaxFlag := fs.String("tls-max", "", "Maximum TLS version: 1.0|1.1|1.2|1.3")
+	caFlag := fs.String("cacert", "", "PEM CA bundle used instead of the system roots to verify the server")
+	certFlag := fs.String("cert", "", "PEM client certificate for mutual TLS (requires -key)")
+	keyFlag := fs.String("key", "", "PEM private key for -cert")
+	insecureFlag := fs.Bool("insecure", false, "Skip TLS certificate and hostname verification (pins are still checked)")
+	var pinFlags stringsFlag
+	fs.Var(&pinFlags, "pin", "Accept only peers whose chain contains a certificate or public key with this SHA-256 hash (hex or sha256/<base64>; repeatable)")
+
+	var header stringsFlag
 	fs.Var(&header, "H", "HTTP header (Name: value)")
 	fs.Var(&header, "header", "HTTP header (Name: value)")
 
@@ -68,6 +202,86 @@ func parseFlags(args []string, stdout, stderr *os.File) (consoleConfig, error) {
 		outputChoice = *outputFlagShort
 	}
 
+	var thresholds []monitor.Threshold
+	for _, tv := range thresholdFlags {
+		t, err := monitor.ParseThreshold(tv)
+		if err != nil {
+			fmt.Fprintf(stderr, "%v\n", err)
+			return consoleConfig{}, err
+		}
+		thresholds = append(thresholds, t)
+	}
+	if *h2WindowFlag > 0 {
+		if err := http2.CheckWindowSize(uint64(*h2WindowFlag)); err != nil {
+			fmt.Fprintf(stderr, "-h2-window: %v\n", err)
+			return consoleConfig{}, err
+		}
+	}
+
+	tlsCfg := tlsinfo.Config{ServerName: *sniFlag, CAFile: *caFlag, CertFile: *certFlag, KeyFile: *keyFlag, InsecureSkipVerify: *insecureFlag, Pins: pinFlags}
+	for _, p := range strings.Split(*alpnFlag, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			tlsCfg.ALPN = append(tlsCfg.ALPN, p)
+		}
+	}
+	var err error
+	if tlsCfg.MinVersion, err = tlsinfo.ParseVersion(*tlsMinFlag); err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return consoleConfig{}, err
+	}
+	if tlsCfg.MaxVersion, err = tlsinfo.ParseVersion(*tlsMaxFlag); err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return consoleConfig{}, err
+	}
+
+	var quicVersions []string
+	for _, v := range strings.Split(*quicVersionsFlag, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			quicVersions = append(quicVersions, v)
+		}
+	}
+
+	var grpcDescriptors []byte
+	if *grpcDescFlag != "" {
+		if grpcDescriptors, err = os.ReadFile(*grpcDescFlag); err != nil {
+			fmt.Fprintf(stderr, "%v\n", err)
+			return consoleConfig{}, err
+		}
+	}
+
+	var script *expect.Script
+	if *scriptFlag != "" {
+		b, err := os.ReadFile(*scriptFlag)
+		if err == nil {
+			script, err = expect.Parse(string(b))
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", *scriptFlag, err)
+			return consoleConfig{}, err
+		}
+	}
+
+	var resolver *netutil.Resolver
+	if *dnsServerFlag != "" || len(resolveFlags) > 0 {
+		resolver = &netutil.Resolver{}
+		if *dnsServerFlag != "" {
+			srv, err := netutil.ParseDNSServer(*dnsServerFlag)
+			if err != nil {
+				fmt.Fprintf(stderr, "%v\n", err)
+				return consoleConfig{}, err
+			}
+			resolver.Server = &srv
+		}
+		for _, rv := range resolveFlags {
+			o, err := netutil.ParseOverride(rv)
+			if err != nil {
+				fmt.Fprintf(stderr, "%v\n", err)
+				return consoleConfig{}, err
+			}
+			resolver.Overrides = append(resolver.Overrides, o)
+		}
+	}
+
 	flagArgs := fs.Args()
 	if len(flagArgs) == 0 {
 		prog := filepath.Base(os.Args[0])
@@ -76,8 +290,18 @@ func parseFlags(args []string, stdout, stderr *os.File) (consoleConfig, error) {
 		return consoleConfig{}, fmt.Errorf("missing target")
 	}
 
+	// a probe alone runs over plain TCP
+	tracerName := *tracerFlag
+	if *probeFlag != "" {
+		explicit := false
+		fs.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "tracer" })
+		if !explicit {
+			tracerName = "tcp"
+		}
+	}
+
 	cfg := consoleConfig{
-		Tracer:            *tracerFlag,
+		Tracer:            tracerName,
 		DryRun:            *dryRun,
 		InjectTraceHeader: *injectTraceHeader,
 		Method:            *methodFlag,
@@ -90,6 +314,40 @@ func parseFlags(args []string, stdout, stderr *os.File) (consoleConfig, error) {
 		Redact:            *redactFlag,
 		RedactRequests:    *redactReqFlag,
 		RedactResponses:   *redactRespFlag,
+		CaptureBody:       *captureBodyFlag,
+		Count:             *countFlag,
+		Concurrency:       *concurrencyFlag,
+		Interval:          *intervalFlag,
+		Watch:             *watchFlag,
+		Thresholds:        thresholds,
+		MaxFailures:       *maxFailuresFlag,
+		Checks:            *checksFlag,
+		TLS:               tlsCfg,
+		Resolver:          resolver,
+		Proxy:             *proxyFlag,
+		NoProxy:           *noProxyFlag,
+		QueryType:         *qtypeFlag,
+		DNSTrace:          *dnsTraceFlag,
+		DNSRoots:          dnsRootFlags,
+		H2CUpgrade:        *h2cUpgradeFlag,
+		H2Window:          *h2WindowFlag,
+		H3AltSvc:          *h3AltSvcFlag,
+		H3ZeroRTT:         *h3ZeroRTTFlag,
+		H3Migrate:         *h3MigrateFlag,
+		QUICVersions:      quicVersions,
+		WSMessages:        wsMessageFlags,
+		WSBinary:          *wsBinaryFlag,
+		WSPings:           *wsPingsFlag,
+		WSListen:          *wsListenFlag,
+		GRPCDescriptors:   grpcDescriptors,
+		GRPCHealth:        *grpcHealthFlag,
+		TCPStream:         *tcpStreamFlag,
+		TCPIdle:           *tcpIdleFlag,
+		TCPMaxBytes:       *tcpMaxBytesFlag,
+		TCPHalfClose:      *tcpHalfCloseFlag,
+		Script:            script,
+		Interactive:       *interactiveFlag,
+		Probe:             *probeFlag,
 	}
 	return cfg, nil
 }
@@ -3,6 +3,8 @@ package console
 import (
 	"context"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 // Run executes the console CLI logic. It returns an exit code appropriate for os.Exit.
@@ -11,7 +13,10 @@ func Run(args []string, stdout, stderr *os.File) int {
 	if err != nil {
 		return 2
 	}
-	return dispatchTrace(context.Background(), cfg, stdout, stderr)
+	// cancel on SIGINT/SIGTERM so long-running modes (watch, benchmark) stop cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return dispatchTrace(ctx, cfg, stdout, stderr)
 }
 
 // HTTP tracing implemented in pkg/http
@@ -0,0 +1,184 @@
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sync"
+)
+
+// version is reported in serverInfo; overridable at build time via -ldflags.
+var version = "dev"
+
+// maxMessageSize bounds a single newline-delimited JSON-RPC message.
+const maxMessageSize = 4 << 20
+
+// server implements the MCP stdio transport: newline-delimited JSON-RPC 2.0
+// messages on stdin, responses on stdout and logs on stderr.
+type server struct {
+	out    io.Writer
+	outMu  sync.Mutex
+	logger *log.Logger
+	// allowUnredacted permits tool callers to disable header redaction.
+	allowUnredacted bool
+
+	mu       sync.Mutex
+	inflight map[string]context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// Run executes the MCP server until stdin is closed. It returns an exit code
+// appropriate for os.Exit.
+func Run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("mcp-server", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	allowUnredacted := fs.Bool("allow-unredacted", false, "If true, tool callers may disable redaction of sensitive headers (unsafe)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	s := &server{
+		out:             stdout,
+		logger:          log.New(stderr, "tracer-mcp: ", log.LstdFlags),
+		allowUnredacted: *allowUnredacted,
+		inflight:        make(map[string]context.CancelFunc),
+	}
+	if err := s.serve(context.Background(), stdin); err != nil {
+		s.logger.Printf("read error: %v", err)
+		return 1
+	}
+	return 0
+}
+
+func (s *server) serve(ctx context.Context, in io.Reader) error {
+	sc := bufio.NewScanner(in)
+	sc.Buffer(make([]byte, 64*1024), maxMessageSize)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var msg rpcMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			s.writeError(json.RawMessage("null"), codeParseError, "parse error: "+err.Error())
+			continue
+		}
+		if msg.Method == "" {
+			// responses to server-initiated requests are not used; ignore them
+			continue
+		}
+		if msg.JSONRPC != "2.0" {
+			s.writeError(msg.ID, codeInvalidRequest, "invalid request: jsonrpc must be \"2.0\"")
+			continue
+		}
+		s.handle(ctx, msg)
+	}
+	// let in-flight tool calls finish writing their responses
+	s.wg.Wait()
+	return sc.Err()
+}
+
+func (s *server) handle(ctx context.Context, msg rpcMessage) {
+	if msg.isNotification() {
+		switch msg.Method {
+		case "notifications/cancelled":
+			var p cancelledParams
+			if err := json.Unmarshal(msg.Params, &p); err == nil {
+				s.cancel(string(p.RequestID))
+			}
+		case "notifications/initialized":
+		default:
+			s.logger.Printf("ignoring notification %q", msg.Method)
+		}
+		return
+	}
+
+	switch msg.Method {
+	case "initialize":
+		var p initializeParams
+		_ = json.Unmarshal(msg.Params, &p)
+		v := protocolVersion
+		if slices.Contains(supportedVersions, p.ProtocolVersion) {
+			v = p.ProtocolVersion
+		}
+		s.writeResult(msg.ID, initializeResult{
+			ProtocolVersion: v,
+			Capabilities:    map[string]interface{}{"tools": map[string]interface{}{"listChanged": false}},
+			ServerInfo:      serverInfo{Name: "tracer", Version: version},
+			Instructions:    "Run network traces (HTTP/TCP/UDP) and receive normalized lifecycle events. Sensitive headers are redacted.",
+		})
+	case "ping":
+		s.writeResult(msg.ID, map[string]interface{}{})
+	case "tools/list":
+		s.writeResult(msg.ID, map[string]interface{}{"tools": toolDefinitions()})
+	case "tools/call":
+		var p toolCallParams
+		if err := json.Unmarshal(msg.Params, &p); err != nil {
+			s.writeError(msg.ID, codeInvalidParams, "invalid params: "+err.Error())
+			return
+		}
+		// traces can take a while; run them concurrently so ping and
+		// cancellation keep working.
+		cctx, cancel := context.WithCancel(ctx)
+		s.track(string(msg.ID), cancel)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.cancel(string(msg.ID))
+			res, rerr := s.callTool(cctx, p)
+			if rerr != nil {
+				s.writeError(msg.ID, rerr.Code, rerr.Message)
+				return
+			}
+			s.writeResult(msg.ID, res)
+		}()
+	default:
+		s.writeError(msg.ID, codeMethodNotFound, fmt.Sprintf("method not found: %s", msg.Method))
+	}
+}
+
+func (s *server) track(id string, cancel context.CancelFunc) {
+	s.mu.Lock()
+	s.inflight[id] = cancel
+	s.mu.Unlock()
+}
+
+// cancel aborts the in-flight request with the given raw JSON id, if any.
+func (s *server) cancel(id string) {
+	s.mu.Lock()
+	cancel, ok := s.inflight[id]
+	delete(s.inflight, id)
+	s.mu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+func (s *server) writeResult(id json.RawMessage, result interface{}) {
+	s.write(rpcResponse{JSONRPC: "2.0", ID: id, Result: result})
+}
+
+func (s *server) writeError(id json.RawMessage, code int, message string) {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	s.write(rpcResponse{JSONRPC: "2.0", ID: id, Error: &rpcError{Code: code, Message: message}})
+}
+
+func (s *server) write(resp rpcResponse) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		b, _ = json.Marshal(rpcResponse{JSONRPC: "2.0", ID: resp.ID, Error: &rpcError{Code: codeInternalError, Message: err.Error()}})
+	}
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	b = append(b, '\n')
+	if _, err := s.out.Write(b); err != nil {
+		s.logger.Printf("write error: %v", err)
+	}
+}
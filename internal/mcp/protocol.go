@@ -0,0 +1,81 @@
+package mcp
+
+import "encoding/json"
+
+// JSON-RPC 2.0 error codes used by the server.
+const (
+	codeParseError     = -32700
+	codeInvalidRequest = -32600
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+	codeInternalError  = -32603
+)
+
+// protocolVersion is the newest MCP revision implemented by this server. When a
+// client requests one of supportedVersions it is echoed back instead.
+const protocolVersion = "2025-06-18"
+
+var supportedVersions = []string{"2025-06-18", "2025-03-26", "2024-11-05"}
+
+// rpcMessage is an incoming JSON-RPC message. Requests carry an ID, notifications do not.
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// isNotification reports whether the message expects no response.
+func (m rpcMessage) isNotification() bool { return len(m.ID) == 0 || string(m.ID) == "null" }
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string { return e.Message }
+
+type initializeParams struct {
+	ProtocolVersion string `json:"protocolVersion"`
+}
+
+type initializeResult struct {
+	ProtocolVersion string                 `json:"protocolVersion"`
+	Capabilities    map[string]interface{} `json:"capabilities"`
+	ServerInfo      serverInfo             `json:"serverInfo"`
+	Instructions    string                 `json:"instructions,omitempty"`
+}
+
+type serverInfo struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type toolCallParams struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+type cancelledParams struct {
+	RequestID json.RawMessage `json:"requestId"`
+}
+
+// toolResult is the result of tools/call. Content carries a text rendering for
+// clients that do not understand structured output.
+type toolResult struct {
+	Content           []contentBlock         `json:"content"`
+	StructuredContent map[string]interface{} `json:"structuredContent,omitempty"`
+	IsError           bool                   `json:"isError"`
+}
+
+type contentBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
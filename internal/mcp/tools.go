@@ -0,0 +1,389 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mrlm-net/tracer/pkg/dns"
+	eventpkg "github.com/mrlm-net/tracer/pkg/event"
+	"github.com/mrlm-net/tracer/pkg/expect"
+	"github.com/mrlm-net/tracer/pkg/grpc"
+	httptracer "github.com/mrlm-net/tracer/pkg/http"
+	"github.com/mrlm-net/tracer/pkg/http2"
+	"github.com/mrlm-net/tracer/pkg/http3"
+	"github.com/mrlm-net/tracer/pkg/netutil"
+	"github.com/mrlm-net/tracer/pkg/probe"
+	"github.com/mrlm-net/tracer/pkg/tcp"
+	"github.com/mrlm-net/tracer/pkg/tracer"
+	_ "github.com/mrlm-net/tracer/pkg/tracer/builtin"
+	"github.com/mrlm-net/tracer/pkg/udp"
+)
+
+// maxTimeout caps the per-call timeout a tool caller may request.
+const maxTimeout = 5 * time.Minute
+
+// maxCaptureBody caps the response body bytes a tool caller may capture.
+const maxCaptureBody = 1 << 20
+
+// traceArgs are the tool arguments shared by all tracers. Fields that do not
+// apply to a tool are ignored.
+type traceArgs struct {
+	URL             string            `json:"url"`
+	Addr            string            `json:"addr"`
+	Method          string            `json:"method"`
+	Headers         map[string]string `json:"headers"`
+	Data            string            `json:"data"`
+	PreferIP        string            `json:"prefer_ip"`
+	InjectTraceID   bool              `json:"inject_trace_id"`
+	DryRun          bool              `json:"dry_run"`
+	TimeoutMS       int64             `json:"timeout_ms"`
+	Redact          *bool             `json:"redact"`
+	RedactRequests  *bool             `json:"redact_requests"`
+	RedactResponses *bool             `json:"redact_responses"`
+	CaptureBody     int64             `json:"capture_body"`
+	Proxy           string            `json:"proxy"`
+	NoProxy         string            `json:"no_proxy"`
+	Name            string            `json:"name"`
+	Type            string            `json:"type"`
+	Server          string            `json:"server"`
+	Trace           bool              `json:"trace"`
+	H2CUpgrade      bool              `json:"h2c_upgrade"`
+	WindowSize      uint32            `json:"window_size"`
+	AltSvc          bool              `json:"alt_svc"`
+	ZeroRTT         bool              `json:"zero_rtt"`
+	Migrate         bool              `json:"migrate"`
+	QUICVersions    []string          `json:"quic_versions"`
+	Messages        []string          `json:"messages"`
+	Binary          bool              `json:"binary"`
+	Pings           *int              `json:"pings"`
+	ListenMS        int64             `json:"listen_ms"`
+	DescriptorSet   []byte            `json:"descriptor_set"`
+	Health          bool              `json:"health"`
+	Stream          bool              `json:"stream"`
+	IdleMS          int64             `json:"idle_ms"`
+	MaxBytes        int64             `json:"max_bytes"`
+	HalfClose       bool              `json:"half_close"`
+	Script          string            `json:"script"`
+	Probe           string            `json:"probe"`
+}
+
+type toolDefinition struct {
+	Name         string                 `json:"name"`
+	Title        string                 `json:"title,omitempty"`
+	Description  string                 `json:"description"`
+	InputSchema  map[string]interface{} `json:"inputSchema"`
+	OutputSchema map[string]interface{} `json:"outputSchema,omitempty"`
+}
+
+func prop(typ, desc string) map[string]interface{} {
+	return map[string]interface{}{"type": typ, "description": desc}
+}
+
+func commonProps() map[string]interface{} {
+	return map[string]interface{}{
+		"data":       prop("string", "Payload to send (request body for HTTP)"),
+		"prefer_ip":  map[string]interface{}{"type": "string", "enum": []string{"auto", "v4", "v6"}, "description": "IP family preference when resolving hostnames"},
+		"dry_run":    prop("boolean", "Emit lifecycle events without performing network I/O"),
+		"timeout_ms": prop("integer", "Trace timeout in milliseconds (default: tracer default, max 300000)"),
+	}
+}
+
+func outputSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"events": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "object"}, "description": "Normalized trace events in emission order"},
+			"error":  prop("string", "Tracer error, if the trace failed"),
+		},
+		"required": []string{"events"},
+	}
+}
+
+func toolDefinitions() []toolDefinition {
+	httpProps := commonProps()
+	httpProps["url"] = prop("string", "Target URL, e.g. https://example.com/")
+	httpProps["method"] = prop("string", "HTTP method (default GET)")
+	httpProps["headers"] = map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": "string"}, "description": "Extra request headers"}
+	httpProps["inject_trace_id"] = prop("boolean", "Add an X-Trace-Id header to outgoing requests")
+	httpProps["capture_body"] = prop("integer", "Capture up to N decoded response body bytes in response_end, with full size, transfer time and SHA-256 (0 disables, max 1048576)")
+	httpProps["proxy"] = prop("string", "Proxy URL: http://[user:pass@]host:port, https://..., socks5://... or socks5h://...; 'direct' ignores HTTP_PROXY/HTTPS_PROXY")
+	httpProps["no_proxy"] = prop("string", "Comma-separated hosts, domains or CIDRs that bypass the proxy (overrides NO_PROXY)")
+	httpProps["redact"] = prop("boolean", "Redact sensitive headers (default true; disabling requires the server to run with -allow-unredacted)")
+	httpProps["redact_requests"] = prop("boolean", "Redact Authorization/Cookie request headers (default true)")
+	httpProps["redact_responses"] = prop("boolean", "Redact Set-Cookie response headers (default true)")
+
+	http2Props := map[string]interface{}{}
+	for k, v := range httpProps {
+		switch k {
+		case "inject_trace_id", "capture_body", "proxy", "no_proxy":
+		default:
+			http2Props[k] = v
+		}
+	}
+	http2Props["url"] = prop("string", "Target URL; https:// negotiates h2 with ALPN, http:// uses h2c with prior knowledge")
+	http2Props["h2c_upgrade"] = prop("boolean", "For http:// URLs, negotiate h2c with an HTTP/1.1 'Upgrade: h2c' request instead of prior knowledge")
+	http2Props["window_size"] = prop("integer", "Receive window advertised for the stream and connection in bytes (default 4194304, max 2147483647); small values expose WINDOW_UPDATE pacing")
+
+	http3Props := map[string]interface{}{}
+	for k, v := range http2Props {
+		switch k {
+		case "h2c_upgrade", "window_size":
+		default:
+			http3Props[k] = v
+		}
+	}
+	http3Props["url"] = prop("string", "Target https:// URL; the QUIC connection goes to the same host and port over UDP unless alt_svc is set")
+	http3Props["alt_svc"] = prop("boolean", "Discover the HTTP/3 endpoint from the Alt-Svc header of an HTTP/1.1 or HTTP/2 response first")
+	http3Props["zero_rtt"] = prop("boolean", "Make a warm-up connection for a session ticket, then send the request as 0-RTT early data on a second connection")
+	http3Props["migrate"] = prop("boolean", "Migrate the connection to a new local UDP socket after the handshake and before the request")
+	http3Props["quic_versions"] = map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}, "description": "QUIC versions to offer, in order: v1 or v2, by name or in hex (default: v1, v2)"}
+
+	wsProps := map[string]interface{}{}
+	for _, k := range []string{"headers", "prefer_ip", "proxy", "no_proxy", "dry_run", "timeout_ms", "redact", "redact_requests", "redact_responses"} {
+		wsProps[k] = httpProps[k]
+	}
+	wsProps["url"] = prop("string", "Target ws:// or wss:// URL")
+	wsProps["data"] = prop("string", "First message to send after the upgrade")
+	wsProps["messages"] = map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}, "description": "Messages to send after data, one at a time; each waits up to listen_ms for a reply"}
+	wsProps["binary"] = prop("boolean", "Send the messages as binary instead of text frames")
+	wsProps["pings"] = prop("integer", "Number of pings sent after the messages to measure the round trip (default 1)")
+	wsProps["listen_ms"] = prop("integer", "How long to wait for each reply and pong, for further messages before closing, and for the closing handshake (default 1000)")
+
+	grpcProps := map[string]interface{}{}
+	for _, k := range []string{"prefer_ip", "dry_run", "timeout_ms", "redact", "redact_requests", "redact_responses"} {
+		grpcProps[k] = httpProps[k]
+	}
+	grpcProps["url"] = prop("string", "Target grpc://host:port/package.Service/Method (grpcs:// for TLS); with health, grpc://host:port[/service]")
+	grpcProps["data"] = prop("string", "JSON request message, or a JSON array of messages for client-streaming methods (default {})")
+	grpcProps["headers"] = map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": "string"}, "description": "Request metadata"}
+	grpcProps["descriptor_set"] = prop("string", "Base64-encoded FileDescriptorSet describing the method, used instead of server reflection")
+	grpcProps["health"] = prop("boolean", "Call grpc.health.v1.Health/Check for the service named by the URL path instead of a method")
+
+	addrProps := func() map[string]interface{} {
+		p := commonProps()
+		p["addr"] = prop("string", "Target host:port, or a URL with http/https scheme")
+		p["no_proxy"] = httpProps["no_proxy"]
+		return p
+	}
+	tcpProps := addrProps()
+	tcpProps["proxy"] = prop("string", "Proxy to tunnel through: http://[user:pass@]host:port or https://... (CONNECT), socks5://... or socks5h://...")
+	tcpProps["stream"] = prop("boolean", "Keep reading after data until the peer closes the connection, idle_ms passes without data, max_bytes are read or the timeout passes, returning one event per chunk with time-to-first-byte and gaps, and whether the connection ended with FIN or RST")
+	tcpProps["idle_ms"] = prop("integer", "How long a stream may go without data in milliseconds (default 5000)")
+	tcpProps["max_bytes"] = prop("integer", "Stop a stream after reading this many bytes (0: no limit)")
+	tcpProps["half_close"] = prop("boolean", "Shut down the write side of the connection (FIN) after sending data")
+	tcpProps["probe"] = map[string]interface{}{"type": "string", "enum": probe.Names(), "description": "Run the protocol handshake of this service instead of sending data and return parsed events (server version, auth methods offered, STARTTLS support) ending with a probe_done summary; addr may then omit the port"}
+	udpProps := addrProps()
+	scriptProp := prop("string", "Send/expect script run after data, one directive per line: 'send <text>', 'sendline <text>' (adds CRLF), 'expect <regexp>', 'timeout <duration>'; text may be a Go quoted string. Each exchange returns a step event and an unmet expectation fails the trace")
+	tcpProps["script"] = scriptProp
+	udpProps["script"] = scriptProp
+	udpProps["proxy"] = prop("string", "SOCKS5 proxy relaying the datagrams (UDP ASSOCIATE): socks5://[user:pass@]host:port or socks5h://...")
+
+	dnsProps := map[string]interface{}{
+		"name":       prop("string", "Domain name to query, e.g. example.com"),
+		"type":       prop("string", "Record type: A (default), AAAA, CNAME, MX, TXT, SRV, NS, SOA, PTR, CAA, ANY or TYPEnnn"),
+		"server":     prop("string", "DNS server: 1.1.1.1, tcp://1.1.1.1:53, tls://1.1.1.1 (DoT) or https://dns.google/dns-query (DoH); default is the system nameserver"),
+		"trace":      prop("boolean", "Resolve iteratively from the root servers like dig +trace, returning one referral event per delegation and alerts for lame servers or authoritative servers that disagree"),
+		"dry_run":    prop("boolean", "Emit lifecycle events without performing network I/O"),
+		"timeout_ms": prop("integer", "Query timeout in milliseconds (default 5000, max 300000)"),
+	}
+
+	return []toolDefinition{
+		{
+			Name:         "trace_http",
+			Title:        "Trace HTTP request",
+			Description:  "Perform an HTTP request and return DNS, connect, TLS, request and response lifecycle events.",
+			InputSchema:  map[string]interface{}{"type": "object", "properties": httpProps, "required": []string{"url"}},
+			OutputSchema: outputSchema(),
+		},
+		{
+			Name:         "trace_http2",
+			Title:        "Trace HTTP/2 request",
+			Description:  "Perform one HTTP/2 request (h2 over TLS or cleartext h2c) and return an event per frame: preface, SETTINGS exchange, HEADERS, DATA, WINDOW_UPDATE, PING, RST_STREAM and GOAWAY, with flow-control stalls.",
+			InputSchema:  map[string]interface{}{"type": "object", "properties": http2Props, "required": []string{"url"}},
+			OutputSchema: outputSchema(),
+		},
+		{
+			Name:         "trace_http3",
+			Title:        "Trace HTTP/3 request",
+			Description:  "Perform one HTTP/3 request over QUIC and return the Initial packets, version negotiation, handshake with transport parameters, 0-RTT usage, connection migration and Alt-Svc discovery events.",
+			InputSchema:  map[string]interface{}{"type": "object", "properties": http3Props, "required": []string{"url"}},
+			OutputSchema: outputSchema(),
+		},
+		{
+			Name:         "trace_ws",
+			Title:        "Trace WebSocket session",
+			Description:  "Open a WebSocket connection and return the upgrade request events (DNS, connect, TLS, upgrade response), then one event per message sent and received with latency, ping/pong round trips and the close code and reason.",
+			InputSchema:  map[string]interface{}{"type": "object", "properties": wsProps, "required": []string{"url"}},
+			OutputSchema: outputSchema(),
+		},
+		{
+			Name:         "trace_grpc",
+			Title:        "Trace gRPC call",
+			Description:  "Call a gRPC method described by server reflection or a descriptor set with a JSON request and return the connection events (DNS, connect, TLS), the resolved method, the HTTP/2 stream with request and response metadata, one event per message sent and received, the trailers and the grpc-status.",
+			InputSchema:  map[string]interface{}{"type": "object", "properties": grpcProps, "required": []string{"url"}},
+			OutputSchema: outputSchema(),
+		},
+		{
+			Name:         "trace_tcp",
+			Title:        "Trace TCP connection",
+			Description:  "Open a TCP connection, optionally send data and read a response (or, with stream, every chunk until the connection ends, or, with probe, the handshake of a Redis, PostgreSQL, MySQL, SMTP, SSH, memcached, MQTT or AMQP server), and return lifecycle events.",
+			InputSchema:  map[string]interface{}{"type": "object", "properties": tcpProps, "required": []string{"addr"}},
+			OutputSchema: outputSchema(),
+		},
+		{
+			Name:         "trace_udp",
+			Title:        "Trace UDP exchange",
+			Description:  "Send a UDP datagram, optionally wait for a response, and return lifecycle events.",
+			InputSchema:  map[string]interface{}{"type": "object", "properties": udpProps, "required": []string{"addr"}},
+			OutputSchema: outputSchema(),
+		},
+		{
+			Name:         "trace_dns",
+			Title:        "Trace DNS query",
+			Description:  "Send a DNS query over UDP, TCP, DoT or DoH and return the RCODE, flags, answer/authority/additional records with TTLs, and timing.",
+			InputSchema:  map[string]interface{}{"type": "object", "properties": dnsProps, "required": []string{"name"}},
+			OutputSchema: outputSchema(),
+		},
+	}
+}
+
+// callTool runs the requested tracer and converts its events to a tool result.
+// Tracer failures are reported as tool errors (isError) rather than protocol errors.
+func (s *server) callTool(ctx context.Context, p toolCallParams) (toolResult, *rpcError) {
+	var args traceArgs
+	if len(p.Arguments) > 0 {
+		if err := json.Unmarshal(p.Arguments, &args); err != nil {
+			return toolResult{}, &rpcError{Code: codeInvalidParams, Message: "invalid arguments: " + err.Error()}
+		}
+	}
+
+	timeout := time.Duration(args.TimeoutMS) * time.Millisecond
+	if timeout > maxTimeout {
+		timeout = maxTimeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var target string
+	switch p.Name {
+	case "trace_http", "trace_http2", "trace_http3", "trace_ws", "trace_grpc":
+		target = args.URL
+		if target == "" {
+			return toolResult{}, &rpcError{Code: codeInvalidParams, Message: "url is required"}
+		}
+	case "trace_tcp", "trace_udp":
+		target = args.Addr
+		if target == "" {
+			return toolResult{}, &rpcError{Code: codeInvalidParams, Message: "addr is required"}
+		}
+	case "trace_dns":
+		target = args.Name
+		if target == "" {
+			return toolResult{}, &rpcError{Code: codeInvalidParams, Message: "name is required"}
+		}
+	default:
+		return toolResult{}, &rpcError{Code: codeInvalidParams, Message: fmt.Sprintf("unknown tool: %s", p.Name)}
+	}
+	if args.WindowSize > 0 {
+		if err := http2.CheckWindowSize(uint64(args.WindowSize)); err != nil {
+			return toolResult{}, &rpcError{Code: codeInvalidParams, Message: "window_size: " + err.Error()}
+		}
+	}
+
+	be := eventpkg.NewBufferingEmitter()
+	err := s.runTrace(ctx, strings.TrimPrefix(p.Name, "trace_"), target, args, be, timeout)
+
+	events := be.Events()
+	structured := map[string]interface{}{"events": events}
+	if err != nil {
+		structured["error"] = err.Error()
+	}
+	text, merr := json.Marshal(structured)
+	if merr != nil {
+		return toolResult{}, &rpcError{Code: codeInternalError, Message: merr.Error()}
+	}
+	return toolResult{
+		Content:           []contentBlock{{Type: "text", Text: string(text)}},
+		StructuredContent: structured,
+		IsError:           err != nil,
+	}, nil
+}
+
+// runTrace invokes the registered tracer for protocol with options derived from args.
+func (s *server) runTrace(ctx context.Context, protocol, target string, args traceArgs, em eventpkg.Emitter, timeout time.Duration) error {
+	h := make(http.Header)
+	for k, v := range args.Headers {
+		h.Set(k, v)
+	}
+	if args.Data != "" && protocol != "ws" && protocol != "grpc" && h.Get("Content-Type") == "" {
+		h.Set("Content-Type", "application/json")
+	}
+	pings := 1
+	if args.Pings != nil {
+		pings = *args.Pings
+	}
+
+	// Redaction is forced on unless the operator explicitly allowed callers
+	// to turn it off when starting the server.
+	redact, redactReq, redactResp := true, true, true
+	if s.allowUnredacted {
+		if args.Redact != nil {
+			redact, redactReq, redactResp = *args.Redact, *args.Redact, *args.Redact
+		}
+		if args.RedactRequests != nil {
+			redactReq = *args.RedactRequests
+		}
+		if args.RedactResponses != nil {
+			redactResp = *args.RedactResponses
+		}
+	}
+
+	var resolver *netutil.Resolver
+	if args.Server != "" {
+		srv, err := netutil.ParseDNSServer(args.Server)
+		if err != nil {
+			return err
+		}
+		resolver = &netutil.Resolver{Server: &srv}
+	}
+	var script *expect.Script
+	if args.Script != "" {
+		var err error
+		if script, err = expect.Parse(args.Script); err != nil {
+			return err
+		}
+	}
+
+	t, err := tracer.New(protocol,
+		tracer.WithEmitter(em),
+		tracer.WithTimeout(timeout),
+		tracer.WithDryRun(args.DryRun),
+		tracer.WithIPPreference(args.PreferIP),
+		tracer.WithData(args.Data),
+		tracer.WithMethod(args.Method),
+		tracer.WithHeaders(h),
+		tracer.WithInjectTraceHeader(args.InjectTraceID),
+		tracer.WithCaptureBody(min(args.CaptureBody, maxCaptureBody)),
+		tracer.WithResolver(resolver),
+		tracer.WithProxy(args.Proxy, args.NoProxy),
+		dns.Settings.With(dns.TracerSettings{QueryType: args.Type, Trace: args.Trace}),
+		http2.Settings.With(http2.TracerSettings{Upgrade: args.H2CUpgrade, Window: args.WindowSize}),
+		http3.Settings.With(http3.TracerSettings{AltSvc: args.AltSvc, ZeroRTT: args.ZeroRTT, Migrate: args.Migrate, Versions: args.QUICVersions}),
+		httptracer.WebSocket.With(httptracer.WebSocketSettings{Messages: args.Messages, Binary: args.Binary, Pings: pings, Listen: time.Duration(args.ListenMS) * time.Millisecond}),
+		grpc.Settings.With(grpc.TracerSettings{Descriptors: args.DescriptorSet, Health: args.Health}),
+		tcp.Settings.With(tcp.TracerSettings{Stream: args.Stream, Idle: time.Duration(args.IdleMS) * time.Millisecond, MaxBytes: args.MaxBytes, HalfClose: args.HalfClose, Script: script, Probe: args.Probe}),
+		udp.Settings.With(udp.TracerSettings{Script: script}),
+		tracer.WithRedact(redact), tracer.WithRedactRequests(redactReq), tracer.WithRedactResponses(redactResp),
+	)
+	if err != nil {
+		return err
+	}
+	return t.Trace(ctx, target)
+}
@@ -0,0 +1,36 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// DefaultTemplate is the HTML report template path used by the CLI and services.
+const DefaultTemplate = "./public/report.html"
+
+// Render injects JSON-encoded events into the HTML report template at tplPath
+// and returns the resulting document.
+func Render(tplPath string, events interface{}) ([]byte, error) {
+	jb, err := json.Marshal(events)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal events: %w", err)
+	}
+	tplBytes, err := os.ReadFile(tplPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template: %w", err)
+	}
+	tplStr := string(tplBytes)
+	if strings.Contains(tplStr, "<!--DATA-->") {
+		tplStr = strings.Replace(tplStr, "<!--DATA-->", string(jb), 1)
+	} else {
+		script := fmt.Sprintf("<script id=\"__DATA__\" type=\"application/json\">%s</script>", jb)
+		if strings.Contains(tplStr, "</body>") {
+			tplStr = strings.Replace(tplStr, "</body>", script+"</body>", 1)
+		} else {
+			tplStr = tplStr + script
+		}
+	}
+	return []byte(tplStr), nil
+}
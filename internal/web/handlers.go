@@ -0,0 +1,382 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mrlm-net/tracer/internal/report"
+	"github.com/mrlm-net/tracer/pkg/dns"
+	eventpkg "github.com/mrlm-net/tracer/pkg/event"
+	"github.com/mrlm-net/tracer/pkg/expect"
+	"github.com/mrlm-net/tracer/pkg/grpc"
+	httptracer "github.com/mrlm-net/tracer/pkg/http"
+	"github.com/mrlm-net/tracer/pkg/http2"
+	"github.com/mrlm-net/tracer/pkg/http3"
+	"github.com/mrlm-net/tracer/pkg/netutil"
+	"github.com/mrlm-net/tracer/pkg/tcp"
+	"github.com/mrlm-net/tracer/pkg/tracer"
+	_ "github.com/mrlm-net/tracer/pkg/tracer/builtin"
+	"github.com/mrlm-net/tracer/pkg/udp"
+)
+
+// maxRequestBody bounds the JSON trace request accepted by the API.
+const maxRequestBody = 1 << 20
+
+// maxCaptureBody caps the response body bytes a caller may capture, since
+// the captured body is held in memory and returned in the events.
+const maxCaptureBody = 1 << 20
+
+// traceRequest is the JSON body of POST /v1/traces/{protocol}. It mirrors the
+// console flags; fields that do not apply to a protocol are ignored.
+type traceRequest struct {
+	Target          string            `json:"target"`
+	Method          string            `json:"method,omitempty"`
+	Headers         map[string]string `json:"headers,omitempty"`
+	Data            string            `json:"data,omitempty"`
+	PreferIP        string            `json:"prefer_ip,omitempty"`
+	InjectTraceID   bool              `json:"inject_trace_id,omitempty"`
+	DryRun          bool              `json:"dry_run,omitempty"`
+	TimeoutMS       int64             `json:"timeout_ms,omitempty"`
+	Redact          *bool             `json:"redact,omitempty"`
+	RedactRequests  *bool             `json:"redact_requests,omitempty"`
+	RedactResponses *bool             `json:"redact_responses,omitempty"`
+	CaptureBody     int64             `json:"capture_body,omitempty"`
+	// Proxy and NoProxy mirror the console -proxy and -no-proxy flags.
+	Proxy   string `json:"proxy,omitempty"`
+	NoProxy string `json:"no_proxy,omitempty"`
+	// DNSServer resolves hostnames with this server instead of the system
+	// resolver and is the server queried by the dns tracer
+	// (1.1.1.1, tcp://..., tls://..., https://.../dns-query).
+	DNSServer string `json:"dns_server,omitempty"`
+	// QueryType is the record type queried by the dns tracer (default A).
+	QueryType string `json:"query_type,omitempty"`
+	// DNSTrace walks the delegation from the root servers (dns tracer only).
+	DNSTrace bool `json:"dns_trace,omitempty"`
+	// H2CUpgrade and H2Window mirror the console -h2c-upgrade and -h2-window
+	// flags (http2 tracer only).
+	H2CUpgrade bool   `json:"h2c_upgrade,omitempty"`
+	H2Window   uint32 `json:"h2_window,omitempty"`
+	// H3AltSvc, ZeroRTT, Migrate and QUICVersions mirror the console
+	// -h3-alt-svc, -h3-0rtt, -h3-migrate and -quic-versions flags (http3
+	// tracer only).
+	H3AltSvc     bool     `json:"h3_alt_svc,omitempty"`
+	ZeroRTT      bool     `json:"zero_rtt,omitempty"`
+	Migrate      bool     `json:"migrate,omitempty"`
+	QUICVersions []string `json:"quic_versions,omitempty"`
+	// WSMessages, WSBinary, WSPings (default 1) and WSListenMS mirror the
+	// console -ws-message, -ws-binary, -ws-pings and -ws-listen flags (ws
+	// tracer only).
+	WSMessages []string `json:"ws_messages,omitempty"`
+	WSBinary   bool     `json:"ws_binary,omitempty"`
+	WSPings    *int     `json:"ws_pings,omitempty"`
+	WSListenMS int64    `json:"ws_listen_ms,omitempty"`
+	// GRPCDescriptorSet (a base64-encoded FileDescriptorSet) and GRPCHealth
+	// mirror the console -grpc-descriptor-set and -grpc-health flags (grpc
+	// tracer only).
+	GRPCDescriptorSet []byte `json:"grpc_descriptor_set,omitempty"`
+	GRPCHealth        bool   `json:"grpc_health,omitempty"`
+	// TCPStream, TCPIdleMS, TCPMaxBytes and TCPHalfClose mirror the console
+	// -tcp-stream, -tcp-idle, -tcp-max-bytes and -tcp-half-close flags (tcp
+	// and tls tracers only).
+	TCPStream    bool  `json:"tcp_stream,omitempty"`
+	TCPIdleMS    int64 `json:"tcp_idle_ms,omitempty"`
+	TCPMaxBytes  int64 `json:"tcp_max_bytes,omitempty"`
+	TCPHalfClose bool  `json:"tcp_half_close,omitempty"`
+	// Script is the text of a send/expect script, as read by the console
+	// -script flag (tcp, tls and udp tracers only).
+	Script string `json:"script,omitempty"`
+	// Probe mirrors the console -probe flag (tcp and tls tracers only).
+	Probe string `json:"probe,omitempty"`
+	// Format selects the response encoding: json (default), ndjson or html.
+	Format string `json:"format,omitempty"`
+	// Async starts the trace in the background and returns its ID immediately;
+	// events are then available from /v1/traces/{id}/events.
+	Async bool `json:"async,omitempty"`
+}
+
+// traceResponse is returned for format=json.
+type traceResponse struct {
+	Events []eventpkg.Event `json:"events"`
+	Error  string           `json:"error,omitempty"`
+}
+
+// asyncResponse is returned with 202 Accepted for async traces.
+type asyncResponse struct {
+	ID        string `json:"id"`
+	StatusURL string `json:"status_url"`
+	EventsURL string `json:"events_url"`
+}
+
+// statusResponse describes an async trace for GET /v1/traces/{id}.
+type statusResponse struct {
+	ID       string           `json:"id"`
+	Protocol string           `json:"protocol"`
+	Target   string           `json:"target"`
+	Status   string           `json:"status"` // running|done
+	Events   []eventpkg.Event `json:"events"`
+	Error    string           `json:"error,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type handler struct {
+	cfg    serviceConfig
+	logger *log.Logger
+	store  *traceStore
+}
+
+func newHandler(cfg serviceConfig, logger *log.Logger) http.Handler {
+	h := &handler{cfg: cfg, logger: logger, store: newTraceStore(cfg.Retention, cfg.MaxAsyncTraces)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/traces/{protocol}", h.handleTrace)
+	mux.HandleFunc("GET /v1/traces/{id}", h.handleStatus)
+	mux.HandleFunc("DELETE /v1/traces/{id}", h.handleCancel)
+	mux.HandleFunc("GET /v1/traces/{id}/events", h.handleEvents)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	return mux
+}
+
+func (h *handler) handleTrace(w http.ResponseWriter, r *http.Request) {
+	protocol := r.PathValue("protocol")
+	if !slices.Contains(tracer.Names(), protocol) {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: fmt.Sprintf("unknown protocol %q (available: %v)", protocol, tracer.Names())})
+		return
+	}
+
+	var req traceRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid request body: " + err.Error()})
+		return
+	}
+	if req.Target == "" {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "target is required"})
+		return
+	}
+	if _, err := req.resolver(); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	if req.H2Window > 0 {
+		if err := http2.CheckWindowSize(uint64(req.H2Window)); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "h2_window: " + err.Error()})
+			return
+		}
+	}
+
+	// Bound every trace by the service maximum; a shorter caller timeout is
+	// also passed to the tracer so its dial/read deadlines match.
+	timeout := time.Duration(req.TimeoutMS) * time.Millisecond
+	if timeout <= 0 || timeout > h.cfg.MaxTimeout {
+		timeout = h.cfg.MaxTimeout
+	}
+
+	if req.Async {
+		t, err := h.store.Start(protocol, req.Target, timeout, func(ctx context.Context, em eventpkg.Emitter) error {
+			err := h.runTrace(ctx, protocol, req, em, timeout)
+			if err != nil {
+				h.logger.Printf("%s trace %s failed: %v", protocol, req.Target, err)
+			}
+			return err
+		})
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, errorResponse{Error: err.Error()})
+			return
+		}
+		w.Header().Set("Location", "/v1/traces/"+t.ID)
+		writeJSON(w, http.StatusAccepted, asyncResponse{ID: t.ID, StatusURL: "/v1/traces/" + t.ID, EventsURL: "/v1/traces/" + t.ID + "/events"})
+		return
+	}
+
+	format, err := negotiateFormat(req.Format, r)
+	if err != nil {
+		writeJSON(w, http.StatusNotAcceptable, errorResponse{Error: err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	if format == "ndjson" {
+		// stream events to the client as they are emitted
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		em := eventpkg.NewStdoutEmitter(&flushWriter{w: w, rc: http.NewResponseController(w)}, true, false)
+		if err := h.runTrace(ctx, protocol, req, em, timeout); err != nil {
+			h.logger.Printf("%s trace %s failed: %v", protocol, req.Target, err)
+		}
+		return
+	}
+
+	be := eventpkg.NewBufferingEmitter()
+	traceErr := h.runTrace(ctx, protocol, req, be, timeout)
+	if traceErr != nil {
+		h.logger.Printf("%s trace %s failed: %v", protocol, req.Target, traceErr)
+	}
+
+	if format == "html" {
+		doc, err := report.Render(h.cfg.ReportTemplate, be.Events())
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write(doc)
+		return
+	}
+
+	resp := traceResponse{Events: be.Events()}
+	if traceErr != nil {
+		resp.Error = traceErr.Error()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// negotiateFormat picks the response format from the request body, the
+// ?format= query parameter or the Accept header, in that order.
+func negotiateFormat(bodyFormat string, r *http.Request) (string, error) {
+	f := bodyFormat
+	if f == "" {
+		f = r.URL.Query().Get("format")
+	}
+	if f == "" {
+		for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+			mt, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			switch mt {
+			case "application/x-ndjson", "application/ndjson":
+				return "ndjson", nil
+			case "text/html":
+				return "html", nil
+			case "application/json":
+				return "json", nil
+			}
+		}
+		return "json", nil
+	}
+	switch strings.ToLower(f) {
+	case "json", "ndjson", "html":
+		return strings.ToLower(f), nil
+	}
+	return "", fmt.Errorf("unsupported format %q (expected json, ndjson or html)", f)
+}
+
+// runTrace invokes the registered tracer for protocol with options derived from req.
+func (h *handler) runTrace(ctx context.Context, protocol string, req traceRequest, em eventpkg.Emitter, timeout time.Duration) error {
+	hdr := make(http.Header)
+	for k, v := range req.Headers {
+		hdr.Set(k, v)
+	}
+	if req.Data != "" && protocol != "ws" && protocol != "grpc" && hdr.Get("Content-Type") == "" {
+		hdr.Set("Content-Type", "application/json")
+	}
+	pings := 1
+	if req.WSPings != nil {
+		pings = *req.WSPings
+	}
+	redact, redactReq, redactResp := h.redaction(req)
+	resolver, err := req.resolver()
+	if err != nil {
+		return err
+	}
+	var script *expect.Script
+	if req.Script != "" {
+		if script, err = expect.Parse(req.Script); err != nil {
+			return err
+		}
+	}
+	t, err := tracer.New(protocol,
+		tracer.WithEmitter(em),
+		tracer.WithTimeout(timeout),
+		tracer.WithDryRun(req.DryRun),
+		tracer.WithIPPreference(req.PreferIP),
+		tracer.WithData(req.Data),
+		tracer.WithMethod(req.Method),
+		tracer.WithHeaders(hdr),
+		tracer.WithInjectTraceHeader(req.InjectTraceID),
+		tracer.WithCaptureBody(min(req.CaptureBody, maxCaptureBody)),
+		tracer.WithResolver(resolver),
+		tracer.WithProxy(req.Proxy, req.NoProxy),
+		dns.Settings.With(dns.TracerSettings{QueryType: req.QueryType, Trace: req.DNSTrace}),
+		http2.Settings.With(http2.TracerSettings{Upgrade: req.H2CUpgrade, Window: req.H2Window}),
+		http3.Settings.With(http3.TracerSettings{AltSvc: req.H3AltSvc, ZeroRTT: req.ZeroRTT, Migrate: req.Migrate, Versions: req.QUICVersions}),
+		httptracer.WebSocket.With(httptracer.WebSocketSettings{Messages: req.WSMessages, Binary: req.WSBinary, Pings: pings, Listen: time.Duration(req.WSListenMS) * time.Millisecond}),
+		grpc.Settings.With(grpc.TracerSettings{Descriptors: req.GRPCDescriptorSet, Health: req.GRPCHealth}),
+		tcp.Settings.With(tcp.TracerSettings{Stream: req.TCPStream, Idle: time.Duration(req.TCPIdleMS) * time.Millisecond, MaxBytes: req.TCPMaxBytes, HalfClose: req.TCPHalfClose, Script: script, Probe: req.Probe}),
+		udp.Settings.With(udp.TracerSettings{Script: script}),
+		tracer.WithRedact(redact), tracer.WithRedactRequests(redactReq), tracer.WithRedactResponses(redactResp),
+	)
+	if err != nil {
+		return err
+	}
+	return t.Trace(ctx, req.Target)
+}
+
+// resolver returns the resolver selected by DNSServer, or nil for the
+// system resolver.
+func (req traceRequest) resolver() (*netutil.Resolver, error) {
+	if req.DNSServer == "" {
+		return nil, nil
+	}
+	srv, err := netutil.ParseDNSServer(req.DNSServer)
+	if err != nil {
+		return nil, err
+	}
+	return &netutil.Resolver{Server: &srv}, nil
+}
+
+// redaction resolves the effective redaction flags for req. Callers may only
+// relax the defaults when the service runs with -allow-unredacted.
+func (h *handler) redaction(req traceRequest) (redact, redactReq, redactResp bool) {
+	redact, redactReq, redactResp = true, true, true
+	if !h.cfg.AllowUnredacted {
+		return
+	}
+	if req.Redact != nil {
+		redact, redactReq, redactResp = *req.Redact, *req.Redact, *req.Redact
+	}
+	if req.RedactRequests != nil {
+		redactReq = *req.RedactRequests
+	}
+	if req.RedactResponses != nil {
+		redactResp = *req.RedactResponses
+	}
+	return
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// flushWriter flushes the response after every write so NDJSON lines reach
+// the client as soon as each event is emitted.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err == nil {
+		f.rc.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,79 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mrlm-net/tracer/internal/report"
+)
+
+// serviceConfig holds parsed flags for the web service.
+type serviceConfig struct {
+	Addr            string
+	ReportTemplate  string
+	AllowUnredacted bool
+	MaxTimeout      time.Duration
+	// Retention is how long finished async traces remain available.
+	Retention time.Duration
+	// MaxAsyncTraces bounds the async traces kept at once, running or
+	// retained; 0 is unlimited.
+	MaxAsyncTraces int
+}
+
+// Run starts the HTTP API and blocks until it is interrupted. It returns an
+// exit code appropriate for os.Exit.
+func Run(args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("web-service", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	addr := fs.String("addr", ":8080", "listen address")
+	tpl := fs.String("report-template", report.DefaultTemplate, "HTML report template used for format=html")
+	allowUnredacted := fs.Bool("allow-unredacted", false, "If true, API callers may disable redaction of sensitive headers (unsafe)")
+	maxTimeout := fs.Duration("max-timeout", 2*time.Minute, "upper bound for the per-trace timeout a caller may request")
+	retention := fs.Duration("trace-retention", 5*time.Minute, "how long finished async traces remain available for status and event requests")
+	maxAsync := fs.Int("max-async-traces", 100, "maximum number of async traces kept at once, running or retained; further async requests get 503 (0: unlimited)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg := serviceConfig{Addr: *addr, ReportTemplate: *tpl, AllowUnredacted: *allowUnredacted, MaxTimeout: *maxTimeout, Retention: *retention, MaxAsyncTraces: *maxAsync}
+	logger := log.New(stderr, "tracer-web: ", log.LstdFlags)
+
+	srv := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           newHandler(cfg, logger),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errCh := make(chan error, 1)
+	go func() {
+		logger.Printf("listening on %s", cfg.Addr)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, http.ErrServerClosed) {
+			logger.Printf("server error: %v", err)
+			return 1
+		}
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logger.Printf("shutdown error: %v", err)
+			return 1
+		}
+	}
+	return 0
+}
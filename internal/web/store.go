@@ -0,0 +1,110 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	eventpkg "github.com/mrlm-net/tracer/pkg/event"
+)
+
+// asyncTrace is a trace started with "async": true. Its events are retained in
+// a StreamEmitter so clients can follow them over SSE while it runs.
+type asyncTrace struct {
+	ID       string
+	Protocol string
+	Target   string
+	Stream   *eventpkg.StreamEmitter
+	cancel   context.CancelFunc
+
+	mu  sync.Mutex
+	err error
+}
+
+func (t *asyncTrace) finish(err error) {
+	t.mu.Lock()
+	t.err = err
+	t.mu.Unlock()
+	t.Stream.Close()
+}
+
+// Err returns the tracer error once the trace has finished.
+func (t *asyncTrace) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// Running reports whether the trace is still in progress.
+func (t *asyncTrace) Running() bool {
+	select {
+	case <-t.Stream.Done():
+		return false
+	default:
+		return true
+	}
+}
+
+// errStoreFull is returned by Start when the store holds its maximum number
+// of traces.
+var errStoreFull = errors.New("too many async traces; retry once earlier traces have expired")
+
+// traceStore keeps async traces addressable by ID until retention elapses
+// after they finish. At most max traces, running or retained, are kept.
+type traceStore struct {
+	mu        sync.Mutex
+	traces    map[string]*asyncTrace
+	retention time.Duration
+	max       int
+}
+
+func newTraceStore(retention time.Duration, max int) *traceStore {
+	return &traceStore{traces: make(map[string]*asyncTrace), retention: retention, max: max}
+}
+
+// Start registers a new trace and runs fn in the background with a context
+// bounded by timeout. fn receives the stream to emit into. It returns
+// errStoreFull instead when the store is full.
+func (s *traceStore) Start(protocol, target string, timeout time.Duration, fn func(ctx context.Context, em eventpkg.Emitter) error) (*asyncTrace, error) {
+	s.mu.Lock()
+	if s.max > 0 && len(s.traces) >= s.max {
+		s.mu.Unlock()
+		return nil, errStoreFull
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	t := &asyncTrace{ID: uuid.NewString(), Protocol: protocol, Target: target, Stream: eventpkg.NewStreamEmitter(), cancel: cancel}
+	s.traces[t.ID] = t
+	s.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		t.finish(fn(ctx, t.Stream))
+		time.AfterFunc(s.retention, func() { s.remove(t.ID) })
+	}()
+	return t, nil
+}
+
+// Get returns the trace with id or nil.
+func (s *traceStore) Get(id string) *asyncTrace {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.traces[id]
+}
+
+// Cancel aborts a running trace. It reports whether the trace exists.
+func (s *traceStore) Cancel(id string) bool {
+	t := s.Get(id)
+	if t == nil {
+		return false
+	}
+	t.cancel()
+	return true
+}
+
+func (s *traceStore) remove(id string) {
+	s.mu.Lock()
+	delete(s.traces, id)
+	s.mu.Unlock()
+}
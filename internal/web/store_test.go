@@ -0,0 +1,47 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	eventpkg "github.com/mrlm-net/tracer/pkg/event"
+)
+
+func TestTraceStoreLimit(t *testing.T) {
+	s := newTraceStore(time.Hour, 2)
+	block := make(chan struct{})
+	defer close(block)
+	run := func(ctx context.Context, _ eventpkg.Emitter) error {
+		<-block
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := s.Start("tcp", "x:1", time.Minute, run); err != nil {
+			t.Fatalf("Start %d: %v", i, err)
+		}
+	}
+	if _, err := s.Start("tcp", "x:1", time.Minute, run); !errors.Is(err, errStoreFull) {
+		t.Fatalf("Start on a full store: got %v, want errStoreFull", err)
+	}
+}
+
+func TestTraceStoreFreesExpired(t *testing.T) {
+	s := newTraceStore(10*time.Millisecond, 1)
+	tr, err := s.Start("tcp", "x:1", time.Minute, func(context.Context, eventpkg.Emitter) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-tr.Stream.Done()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Get(tr.ID) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("finished trace was not removed after retention")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := s.Start("tcp", "x:1", time.Minute, func(context.Context, eventpkg.Emitter) error { return nil }); err != nil {
+		t.Fatalf("Start after expiry: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// sseKeepAlive is the interval between SSE comment lines that keep idle
+// connections open through proxies.
+const sseKeepAlive = 15 * time.Second
+
+func (h *handler) handleStatus(w http.ResponseWriter, r *http.Request) {
+	t := h.store.Get(r.PathValue("id"))
+	if t == nil {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "trace not found"})
+		return
+	}
+	resp := statusResponse{ID: t.ID, Protocol: t.Protocol, Target: t.Target, Status: "running", Events: t.Stream.Events()}
+	if !t.Running() {
+		resp.Status = "done"
+		if err := t.Err(); err != nil {
+			resp.Error = err.Error()
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *handler) handleCancel(w http.ResponseWriter, r *http.Request) {
+	if !h.store.Cancel(r.PathValue("id")) {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "trace not found"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleEvents streams the events of an async trace as Server-Sent Events.
+// Each event carries its index as the SSE id so clients can resume with
+// Last-Event-ID. A final "end" event reports the tracer error, if any.
+func (h *handler) handleEvents(w http.ResponseWriter, r *http.Request) {
+	t := h.store.Get(r.PathValue("id"))
+	if t == nil {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "trace not found"})
+		return
+	}
+
+	from := 0
+	if last := r.Header.Get("Last-Event-ID"); last != "" {
+		if n, err := strconv.Atoi(last); err == nil && n >= 0 {
+			from = n + 1
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	ctx := r.Context()
+	events := t.Stream.Subscribe(ctx, from)
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+
+	idx := from
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				if ctx.Err() != nil {
+					return
+				}
+				end := map[string]string{}
+				if err := t.Err(); err != nil {
+					end["error"] = err.Error()
+				}
+				b, _ := json.Marshal(end)
+				fmt.Fprintf(w, "event: end\ndata: %s\n\n", b)
+				rc.Flush()
+				return
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				h.logger.Printf("marshal event: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", idx, b); err != nil {
+				return
+			}
+			idx++
+			rc.Flush()
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			rc.Flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
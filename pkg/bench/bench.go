@@ -0,0 +1,271 @@
+package bench
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mrlm-net/tracer/pkg/event"
+)
+
+// RunFunc performs a single trace, emitting its events to em.
+type RunFunc func(ctx context.Context, em event.Emitter) error
+
+// StageEvents maps aggregated stage names to the lifecycle event whose
+// DurationNS is sampled for that stage. "total" is measured around RunFunc.
+var StageEvents = map[string]string{
+	"dns":        "dns_done",
+	"connect":    "connect_done",
+	"tls":        "tls_handshake_done",
+	"first_byte": "got_first_response_byte",
+}
+
+// Stages lists aggregated stages in reporting order.
+var Stages = []string{"dns", "connect", "tls", "first_byte", "total"}
+
+type Option func(*benchConfig)
+
+type benchConfig struct {
+	Emitter     event.Emitter
+	Count       int
+	Concurrency int
+	Interval    time.Duration
+	// IterationEvents emits one metric event per completed iteration.
+	IterationEvents bool
+}
+
+// WithEmitter sets the emitter receiving metric events.
+func WithEmitter(e event.Emitter) Option { return func(c *benchConfig) { c.Emitter = e } }
+
+// WithCount sets the number of iterations (default 1).
+func WithCount(n int) Option { return func(c *benchConfig) { c.Count = n } }
+
+// WithConcurrency sets how many iterations may run at once (default 1).
+func WithConcurrency(n int) Option { return func(c *benchConfig) { c.Concurrency = n } }
+
+// WithInterval sets the minimum delay between iteration starts.
+func WithInterval(d time.Duration) Option { return func(c *benchConfig) { c.Interval = d } }
+
+// WithIterationEvents enables an "iteration" metric event per completed run.
+func WithIterationEvents(v bool) Option { return func(c *benchConfig) { c.IterationEvents = v } }
+
+// Stats summarizes the samples collected for one stage. Durations are in
+// nanoseconds to match event.Event.DurationNS.
+type Stats struct {
+	Count int   `json:"count"`
+	Min   int64 `json:"min_ns"`
+	Avg   int64 `json:"avg_ns"`
+	P50   int64 `json:"p50_ns"`
+	P90   int64 `json:"p90_ns"`
+	P99   int64 `json:"p99_ns"`
+	Max   int64 `json:"max_ns"`
+}
+
+// Result is the aggregate outcome of a benchmark run.
+type Result struct {
+	Protocol   string
+	Iterations int
+	Errors     int
+	// ErrorStages counts error events by stage (e.g. connect_error).
+	ErrorStages map[string]int
+	Stages      map[string]Stats
+	Elapsed     time.Duration
+}
+
+// iteration is the outcome of a single RunFunc call.
+type iteration struct {
+	index    int
+	protocol string
+	samples  map[string]int64
+	errs     map[string]int
+	err      error
+}
+
+// Run executes run repeatedly according to opts, aggregates per-stage
+// durations and emits them as metric events. The returned error is non-nil
+// only when ctx is cancelled; individual trace failures are counted in Result.
+func Run(ctx context.Context, run RunFunc, opts ...Option) (*Result, error) {
+	cfg := &benchConfig{Count: 1, Concurrency: 1}
+	for _, o := range opts {
+		o(cfg)
+	}
+	if cfg.Count < 1 {
+		cfg.Count = 1
+	}
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	if cfg.Emitter == nil {
+		cfg.Emitter = event.NewStdoutEmitter(os.Stdout, true, true)
+	}
+
+	benchID := uuid.NewString()
+	start := time.Now()
+
+	jobs := make(chan int)
+	results := make(chan iteration)
+	var wg sync.WaitGroup
+	for w := 0; w < cfg.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results <- runOnce(ctx, i, run)
+			}
+		}()
+	}
+
+	// dispatch iterations, pacing starts by Interval
+	go func() {
+		defer close(jobs)
+		var tick <-chan time.Time
+		if cfg.Interval > 0 {
+			t := time.NewTicker(cfg.Interval)
+			defer t.Stop()
+			tick = t.C
+		}
+		for i := 0; i < cfg.Count; i++ {
+			if i > 0 && tick != nil {
+				select {
+				case <-tick:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	res := &Result{ErrorStages: map[string]int{}, Stages: map[string]Stats{}}
+	samples := map[string][]int64{}
+	for it := range results {
+		res.Iterations++
+		if res.Protocol == "" {
+			res.Protocol = it.protocol
+		}
+		if it.err != nil {
+			res.Errors++
+		}
+		for stage, n := range it.errs {
+			res.ErrorStages[stage] += n
+		}
+		for stage, d := range it.samples {
+			samples[stage] = append(samples[stage], d)
+		}
+		if cfg.IterationEvents {
+			payload := map[string]interface{}{"iteration": it.index}
+			for stage, d := range it.samples {
+				payload[stage+"_ns"] = d
+			}
+			if it.err != nil {
+				payload["error"] = it.err.Error()
+			}
+			cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: it.protocol, EventType: "metric", Stage: "iteration", TraceID: benchID, DurationNS: it.samples["total"], Payload: payload})
+		}
+	}
+	res.Elapsed = time.Since(start)
+
+	for _, stage := range Stages {
+		if s := samples[stage]; len(s) > 0 {
+			res.Stages[stage] = Summarize(s)
+		}
+	}
+	emitResult(ctx, cfg, benchID, res)
+
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// runOnce executes a single iteration with a private buffer so its events can
+// be sampled without interleaving with concurrent iterations.
+func runOnce(ctx context.Context, index int, run RunFunc) iteration {
+	be := event.NewBufferingEmitter()
+	start := time.Now()
+	err := run(ctx, be)
+	it := iteration{index: index, err: err, samples: map[string]int64{"total": int64(time.Since(start))}, errs: map[string]int{}}
+
+	for _, e := range be.Events() {
+		if it.protocol == "" {
+			it.protocol = e.Protocol
+		}
+		if e.EventType == "error" {
+			it.errs[e.Stage]++
+			continue
+		}
+		for stage, evStage := range StageEvents {
+			// keep the first occurrence; later ones belong to redirects or retries
+			if e.Stage == evStage && e.DurationNS > 0 {
+				if _, seen := it.samples[stage]; !seen {
+					it.samples[stage] = e.DurationNS
+				}
+			}
+		}
+	}
+	return it
+}
+
+func emitResult(ctx context.Context, cfg *benchConfig, benchID string, res *Result) {
+	for _, stage := range Stages {
+		st, ok := res.Stages[stage]
+		if !ok {
+			continue
+		}
+		cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: res.Protocol, EventType: "metric", Stage: stage, TraceID: benchID, DurationNS: st.Avg, Payload: map[string]interface{}{
+			"count": st.Count, "min_ns": st.Min, "avg_ns": st.Avg, "p50_ns": st.P50, "p90_ns": st.P90, "p99_ns": st.P99, "max_ns": st.Max,
+		}})
+	}
+	cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: res.Protocol, EventType: "metric", Stage: "bench_summary", TraceID: benchID, DurationNS: int64(res.Elapsed), Payload: map[string]interface{}{
+		"iterations":   res.Iterations,
+		"requested":    cfg.Count,
+		"concurrency":  cfg.Concurrency,
+		"interval_ns":  int64(cfg.Interval),
+		"errors":       res.Errors,
+		"error_stages": res.ErrorStages,
+	}})
+}
+
+// Summarize computes min/avg/percentiles/max over samples using the
+// nearest-rank method. It does not modify samples.
+func Summarize(samples []int64) Stats {
+	if len(samples) == 0 {
+		return Stats{}
+	}
+	s := append([]int64(nil), samples...)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	var sum int64
+	for _, v := range s {
+		sum += v
+	}
+	return Stats{
+		Count: len(s),
+		Min:   s[0],
+		Avg:   sum / int64(len(s)),
+		P50:   percentile(s, 50),
+		P90:   percentile(s, 90),
+		P99:   percentile(s, 99),
+		Max:   s[len(s)-1],
+	}
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted samples.
+func percentile(sorted []int64, p int) int64 {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
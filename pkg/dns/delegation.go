@@ -0,0 +1,424 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mrlm-net/tracer/pkg/event"
+	"github.com/mrlm-net/tracer/pkg/netutil"
+	"github.com/mrlm-net/tracer/pkg/tracecommon"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// RootServers are the addresses of the IANA root servers, IPv4 then IPv6,
+// used by TraceDelegation unless WithRoots is given.
+var RootServers = []string{
+	"198.41.0.4",          // a.root-servers.net
+	"170.247.170.2",       // b.root-servers.net
+	"192.33.4.12",         // c.root-servers.net
+	"199.7.91.13",         // d.root-servers.net
+	"192.203.230.10",      // e.root-servers.net
+	"192.5.5.241",         // f.root-servers.net
+	"192.112.36.4",        // g.root-servers.net
+	"198.97.190.53",       // h.root-servers.net
+	"192.36.148.17",       // i.root-servers.net
+	"192.58.128.30",       // j.root-servers.net
+	"193.0.14.129",        // k.root-servers.net
+	"199.7.83.42",         // l.root-servers.net
+	"202.12.27.33",        // m.root-servers.net
+	"2001:503:ba3e::2:30", // a.root-servers.net
+	"2801:1b8:10::b",      // b.root-servers.net
+	"2001:500:2::c",       // c.root-servers.net
+	"2001:500:2d::d",      // d.root-servers.net
+	"2001:500:a8::e",      // e.root-servers.net
+	"2001:500:2f::f",      // f.root-servers.net
+	"2001:500:12::d0d",    // g.root-servers.net
+	"2001:500:1::53",      // h.root-servers.net
+	"2001:7fe::53",        // i.root-servers.net
+	"2001:503:c27::2:30",  // j.root-servers.net
+	"2001:7fd::1",         // k.root-servers.net
+	"2001:500:9f::42",     // l.root-servers.net
+	"2001:dc3::35",        // m.root-servers.net
+}
+
+// maxDelegationDepth bounds the number of referrals followed.
+const maxDelegationDepth = 32
+
+// nameServer is one server of a zone's NS set.
+type nameServer struct {
+	Name  string
+	Addrs []net.IP
+	// Glue is true when Addrs came from the referral's additional section
+	// rather than a separate lookup.
+	Glue bool
+}
+
+// step is the outcome of querying one server while walking the delegation.
+type step struct {
+	Server nameServer
+	Addr   string
+	RTT    time.Duration
+	Msg    *dnsmessage.Message
+	Err    error
+}
+
+// TraceDelegation resolves name iteratively, like dig +trace: it asks a root
+// server, follows each referral with non-recursive queries and stops at the
+// first authoritative answer. It emits a referral event per delegation
+// (queried server, NS set, glue, RTT) and an answer event, and raises alerts
+// for lame servers (no authoritative answer or referral) and for
+// authoritative servers of the final zone that disagree with each other.
+//
+// Servers learned from referrals are queried on the port of the root
+// servers, so a local stub hierarchy can run on an unprivileged port; roots
+// with different ports are rejected. NS
+// names without glue are resolved with the server given by WithServer, or
+// the system resolver.
+func TraceDelegation(ctx context.Context, name string, opts ...Option) error {
+	cfg := &traceConfig{Timeout: 5 * time.Second, Type: dnsmessage.TypeA, Recursion: true}
+	for _, o := range opts {
+		o(cfg)
+	}
+
+	if cfg.Emitter == nil {
+		cfg.Emitter = event.NewStdoutEmitter(os.Stdout, true, true)
+	}
+
+	traceID := tracecommon.StartRequest(ctx, cfg.Emitter, "dns", name)
+	if cfg.Dry {
+		tracecommon.EmitDryRun(ctx, cfg.Emitter, "dns", traceID)
+		return nil
+	}
+
+	w := &walker{cfg: cfg, traceID: traceID, qname: fqdn(name), port: "53"}
+	roots := cfg.Roots
+	if len(roots) == 0 {
+		roots = RootServers
+	}
+	servers := make([]nameServer, 0, len(roots))
+	for i, r := range roots {
+		host, port, err := splitServer(r)
+		if err != nil {
+			tracecommon.EmitError(ctx, cfg.Emitter, "dns", "delegation_error", traceID, err)
+			return err
+		}
+		// referrals carry no ports, so every root must share the one used
+		// for the servers they lead to
+		if i == 0 {
+			w.port = port
+		} else if port != w.port {
+			err := fmt.Errorf("root servers use different ports (%s and %s); referrals are queried on a single port", w.port, port)
+			tracecommon.EmitError(ctx, cfg.Emitter, "dns", "delegation_error", traceID, err)
+			return err
+		}
+		servers = append(servers, nameServer{Name: r, Addrs: []net.IP{host}})
+	}
+
+	if err := w.walk(ctx, servers); err != nil {
+		tracecommon.EmitError(ctx, cfg.Emitter, "dns", "delegation_error", traceID, err)
+		return err
+	}
+	tracecommon.EmitLifecycle(ctx, cfg.Emitter, "dns", "request_end", traceID, "", 0, nil, nil)
+	return nil
+}
+
+type walker struct {
+	cfg     *traceConfig
+	traceID string
+	qname   string
+	port    string
+}
+
+func (w *walker) walk(ctx context.Context, servers []nameServer) error {
+	zone := "."
+	for depth := 0; depth < maxDelegationDepth; depth++ {
+		st, err := w.queryZone(ctx, zone, servers)
+		if err != nil {
+			return err
+		}
+		child, ns := referral(st.Msg, zone, w.qname)
+		if child == "" {
+			w.answer(ctx, depth, zone, st, servers)
+			return nil
+		}
+		ns = w.addresses(ctx, ns, st.Msg)
+		w.emitReferral(ctx, depth, zone, child, st, ns)
+		zone, servers = child, ns
+	}
+	return fmt.Errorf("delegation for %s exceeds %d referrals", w.qname, maxDelegationDepth)
+}
+
+// queryZone asks the servers of zone in order and returns the first usable
+// response: an authoritative answer or a referral closer to the query name.
+// Servers that fail are reported as lame.
+func (w *walker) queryZone(ctx context.Context, zone string, servers []nameServer) (step, error) {
+	tried := 0
+	// every server is tried on the preferred family before falling back
+	for _, fallback := range []bool{false, true} {
+		for _, ns := range servers {
+			preferred, other := w.family(ns.Addrs)
+			ips := preferred
+			if fallback {
+				ips = other
+			}
+			for _, ip := range ips {
+				tried++
+				st := w.query(ctx, ns, ip)
+				if reason := lameReason(st, zone, w.qname); reason != "" {
+					w.emitLame(ctx, zone, st, reason)
+					continue
+				}
+				return st, nil
+			}
+		}
+	}
+	if tried == 0 {
+		return step{}, fmt.Errorf("no addresses for any name server of %s", zone)
+	}
+	return step{}, fmt.Errorf("none of the %d servers of %s answered for %s", tried, zone, w.qname)
+}
+
+// family splits addresses into the family of the IP preference (v4 for
+// ""/"auto") and the other one, used when no preferred address answers.
+func (w *walker) family(ips []net.IP) (preferred, other []net.IP) {
+	var v4s, v6s []net.IP
+	for _, ip := range ips {
+		if netutil.IsIPv4(ip) {
+			v4s = append(v4s, ip)
+		} else {
+			v6s = append(v6s, ip)
+		}
+	}
+	if strings.ToLower(w.cfg.IPPref) == "v6" {
+		return v6s, v4s
+	}
+	return v4s, v6s
+}
+
+func (w *walker) query(ctx context.Context, ns nameServer, ip net.IP) step {
+	st := step{Server: ns, Addr: net.JoinHostPort(ip.String(), w.port)}
+	srv := netutil.DNSServer{Transport: "udp", Addr: st.Addr, Timeout: w.cfg.Timeout}
+	start := time.Now()
+	st.Msg, st.Err = netutil.QueryIterative(ctx, srv, w.qname, w.cfg.Type)
+	st.RTT = time.Since(start)
+	return st
+}
+
+// lameReason returns why a response is unusable for zone, or "".
+func lameReason(st step, zone, qname string) string {
+	var re *netutil.RCodeError
+	switch {
+	case errors.As(st.Err, &re):
+		// an authoritative NXDOMAIN is a valid final answer
+		if re.RCode == dnsmessage.RCodeNameError && st.Msg.Header.Authoritative {
+			return ""
+		}
+		return strings.ToLower(netutil.RCodeName(re.RCode))
+	case st.Err != nil:
+		return netutil.DNSErrorKind(st.Err)
+	case st.Msg.Header.Authoritative:
+		return ""
+	}
+	if child, _ := referral(st.Msg, zone, qname); child != "" {
+		return ""
+	}
+	if hasNS(st.Msg.Authorities) {
+		return "upward_referral"
+	}
+	return "not_authoritative"
+}
+
+// referral returns the child zone and NS set when msg delegates qname to a
+// zone below zone; child is "" otherwise.
+func referral(msg *dnsmessage.Message, zone, qname string) (string, []nameServer) {
+	if msg.Header.Authoritative && len(msg.Answers) > 0 {
+		return "", nil
+	}
+	var child string
+	var ns []nameServer
+	for _, rr := range msg.Authorities {
+		b, ok := rr.Body.(*dnsmessage.NSResource)
+		if !ok {
+			continue
+		}
+		owner := strings.ToLower(rr.Header.Name.String())
+		if owner == zone || !isSubdomain(owner, zone) || !isSubdomain(qname, owner) {
+			continue
+		}
+		if child != "" && owner != child {
+			continue
+		}
+		child = owner
+		ns = append(ns, nameServer{Name: strings.ToLower(b.NS.String())})
+	}
+	return child, ns
+}
+
+// addresses fills in each server's addresses from the glue in msg, looking
+// up the names that have none.
+func (w *walker) addresses(ctx context.Context, ns []nameServer, msg *dnsmessage.Message) []nameServer {
+	for i := range ns {
+		for _, rr := range msg.Additionals {
+			if !strings.EqualFold(rr.Header.Name.String(), ns[i].Name) {
+				continue
+			}
+			switch b := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				ns[i].Addrs = append(ns[i].Addrs, net.IP(b.A[:]))
+			case *dnsmessage.AAAAResource:
+				ns[i].Addrs = append(ns[i].Addrs, net.IP(b.AAAA[:]))
+			}
+		}
+		ns[i].Glue = len(ns[i].Addrs) > 0
+		if !ns[i].Glue {
+			r := &netutil.Resolver{Server: w.cfg.Server}
+			ns[i].Addrs, _ = r.LookupIP(ctx, strings.TrimSuffix(ns[i].Name, "."), "53")
+		}
+	}
+	return ns
+}
+
+func (w *walker) emitReferral(ctx context.Context, depth int, zone, child string, st step, ns []nameServer) {
+	names := make([]string, 0, len(ns))
+	glue := map[string][]string{}
+	resolved := map[string][]string{}
+	var unresolved []string
+	for _, n := range ns {
+		names = append(names, n.Name)
+		if len(n.Addrs) == 0 {
+			unresolved = append(unresolved, n.Name)
+			continue
+		}
+		if n.Glue {
+			glue[n.Name] = ipStrings(n.Addrs)
+		} else {
+			resolved[n.Name] = ipStrings(n.Addrs)
+		}
+	}
+	payload := map[string]interface{}{
+		"depth": depth, "zone": zone, "server": st.Server.Name, "server_addr": st.Addr,
+		"child_zone": child, "ns": names, "glue": glue, "rcode": netutil.RCodeName(st.Msg.Header.RCode),
+	}
+	if len(resolved) > 0 {
+		payload["resolved"] = resolved
+	}
+	if len(unresolved) > 0 {
+		payload["unresolved"] = unresolved
+	}
+	tracecommon.EmitLifecycle(ctx, w.cfg.Emitter, "dns", "referral", w.traceID, "", int64(st.RTT), nil, payload)
+}
+
+func (w *walker) emitLame(ctx context.Context, zone string, st step, reason string) {
+	payload := map[string]interface{}{"zone": zone, "server": st.Server.Name, "server_addr": st.Addr, "reason": reason}
+	if st.Err != nil {
+		payload["error"] = st.Err.Error()
+	}
+	w.cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "dns", EventType: "alert", Stage: "lame_delegation", TraceID: w.traceID, DurationNS: int64(st.RTT), Payload: payload})
+}
+
+// answer reports the final response and compares it with the answers of the
+// zone's other servers.
+func (w *walker) answer(ctx context.Context, depth int, zone string, st step, servers []nameServer) {
+	payload := Describe(st.Msg)
+	payload["depth"] = depth
+	payload["zone"] = zone
+	payload["server"] = st.Server.Name
+	payload["server_addr"] = st.Addr
+
+	answers := map[string][]string{st.Addr: answerSet(st.Msg)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, ns := range servers {
+		preferred, other := w.family(ns.Addrs)
+		ips := append(preferred, other...)
+		if len(ips) == 0 || ns.Name == st.Server.Name {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			other := w.query(ctx, ns, ips[0])
+			if reason := lameReason(other, zone, w.qname); reason != "" {
+				w.emitLame(ctx, zone, other, reason)
+				return
+			}
+			mu.Lock()
+			answers[other.Addr] = answerSet(other.Msg)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	payload["servers_checked"] = len(answers)
+	tracecommon.EmitLifecycle(ctx, w.cfg.Emitter, "dns", "answer", w.traceID, "", int64(st.RTT), nil, payload)
+
+	ref := answers[st.Addr]
+	for _, a := range answers {
+		if !slices.Equal(a, ref) {
+			w.cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "dns", EventType: "alert", Stage: "inconsistent_answers", TraceID: w.traceID, Payload: map[string]interface{}{
+				"zone": zone, "name": w.qname, "type": TypeName(w.cfg.Type), "answers": answers,
+			}})
+			return
+		}
+	}
+}
+
+// answerSet renders the RCODE and answer records without TTLs, sorted, so
+// responses from different servers can be compared.
+func answerSet(msg *dnsmessage.Message) []string {
+	set := []string{netutil.RCodeName(msg.Header.RCode)}
+	for _, r := range records(msg.Answers) {
+		set = append(set, fmt.Sprintf("%s %s %s", r["name"], r["type"], r["data"]))
+	}
+	slices.Sort(set[1:])
+	return set
+}
+
+func hasNS(rs []dnsmessage.Resource) bool {
+	for _, rr := range rs {
+		if rr.Header.Type == dnsmessage.TypeNS {
+			return true
+		}
+	}
+	return false
+}
+
+func ipStrings(ips []net.IP) []string {
+	out := make([]string, len(ips))
+	for i, ip := range ips {
+		out[i] = ip.String()
+	}
+	return out
+}
+
+// splitServer parses an IP address with an optional port (default 53).
+func splitServer(s string) (net.IP, string, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host, port = strings.Trim(s, "[]"), "53"
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, "", fmt.Errorf("invalid root server %q, expected an IP address with optional port", s)
+	}
+	return ip, port, nil
+}
+
+func fqdn(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// isSubdomain reports whether child equals parent or lies below it.
+func isSubdomain(child, parent string) bool {
+	return parent == "." || child == parent || strings.HasSuffix(child, "."+parent)
+}
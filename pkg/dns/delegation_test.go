@@ -0,0 +1,172 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrlm-net/tracer/pkg/event"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveStub answers UDP queries on addr with the message reply builds for
+// the question, until the test ends.
+func serveStub(t *testing.T, addr string, reply func(q dnsmessage.Question) dnsmessage.Message) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Skipf("listen %s: %v", addr, err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var q dnsmessage.Message
+			if q.Unpack(buf[:n]) != nil || len(q.Questions) != 1 {
+				continue
+			}
+			m := reply(q.Questions[0])
+			m.Header.ID, m.Header.Response = q.Header.ID, true
+			m.Questions = q.Questions
+			if out, err := m.Pack(); err == nil {
+				_, _ = pc.WriteTo(out, from)
+			}
+		}
+	}()
+}
+
+func rrName(s string) dnsmessage.Name { return dnsmessage.MustNewName(s) }
+
+// delegate refers every question to zone, served by the named servers at
+// the given glue addresses.
+func delegate(zone string, glue map[string][4]byte, order ...string) func(dnsmessage.Question) dnsmessage.Message {
+	return func(dnsmessage.Question) dnsmessage.Message {
+		var m dnsmessage.Message
+		for _, ns := range order {
+			hdr := dnsmessage.ResourceHeader{Name: rrName(zone), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET, TTL: 3600}
+			m.Authorities = append(m.Authorities, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.NSResource{NS: rrName(ns)}})
+			hdr = dnsmessage.ResourceHeader{Name: rrName(ns), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 3600}
+			m.Additionals = append(m.Additionals, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AResource{A: glue[ns]}})
+		}
+		return m
+	}
+}
+
+// authoritative answers every question with one A record.
+func authoritative(a [4]byte) func(dnsmessage.Question) dnsmessage.Message {
+	return func(q dnsmessage.Question) dnsmessage.Message {
+		hdr := dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300}
+		return dnsmessage.Message{
+			Header:  dnsmessage.Header{Authoritative: true},
+			Answers: []dnsmessage.Resource{{Header: hdr, Body: &dnsmessage.AResource{A: a}}},
+		}
+	}
+}
+
+func TestTraceDelegation(t *testing.T) {
+	// every server of the stub hierarchy listens on the root's port
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	pc.Close()
+	at := func(ip string) string { return net.JoinHostPort(ip, port) }
+
+	serveStub(t, at("127.0.0.1"), delegate("test.", map[string][4]byte{"ns.test.": {127, 0, 0, 2}}, "ns.test."))
+	serveStub(t, at("127.0.0.2"), delegate("example.test.", map[string][4]byte{
+		"lame.example.test.": {127, 0, 0, 3},
+		"ns1.example.test.":  {127, 0, 0, 4},
+		"ns2.example.test.":  {127, 0, 0, 5},
+	}, "lame.example.test.", "ns1.example.test.", "ns2.example.test."))
+	// a server of the zone that neither answers authoritatively nor refers
+	serveStub(t, at("127.0.0.3"), func(dnsmessage.Question) dnsmessage.Message { return dnsmessage.Message{} })
+	serveStub(t, at("127.0.0.4"), authoritative([4]byte{192, 0, 2, 1}))
+	serveStub(t, at("127.0.0.5"), authoritative([4]byte{192, 0, 2, 2}))
+
+	want := []string{
+		"referral test.",
+		"referral example.test.",
+		"lame_delegation " + at("127.0.0.3") + " not_authoritative",
+		// the final zone's servers are all asked again to compare answers
+		"lame_delegation " + at("127.0.0.3") + " not_authoritative",
+		"answer " + at("127.0.0.4"),
+		"inconsistent_answers",
+		"request_end",
+	}
+	// the hierarchy has IPv4 addresses only, so preferring v6 falls back
+	for _, pref := range []string{"auto", "v6"} {
+		be := event.NewBufferingEmitter()
+		err = TraceDelegation(context.Background(), "www.example.test", WithEmitter(be), WithRoots(at("127.0.0.1")), WithTimeout(time.Second), WithIPPreference(pref))
+		if err != nil {
+			t.Fatalf("%s: TraceDelegation: %v", pref, err)
+		}
+
+		var stages []string
+		for _, e := range be.Events() {
+			switch e.Stage {
+			case "referral":
+				stages = append(stages, e.Stage+" "+e.Payload["child_zone"].(string))
+			case "lame_delegation":
+				stages = append(stages, e.Stage+" "+e.Payload["server_addr"].(string)+" "+e.Payload["reason"].(string))
+			case "answer":
+				stages = append(stages, e.Stage+" "+e.Payload["server_addr"].(string))
+			case "inconsistent_answers", "request_end":
+				stages = append(stages, e.Stage)
+			}
+		}
+		if strings.Join(stages, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: stages:\n%s\nwant:\n%s", pref, strings.Join(stages, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+func TestTraceDelegationMixedRootPorts(t *testing.T) {
+	be := event.NewBufferingEmitter()
+	err := TraceDelegation(context.Background(), "example.test", WithEmitter(be), WithRoots("127.0.0.1:5353", "127.0.0.2"))
+	if err == nil || !strings.Contains(err.Error(), "different ports") {
+		t.Fatalf("TraceDelegation = %v, want a mixed port error", err)
+	}
+}
+
+func TestWalkerFamily(t *testing.T) {
+	v4, v4b, v6 := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("2001:db8::1")
+	tests := []struct {
+		pref             string
+		preferred, other []net.IP
+	}{
+		{pref: "", preferred: []net.IP{v4, v4b}, other: []net.IP{v6}},
+		{pref: "v4", preferred: []net.IP{v4, v4b}, other: []net.IP{v6}},
+		{pref: "V6", preferred: []net.IP{v6}, other: []net.IP{v4, v4b}},
+	}
+	for _, tt := range tests {
+		w := &walker{cfg: &traceConfig{IPPref: tt.pref}}
+		preferred, other := w.family([]net.IP{v4, v6, v4b})
+		if fmt.Sprint(preferred) != fmt.Sprint(tt.preferred) || fmt.Sprint(other) != fmt.Sprint(tt.other) {
+			t.Errorf("%q: family = %v, %v; want %v, %v", tt.pref, preferred, other, tt.preferred, tt.other)
+		}
+	}
+}
+
+func TestRootServers(t *testing.T) {
+	var v6 int
+	for _, r := range RootServers {
+		ip, port, err := splitServer(r)
+		if err != nil || port != "53" {
+			t.Errorf("%s: splitServer = %v, %s, %v", r, ip, port, err)
+		}
+		if ip.To4() == nil {
+			v6++
+		}
+	}
+	if v6 != 13 {
+		t.Errorf("%d IPv6 roots, want 13", v6)
+	}
+}
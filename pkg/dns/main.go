@@ -0,0 +1,163 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mrlm-net/tracer/pkg/event"
+	"github.com/mrlm-net/tracer/pkg/netutil"
+	"github.com/mrlm-net/tracer/pkg/tracecommon"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type Option func(*traceConfig)
+
+type traceConfig struct {
+	Emitter event.Emitter
+	Dry     bool
+	Timeout time.Duration
+	// Server is the DNS server queried; nil uses the first nameserver of the
+	// system configuration over UDP.
+	Server *netutil.DNSServer
+	Type   dnsmessage.Type
+	// Recursion sets the RD (recursion desired) flag.
+	Recursion bool
+	// Roots are the servers TraceDelegation starts from (default
+	// RootServers).
+	Roots []string
+	// IPPref selects the address family of name servers TraceDelegation
+	// queries first: "v4", "v6" or ""/"auto" (IPv4).
+	IPPref string
+}
+
+// WithEmitter sets a custom emitter.
+func WithEmitter(e event.Emitter) Option { return func(c *traceConfig) { c.Emitter = e } }
+
+// WithDryRun enables dry-run mode.
+func WithDryRun(d bool) Option { return func(c *traceConfig) { c.Dry = d } }
+
+// WithTimeout sets the timeout of each query exchange.
+func WithTimeout(d time.Duration) Option { return func(c *traceConfig) { c.Timeout = d } }
+
+// WithServer sets the DNS server and transport (udp, tcp, dot, doh).
+func WithServer(s netutil.DNSServer) Option { return func(c *traceConfig) { c.Server = &s } }
+
+// WithType sets the query type (default A).
+func WithType(t dnsmessage.Type) Option { return func(c *traceConfig) { c.Type = t } }
+
+// WithRecursion controls the RD flag (default true).
+func WithRecursion(v bool) Option { return func(c *traceConfig) { c.Recursion = v } }
+
+// WithRoots sets the root servers (IP[:port]) TraceDelegation starts from.
+func WithRoots(addrs ...string) Option { return func(c *traceConfig) { c.Roots = addrs } }
+
+// WithIPPreference sets the name server address family TraceDelegation
+// tries first: "v4", "v6" or ""/"auto". The other family is used when no
+// server of a zone answers on the preferred one.
+func WithIPPreference(p string) Option { return func(c *traceConfig) { c.IPPref = p } }
+
+// TraceQuery sends a query for name to the configured server and emits
+// query_send and response_recv events. A truncated UDP response is retried
+// over TCP (tcp_fallback). Responses with an error RCODE are reported, not
+// returned as errors; only transport failures fail the trace.
+func TraceQuery(ctx context.Context, name string, opts ...Option) error {
+	cfg := &traceConfig{Timeout: 5 * time.Second, Type: dnsmessage.TypeA, Recursion: true}
+	for _, o := range opts {
+		o(cfg)
+	}
+
+	if cfg.Emitter == nil {
+		cfg.Emitter = event.NewStdoutEmitter(os.Stdout, true, true)
+	}
+
+	traceID := tracecommon.StartRequest(ctx, cfg.Emitter, "dns", name)
+	if cfg.Dry {
+		tracecommon.EmitDryRun(ctx, cfg.Emitter, "dns", traceID)
+		return nil
+	}
+
+	srv, err := server(cfg)
+	if err != nil {
+		tracecommon.EmitError(ctx, cfg.Emitter, "dns", "query_error", traceID, err)
+		return err
+	}
+
+	msg, err := exchange(ctx, cfg, srv, name, traceID)
+	if err != nil {
+		return err
+	}
+	if msg.Header.Truncated && srv.Transport == "udp" {
+		tracecommon.EmitLifecycle(ctx, cfg.Emitter, "dns", "tcp_fallback", traceID, "", 0, nil, map[string]interface{}{"server": srv.Addr})
+		srv.Transport = "tcp"
+		if _, err = exchange(ctx, cfg, srv, name, traceID); err != nil {
+			return err
+		}
+	}
+
+	tracecommon.EmitLifecycle(ctx, cfg.Emitter, "dns", "request_end", traceID, "", 0, nil, nil)
+	return nil
+}
+
+// server returns the configured server or the first system nameserver.
+func server(cfg *traceConfig) (netutil.DNSServer, error) {
+	var srv netutil.DNSServer
+	if cfg.Server != nil {
+		srv = *cfg.Server
+	} else {
+		ns := netutil.SystemNameservers()
+		if len(ns) == 0 {
+			return srv, errors.New("no DNS server configured and none found in /etc/resolv.conf")
+		}
+		var err error
+		if srv, err = netutil.ParseDNSServer(ns[0]); err != nil {
+			return srv, err
+		}
+	}
+	srv.Timeout = cfg.Timeout
+	return srv, nil
+}
+
+// exchange performs one query/response round trip and emits its events.
+func exchange(ctx context.Context, cfg *traceConfig, srv netutil.DNSServer, name, traceID string) (*dnsmessage.Message, error) {
+	newQuery := netutil.NewQuery
+	if !cfg.Recursion {
+		newQuery = netutil.NewIterativeQuery
+	}
+	query, id, err := newQuery(name, cfg.Type)
+	if err != nil {
+		tracecommon.EmitError(ctx, cfg.Emitter, "dns", "query_error", traceID, err)
+		return nil, err
+	}
+	tracecommon.EmitLifecycle(ctx, cfg.Emitter, "dns", "query_send", traceID, "", 0, nil, map[string]interface{}{
+		"server": srv.String(), "transport": srv.Transport, "name": name, "type": TypeName(cfg.Type), "id": id, "recursion_desired": cfg.Recursion, "bytes_sent": len(query),
+	})
+
+	start := time.Now()
+	raw, err := srv.Exchange(ctx, query)
+	rtt := time.Since(start)
+	if err != nil {
+		cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "dns", EventType: "error", Stage: "query_error", TraceID: traceID, DurationNS: int64(rtt), Payload: map[string]interface{}{"server": srv.String(), "transport": srv.Transport, "error": err.Error(), "error_kind": netutil.DNSErrorKind(err)}})
+		return nil, err
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(raw); err != nil {
+		err = fmt.Errorf("invalid DNS response: %w", err)
+		tracecommon.EmitError(ctx, cfg.Emitter, "dns", "query_error", traceID, err)
+		return nil, err
+	}
+	if msg.Header.ID != id {
+		err := fmt.Errorf("DNS response ID %d does not match query ID %d", msg.Header.ID, id)
+		tracecommon.EmitError(ctx, cfg.Emitter, "dns", "query_error", traceID, err)
+		return nil, err
+	}
+
+	payload := Describe(&msg)
+	payload["server"] = srv.String()
+	payload["transport"] = srv.Transport
+	payload["bytes_recv"] = len(raw)
+	tracecommon.EmitLifecycle(ctx, cfg.Emitter, "dns", "response_recv", traceID, "", int64(rtt), nil, payload)
+	return &msg, nil
+}
@@ -0,0 +1,155 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/mrlm-net/tracer/pkg/netutil"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var typeNames = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"TXT":   dnsmessage.TypeTXT,
+	"SRV":   dnsmessage.TypeSRV,
+	"NS":    dnsmessage.TypeNS,
+	"SOA":   dnsmessage.TypeSOA,
+	"PTR":   dnsmessage.TypePTR,
+	"CAA":   dnsmessage.Type(257),
+	"ANY":   dnsmessage.TypeALL,
+}
+
+// ParseType parses a record type name (A, AAAA, CNAME, MX, TXT, SRV, NS,
+// SOA, PTR, CAA, ANY) or the generic TYPEnnn form, case-insensitively.
+func ParseType(s string) (dnsmessage.Type, error) {
+	u := strings.ToUpper(strings.TrimSpace(s))
+	if u == "" {
+		return dnsmessage.TypeA, nil
+	}
+	if t, ok := typeNames[u]; ok {
+		return t, nil
+	}
+	if n, ok := strings.CutPrefix(u, "TYPE"); ok {
+		if v, err := strconv.ParseUint(n, 10, 16); err == nil {
+			return dnsmessage.Type(v), nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported DNS record type %q", s)
+}
+
+// TypeName returns the mnemonic of t (e.g. "MX"), or TYPEnnn for types
+// without one.
+func TypeName(t dnsmessage.Type) string {
+	for name, v := range typeNames {
+		if v == t {
+			return name
+		}
+	}
+	if t == dnsmessage.TypeOPT {
+		return "OPT"
+	}
+	return fmt.Sprintf("TYPE%d", uint16(t))
+}
+
+// Describe summarizes a response: RCODE, header flags and every section with
+// per-record name, type, class, TTL and rendered data.
+func Describe(m *dnsmessage.Message) map[string]interface{} {
+	h := m.Header
+	d := map[string]interface{}{
+		"id":     h.ID,
+		"rcode":  netutil.RCodeName(h.RCode),
+		"opcode": int(h.OpCode),
+		"flags": map[string]bool{
+			"qr": h.Response,
+			"aa": h.Authoritative,
+			"tc": h.Truncated,
+			"rd": h.RecursionDesired,
+			"ra": h.RecursionAvailable,
+			"ad": h.AuthenticData,
+			"cd": h.CheckingDisabled,
+		},
+		"truncated":   h.Truncated,
+		"answers":     records(m.Answers),
+		"authorities": records(m.Authorities),
+		"additionals": records(m.Additionals),
+	}
+	if len(m.Questions) > 0 {
+		q := m.Questions[0]
+		d["question"] = map[string]interface{}{"name": q.Name.String(), "type": TypeName(q.Type)}
+	}
+	for _, r := range m.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			d["edns"] = map[string]interface{}{
+				"udp_size":  int(r.Header.Class),
+				"dnssec_ok": r.Header.DNSSECAllowed(),
+				"version":   int(r.Header.TTL >> 16 & 0xff),
+			}
+		}
+	}
+	return d
+}
+
+func records(rs []dnsmessage.Resource) []map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(rs))
+	for _, r := range rs {
+		// the EDNS pseudo-record is reported separately
+		if r.Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		out = append(out, map[string]interface{}{
+			"name":  r.Header.Name.String(),
+			"type":  TypeName(r.Header.Type),
+			"class": className(r.Header.Class),
+			"ttl":   r.Header.TTL,
+			"data":  recordData(r.Body),
+		})
+	}
+	return out
+}
+
+func className(c dnsmessage.Class) string {
+	switch c {
+	case dnsmessage.ClassINET:
+		return "IN"
+	case dnsmessage.ClassCHAOS:
+		return "CH"
+	}
+	return fmt.Sprintf("CLASS%d", uint16(c))
+}
+
+// recordData renders a record body in presentation (zone file) format.
+func recordData(b dnsmessage.ResourceBody) string {
+	switch r := b.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(r.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(r.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		return r.CNAME.String()
+	case *dnsmessage.NSResource:
+		return r.NS.String()
+	case *dnsmessage.PTRResource:
+		return r.PTR.String()
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%d %s", r.Pref, r.MX.String())
+	case *dnsmessage.TXTResource:
+		parts := make([]string, len(r.TXT))
+		for i, s := range r.TXT {
+			parts[i] = strconv.Quote(s)
+		}
+		return strings.Join(parts, " ")
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf("%d %d %d %s", r.Priority, r.Weight, r.Port, r.Target.String())
+	case *dnsmessage.SOAResource:
+		return fmt.Sprintf("%s %s %d %d %d %d %d", r.NS.String(), r.MBox.String(), r.Serial, r.Refresh, r.Retry, r.Expire, r.MinTTL)
+	case *dnsmessage.UnknownResource:
+		// RFC 3597 generic form
+		return fmt.Sprintf("\\# %d %x", len(r.Data), r.Data)
+	}
+	return ""
+}
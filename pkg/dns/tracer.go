@@ -0,0 +1,59 @@
+package dns
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/mrlm-net/tracer/pkg/tracer"
+)
+
+func init() {
+	tracer.Register("dns", newTracer)
+}
+
+// TracerSettings are the dns tracer's own options: the record type queried
+// (default A) and, with Trace, a walk of the delegation from Roots (IP[:port],
+// default the IANA root servers) instead of one query.
+type TracerSettings struct {
+	QueryType string
+	Trace     bool
+	Roots     []string
+}
+
+// Settings is the key of TracerSettings in tracer.Options.
+var Settings = tracer.NewKey[TracerSettings]("dns")
+
+// newTracer queries the name given as target. The server comes from the
+// shared resolver (-dns-server) and the record type from the settings; with
+// Trace the delegation is walked from the roots instead.
+func newTracer(o tracer.Options) (tracer.Tracer, error) {
+	s, _ := Settings.Get(o)
+	t, err := ParseType(s.QueryType)
+	if err != nil {
+		return nil, err
+	}
+	opts := []Option{WithEmitter(o.Emitter), WithDryRun(o.DryRun), WithType(t), WithIPPreference(o.IPPref), WithRoots(s.Roots...)}
+	if o.Timeout > 0 {
+		opts = append(opts, WithTimeout(o.Timeout))
+	}
+	if o.Resolver != nil && o.Resolver.Server != nil {
+		opts = append(opts, WithServer(*o.Resolver.Server))
+	}
+	return tracer.Func(func(ctx context.Context, target string) error {
+		if s.Trace {
+			return TraceDelegation(ctx, targetName(target), opts...)
+		}
+		return TraceQuery(ctx, targetName(target), opts...)
+	}), nil
+}
+
+// targetName accepts a bare name or a URL and returns the hostname to query.
+func targetName(target string) string {
+	if strings.Contains(target, "://") {
+		if u, err := url.Parse(target); err == nil && u.Hostname() != "" {
+			return u.Hostname()
+		}
+	}
+	return target
+}
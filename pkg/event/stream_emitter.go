@@ -0,0 +1,111 @@
+package event
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// StreamEmitter fans events out to any number of subscribers while a trace is
+// running. Every event is retained so late subscribers first receive the
+// history and then live events. Emit never blocks on slow subscribers. It is
+// safe for concurrent use.
+type StreamEmitter struct {
+	mu      sync.Mutex
+	events  []Event
+	closed  bool
+	changed chan struct{}
+	done    chan struct{}
+}
+
+// NewStreamEmitter returns a new StreamEmitter.
+func NewStreamEmitter() *StreamEmitter {
+	return &StreamEmitter{changed: make(chan struct{}), done: make(chan struct{})}
+}
+
+// Emit records e and wakes up subscribers. Events emitted after Close are dropped.
+func (s *StreamEmitter) Emit(_ context.Context, e Event) error {
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now().UTC()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.events = append(s.events, e)
+	s.notifyLocked()
+	return nil
+}
+
+// Close marks the stream as complete. Subscriber channels are closed once they
+// have delivered all events. Close is idempotent.
+func (s *StreamEmitter) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.done)
+	s.notifyLocked()
+}
+
+func (s *StreamEmitter) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Done returns a channel that is closed when the stream is closed.
+func (s *StreamEmitter) Done() <-chan struct{} { return s.done }
+
+// Events returns a copy of the events emitted so far.
+func (s *StreamEmitter) Events() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Event, len(s.events))
+	copy(out, s.events)
+	return out
+}
+
+// Subscribe returns a channel delivering every event starting at index from
+// (0 for the full history). The channel is closed after the stream is closed
+// and drained, or when ctx is cancelled.
+func (s *StreamEmitter) Subscribe(ctx context.Context, from int) <-chan Event {
+	out := make(chan Event, 16)
+	go func() {
+		defer close(out)
+		next := max(from, 0)
+		for {
+			s.mu.Lock()
+			var batch []Event
+			if next < len(s.events) {
+				batch = append(batch, s.events[next:]...)
+			}
+			closed := s.closed
+			changed := s.changed
+			s.mu.Unlock()
+
+			for _, e := range batch {
+				select {
+				case out <- e:
+					next++
+				case <-ctx.Done():
+					return
+				}
+			}
+			if len(batch) > 0 {
+				continue
+			}
+			if closed {
+				return
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,189 @@
+// Package expect parses the send/expect scripts the tcp, tls and udp tracers
+// run against line-based protocols, and reports the outcome of each step.
+package expect
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Script is a parsed script: the steps run in order on one connection.
+//
+// Each line holds one directive; blank lines and lines starting with # are
+// skipped:
+//
+//	send <text>        send text as is
+//	sendline [text]    send text followed by CRLF
+//	expect <regexp>    wait until the data received matches regexp
+//	timeout <duration> how long the following expects wait (e.g. 2s)
+//
+// Text and patterns are taken verbatim up to the end of the line, or written
+// as a Go double-quoted string to use escapes such as \r\n or keep trailing
+// spaces. Patterns are Go regular expressions in multi-line mode, so ^ and $
+// match at line boundaries.
+type Script struct {
+	Steps []Step
+}
+
+// Step is one exchange: a payload to send, a pattern to wait for, or both.
+type Step struct {
+	// Line is the script line of the step's first directive.
+	Line int
+	Send []byte
+	// Expect is nil for steps that only send.
+	Expect *regexp.Regexp
+	// Pattern is Expect as written in the script.
+	Pattern string
+	// Timeout bounds the wait for Expect; 0 leaves it to the tracer.
+	Timeout time.Duration
+}
+
+// Parse reads a script.
+func Parse(src string) (*Script, error) {
+	s := &Script{}
+	var timeout time.Duration
+	sc := bufio.NewScanner(strings.NewReader(src))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		directive, arg := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			directive, arg = line[:i], strings.TrimLeft(line[i:], " \t")
+		}
+		fail := func(err error) (*Script, error) {
+			return nil, fmt.Errorf("script line %d: %w", n, err)
+		}
+		// a bare sendline sends an empty line
+		if arg == "" && directive != "sendline" {
+			return fail(fmt.Errorf("%s needs an argument", directive))
+		}
+		switch directive {
+		case "send", "sendline":
+			text, err := unquote(arg)
+			if err != nil {
+				return fail(err)
+			}
+			if directive == "sendline" {
+				text += "\r\n"
+			}
+			s.Steps = append(s.Steps, Step{Line: n, Send: []byte(text)})
+		case "expect":
+			pattern, err := unquote(arg)
+			if err != nil {
+				return fail(err)
+			}
+			re, err := regexp.Compile("(?m)" + pattern)
+			if err != nil {
+				return fail(err)
+			}
+			// an expect answers the send before it
+			if last := len(s.Steps) - 1; last < 0 || s.Steps[last].Expect != nil {
+				s.Steps = append(s.Steps, Step{Line: n})
+			}
+			st := &s.Steps[len(s.Steps)-1]
+			st.Expect, st.Pattern, st.Timeout = re, pattern, timeout
+		case "timeout":
+			d, err := time.ParseDuration(arg)
+			if err != nil {
+				return fail(err)
+			}
+			if d <= 0 {
+				return fail(fmt.Errorf("timeout must be positive, got %s", arg))
+			}
+			timeout = d
+		default:
+			return fail(fmt.Errorf("unknown directive %q (want send, sendline, expect or timeout)", directive))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(s.Steps) == 0 {
+		return nil, fmt.Errorf("script has no send or expect steps")
+	}
+	return s, nil
+}
+
+// unquote returns arg, or the string it quotes when it is written as a Go
+// double-quoted string.
+func unquote(arg string) (string, error) {
+	if !strings.HasPrefix(arg, `"`) {
+		return arg, nil
+	}
+	s, err := strconv.Unquote(arg)
+	if err != nil {
+		return "", fmt.Errorf("invalid quoted string %s", arg)
+	}
+	return s, nil
+}
+
+// maxShown caps the received data quoted in step events.
+const maxShown = 256
+
+// Result is the outcome of one step.
+type Result struct {
+	Index int
+	Step  *Step
+	// BytesSent and BytesRecv count the data written and read in the step.
+	BytesSent int
+	BytesRecv int
+	// Match is the data matching Expect; Unmatched is the data received
+	// without a match when the step failed.
+	Match     []byte
+	Unmatched []byte
+	// Redact reports Match and Unmatched only by their length, as the data
+	// received may echo credentials the script sent.
+	Redact bool
+	// Wait is the time from the end of the send to the match.
+	Wait time.Duration
+	Err  error
+}
+
+// Payload renders r as the payload of a step event.
+func (r Result) Payload() map[string]interface{} {
+	p := map[string]interface{}{"index": r.Index, "line": r.Step.Line, "bytes_sent": r.BytesSent, "bytes_recv": r.BytesRecv}
+	if r.Step.Expect != nil {
+		p["expect"] = r.Step.Pattern
+		p["matched"] = r.Err == nil
+		p["wait_ns"] = int64(r.Wait)
+		if r.Err == nil {
+			p["match"] = r.shown(r.Match, false)
+		}
+	}
+	if r.Err != nil {
+		p["error"] = r.Err.Error()
+		if len(r.Unmatched) > 0 {
+			p["received"] = r.shown(r.Unmatched, true)
+		}
+	}
+	return p
+}
+
+// Failure describes a failed step for the error the trace returns.
+func (r Result) Failure() error {
+	if r.Step.Expect == nil {
+		return fmt.Errorf("script step %d (line %d): %w", r.Index, r.Step.Line, r.Err)
+	}
+	return fmt.Errorf("script step %d (line %d): expect %q: %w", r.Index, r.Step.Line, r.Step.Pattern, r.Err)
+}
+
+// shown quotes up to maxShown bytes of b, its end when tail is set, or only
+// its length when r is redacted.
+func (r Result) shown(b []byte, tail bool) string {
+	if r.Redact {
+		return fmt.Sprintf("REDACTED (%d bytes)", len(b))
+	}
+	if len(b) <= maxShown {
+		return string(b)
+	}
+	if tail {
+		return "…" + string(b[len(b)-maxShown:])
+	}
+	return string(b[:maxShown]) + "…"
+}
@@ -0,0 +1,142 @@
+package expect
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	type step struct {
+		line    int
+		send    string
+		pattern string
+		timeout time.Duration
+	}
+	tests := []struct {
+		name  string
+		src   string
+		steps []step
+		err   string
+	}{
+		{
+			name: "send and expect pair",
+			src:  "send PING\nexpect ^PONG",
+			steps: []step{
+				{line: 1, send: "PING", pattern: "^PONG"},
+			},
+		},
+		{
+			name: "greeting before the first send",
+			src:  "# smtp\n\nexpect ^220\nsendline EHLO a.example\nexpect \"^250 \"\nsendline QUIT",
+			steps: []step{
+				{line: 3, pattern: "^220"},
+				{line: 4, send: "EHLO a.example\r\n", pattern: "^250 "},
+				{line: 6, send: "QUIT\r\n"},
+			},
+		},
+		{
+			name: "bare sendline and quoted text",
+			src:  "sendline\nsend \"a\\tb \"",
+			steps: []step{
+				{line: 1, send: "\r\n"},
+				{line: 2, send: "a\tb "},
+			},
+		},
+		{
+			name: "consecutive expects",
+			src:  "expect one\nexpect two",
+			steps: []step{
+				{line: 1, pattern: "one"},
+				{line: 2, pattern: "two"},
+			},
+		},
+		{
+			name: "timeout applies to later expects",
+			src:  "expect a\ntimeout 2s\nsend b\nexpect c",
+			steps: []step{
+				{line: 1, pattern: "a"},
+				{line: 3, send: "b", pattern: "c", timeout: 2 * time.Second},
+			},
+		},
+		{name: "empty", src: "# nothing\n", err: "no send or expect steps"},
+		{name: "missing argument", src: "send", err: "script line 1: send needs an argument"},
+		{name: "unknown directive", src: "send a\nwait 1s", err: "script line 2: unknown directive \"wait\""},
+		{name: "invalid pattern", src: "expect (", err: "script line 1: error parsing regexp"},
+		{name: "invalid quoted string", src: "send \"a", err: "script line 1: invalid quoted string"},
+		{name: "invalid timeout", src: "timeout soon", err: "script line 1: time: invalid duration"},
+		{name: "negative timeout", src: "timeout -1s", err: "timeout must be positive"},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.src)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(s.Steps) != len(tt.steps) {
+			t.Errorf("%s: %d steps, want %d", tt.name, len(s.Steps), len(tt.steps))
+			continue
+		}
+		for i, want := range tt.steps {
+			got := s.Steps[i]
+			pattern := ""
+			if got.Expect != nil {
+				pattern = got.Pattern
+			}
+			if got.Line != want.line || string(got.Send) != want.send || pattern != want.pattern || got.Timeout != want.timeout {
+				t.Errorf("%s: step %d = {%d %q %q %s}, want {%d %q %q %s}", tt.name, i+1,
+					got.Line, got.Send, pattern, got.Timeout, want.line, want.send, want.pattern, want.timeout)
+			}
+		}
+	}
+}
+
+func TestParseMultiLine(t *testing.T) {
+	s, err := Parse("expect ^250 OK$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Steps[0].Expect.MatchString("250-SIZE\r\n250 OK\n") {
+		t.Error("^ and $ do not match at line boundaries")
+	}
+}
+
+func TestResultPayload(t *testing.T) {
+	s, err := Parse("sendline AUTH secret\nexpect ^\\+OK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &s.Steps[0]
+	tests := []struct {
+		name   string
+		r      Result
+		key    string
+		want   string
+		absent string
+	}{
+		{name: "match", r: Result{Step: st, Match: []byte("+OK")}, key: "match", want: "+OK", absent: "received"},
+		{name: "redacted match", r: Result{Step: st, Match: []byte("+OK"), Redact: true}, key: "match", want: "REDACTED (3 bytes)"},
+		{name: "failure", r: Result{Step: st, Unmatched: []byte("-ERR AUTH secret"), Err: errors.New("no match")}, key: "received", want: "-ERR AUTH secret", absent: "match"},
+		{name: "redacted failure", r: Result{Step: st, Unmatched: []byte("-ERR AUTH secret"), Err: errors.New("no match"), Redact: true}, key: "received", want: "REDACTED (16 bytes)"},
+		{name: "long failure keeps the tail", r: Result{Step: st, Unmatched: []byte(strings.Repeat("x", 300) + "end"), Err: errors.New("no match")}, key: "received", want: "…" + strings.Repeat("x", maxShown-3) + "end"},
+	}
+	for _, tt := range tests {
+		p := tt.r.Payload()
+		if got, _ := p[tt.key].(string); got != tt.want {
+			t.Errorf("%s: %s = %q, want %q", tt.name, tt.key, got, tt.want)
+		}
+		if _, ok := p[tt.absent]; tt.absent != "" && ok {
+			t.Errorf("%s: unexpected %s", tt.name, tt.absent)
+		}
+		if p["expect"] != `^\+OK` {
+			t.Errorf("%s: expect = %v", tt.name, p["expect"])
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mrlm-net/tracer/pkg/event"
+	"github.com/mrlm-net/tracer/pkg/netutil"
+	"github.com/mrlm-net/tracer/pkg/tlsinfo"
+	"github.com/mrlm-net/tracer/pkg/tracecommon"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// tracedCall marks the context of the traced call; reflection calls share
+// the connection but are summarized by method_resolved instead.
+type tracedCall struct{}
+
+// client holds the state of one trace: it dials the connection, performs
+// the TLS handshake and, as the connection's stats.Handler, reports the
+// HTTP/2 stream of the traced call.
+type client struct {
+	ctx     context.Context
+	cfg     *traceConfig
+	traceID string
+	// types resolves message types for JSON rendering, including Any.
+	types *dynamicpb.Types
+
+	mu     sync.Mutex
+	connID string
+	// began is when the call's stream started; sent and received count its
+	// messages.
+	began          time.Time
+	sent, received int
+	// trailers holds trailers_recv until the stream ends: gRPC reports
+	// them as soon as they arrive, before the last message is consumed.
+	trailers   map[string]interface{}
+	trailersAt time.Duration
+	closing    bool
+}
+
+// emit reports a call event. Events are dropped once the connection is
+// being closed so none follow request_end.
+func (c *client) emit(eventType, stage string, d time.Duration, payload map[string]interface{}) {
+	c.mu.Lock()
+	closing, connID := c.closing, c.connID
+	c.mu.Unlock()
+	if closing {
+		return
+	}
+	c.cfg.Emitter.Emit(c.ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "grpc", EventType: eventType, Stage: stage, TraceID: c.traceID, ConnID: connID, DurationNS: int64(d), Payload: payload})
+}
+
+// dial connects to addr with Happy Eyeballs and emits
+// connect_start/connect_done. gRPC calls it again if the connection is lost
+// and re-established during the trace.
+func (c *client) dial(ctx context.Context, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		tracecommon.EmitError(c.ctx, c.cfg.Emitter, "grpc", "resolve_error", c.traceID, err)
+		return nil, err
+	}
+
+	start := time.Now()
+	c.cfg.Emitter.Emit(c.ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "grpc", EventType: "lifecycle", Stage: "connect_start", TraceID: c.traceID, Payload: map[string]interface{}{"addr": addr}})
+	dnsStart, dnsDone := tracecommon.DNSHooks(c.ctx, c.cfg.Emitter, "grpc", c.traceID)
+	res, err := netutil.Dial(ctx, host, port, netutil.DialOptions{
+		Network:    "tcp",
+		Prefer:     c.cfg.IPPref,
+		OnDNSStart: dnsStart,
+		OnDNSDone:  dnsDone,
+		Resolver:   c.cfg.Resolver,
+		OnAttempt: func(a netutil.DialAttempt) {
+			tracecommon.EmitDialAttempt(c.ctx, c.cfg.Emitter, "grpc", c.traceID, a)
+		},
+	})
+	if err != nil {
+		// resolution failures were already reported as dns_error
+		if !netutil.IsDNSError(err) {
+			tracecommon.EmitError(c.ctx, c.cfg.Emitter, "grpc", "connect_error", c.traceID, err)
+		}
+		return nil, err
+	}
+	connID := uuid.NewString()
+	c.mu.Lock()
+	c.connID = connID
+	c.mu.Unlock()
+	tags := tracecommon.BuildTags(res.IP, res.Resolved, res.Family)
+	tracecommon.EmitLifecycle(c.ctx, c.cfg.Emitter, "grpc", "connect_done", c.traceID, connID, int64(time.Since(start)), tags, map[string]interface{}{"remote": res.Conn.RemoteAddr().String(), "local": res.Conn.LocalAddr().String()})
+	return res.Conn, nil
+}
+
+// tlsCreds performs the client TLS handshake offering only h2 and reports
+// it with tls_handshake_start/done.
+type tlsCreds struct {
+	c  *client
+	tc *tls.Config
+}
+
+var _ credentials.TransportCredentials = (*tlsCreds)(nil)
+
+func (t *tlsCreds) ClientHandshake(ctx context.Context, authority string, raw net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	c := t.c
+	start := map[string]interface{}{"alpn_offered": t.tc.NextProtos}
+	if net.ParseIP(t.tc.ServerName) == nil {
+		start["server_name"] = t.tc.ServerName
+	}
+	tracecommon.EmitLifecycle(c.ctx, c.cfg.Emitter, "grpc", "tls_handshake_start", c.traceID, c.currentConn(), 0, nil, start)
+
+	began := time.Now()
+	conn := tls.Client(raw, t.tc)
+	herr := conn.HandshakeContext(ctx)
+	name := t.tc.ServerName
+	if name == "" {
+		name, _, _ = net.SplitHostPort(authority)
+	}
+	cs := conn.ConnectionState()
+	payload := tlsinfo.Describe(cs, herr, tlsinfo.Options{Host: name, ALPN: t.tc.NextProtos, Roots: t.tc.RootCAs})
+	tracecommon.EmitLifecycle(c.ctx, c.cfg.Emitter, "grpc", "tls_handshake_done", c.traceID, c.currentConn(), int64(time.Since(began)), nil, payload)
+	if herr != nil {
+		tracecommon.EmitError(c.ctx, c.cfg.Emitter, "grpc", "tls_error", c.traceID, herr)
+		conn.Close()
+		return nil, nil, herr
+	}
+	if p := cs.NegotiatedProtocol; p != "h2" {
+		if p == "" {
+			p = "none"
+		}
+		err := fmt.Errorf("server did not negotiate h2 via ALPN (selected %s)", p)
+		tracecommon.EmitError(c.ctx, c.cfg.Emitter, "grpc", "alpn_error", c.traceID, err)
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, credentials.TLSInfo{State: cs, CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.PrivacyAndIntegrity}}, nil
+}
+
+func (t *tlsCreds) ServerHandshake(net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("grpc tracer: server handshake not supported")
+}
+
+func (t *tlsCreds) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "tls", ServerName: t.tc.ServerName}
+}
+
+func (t *tlsCreds) Clone() credentials.TransportCredentials {
+	return &tlsCreds{c: t.c, tc: t.tc.Clone()}
+}
+
+func (t *tlsCreds) OverrideServerName(name string) error {
+	t.tc.ServerName = name
+	return nil
+}
+
+func (c *client) currentConn() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connID
+}
+
+// TagRPC and TagConn implement stats.Handler; the call is recognized by
+// its context instead.
+func (c *client) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context { return ctx }
+
+func (c *client) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context { return ctx }
+
+// HandleConn reports the HTTP/2 connection becoming ready (after the
+// preface and SETTINGS) and closing before the trace ends.
+func (c *client) HandleConn(_ context.Context, s stats.ConnStats) {
+	switch s.(type) {
+	case *stats.ConnBegin:
+		c.emit("lifecycle", "connection_ready", 0, map[string]interface{}{})
+	case *stats.ConnEnd:
+		c.emit("lifecycle", "connection_closed", 0, map[string]interface{}{})
+	}
+}
+
+// HandleRPC reports the stream of the traced call: its start, the request
+// and response metadata, every message and the trailers.
+func (c *client) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	if ctx.Value(tracedCall{}) == nil {
+		return
+	}
+	c.mu.Lock()
+	since := time.Duration(0)
+	if !c.began.IsZero() {
+		since = time.Since(c.began)
+	}
+	c.mu.Unlock()
+
+	switch s := s.(type) {
+	case *stats.Begin:
+		c.mu.Lock()
+		c.began = s.BeginTime
+		c.mu.Unlock()
+		c.emit("lifecycle", "stream_start", 0, map[string]interface{}{"client_streaming": s.IsClientStream, "server_streaming": s.IsServerStream})
+	case *stats.OutHeader:
+		payload := map[string]interface{}{"method": s.FullMethod, "metadata": metadataMap(s.Header, c.cfg.RedactRequests, true)}
+		// sent as grpc-timeout
+		if d, ok := ctx.Deadline(); ok {
+			payload["timeout_ns"] = int64(time.Until(d))
+		}
+		if s.Compression != "" {
+			payload["compression"] = s.Compression
+		}
+		c.emit("lifecycle", "headers_send", 0, payload)
+	case *stats.OutPayload:
+		c.mu.Lock()
+		c.sent++
+		n := c.sent
+		c.mu.Unlock()
+		payload := map[string]interface{}{"index": n, "bytes": s.Length, "wire_bytes": s.WireLength, "message": c.render(s.Payload)}
+		if s.CompressedLength != s.Length {
+			payload["compressed_bytes"] = s.CompressedLength
+		}
+		c.emit("lifecycle", "message_send", since, payload)
+	case *stats.InHeader:
+		payload := map[string]interface{}{"metadata": metadataMap(s.Header, c.cfg.RedactResponses, false), "wire_bytes": s.WireLength}
+		if s.Compression != "" {
+			payload["compression"] = s.Compression
+		}
+		c.emit("lifecycle", "headers_recv", since, payload)
+	case *stats.InPayload:
+		c.mu.Lock()
+		c.received++
+		n := c.received
+		c.mu.Unlock()
+		payload := map[string]interface{}{"index": n, "bytes": s.Length, "wire_bytes": s.WireLength, "message": c.render(s.Payload)}
+		if s.CompressedLength != s.Length {
+			payload["compressed_bytes"] = s.CompressedLength
+		}
+		c.emit("lifecycle", "message_recv", since, payload)
+	case *stats.InTrailer:
+		c.mu.Lock()
+		c.trailers = map[string]interface{}{"metadata": metadataMap(s.Trailer, c.cfg.RedactResponses, false), "wire_bytes": s.WireLength}
+		c.trailersAt = since
+		c.mu.Unlock()
+	case *stats.End:
+		c.mu.Lock()
+		payload := map[string]interface{}{"messages_sent": c.sent, "messages_received": c.received}
+		trailers, at := c.trailers, c.trailersAt
+		c.mu.Unlock()
+		if trailers != nil {
+			c.emit("lifecycle", "trailers_recv", at, trailers)
+		}
+		if s.Error != nil {
+			payload["error"] = s.Error.Error()
+		}
+		c.emit("lifecycle", "stream_end", s.EndTime.Sub(s.BeginTime), payload)
+	}
+}
+
+// metadataMap renders metadata, base64-encoding binary (-bin) values and
+// redacting authorization and cookie (requests) or set-cookie (responses)
+// when redact is set.
+func metadataMap(md metadata.MD, redact, req bool) map[string][]string {
+	m := make(map[string][]string, len(md))
+	for k, vs := range md {
+		for _, v := range vs {
+			switch {
+			case redact && tracecommon.SensitiveHeader(k, req):
+				v = "REDACTED"
+			case strings.HasSuffix(k, "-bin"):
+				v = base64.StdEncoding.EncodeToString([]byte(v))
+			}
+			m[k] = append(m[k], v)
+		}
+	}
+	return m
+}
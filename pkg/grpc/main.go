@@ -0,0 +1,339 @@
+package grpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mrlm-net/tracer/pkg/event"
+	"github.com/mrlm-net/tracer/pkg/netutil"
+	"github.com/mrlm-net/tracer/pkg/tlsinfo"
+	"github.com/mrlm-net/tracer/pkg/tracecommon"
+	grpcgo "google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+type Option func(*traceConfig)
+
+type traceConfig struct {
+	Emitter event.Emitter
+	Dry     bool
+	Timeout time.Duration
+	// Body is the JSON request message; a JSON array holds the messages of
+	// a client-streaming call.
+	Body []byte
+	// Headers are sent as request metadata.
+	Headers http.Header
+	IPPref  string
+	// Resolver selects the DNS server and static overrides used to dial.
+	Resolver *netutil.Resolver
+	// TLS configures grpcs:// targets; ALPN is always h2.
+	TLS *tlsinfo.Config
+	// Descriptors is a serialized FileDescriptorSet (protoc
+	// --descriptor_set_out --include_imports) describing the method; empty
+	// uses server reflection.
+	Descriptors []byte
+	// Health calls grpc.health.v1.Health/Check for the service named by the
+	// URL path (empty: the whole server) instead of a method.
+	Health          bool
+	RedactRequests  bool
+	RedactResponses bool
+}
+
+// WithEmitter sets a custom emitter.
+func WithEmitter(e event.Emitter) Option { return func(c *traceConfig) { c.Emitter = e } }
+
+// WithDryRun enables dry-run mode.
+func WithDryRun(d bool) Option { return func(c *traceConfig) { c.Dry = d } }
+
+// WithTimeout bounds the whole trace, including reflection; the remaining
+// time is sent to the server as the call deadline.
+func WithTimeout(d time.Duration) Option { return func(c *traceConfig) { c.Timeout = d } }
+
+// WithBodyString sets the JSON-encoded request message, or a JSON array of
+// messages for client-streaming methods.
+func WithBodyString(s string) Option { return func(c *traceConfig) { c.Body = []byte(s) } }
+
+// WithHeaders sets request metadata.
+func WithHeaders(h http.Header) Option { return func(c *traceConfig) { c.Headers = h } }
+
+// WithIPPreference sets IP family preference: "v4", "v6" or ""/"auto".
+func WithIPPreference(p string) Option { return func(c *traceConfig) { c.IPPref = p } }
+
+// WithResolver sets the resolver used to dial (custom DNS server, DoT, DoH
+// or --resolve style overrides); nil uses the system resolver.
+func WithResolver(r *netutil.Resolver) Option { return func(c *traceConfig) { c.Resolver = r } }
+
+// WithTLSConfig sets the TLS client configuration for grpcs:// targets. The
+// ALPN list is replaced with h2.
+func WithTLSConfig(c tlsinfo.Config) Option { return func(cfg *traceConfig) { cfg.TLS = &c } }
+
+// WithDescriptorSet describes the service with a serialized
+// FileDescriptorSet instead of asking the server through reflection.
+func WithDescriptorSet(b []byte) Option { return func(c *traceConfig) { c.Descriptors = b } }
+
+// WithHealth calls the standard grpc.health.v1 Check method for the service
+// named by the URL path instead of the method it names.
+func WithHealth(v bool) Option { return func(c *traceConfig) { c.Health = v } }
+
+// WithRedactRequests controls redaction of request metadata (authorization, cookie).
+func WithRedactRequests(v bool) Option { return func(c *traceConfig) { c.RedactRequests = v } }
+
+// WithRedactResponses controls redaction of response metadata (set-cookie).
+func WithRedactResponses(v bool) Option { return func(c *traceConfig) { c.RedactResponses = v } }
+
+// target is a parsed grpc:// or grpcs:// URL.
+type target struct {
+	addr    string
+	secure  bool
+	service string
+	method  string
+	// check is the service whose health is checked.
+	check string
+}
+
+// parseTarget splits grpc[s]://host[:port]/package.Service/Method. With
+// health the path is the optional service name to check.
+func parseTarget(raw string, health bool) (target, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return target{}, err
+	}
+	if u.Scheme != "grpc" && u.Scheme != "grpcs" {
+		return target{}, fmt.Errorf("unsupported scheme %q (want grpc or grpcs)", u.Scheme)
+	}
+	t := target{secure: u.Scheme == "grpcs"}
+	defPort := "80"
+	if t.secure {
+		defPort = "443"
+	}
+	host, port, _, _, _, zone, err := netutil.ParseAddr(u.Host, defPort)
+	if err != nil {
+		return target{}, err
+	}
+	if zone != "" {
+		host += "%" + zone
+	}
+	t.addr = net.JoinHostPort(host, port)
+
+	path := strings.Trim(u.Path, "/")
+	if health {
+		if strings.Contains(path, "/") {
+			return target{}, fmt.Errorf("health check target %q: the path is a service name, not a method", raw)
+		}
+		t.service, t.method, t.check = "grpc.health.v1.Health", "Check", path
+		return t, nil
+	}
+	svc, m, ok := strings.Cut(path, "/")
+	if !ok || svc == "" || m == "" || strings.Contains(m, "/") {
+		return target{}, fmt.Errorf("target %q does not name a method (want grpc://host:port/package.Service/Method)", raw)
+	}
+	t.service, t.method = svc, m
+	return t, nil
+}
+
+// TraceURL calls the method named by targetURL with the JSON request and
+// emits connection, TLS and HTTP/2 stream events: request and response
+// metadata, every message sent and received, the trailers and the final
+// grpc-status. The method is described by server reflection unless a
+// descriptor set is given; WithHealth calls grpc.health.v1.Health/Check.
+func TraceURL(ctx context.Context, targetURL string, opts ...Option) error {
+	cfg := &traceConfig{Timeout: 30 * time.Second, RedactRequests: true, RedactResponses: true}
+	for _, o := range opts {
+		o(cfg)
+	}
+
+	if cfg.Emitter == nil {
+		cfg.Emitter = event.NewStdoutEmitter(os.Stdout, true, true)
+	}
+
+	traceID := tracecommon.StartRequest(ctx, cfg.Emitter, "grpc", targetURL)
+	if cfg.Dry {
+		tracecommon.EmitDryRun(ctx, cfg.Emitter, "grpc", traceID)
+		return nil
+	}
+
+	t, err := parseTarget(targetURL, cfg.Health)
+	if err != nil {
+		tracecommon.EmitError(ctx, cfg.Emitter, "grpc", "request_new", traceID, err)
+		return err
+	}
+
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+
+	c := &client{ctx: ctx, cfg: cfg, traceID: traceID}
+	creds := insecure.NewCredentials()
+	if t.secure {
+		var tcfg tlsinfo.Config
+		if cfg.TLS != nil {
+			tcfg = *cfg.TLS
+		}
+		tcfg.ALPN = []string{"h2"}
+		host, _, _ := net.SplitHostPort(t.addr)
+		tc, err := tcfg.Build(host)
+		if err != nil {
+			tracecommon.EmitError(ctx, cfg.Emitter, "grpc", "tls_config_error", traceID, err)
+			return err
+		}
+		creds = &tlsCreds{c: c, tc: tc}
+	}
+	conn, err := grpcgo.NewClient("passthrough:///"+t.addr,
+		grpcgo.WithContextDialer(c.dial),
+		grpcgo.WithTransportCredentials(creds),
+		grpcgo.WithStatsHandler(c),
+		grpcgo.WithNoProxy(),
+		grpcgo.WithDisableRetry(),
+	)
+	if err != nil {
+		tracecommon.EmitError(ctx, cfg.Emitter, "grpc", "request_new", traceID, err)
+		return err
+	}
+
+	c.connect(conn)
+	err = c.call(conn, t)
+	c.mu.Lock()
+	c.closing = true
+	connID := c.connID
+	c.mu.Unlock()
+	conn.Close()
+	tracecommon.EmitLifecycle(ctx, cfg.Emitter, "grpc", "request_end", traceID, connID, 0, nil, nil)
+	return err
+}
+
+// connect establishes the connection before the first call so the stream
+// events do not include dialing. Failures surface from the call itself.
+func (c *client) connect(conn *grpcgo.ClientConn) {
+	conn.Connect()
+	for s := conn.GetState(); s != connectivity.Ready; s = conn.GetState() {
+		if s == connectivity.TransientFailure || !conn.WaitForStateChange(c.ctx, s) {
+			return
+		}
+	}
+}
+
+// call resolves the method, encodes the request messages and runs the call
+// on a stream matching the method's streaming kind. The metadata is sent on
+// the reflection stream as well, since servers may require it there too.
+func (c *client) call(conn *grpcgo.ClientConn, t target) error {
+	mdOut := metadata.MD{}
+	for k, vs := range c.cfg.Headers {
+		lk := strings.ToLower(k)
+		switch lk {
+		case "host", "connection", "te", "content-type", "user-agent", "transfer-encoding", "upgrade":
+			continue
+		}
+		mdOut.Append(lk, vs...)
+	}
+	mdCtx := metadata.NewOutgoingContext(c.ctx, mdOut)
+
+	md, types, err := c.resolve(mdCtx, conn, t)
+	if err != nil {
+		return err
+	}
+	c.types = types
+	body := c.cfg.Body
+	if c.cfg.Health && len(body) == 0 {
+		body, _ = json.Marshal(map[string]string{"service": t.check})
+	}
+	reqs, err := decodeRequests(md, body, types)
+	if err != nil {
+		c.emit("error", "message_error", 0, map[string]interface{}{"error": err.Error()})
+		return err
+	}
+
+	ctx := context.WithValue(mdCtx, tracedCall{}, true)
+	method := "/" + protoName(md)
+	desc := &grpcgo.StreamDesc{StreamName: string(md.Name()), ClientStreams: md.IsStreamingClient(), ServerStreams: md.IsStreamingServer()}
+
+	var last *dynamicpb.Message
+	stream, err := conn.NewStream(ctx, desc, method)
+	if err == nil {
+		for _, m := range reqs {
+			if err = stream.SendMsg(m); err != nil {
+				break
+			}
+		}
+		// a failed send leaves the status to RecvMsg
+		if err == nil || errors.Is(err, io.EOF) {
+			err = stream.CloseSend()
+		}
+		for err == nil {
+			m := dynamicpb.NewMessage(md.Output())
+			if err = stream.RecvMsg(m); err == nil {
+				last = m
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	}
+
+	st := status.Convert(err)
+	payload := map[string]interface{}{"grpc_status": int(st.Code()), "code": st.Code().String()}
+	if st.Message() != "" {
+		payload["grpc_message"] = st.Message()
+	}
+	if d := st.Proto().GetDetails(); len(d) > 0 {
+		details := make([]string, 0, len(d))
+		for _, a := range d {
+			details = append(details, a.GetTypeUrl())
+		}
+		payload["details"] = details
+	}
+	if err != nil {
+		payload["error"] = err.Error()
+		c.emit("error", "grpc_status", 0, payload)
+		return err
+	}
+	c.emit("lifecycle", "grpc_status", 0, payload)
+	if c.cfg.Health {
+		return c.checkHealth(t.check, last)
+	}
+	return nil
+}
+
+// checkHealth reports the serving status of a health check response and
+// fails unless it is SERVING.
+func (c *client) checkHealth(service string, resp *dynamicpb.Message) error {
+	state := "UNKNOWN"
+	if resp != nil {
+		fd := resp.Descriptor().Fields().ByName("status")
+		n := resp.Get(fd).Enum()
+		state = fmt.Sprint(n)
+		if v := fd.Enum().Values().ByNumber(n); v != nil {
+			state = string(v.Name())
+		}
+	}
+	payload := map[string]interface{}{"service": service, "status": state}
+	if state != "SERVING" {
+		err := fmt.Errorf("health check of %q: %s", service, state)
+		payload["error"] = err.Error()
+		c.emit("error", "health_status", 0, payload)
+		return err
+	}
+	c.emit("lifecycle", "health_status", 0, payload)
+	return nil
+}
+
+// protoName returns the fully-qualified name of the method descriptor's
+// service and method, as written in targets.
+func protoName(md protoreflect.MethodDescriptor) string {
+	return string(md.Parent().FullName()) + "/" + string(md.Name())
+}
@@ -0,0 +1,94 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/mrlm-net/tracer/pkg/event"
+	grpcgo "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// serveGRPC starts a server offering health and reflection that rejects
+// every call, reflection included, without the bearer token.
+func serveGRPC(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	authorized := func(ctx context.Context) error {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if v := md.Get("authorization"); len(v) != 1 || v[0] != "Bearer token" {
+			return status.Error(codes.Unauthenticated, "missing token")
+		}
+		return nil
+	}
+	srv := grpcgo.NewServer(
+		grpcgo.UnaryInterceptor(func(ctx context.Context, req any, _ *grpcgo.UnaryServerInfo, h grpcgo.UnaryHandler) (any, error) {
+			if err := authorized(ctx); err != nil {
+				return nil, err
+			}
+			return h(ctx, req)
+		}),
+		grpcgo.StreamInterceptor(func(s any, ss grpcgo.ServerStream, _ *grpcgo.StreamServerInfo, h grpcgo.StreamHandler) error {
+			if err := authorized(ss.Context()); err != nil {
+				return err
+			}
+			return h(s, ss)
+		}),
+	)
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	reflection.Register(srv)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	return l.Addr().String()
+}
+
+func TestTraceURLReflectionMetadata(t *testing.T) {
+	addr := serveGRPC(t)
+	be := event.NewBufferingEmitter()
+	err := TraceURL(context.Background(), "grpc://"+addr+"/grpc.health.v1.Health/Check", WithEmitter(be), WithHeaders(http.Header{"Authorization": {"Bearer token"}}))
+	if err != nil {
+		t.Fatalf("TraceURL: %v", err)
+	}
+	seen := map[string]bool{}
+	for _, e := range be.Events() {
+		seen[e.Stage] = true
+		switch e.Stage {
+		case "method_resolved":
+			if src := e.Payload["source"]; src != "reflection" {
+				t.Errorf("method_resolved source = %v, want reflection", src)
+			}
+		case "headers_send":
+			if md := e.Payload["metadata"].(map[string][]string); md["authorization"][0] != "REDACTED" {
+				t.Errorf("headers_send authorization = %v, want REDACTED", md["authorization"])
+			}
+		case "grpc_status":
+			if code := e.Payload["code"]; code != "OK" {
+				t.Errorf("grpc_status code = %v, want OK", code)
+			}
+		}
+	}
+	for _, stage := range []string{"connect_done", "method_resolved", "stream_start", "headers_send", "message_send", "message_recv", "trailers_recv", "grpc_status", "request_end"} {
+		if !seen[stage] {
+			t.Errorf("no %s event", stage)
+		}
+	}
+}
+
+func TestTraceURLUnauthenticated(t *testing.T) {
+	addr := serveGRPC(t)
+	be := event.NewBufferingEmitter()
+	err := TraceURL(context.Background(), "grpc://"+addr+"/grpc.health.v1.Health/Check", WithEmitter(be))
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("TraceURL = %v, want Unauthenticated from reflection", err)
+	}
+}
@@ -0,0 +1,274 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	grpcgo "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Reflection service methods, newest first. Both versions share the same
+// messages, so the v1 types are used on either stream.
+var reflectionMethods = []struct{ api, method string }{
+	{"v1", "/grpc.reflection.v1.ServerReflection/ServerReflectionInfo"},
+	{"v1alpha", "/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo"},
+}
+
+// resolve finds the method descriptor from the health proto, the descriptor
+// set or server reflection and reports it as method_resolved. Reflection
+// runs on ctx, which carries the outgoing metadata.
+func (c *client) resolve(ctx context.Context, conn *grpcgo.ClientConn, t target) (protoreflect.MethodDescriptor, *dynamicpb.Types, error) {
+	start := time.Now()
+	payload := map[string]interface{}{"service": t.service, "method": t.method}
+	var (
+		files *protoregistry.Files
+		err   error
+	)
+	switch {
+	case c.cfg.Health:
+		payload["source"] = "health"
+		files = new(protoregistry.Files)
+		err = files.RegisterFile(healthpb.File_grpc_health_v1_health_proto)
+	case len(c.cfg.Descriptors) > 0:
+		payload["source"] = "descriptor_set"
+		files, err = descriptorSet(c.cfg.Descriptors)
+	default:
+		payload["source"] = "reflection"
+		var api string
+		files, api, err = c.reflect(ctx, conn, t.service)
+		if api != "" {
+			payload["api"] = api
+		}
+	}
+	var md protoreflect.MethodDescriptor
+	if err == nil {
+		md, err = findMethod(files, t)
+	}
+	if err != nil {
+		payload["error"] = err.Error()
+		c.emit("error", "method_error", time.Since(start), payload)
+		return nil, nil, err
+	}
+	payload["files"] = files.NumFiles()
+	payload["input_type"] = string(md.Input().FullName())
+	payload["output_type"] = string(md.Output().FullName())
+	payload["client_streaming"] = md.IsStreamingClient()
+	payload["server_streaming"] = md.IsStreamingServer()
+	c.emit("lifecycle", "method_resolved", time.Since(start), payload)
+	return md, dynamicpb.NewTypes(files), nil
+}
+
+func findMethod(files *protoregistry.Files, t target) (protoreflect.MethodDescriptor, error) {
+	d, err := files.FindDescriptorByName(protoreflect.FullName(t.service))
+	if err != nil {
+		return nil, fmt.Errorf("service %s: %w", t.service, err)
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a service", t.service)
+	}
+	md := sd.Methods().ByName(protoreflect.Name(t.method))
+	if md == nil {
+		return nil, fmt.Errorf("service %s has no method %s", t.service, t.method)
+	}
+	return md, nil
+}
+
+// descriptorSet builds a registry from a serialized FileDescriptorSet.
+func descriptorSet(b []byte) (*protoregistry.Files, error) {
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("parse descriptor set: %w", err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("descriptor set: %w", err)
+	}
+	return files, nil
+}
+
+// reflect asks the server for the file defining service and the files it
+// depends on, trying reflection v1 before v1alpha.
+func (c *client) reflect(ctx context.Context, conn *grpcgo.ClientConn, service string) (*protoregistry.Files, string, error) {
+	var err error
+	for _, r := range reflectionMethods {
+		var files *protoregistry.Files
+		files, err = c.reflectWith(ctx, conn, r.method, service)
+		if status.Code(err) == codes.Unimplemented {
+			continue
+		}
+		return files, r.api, err
+	}
+	return nil, "", fmt.Errorf("server reflection is not available (%w); supply a descriptor set", err)
+}
+
+func (c *client) reflectWith(ctx context.Context, conn *grpcgo.ClientConn, method, service string) (*protoregistry.Files, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := conn.NewStream(ctx, &grpcgo.StreamDesc{ClientStreams: true, ServerStreams: true}, method)
+	if err != nil {
+		return nil, err
+	}
+	ask := func(req *rpb.ServerReflectionRequest) (*rpb.ServerReflectionResponse, error) {
+		if err := stream.SendMsg(req); err != nil {
+			return nil, err
+		}
+		resp := new(rpb.ServerReflectionResponse)
+		if err := stream.RecvMsg(resp); err != nil {
+			return nil, err
+		}
+		if e := resp.GetErrorResponse(); e != nil {
+			return nil, status.Error(codes.Code(e.GetErrorCode()), e.GetErrorMessage())
+		}
+		return resp, nil
+	}
+
+	protos := map[string]*descriptorpb.FileDescriptorProto{}
+	add := func(resp *rpb.ServerReflectionResponse) error {
+		for _, b := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			fd := new(descriptorpb.FileDescriptorProto)
+			if err := proto.Unmarshal(b, fd); err != nil {
+				return fmt.Errorf("parse reflected descriptor: %w", err)
+			}
+			protos[fd.GetName()] = fd
+		}
+		return nil
+	}
+	resp, err := ask(&rpb.ServerReflectionRequest{MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: service}})
+	if status.Code(err) == codes.NotFound {
+		if names := listServices(ask); len(names) > 0 {
+			err = fmt.Errorf("%w (the server offers %v)", err, names)
+		}
+	}
+	if err == nil {
+		err = add(resp)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("symbol %s: %w", service, err)
+	}
+
+	// servers usually send every dependency the client has not seen yet,
+	// but may leave some out; ask for those by name
+	files := new(protoregistry.Files)
+	var register func(name string) error
+	register = func(name string) error {
+		if _, err := files.FindFileByPath(name); err == nil {
+			return nil
+		}
+		fd, ok := protos[name]
+		if !ok {
+			resp, err := ask(&rpb.ServerReflectionRequest{MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: name}})
+			if err == nil {
+				err = add(resp)
+			}
+			if fd, ok = protos[name]; !ok {
+				// well-known types are compiled in
+				if g, gerr := protoregistry.GlobalFiles.FindFileByPath(name); gerr == nil {
+					return files.RegisterFile(g)
+				}
+				if err == nil {
+					err = errors.New("not returned by the server")
+				}
+				return fmt.Errorf("dependency %s: %w", name, err)
+			}
+		}
+		for _, dep := range fd.GetDependency() {
+			if err := register(dep); err != nil {
+				return err
+			}
+		}
+		f, err := protodesc.NewFile(fd, files)
+		if err != nil {
+			return err
+		}
+		return files.RegisterFile(f)
+	}
+	names := make([]string, 0, len(protos))
+	for name := range protos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := register(name); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// listServices returns the services the server exposes through reflection,
+// or nil if it cannot tell.
+func listServices(ask func(*rpb.ServerReflectionRequest) (*rpb.ServerReflectionResponse, error)) []string {
+	resp, err := ask(&rpb.ServerReflectionRequest{MessageRequest: &rpb.ServerReflectionRequest_ListServices{ListServices: "*"}})
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, s := range resp.GetListServicesResponse().GetService() {
+		names = append(names, s.GetName())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// decodeRequests parses the JSON request: one object, or for
+// client-streaming methods an array of objects sent in order. An empty
+// body sends one empty message.
+func decodeRequests(md protoreflect.MethodDescriptor, body []byte, types *dynamicpb.Types) ([]*dynamicpb.Message, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		body = []byte("{}")
+	}
+	raws := []json.RawMessage{body}
+	if body[0] == '[' {
+		if !md.IsStreamingClient() {
+			return nil, fmt.Errorf("%s is not client-streaming: send one JSON object, not an array", md.FullName())
+		}
+		if err := json.Unmarshal(body, &raws); err != nil {
+			return nil, fmt.Errorf("request: %w", err)
+		}
+	}
+	opts := protojson.UnmarshalOptions{Resolver: types}
+	msgs := make([]*dynamicpb.Message, 0, len(raws))
+	for i, raw := range raws {
+		m := dynamicpb.NewMessage(md.Input())
+		if err := opts.Unmarshal(raw, m); err != nil {
+			return nil, fmt.Errorf("request message %d as %s: %w", i+1, md.Input().FullName(), err)
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+// render converts a message to its JSON form for event payloads.
+func (c *client) render(v interface{}) interface{} {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil
+	}
+	b, err := protojson.MarshalOptions{Resolver: c.types}.Marshal(m)
+	if err != nil {
+		return fmt.Sprintf("unrenderable %s: %v", m.ProtoReflect().Descriptor().FullName(), err)
+	}
+	var out interface{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return string(b)
+	}
+	return out
+}
@@ -0,0 +1,55 @@
+package grpc
+
+import (
+	"context"
+
+	"github.com/mrlm-net/tracer/pkg/tracer"
+)
+
+func init() {
+	tracer.Register("grpc", newTracer)
+}
+
+// TracerSettings are the grpc tracer's own options: Descriptors is a
+// serialized FileDescriptorSet describing the method instead of server
+// reflection, and Health calls grpc.health.v1.Health/Check instead of the
+// method.
+type TracerSettings struct {
+	Descriptors []byte
+	Health      bool
+}
+
+// Settings is the key of TracerSettings in tracer.Options.
+var Settings = tracer.NewKey[TracerSettings]("grpc")
+
+// sharedOptions converts shared tracer options into TraceURL options.
+func sharedOptions(o tracer.Options) []Option {
+	s, _ := Settings.Get(o)
+	opts := []Option{WithEmitter(o.Emitter), WithDryRun(o.DryRun), WithIPPreference(o.IPPref), WithHealth(s.Health)}
+	if o.Timeout > 0 {
+		opts = append(opts, WithTimeout(o.Timeout))
+	}
+	if o.Resolver != nil {
+		opts = append(opts, WithResolver(o.Resolver))
+	}
+	if len(o.Headers) > 0 {
+		opts = append(opts, WithHeaders(o.Headers))
+	}
+	if o.Data != "" {
+		opts = append(opts, WithBodyString(o.Data))
+	}
+	if o.TLS != nil {
+		opts = append(opts, WithTLSConfig(*o.TLS))
+	}
+	if len(s.Descriptors) > 0 {
+		opts = append(opts, WithDescriptorSet(s.Descriptors))
+	}
+	opts = append(opts, WithRedactRequests(o.RedactRequests), WithRedactResponses(o.RedactResponses))
+	return opts
+}
+
+func newTracer(o tracer.Options) (tracer.Tracer, error) {
+	return tracer.Func(func(ctx context.Context, target string) error {
+		return TraceURL(ctx, target, sharedOptions(o)...)
+	}), nil
+}
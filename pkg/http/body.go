@@ -0,0 +1,190 @@
+package http
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+)
+
+// acceptEncoding is sent when body capture is enabled and the caller did not
+// set Accept-Encoding. Setting it ourselves stops net/http from decoding gzip
+// transparently, so wire and decoded sizes can both be measured.
+const acceptEncoding = "gzip, deflate, br"
+
+// bodyCapture is the outcome of reading a full response body.
+type bodyCapture struct {
+	WireBytes    int64
+	DecodedBytes int64
+	Encoding     string
+	SHA256       string
+	Captured     []byte
+	Truncated    bool
+	Transfer     time.Duration
+	DecodeErr    error
+	ReadErr      error
+}
+
+// errUnsupportedEncoding is the decode error of a Content-Encoding the
+// tracer cannot decode; the raw body is captured instead.
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// err returns why the body could not be read in full: a read failure, or a
+// body that is not valid in its Content-Encoding. Unsupported encodings are
+// not failures.
+func (b bodyCapture) err() error {
+	switch {
+	case b.ReadErr != nil:
+		return b.ReadErr
+	case b.DecodeErr != nil && !errors.Is(b.DecodeErr, errUnsupportedEncoding):
+		return b.DecodeErr
+	}
+	return nil
+}
+
+// payload renders the capture as response_end payload fields.
+func (b bodyCapture) payload(p map[string]interface{}) {
+	p["bytes_read"] = b.WireBytes
+	p["body_bytes_wire"] = b.WireBytes
+	p["body_bytes_decoded"] = b.DecodedBytes
+	p["body_sha256"] = b.SHA256
+	p["body_truncated"] = b.Truncated
+	p["transfer_ns"] = int64(b.Transfer)
+	if b.Encoding != "" {
+		p["content_encoding"] = b.Encoding
+	}
+	if utf8.Valid(b.Captured) {
+		p["body"] = string(b.Captured)
+		p["body_encoding"] = "utf-8"
+	} else {
+		p["body"] = base64.StdEncoding.EncodeToString(b.Captured)
+		p["body_encoding"] = "base64"
+	}
+	if b.DecodeErr != nil {
+		p["decode_error"] = b.DecodeErr.Error()
+	}
+	if b.ReadErr != nil {
+		p["read_error"] = b.ReadErr.Error()
+	}
+}
+
+// countingReader counts bytes read through it and remembers the first
+// non-EOF error so read failures can be told apart from decode failures.
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if err != nil && err != io.EOF && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// captureBody reads r to EOF, decoding contentEncoding (gzip, deflate, br;
+// comma-separated lists are decoded in reverse order). It keeps up to limit
+// decoded bytes and hashes the full decoded body. When decoding fails the
+// remaining wire bytes are still drained so the wire size stays accurate.
+func captureBody(r io.Reader, contentEncoding string, limit int64) bodyCapture {
+	start := time.Now()
+	wire := &countingReader{r: r}
+	res := bodyCapture{Encoding: strings.TrimSpace(contentEncoding)}
+
+	decoded, err := decodeReader(wire, res.Encoding)
+	if err != nil {
+		res.DecodeErr = err
+		decoded = wire
+	}
+
+	h := sha256.New()
+	var captured strings.Builder
+	n, err := io.Copy(io.MultiWriter(h, &limitedWriter{w: &captured, n: limit}), decoded)
+	res.DecodedBytes = n
+	if err != nil && wire.err == nil {
+		res.DecodeErr = err
+		// drain what is left so the wire size reflects the full body
+		io.Copy(io.Discard, wire)
+	}
+	res.ReadErr = wire.err
+	res.WireBytes = wire.n
+	res.SHA256 = hex.EncodeToString(h.Sum(nil))
+	res.Captured = []byte(captured.String())
+	res.Truncated = res.DecodedBytes > int64(len(res.Captured))
+	res.Transfer = time.Since(start)
+	return res
+}
+
+// decodeReader wraps r with decoders for a Content-Encoding header value.
+func decodeReader(r io.Reader, contentEncoding string) (io.Reader, error) {
+	if contentEncoding == "" {
+		return r, nil
+	}
+	codings := strings.Split(contentEncoding, ",")
+	// codings are listed in the order they were applied; undo them in reverse
+	for i := len(codings) - 1; i >= 0; i-- {
+		switch c := strings.ToLower(strings.TrimSpace(codings[i])); c {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			zr, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, fmt.Errorf("gzip: %w", err)
+			}
+			r = zr
+		case "br":
+			r = brotli.NewReader(r)
+		case "deflate":
+			r = deflateReader(r)
+		default:
+			return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, c)
+		}
+	}
+	return r, nil
+}
+
+// deflateReader handles both zlib-wrapped (RFC 1950, what the spec requires)
+// and raw DEFLATE streams, which some servers send for "deflate".
+func deflateReader(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	hdr, err := br.Peek(2)
+	if err == nil && hdr[0]&0x0f == 8 && (uint16(hdr[0])<<8|uint16(hdr[1]))%31 == 0 {
+		if zr, err := zlib.NewReader(br); err == nil {
+			return zr
+		}
+	}
+	return flate.NewReader(br)
+}
+
+// limitedWriter keeps at most n bytes and silently discards the rest.
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.n > 0 {
+		k := int64(len(p))
+		if k > l.n {
+			k = l.n
+		}
+		if _, err := l.w.Write(p[:k]); err != nil {
+			return 0, err
+		}
+		l.n -= k
+	}
+	return len(p), nil
+}
@@ -0,0 +1,42 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestCaptureBodyErr(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("hello world"))
+	zw.Close()
+	tests := []struct {
+		name     string
+		body     io.Reader
+		encoding string
+		want     string
+		err      string
+	}{
+		{name: "plain", body: strings.NewReader("hello"), want: "hello"},
+		{name: "gzip", body: bytes.NewReader(gz.Bytes()), encoding: "gzip", want: "hello world"},
+		// the raw body is captured and the trace goes on
+		{name: "unsupported encoding", body: strings.NewReader("raw"), encoding: "zstd", want: "raw"},
+		{name: "connection reset", body: io.MultiReader(strings.NewReader("hel"), iotest.ErrReader(io.ErrUnexpectedEOF)), want: "hel", err: "unexpected EOF"},
+		{name: "truncated gzip", body: bytes.NewReader(gz.Bytes()[:gz.Len()-4]), encoding: "gzip", want: "hello world", err: "unexpected EOF"},
+		{name: "corrupt gzip", body: strings.NewReader("not gzip"), encoding: "gzip", err: "gzip"},
+	}
+	for _, tt := range tests {
+		bc := captureBody(tt.body, tt.encoding, 64)
+		err := bc.err()
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+		}
+		if string(bc.Captured) != tt.want {
+			t.Errorf("%s: captured %q, want %q", tt.name, bc.Captured, tt.want)
+		}
+	}
+}
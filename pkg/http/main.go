@@ -4,18 +4,22 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptrace"
+	"net/url"
 	"os"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/mrlm-net/tracer/pkg/event"
 	"github.com/mrlm-net/tracer/pkg/netutil"
+	"github.com/mrlm-net/tracer/pkg/tlsinfo"
+	"github.com/mrlm-net/tracer/pkg/tracecommon"
 )
 
 type Option func(*traceConfig)
@@ -41,6 +45,38 @@ type traceConfig struct {
 	// Headers are additional headers to set on the outgoing request.
 	Headers http.Header
 	IPPref  string
+	// CaptureBody, when positive, reads the full response body, decodes its
+	// Content-Encoding and includes up to CaptureBody decoded bytes in the
+	// response_end event together with sizes, transfer time and a SHA-256 digest.
+	CaptureBody int64
+	// MaxRequestBody bounds how much of Body is buffered for previews and
+	// redirect replay; larger bodies are streamed and cannot be replayed.
+	MaxRequestBody int64
+	// BodyPreview is the number of request body bytes shown in request_send.
+	BodyPreview int
+	// TLS customizes the transport's TLS client configuration; nil keeps
+	// the net/http defaults.
+	TLS *tlsinfo.Config
+	// Resolver selects the DNS server and static overrides used to dial.
+	Resolver *netutil.Resolver
+	// Proxy is the proxy URL (http, https, socks5, socks5h); "" uses
+	// HTTP_PROXY/HTTPS_PROXY from the environment and ProxyDirect none.
+	Proxy string
+	// NoProxy overrides NO_PROXY when non-empty.
+	NoProxy string
+	// WSMessages are the messages TraceWebSocket sends, as binary frames
+	// when WSBinary is set. WSPings pings measure the round trip and the
+	// connection is closed WSListen after the last exchange.
+	WSMessages []string
+	WSBinary   bool
+	WSPings    int
+	WSListen   time.Duration
+
+	// protocol is the event protocol: "http", or "ws" for TraceWebSocket.
+	protocol string
+	// ws, when set, turns the request into a WebSocket upgrade and runs the
+	// session on the upgraded connection.
+	ws *wsUpgrade
 }
 
 // WithEmitter sets a custom event.Emitter for TraceURL.
@@ -58,10 +94,16 @@ func WithInjectTraceHeader(v bool) Option { return func(c *traceConfig) { c.Inje
 // WithMethod sets the HTTP request method (e.g. POST, PUT, PATCH).
 func WithMethod(m string) Option { return func(c *traceConfig) { c.Method = m } }
 
-// WithBody sets the request body for TraceURL. Caller is responsible for
-// providing an io.Reader that can be read once by the tracer.
+// WithBody sets the request body for TraceURL. The tracer buffers up to
+// MaxRequestBody bytes so 307/308 redirects can replay the body.
 func WithBody(r io.Reader) Option { return func(c *traceConfig) { c.Body = r } }
 
+// WithMaxRequestBody sets how many request body bytes are buffered (default 10 MiB).
+func WithMaxRequestBody(n int64) Option { return func(c *traceConfig) { c.MaxRequestBody = n } }
+
+// WithBodyPreview sets how many request body bytes request_send shows (default 512).
+func WithBodyPreview(n int) Option { return func(c *traceConfig) { c.BodyPreview = n } }
+
 // WithBodyString is a convenience to set a string body.
 func WithBodyString(s string) Option {
 	return func(c *traceConfig) { c.Body = bytes.NewBufferString(s) }
@@ -73,6 +115,26 @@ func WithHeaders(h http.Header) Option { return func(c *traceConfig) { c.Headers
 // WithIPPreference sets IP family preference for the HTTP transport: "v4", "v6" or ""/"auto".
 func WithIPPreference(p string) Option { return func(c *traceConfig) { c.IPPref = p } }
 
+// WithCaptureBody enables response body capture of up to limit decoded bytes
+// (0 disables). The full body is always read, sized and hashed when enabled.
+func WithCaptureBody(limit int64) Option { return func(c *traceConfig) { c.CaptureBody = limit } }
+
+// WithTLSConfig sets the TLS client configuration (CA bundle, client
+// certificate, server name, pins, versions, insecure mode).
+func WithTLSConfig(c tlsinfo.Config) Option { return func(cfg *traceConfig) { cfg.TLS = &c } }
+
+// WithResolver sets the resolver used to dial (custom DNS server, DoT, DoH
+// or --resolve style overrides); nil uses the system resolver.
+func WithResolver(r *netutil.Resolver) Option { return func(c *traceConfig) { c.Resolver = r } }
+
+// WithProxy sends requests through a proxy: http://, https://, socks5:// or
+// socks5h:// with optional user:password. Without it HTTP_PROXY and
+// HTTPS_PROXY are honored; ProxyDirect disables proxying.
+func WithProxy(p string) Option { return func(c *traceConfig) { c.Proxy = p } }
+
+// WithNoProxy sets the hosts that bypass the proxy, in NO_PROXY syntax.
+func WithNoProxy(s string) Option { return func(c *traceConfig) { c.NoProxy = s } }
+
 // WithRedact sets coarse-grained redaction. It sets both request and response
 // redaction flags so it provides a single toggle for legacy callers.
 func WithRedact(v bool) Option {
@@ -88,7 +150,13 @@ func WithRedactResponses(v bool) Option { return func(c *traceConfig) { c.Redact
 // TraceURL performs an HTTP request to targetURL and emits normalized events via the configured Emitter.
 // By default it performs a GET; use WithMethod/WithBody/WithHeaders to customize.
 func TraceURL(ctx context.Context, targetURL string, opts ...Option) error {
-	cfg := &traceConfig{Timeout: 30 * time.Second, Redact: true}
+	cfg := newConfig(opts)
+	cfg.protocol = "http"
+	return trace(ctx, cfg, targetURL)
+}
+
+func newConfig(opts []Option) *traceConfig {
+	cfg := &traceConfig{Timeout: 30 * time.Second, Redact: true, MaxRequestBody: defaultMaxRequestBody, BodyPreview: defaultBodyPreview, WSPings: 1, WSListen: time.Second}
 	cfg.RedactRequests = true
 	cfg.RedactResponses = true
 	for _, o := range opts {
@@ -98,15 +166,24 @@ func TraceURL(ctx context.Context, targetURL string, opts ...Option) error {
 	if cfg.Emitter == nil {
 		cfg.Emitter = event.NewStdoutEmitter(os.Stdout, true, true)
 	}
+	return cfg
+}
 
+// trace runs the request described by cfg; TraceURL and TraceWebSocket
+// differ only in the configuration they pass.
+func trace(ctx context.Context, cfg *traceConfig, targetURL string) error {
 	// simple trace id (UUID)
 	traceID := uuid.NewString()
 
-	// emit request_start
-	cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "http", EventType: "lifecycle", Stage: "request_start", TraceID: traceID, Payload: map[string]interface{}{"url": targetURL}})
+	// emit request_start, echoing any custom TLS settings (without secrets)
+	startPayload := map[string]interface{}{"url": targetURL}
+	if cfg.TLS != nil && !cfg.TLS.IsZero() {
+		startPayload["tls"] = cfg.TLS.Summary()
+	}
+	cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: cfg.protocol, EventType: "lifecycle", Stage: "request_start", TraceID: traceID, Payload: startPayload})
 
 	if cfg.Dry {
-		cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "http", EventType: "lifecycle", Stage: "dry_run", TraceID: traceID})
+		cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: cfg.protocol, EventType: "lifecycle", Stage: "dry_run", TraceID: traceID})
 		return nil
 	}
 
@@ -114,9 +191,29 @@ func TraceURL(ctx context.Context, targetURL string, opts ...Option) error {
 	if cfg.Method != "" {
 		method = cfg.Method
 	}
-	req, err := http.NewRequestWithContext(ctx, method, targetURL, cfg.Body)
+	// buffer the body so it can be previewed and replayed on 307/308 redirects
+	var body *requestBody
+	var bodyReader io.Reader
+	if cfg.Body != nil {
+		var err error
+		if body, err = bufferRequestBody(cfg.Body, cfg.MaxRequestBody); err != nil {
+			cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: cfg.protocol, EventType: "error", Stage: "request_body", TraceID: traceID, Payload: map[string]interface{}{"error": err.Error()}})
+			return err
+		}
+		bodyReader = body.Reader()
+	}
+	// the upgraded connection outlives client.Do, so a WebSocket trace is
+	// bounded by its context rather than the client timeout
+	reqCtx, reqURL := ctx, targetURL
+	if cfg.ws != nil {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+		reqURL = cfg.ws.url
+	}
+	req, err := http.NewRequestWithContext(reqCtx, method, reqURL, bodyReader)
 	if err != nil {
-		cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "http", EventType: "error", Stage: "request_new", TraceID: traceID, Payload: map[string]interface{}{"error": err.Error()}})
+		cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: cfg.protocol, EventType: "error", Stage: "request_new", TraceID: traceID, Payload: map[string]interface{}{"error": err.Error()}})
 		return err
 	}
 
@@ -129,6 +226,16 @@ func TraceURL(ctx context.Context, targetURL string, opts ...Option) error {
 		}
 	}
 
+	if cfg.ws != nil {
+		cfg.ws.prepare(req)
+	}
+
+	// request encoded bodies ourselves so net/http does not decode gzip
+	// transparently and the wire size stays observable
+	if cfg.CaptureBody > 0 && req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+
 	start := time.Now()
 
 	var mu sync.Mutex
@@ -157,24 +264,21 @@ func TraceURL(ctx context.Context, targetURL string, opts ...Option) error {
 		} else {
 			d = time.Since(start)
 		}
-		cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "http", EventType: "lifecycle", Stage: stage, TraceID: traceID, DurationNS: int64(d), Payload: payload})
+		cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: cfg.protocol, EventType: "lifecycle", Stage: stage, TraceID: traceID, DurationNS: int64(d), Payload: payload})
 	}
 
 	emit := func(stage string, payload map[string]interface{}) {
 		// general emit uses overall request elapsed time
-		cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "http", EventType: "lifecycle", Stage: stage, TraceID: traceID, DurationNS: int64(time.Since(start)), Payload: payload})
+		cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: cfg.protocol, EventType: "lifecycle", Stage: stage, TraceID: traceID, DurationNS: int64(time.Since(start)), Payload: payload})
 	}
 
+	// httpTransport is set below once the transport is built; the TLS hook
+	// reads the ALPN list net/http configured on it.
+	var httpTransport *http.Transport
+
 	trace := &httptrace.ClientTrace{
-		DNSStart: func(info httptrace.DNSStartInfo) {
-			// record DNS start (only emit once per roundtrip)
-			if recordStageStart("dns") {
-				emit("dns_start", map[string]interface{}{"host": info.Host})
-			}
-		},
-		DNSDone: func(info httptrace.DNSDoneInfo) {
-			emitStageDone("dns", "dns_done", map[string]interface{}{"addrs": info.Addrs})
-		},
+		// DNS events come from the dialer (see dialCtx) so they carry the
+		// same fields as the tcp and udp tracers.
 		ConnectStart: func(network, addr string) {
 			if recordStageStart("connect:" + addr) {
 				emit("connect_start", map[string]interface{}{"network": network, "addr": addr})
@@ -195,7 +299,14 @@ func TraceURL(ctx context.Context, targetURL string, opts ...Option) error {
 			}
 		},
 		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
-			emitStageDone("tls", "tls_handshake_done", map[string]interface{}{"negotiated_proto": cs.NegotiatedProtocol, "cipher_suite": cs.CipherSuite, "err": errorString(err)})
+			var o tlsinfo.Options
+			if httpTransport != nil && httpTransport.TLSClientConfig != nil {
+				o.ALPN = httpTransport.TLSClientConfig.NextProtos
+				o.Roots = httpTransport.TLSClientConfig.RootCAs
+			}
+			payload := tlsinfo.Describe(cs, err, o)
+			payload["err"] = errorString(err)
+			emitStageDone("tls", "tls_handshake_done", payload)
 		},
 		GotFirstResponseByte: func() { emit("got_first_response_byte", nil) },
 	}
@@ -209,18 +320,84 @@ func TraceURL(ctx context.Context, targetURL string, opts ...Option) error {
 		defaultPort = "443"
 	}
 
+	dialDirect := func(ctx context.Context, network, address string) (net.Conn, error) {
+		// address is host:port; hostnames are dialed with Happy Eyeballs and
+		// every attempt is reported as a dial_attempt event
+		host, port, _, _, _, zone, _ := netutil.ParseAddr(address, defaultPort)
+		if zone != "" {
+			host += "%" + zone
+		}
+		dnsStart, dnsDone := tracecommon.DNSHooks(ctx, cfg.Emitter, cfg.protocol, traceID)
+		res, err := netutil.Dial(ctx, host, port, netutil.DialOptions{
+			Network:    "tcp",
+			Prefer:     cfg.IPPref,
+			Timeout:    cfg.Timeout,
+			OnDNSStart: dnsStart,
+			OnDNSDone:  dnsDone,
+			Resolver:   cfg.Resolver,
+			OnAttempt: func(a netutil.DialAttempt) {
+				tracecommon.EmitDialAttempt(ctx, cfg.Emitter, cfg.protocol, traceID, a)
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return res.Conn, nil
+	}
+
+	router, err := newProxyRouter(cfg.Proxy, cfg.NoProxy)
+	if err != nil {
+		cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: cfg.protocol, EventType: "error", Stage: "proxy_config", TraceID: traceID, Payload: map[string]interface{}{"error": err.Error()}})
+		return err
+	}
+
+	// dialProxy connects to a proxy and reports the leg as proxy_dial.
+	dialProxy := func(ctx context.Context, network, address string, proxyURL *url.URL) (net.Conn, error) {
+		dialStart := time.Now()
+		conn, err := dialDirect(ctx, network, address)
+		if err != nil {
+			cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: cfg.protocol, EventType: "error", Stage: "proxy_error", TraceID: traceID, DurationNS: int64(time.Since(dialStart)), Payload: map[string]interface{}{"proxy": proxyString(proxyURL), "error": err.Error()}})
+			return nil, err
+		}
+		cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: cfg.protocol, EventType: "lifecycle", Stage: "proxy_dial", TraceID: traceID, DurationNS: int64(time.Since(dialStart)), Payload: map[string]interface{}{"proxy": proxyString(proxyURL), "addr": address, "remote": conn.RemoteAddr().String()}})
+		return conn, nil
+	}
+
+	// dialSOCKS reaches address through a SOCKS5 proxy, reporting the proxy
+	// dial and each SOCKS step. socks5 resolves the target locally (with
+	// dns_* events); socks5h lets the proxy resolve it.
+	dialSOCKS := func(ctx context.Context, network, address string, proxyURL *url.URL) (net.Conn, error) {
+		dnsStart, dnsDone := tracecommon.DNSHooks(ctx, cfg.Emitter, cfg.protocol, traceID)
+		d := &netutil.ProxyDialer{URL: proxyURL, Options: netutil.DialOptions{
+			Prefer:     cfg.IPPref,
+			Timeout:    cfg.Timeout,
+			OnDNSStart: dnsStart,
+			OnDNSDone:  dnsDone,
+			Resolver:   cfg.Resolver,
+			OnAttempt: func(a netutil.DialAttempt) {
+				tracecommon.EmitDialAttempt(ctx, cfg.Emitter, cfg.protocol, traceID, a)
+			},
+		}}
+		return tracecommon.DialProxy(ctx, cfg.Emitter, cfg.protocol, traceID, d, network, address)
+	}
+
 	dialCtx := func(ctx context.Context, network, address string) (net.Conn, error) {
-		// address is host:port
-		host, port, join, ip, isIP, _, _ := netutil.ParseAddr(address, defaultPort)
-		if isIP {
-			if netutil.IsIPv4(ip) {
-				return (&net.Dialer{Timeout: cfg.Timeout}).DialContext(ctx, "tcp4", join)
-			}
-			return (&net.Dialer{Timeout: cfg.Timeout}).DialContext(ctx, "tcp6", join)
+		switch socksURL, proxyURL := router.dialFor(address); {
+		case socksURL != nil:
+			return dialSOCKS(ctx, network, address, socksURL)
+		case proxyURL != nil:
+			return dialProxy(ctx, network, address, proxyURL)
+		}
+		return dialDirect(ctx, network, address)
+	}
+
+	// the transport sets SNI per host unless a server name override is given
+	var tlsConf *tls.Config
+	if cfg.TLS != nil {
+		if tlsConf, err = cfg.TLS.Build(""); err != nil {
+			cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: cfg.protocol, EventType: "error", Stage: "tls_config", TraceID: traceID, Payload: map[string]interface{}{"error": err.Error()}})
+			return err
 		}
-		// hostname: attempt ResolveAndDial honoring preference
-		conn, _, _, _, err := netutil.ResolveAndDial(ctx, "tcp", host, port, cfg.IPPref, cfg.Timeout)
-		return conn, err
 	}
 
 	// clone default transport when possible and inject DialContext
@@ -228,23 +405,75 @@ func TraceURL(ctx context.Context, targetURL string, opts ...Option) error {
 	if bt, ok := http.DefaultTransport.(*http.Transport); ok {
 		tr := bt.Clone()
 		tr.DialContext = dialCtx
+		tr.Proxy = func(r *http.Request) (*url.URL, error) {
+			u, err := router.route(r.URL)
+			if err != nil {
+				return nil, err
+			}
+			if u != nil || router.configured {
+				emit("proxy_select", map[string]interface{}{"target": canonicalAddr(r.URL), "proxy": proxyString(u), "direct": u == nil})
+			}
+			// SOCKS proxies are handled by dialCtx
+			if u != nil && netutil.IsSOCKS(u) {
+				return nil, nil
+			}
+			return u, nil
+		}
+		tr.GetProxyConnectHeader = func(ctx context.Context, proxyURL *url.URL, target string) (http.Header, error) {
+			recordStageStart("proxy_connect:" + target)
+			emit("proxy_connect_send", map[string]interface{}{"proxy": proxyString(proxyURL), "target": target})
+			return nil, nil
+		}
+		tr.OnProxyConnectResponse = func(ctx context.Context, proxyURL *url.URL, connectReq *http.Request, connectRes *http.Response) error {
+			reqHdrs := copyHeaders(connectReq.Header)
+			if cfg.RedactRequests {
+				redactProxyHeaders(reqHdrs)
+			}
+			emitStageDone("proxy_connect:"+connectReq.Host, "proxy_connect_response", map[string]interface{}{
+				"proxy": proxyString(proxyURL), "target": connectReq.Host, "status": connectRes.Status, "headers": copyHeaders(connectRes.Header), "request_headers": reqHdrs,
+			})
+			if connectRes.StatusCode == http.StatusOK {
+				emit("tunnel_established", map[string]interface{}{"proxy": proxyString(proxyURL), "target": connectReq.Host, "type": "connect"})
+			}
+			return nil
+		}
+		if tlsConf != nil {
+			tr.TLSClientConfig = tlsConf
+		}
+		if cfg.ws != nil {
+			// the Upgrade handshake needs HTTP/1.1
+			tr.ForceAttemptHTTP2 = false
+			tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+			if tr.TLSClientConfig != nil {
+				tr.TLSClientConfig = tr.TLSClientConfig.Clone()
+				tr.TLSClientConfig.NextProtos = []string{"http/1.1"}
+			}
+		}
 		// keep TLS handshake timeout in sync with overall timeout
 		tr.TLSHandshakeTimeout = cfg.Timeout
 		baseTransport = tr
+		httpTransport = tr
 	}
 
 	// Wrap the transport to capture per-hop request/response headers
-	transport := &tracingTransport{base: baseTransport, emitter: cfg.Emitter, traceID: traceID, redactRequests: cfg.RedactRequests, redactResponses: cfg.RedactResponses, injectTraceHeader: cfg.InjectTraceHeader}
+	transport := &tracingTransport{base: baseTransport, emitter: cfg.Emitter, protocol: cfg.protocol, traceID: traceID, redactRequests: cfg.RedactRequests, redactResponses: cfg.RedactResponses, injectTraceHeader: cfg.InjectTraceHeader, body: body, bodyPreview: cfg.BodyPreview}
 
 	client := &http.Client{Timeout: cfg.Timeout, Transport: transport}
+	if cfg.ws != nil {
+		client.Timeout = 0
+	}
 
 	// CheckRedirect allows us to emit redirect events and preserve trace context
 	client.CheckRedirect = func(newReq *http.Request, via []*http.Request) error {
+		// a redirected upgrade is reported as upgrade_error
+		if cfg.ws != nil {
+			return http.ErrUseLastResponse
+		}
 		from := ""
 		if len(via) > 0 {
 			from = via[len(via)-1].URL.String()
 		}
-		cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "http", EventType: "lifecycle", Stage: "redirect", TraceID: traceID, Payload: map[string]interface{}{"from": from, "to": newReq.URL.String()}})
+		cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: cfg.protocol, EventType: "lifecycle", Stage: "redirect", TraceID: traceID, Payload: map[string]interface{}{"from": from, "to": newReq.URL.String()}})
 
 		// propagate previous ClientTrace to new request so callbacks continue
 		// copy the ClientTrace value before attaching it to avoid a self-referential
@@ -268,11 +497,29 @@ func TraceURL(ctx context.Context, targetURL string, opts ...Option) error {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "http", EventType: "error", Stage: "request_do", TraceID: traceID, Payload: map[string]interface{}{"error": err.Error()}})
+		cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: cfg.protocol, EventType: "error", Stage: "request_do", TraceID: traceID, Payload: map[string]interface{}{"error": err.Error()}})
 		return err
 	}
 	defer resp.Body.Close()
 
+	if cfg.ws != nil {
+		return cfg.ws.run(ctx, reqCtx, cfg, traceID, start, resp)
+	}
+
+	if cfg.CaptureBody > 0 {
+		bc := captureBody(resp.Body, resp.Header.Get("Content-Encoding"), cfg.CaptureBody)
+		payload := map[string]interface{}{"status": resp.Status}
+		bc.payload(payload)
+		if err := bc.err(); err != nil {
+			// the body ended early or is corrupt: report what was read
+			payload["error"] = err.Error()
+			cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: cfg.protocol, EventType: "error", Stage: "body_read_error", TraceID: traceID, DurationNS: int64(time.Since(start)), Payload: payload})
+			return fmt.Errorf("reading response body: %w", err)
+		}
+		emit("response_end", payload)
+		return nil
+	}
+
 	// read small amount of body to ensure response flow
 	n, _ := ioCopyNDiscard(resp.Body, 1024)
 	emit("response_end", map[string]interface{}{"status": resp.Status, "bytes_read": n})
@@ -296,10 +543,17 @@ func ioCopyNDiscard(r io.Reader, n int64) (int64, error) {
 type tracingTransport struct {
 	base              http.RoundTripper
 	emitter           event.Emitter
+	protocol          string
 	traceID           string
 	redactRequests    bool
 	redactResponses   bool
 	injectTraceHeader bool
+	// body is the buffered request body (nil without a body) and bodyPreview
+	// the number of its bytes shown in request_send.
+	body        *requestBody
+	bodyPreview int
+	// hops counts round trips; each redirect is a new hop.
+	hops atomic.Int64
 }
 
 func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -313,25 +567,33 @@ func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error)
 		r.Header.Set("X-Trace-Id", t.traceID)
 	}
 
+	hop := t.hops.Add(1) - 1
+	hopStart := time.Now()
+
 	// emit request_send with headers (sanitized)
-	reqHdrs := copyHeaders(r.Header)
-	if t.redactRequests {
-		sanitizeHeaders(reqHdrs, true)
+	reqHdrs := tracecommon.CopyHeaders(r.Header, t.redactRequests, true)
+	payload := map[string]interface{}{"method": r.Method, "url": r.URL.String(), "headers": reqHdrs, "hop": hop}
+	// redirects that switch to GET (301/302/303) drop the body
+	if t.body != nil && r.Body != nil && r.Body != http.NoBody {
+		size := int64(len(t.body.Data))
+		if !t.body.Complete {
+			size = -1
+		}
+		payload["body_size"] = size
+		payload["body_preview"] = t.body.preview(r.Header.Get("Content-Type"), t.bodyPreview, t.redactRequests)
+		payload["body_replayable"] = r.GetBody != nil
 	}
-	t.emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "http", EventType: "lifecycle", Stage: "request_send", TraceID: t.traceID, Payload: map[string]interface{}{"method": r.Method, "url": r.URL.String(), "headers": reqHdrs}})
+	t.emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: t.protocol, EventType: "lifecycle", Stage: "request_send", TraceID: t.traceID, Payload: payload})
 
 	resp, err := t.base.RoundTrip(r)
 	if err != nil {
-		t.emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "http", EventType: "error", Stage: "request_error", TraceID: t.traceID, Payload: map[string]interface{}{"error": err.Error()}})
+		t.emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: t.protocol, EventType: "error", Stage: "request_error", TraceID: t.traceID, DurationNS: int64(time.Since(hopStart)), Payload: map[string]interface{}{"error": err.Error(), "hop": hop}})
 		return nil, err
 	}
 
 	// emit response_headers for this hop
-	respHdrs := copyHeaders(resp.Header)
-	if t.redactResponses {
-		sanitizeHeaders(respHdrs, false)
-	}
-	t.emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "http", EventType: "lifecycle", Stage: "response_headers", TraceID: t.traceID, Payload: map[string]interface{}{"status": resp.Status, "headers": respHdrs}})
+	respHdrs := tracecommon.CopyHeaders(resp.Header, t.redactResponses, false)
+	t.emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: t.protocol, EventType: "lifecycle", Stage: "response_headers", TraceID: t.traceID, DurationNS: int64(time.Since(hopStart)), Payload: map[string]interface{}{"status": resp.Status, "headers": respHdrs, "hop": hop}})
 
 	return resp, nil
 }
@@ -343,19 +605,3 @@ func copyHeaders(h http.Header) map[string][]string {
 	}
 	return out
 }
-
-// sanitizeHeaders redacts sensitive header values. If req is true, redact Authorization/Cookie; for responses redact Set-Cookie.
-func sanitizeHeaders(h map[string][]string, req bool) {
-	for k := range h {
-		lk := strings.ToLower(k)
-		if req {
-			if lk == "authorization" || lk == "cookie" {
-				h[k] = []string{"REDACTED"}
-			}
-		} else {
-			if lk == "set-cookie" {
-				h[k] = []string{"REDACTED"}
-			}
-		}
-	}
-}
@@ -0,0 +1,122 @@
+package http
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mrlm-net/tracer/pkg/netutil"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// ProxyDirect disables proxying, including proxies from the environment.
+const ProxyDirect = netutil.ProxyDirect
+
+// proxyRouter decides, per request, whether and through which proxy to
+// connect, and remembers the decision for the dialer: HTTP(S) proxies are
+// handled by net/http, SOCKS proxies by the dialer itself.
+type proxyRouter struct {
+	fn func(*url.URL) (*url.URL, error)
+	// configured is true when a proxy was given explicitly or through the
+	// environment, so bypass decisions are worth reporting.
+	configured bool
+
+	mu sync.Mutex
+	// socks maps an origin address to the SOCKS proxy used to reach it.
+	socks map[string]*url.URL
+	// proxies maps an HTTP(S) proxy address to its URL.
+	proxies map[string]*url.URL
+}
+
+// newProxyRouter builds a router for proxy ("" reads HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY from the environment, ProxyDirect disables
+// proxying) and noProxy (overrides NO_PROXY when non-empty).
+func newProxyRouter(proxy, noProxy string) (*proxyRouter, error) {
+	var c *httpproxy.Config
+	switch proxy {
+	case ProxyDirect:
+		c = &httpproxy.Config{}
+	case "":
+		c = httpproxy.FromEnvironment()
+	default:
+		u, err := netutil.ParseProxy(proxy)
+		if err != nil {
+			return nil, err
+		}
+		c = &httpproxy.Config{HTTPProxy: u.String(), HTTPSProxy: u.String(), NoProxy: os.Getenv("NO_PROXY")}
+		if c.NoProxy == "" {
+			c.NoProxy = os.Getenv("no_proxy")
+		}
+	}
+	if noProxy != "" {
+		c.NoProxy = noProxy
+	}
+	return &proxyRouter{
+		fn:         c.ProxyFunc(),
+		configured: c.HTTPProxy != "" || c.HTTPSProxy != "",
+		socks:      map[string]*url.URL{},
+		proxies:    map[string]*url.URL{},
+	}, nil
+}
+
+// route returns the proxy for target and records it for dialFor; SOCKS
+// proxies are returned too but must not be handed to net/http.
+func (p *proxyRouter) route(target *url.URL) (*url.URL, error) {
+	u, err := p.fn(target)
+	if err != nil || u == nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if netutil.IsSOCKS(u) {
+		p.socks[canonicalAddr(target)] = u
+	} else {
+		p.proxies[canonicalAddr(u)] = u
+	}
+	return u, nil
+}
+
+// dialFor reports how the dialer should treat a connection to addr: through
+// a SOCKS proxy (socks != nil), as the connection to an HTTP(S) proxy
+// (proxy != nil) or directly (both nil).
+func (p *proxyRouter) dialFor(addr string) (socks, proxy *url.URL) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.socks[addr], p.proxies[addr]
+}
+
+// canonicalAddr returns host:port for u with the scheme's default port, the
+// same form net/http passes to DialContext.
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// proxyString renders a proxy URL for events with the password masked.
+func proxyString(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	return u.Redacted()
+}
+
+// redactProxyHeaders masks Proxy-Authorization in CONNECT request headers.
+func redactProxyHeaders(h map[string][]string) {
+	for k := range h {
+		if strings.EqualFold(k, "Proxy-Authorization") {
+			h[k] = []string{"REDACTED"}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// defaultMaxRequestBody bounds how much of a request body is buffered for
+	// previews and redirect replay.
+	defaultMaxRequestBody = 10 << 20
+	// defaultBodyPreview is the number of request body bytes shown in request_send.
+	defaultBodyPreview = 512
+)
+
+// sensitiveKeys are JSON object keys and form fields whose values are
+// redacted from request body previews. Keys are compared lower-cased with
+// '-' normalized to '_'; any key containing "password", "secret" or "token"
+// is redacted as well.
+var sensitiveKeys = map[string]bool{
+	"authorization": true, "api_key": true, "apikey": true, "private_key": true,
+	"credentials": true, "credential": true, "passwd": true, "pin": true,
+}
+
+// requestBody is a buffered request body. When the source exceeded the
+// buffer limit Complete is false and the remainder is streamed once, so the
+// body cannot be replayed on redirects.
+type requestBody struct {
+	Data     []byte
+	Complete bool
+	rest     io.Reader
+}
+
+// bufferRequestBody reads up to max bytes of r into memory.
+func bufferRequestBody(r io.Reader, max int64) (*requestBody, error) {
+	data, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) <= max {
+		return &requestBody{Data: data, Complete: true}, nil
+	}
+	return &requestBody{Data: data[:max], rest: io.MultiReader(bytes.NewReader(data[max:]), r)}, nil
+}
+
+// Reader returns the body to send. Complete bodies are returned as a
+// *bytes.Reader so net/http sets ContentLength and GetBody, which lets 307/308
+// redirects replay the body.
+func (b *requestBody) Reader() io.Reader {
+	if b.Complete {
+		return bytes.NewReader(b.Data)
+	}
+	return io.MultiReader(bytes.NewReader(b.Data), b.rest)
+}
+
+// preview renders at most n bytes of the body for request_send. With redact
+// set, sensitive fields of JSON and form bodies are masked; other or partial
+// bodies are replaced entirely because they cannot be inspected safely.
+func (b *requestBody) preview(contentType string, n int, redact bool) string {
+	data := b.Data
+	if redact {
+		redacted, ok := redactBody(data, contentType, b.Complete)
+		if !ok {
+			return fmt.Sprintf("REDACTED (%d bytes)", len(data))
+		}
+		data = redacted
+	}
+	if len(data) > n {
+		data = data[:n]
+		// avoid cutting a multi-byte rune in half; trimming more than a
+		// partial rune would empty binary data instead of detecting it
+		for i := 0; i < utf8.UTFMax-1 && len(data) > 0 && !utf8.Valid(data); i++ {
+			data = data[:len(data)-1]
+		}
+	}
+	if !utf8.Valid(data) {
+		return fmt.Sprintf("(binary, %d bytes)", len(b.Data))
+	}
+	return string(data)
+}
+
+// redactBody masks sensitive fields of JSON and form-urlencoded bodies. It
+// reports false when the body cannot be parsed.
+func redactBody(data []byte, contentType string, complete bool) ([]byte, bool) {
+	if len(data) == 0 {
+		return data, true
+	}
+	if !complete {
+		return nil, false
+	}
+	mt, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mt == "application/x-www-form-urlencoded":
+		vals, err := url.ParseQuery(string(data))
+		if err != nil {
+			return nil, false
+		}
+		for k := range vals {
+			if isSensitiveKey(k) {
+				vals[k] = []string{"REDACTED"}
+			}
+		}
+		return []byte(vals.Encode()), true
+	case mt == "application/json" || strings.HasSuffix(mt, "+json") || (mt == "" && json.Valid(data)):
+		var v interface{}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, false
+		}
+		out, err := json.Marshal(redactJSON(v))
+		if err != nil {
+			return nil, false
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+func redactJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, vv := range t {
+			if isSensitiveKey(k) {
+				t[k] = "REDACTED"
+			} else {
+				t[k] = redactJSON(vv)
+			}
+		}
+	case []interface{}:
+		for i := range t {
+			t[i] = redactJSON(t[i])
+		}
+	}
+	return v
+}
+
+func isSensitiveKey(k string) bool {
+	lk := strings.ReplaceAll(strings.ToLower(k), "-", "_")
+	if sensitiveKeys[lk] {
+		return true
+	}
+	return strings.Contains(lk, "password") || strings.Contains(lk, "secret") || strings.Contains(lk, "token")
+}
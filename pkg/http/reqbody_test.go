@@ -0,0 +1,32 @@
+package http
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRequestBodyPreview(t *testing.T) {
+	binary := bytes.Repeat([]byte{0xff, 0x00, 0x9c}, 10)
+	tests := []struct {
+		name        string
+		data        []byte
+		contentType string
+		n           int
+		redact      bool
+		want        string
+	}{
+		{name: "short text", data: []byte("hello"), n: 10, want: "hello"},
+		{name: "truncated text", data: []byte("hello world"), n: 5, want: "hello"},
+		{name: "cut rune", data: []byte("aé€"), n: 5, want: "aé"},
+		{name: "short binary", data: binary[:6], n: 10, want: "(binary, 6 bytes)"},
+		{name: "long binary", data: binary, n: 8, want: "(binary, 30 bytes)"},
+		{name: "redacted json", data: []byte(`{"password":"x"}`), contentType: "application/json", n: 100, redact: true, want: `{"password":"REDACTED"}`},
+		{name: "redacted binary", data: binary, contentType: "application/octet-stream", n: 8, redact: true, want: "REDACTED (30 bytes)"},
+	}
+	for _, tt := range tests {
+		b := &requestBody{Data: tt.data, Complete: true}
+		if got := b.preview(tt.contentType, tt.n, tt.redact); got != tt.want {
+			t.Errorf("%s: preview = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package http
+
+import (
+	"context"
+	"time"
+
+	"github.com/mrlm-net/tracer/pkg/netutil"
+	"github.com/mrlm-net/tracer/pkg/tracer"
+)
+
+func init() {
+	tracer.Register("http", newTracer)
+	tracer.Register("ws", newWSTracer)
+}
+
+// WebSocketSettings are the ws tracer's own options: the messages sent
+// after Data, as binary frames with Binary, the number of pings sent and how
+// long to listen after the last reply before closing (0: the default).
+type WebSocketSettings struct {
+	Messages []string
+	Binary   bool
+	Pings    int
+	Listen   time.Duration
+}
+
+// WebSocket is the key of WebSocketSettings in tracer.Options.
+var WebSocket = tracer.NewKey[WebSocketSettings]("ws")
+
+// sharedOptions converts shared tracer options into TraceURL options.
+func sharedOptions(o tracer.Options) []Option {
+	opts := []Option{WithEmitter(o.Emitter), WithDryRun(o.DryRun), WithIPPreference(o.IPPref), WithInjectTraceHeader(o.InjectTraceHeader)}
+	if o.Timeout > 0 {
+		opts = append(opts, WithTimeout(o.Timeout))
+	}
+	if o.Resolver != nil {
+		opts = append(opts, WithResolver(o.Resolver))
+	}
+	if o.Method != "" {
+		opts = append(opts, WithMethod(o.Method))
+	}
+	if len(o.Headers) > 0 {
+		opts = append(opts, WithHeaders(o.Headers))
+	}
+	if o.CaptureBody > 0 {
+		opts = append(opts, WithCaptureBody(o.CaptureBody))
+	}
+	if o.TLS != nil {
+		opts = append(opts, WithTLSConfig(*o.TLS))
+	}
+	if o.Proxy != "" || o.NoProxy != "" {
+		opts = append(opts, WithProxy(o.Proxy), WithNoProxy(o.NoProxy))
+	}
+	opts = append(opts, WithRedactRequests(o.RedactRequests), WithRedactResponses(o.RedactResponses))
+	return opts
+}
+
+func newTracer(o tracer.Options) (tracer.Tracer, error) {
+	if o.Proxy != "" && o.Proxy != ProxyDirect {
+		if _, err := netutil.ParseProxy(o.Proxy); err != nil {
+			return nil, err
+		}
+	}
+	return tracer.Func(func(ctx context.Context, target string) error {
+		opts := sharedOptions(o)
+		// the body reader is consumed per request, so build it per trace
+		if o.Data != "" {
+			opts = append(opts, WithBodyString(o.Data))
+		}
+		return TraceURL(ctx, target, opts...)
+	}), nil
+}
+
+// newWSTracer builds the ws tracer; Data is sent as the first message.
+func newWSTracer(o tracer.Options) (tracer.Tracer, error) {
+	if o.Proxy != "" && o.Proxy != ProxyDirect {
+		if _, err := netutil.ParseProxy(o.Proxy); err != nil {
+			return nil, err
+		}
+	}
+	var messages []string
+	if o.Data != "" {
+		messages = append(messages, o.Data)
+	}
+	s, _ := WebSocket.Get(o)
+	messages = append(messages, s.Messages...)
+	opts := append(sharedOptions(o), WithMessages(messages...), WithBinary(s.Binary), WithPings(s.Pings))
+	if s.Listen > 0 {
+		opts = append(opts, WithListen(s.Listen))
+	}
+	return tracer.Func(func(ctx context.Context, target string) error {
+		return TraceWebSocket(ctx, target, opts...)
+	}), nil
+}
@@ -0,0 +1,533 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mrlm-net/tracer/pkg/event"
+	"github.com/mrlm-net/tracer/pkg/tracecommon"
+)
+
+// WithMessages sets the messages TraceWebSocket sends after the upgrade.
+// Each one is sent when the reply to the previous one arrived or the listen
+// time passed.
+func WithMessages(m ...string) Option { return func(c *traceConfig) { c.WSMessages = m } }
+
+// WithBinary sends the messages as binary instead of text frames.
+func WithBinary(v bool) Option { return func(c *traceConfig) { c.WSBinary = v } }
+
+// WithPings sets how many pings TraceWebSocket sends after the messages to
+// measure the round trip (default 1).
+func WithPings(n int) Option { return func(c *traceConfig) { c.WSPings = n } }
+
+// WithListen sets how long TraceWebSocket waits for each reply and pong, for
+// further messages before closing and for the closing handshake (default 1s).
+func WithListen(d time.Duration) Option { return func(c *traceConfig) { c.WSListen = d } }
+
+// TraceWebSocket opens a WebSocket connection to targetURL (ws:// or wss://)
+// and emits the events of the upgrade request, as TraceURL does, followed by
+// one event per message, ping, pong and close frame. The whole trace,
+// including the listen time, is bounded by the timeout.
+func TraceWebSocket(ctx context.Context, targetURL string, opts ...Option) error {
+	cfg := newConfig(opts)
+	cfg.protocol = "ws"
+	cfg.Method = http.MethodGet
+	cfg.Body = nil
+	cfg.CaptureBody = 0
+
+	u, err := url.Parse(targetURL)
+	if err == nil {
+		switch u.Scheme {
+		case "ws":
+			u.Scheme = "http"
+		case "wss":
+			u.Scheme = "https"
+		default:
+			err = fmt.Errorf("unsupported scheme %q (want ws or wss)", u.Scheme)
+		}
+	}
+	if err != nil {
+		traceID := tracecommon.StartRequest(ctx, cfg.Emitter, cfg.protocol, targetURL)
+		tracecommon.EmitError(ctx, cfg.Emitter, cfg.protocol, "request_new", traceID, err)
+		return err
+	}
+	cfg.ws = &wsUpgrade{target: targetURL, url: u.String()}
+	return trace(ctx, cfg, targetURL)
+}
+
+// wsUpgrade holds the state of the upgrade request.
+type wsUpgrade struct {
+	// url is the target with its ws/wss scheme mapped to http/https.
+	target string
+	url    string
+	key    string
+}
+
+// prepare adds the upgrade headers (RFC 6455 section 4.1). Headers given by
+// the caller, such as Sec-WebSocket-Protocol, are kept.
+func (w *wsUpgrade) prepare(req *http.Request) {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	w.key = base64.StdEncoding.EncodeToString(b[:])
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", w.key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+}
+
+// run validates the upgrade response and runs the session on the upgraded
+// connection. Events are emitted with ctx; sessCtx bounds the session.
+func (w *wsUpgrade) run(ctx, sessCtx context.Context, cfg *traceConfig, traceID string, start time.Time, resp *http.Response) error {
+	emit := func(kind, stage string, d time.Duration, payload map[string]interface{}) {
+		cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: cfg.protocol, EventType: kind, Stage: stage, TraceID: traceID, DurationNS: int64(d), Payload: payload})
+	}
+
+	accept := resp.Header.Get("Sec-WebSocket-Accept")
+	extensions := resp.Header.Values("Sec-WebSocket-Extensions")
+	payload := map[string]interface{}{
+		"status":       resp.Status,
+		"upgrade":      resp.Header.Get("Upgrade"),
+		"accept_valid": accept == acceptKey(w.key),
+		"subprotocol":  resp.Header.Get("Sec-WebSocket-Protocol"),
+	}
+	if len(extensions) > 0 {
+		payload["extensions"] = extensions
+	}
+	if loc := resp.Header.Get("Location"); loc != "" {
+		payload["location"] = loc
+	}
+	emit("lifecycle", "upgrade_response", time.Since(start), payload)
+
+	rw, ok := resp.Body.(io.ReadWriteCloser)
+	var err error
+	switch {
+	case resp.StatusCode != http.StatusSwitchingProtocols:
+		err = fmt.Errorf("server did not switch protocols: %s", resp.Status)
+	case !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket"):
+		err = fmt.Errorf("unexpected Upgrade header %q", resp.Header.Get("Upgrade"))
+	case accept != acceptKey(w.key):
+		err = fmt.Errorf("invalid Sec-WebSocket-Accept %q", accept)
+	case len(extensions) > 0:
+		// we offer none, so frames could not be decoded
+		err = fmt.Errorf("server enabled extensions that were not offered: %s", strings.Join(extensions, ", "))
+	case !ok:
+		err = errors.New("upgraded connection is not writable")
+	}
+	if err != nil {
+		emit("error", "upgrade_error", time.Since(start), map[string]interface{}{"status": resp.Status, "error": err.Error()})
+		return err
+	}
+
+	s := &wsSession{
+		cfg: cfg, emit: emit, conn: rw, br: bufio.NewReader(rw), opened: time.Now(),
+		pings: map[string]wsPing{}, msgs: make(chan struct{}, 1), pongs: make(chan struct{}, 1), done: make(chan struct{}),
+	}
+	emit("lifecycle", "ws_open", time.Since(start), map[string]interface{}{"url": w.target, "subprotocol": resp.Header.Get("Sec-WebSocket-Protocol")})
+	return s.run(sessCtx)
+}
+
+// wsPing is a ping awaiting its pong, keyed by payload in wsSession.pings.
+type wsPing struct {
+	index  int
+	sentAt time.Time
+}
+
+// wsSession is an open WebSocket connection. The reader goroutine handles
+// every received frame, answering pings and close frames; the main
+// goroutine sends messages and pings and waits for their replies.
+type wsSession struct {
+	cfg    *traceConfig
+	emit   func(kind, stage string, d time.Duration, payload map[string]interface{})
+	conn   io.ReadWriteCloser
+	br     *bufio.Reader
+	opened time.Time
+
+	// wmu serializes frame writes from both goroutines.
+	wmu sync.Mutex
+
+	// mu guards the fields below. It is held while our messages, pings and
+	// close frame are written and reported, so their replies are always
+	// reported after them; wmu is taken after mu, never before.
+	mu          sync.Mutex
+	lastSend    time.Time
+	sent        int
+	received    int
+	bytesSent   int64
+	bytesRecv   int64
+	pings       map[string]wsPing
+	closeSentAt time.Time
+	closeRecv   bool
+	closeCode   int
+	closeReason string
+	initiator   string
+	readErr     error
+	// shutdown is set once the session is over; reads then fail because we
+	// closed the connection.
+	shutdown bool
+
+	// msgs and pongs signal received data messages and pongs; done is
+	// closed when the reader stops.
+	msgs  chan struct{}
+	pongs chan struct{}
+	done  chan struct{}
+}
+
+func (s *wsSession) run(parent context.Context) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		s.conn.Close()
+	}()
+	go s.read()
+
+	op := byte(opText)
+	if s.cfg.WSBinary {
+		op = opBinary
+	}
+	listen := s.cfg.WSListen
+	open := true
+	for i, m := range s.cfg.WSMessages {
+		if open = s.send(i, op, []byte(m)); !open {
+			break
+		}
+		if open = s.wait(ctx, s.msgs, listen); !open {
+			break
+		}
+	}
+	for i := 0; open && i < s.cfg.WSPings; i++ {
+		if open = s.ping(i); !open {
+			break
+		}
+		if !s.waitPong(ctx, i, listen) {
+			break
+		}
+	}
+	if open {
+		s.wait(ctx, nil, listen)
+	}
+	// close unless the server did or the connection is gone, then wait for
+	// the server's close frame
+	s.mu.Lock()
+	closing := s.initiator == "" && s.readErr == nil && ctx.Err() == nil
+	s.mu.Unlock()
+	if closing && s.writeClose(closeNormal, "") {
+		s.wait(ctx, nil, listen)
+	}
+	s.mu.Lock()
+	s.shutdown = true
+	s.mu.Unlock()
+	cancel()
+	<-s.done
+	return s.finish(parent)
+}
+
+// send writes one data message.
+func (s *wsSession) send(i int, op byte, data []byte) bool {
+	// a message pushed before this one is not its reply
+	select {
+	case <-s.msgs:
+	default:
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	began := time.Now()
+	if err := s.write(op, data); err != nil {
+		s.failLocked(err)
+		return false
+	}
+	s.lastSend = time.Now()
+	s.sent++
+	s.bytesSent += int64(len(data))
+	s.emit("lifecycle", "message_send", time.Since(began), map[string]interface{}{"index": i, "opcode": opName(op), "size": len(data)})
+	return true
+}
+
+// ping sends a ping whose payload identifies it.
+func (s *wsSession) ping(i int) bool {
+	data := fmt.Sprintf("tracer-%d", i)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pings[data] = wsPing{index: i, sentAt: time.Now()}
+	if err := s.write(opPing, []byte(data)); err != nil {
+		s.failLocked(err)
+		return false
+	}
+	s.emit("lifecycle", "ping_send", 0, map[string]interface{}{"index": i, "size": len(data)})
+	return true
+}
+
+// waitPong waits for the pong of ping i. A missing pong is an alert, not
+// an error: the connection may still be usable.
+func (s *wsSession) waitPong(ctx context.Context, i int, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.pongs:
+			s.mu.Lock()
+			_, pending := s.pings[fmt.Sprintf("tracer-%d", i)]
+			s.mu.Unlock()
+			if !pending {
+				return true
+			}
+		case <-t.C:
+			s.emit("alert", "pong_timeout", d, map[string]interface{}{"index": i})
+			return true
+		case <-s.done:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// wait returns when ch fires (nil: never), after d, or false when the
+// connection ended first.
+func (s *wsSession) wait(ctx context.Context, ch chan struct{}, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ch:
+	case <-t.C:
+	case <-s.done:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+	return true
+}
+
+func (s *wsSession) write(op byte, data []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return writeFrame(s.conn, op, data)
+}
+
+// writeClose sends a close frame once.
+func (s *wsSession) writeClose(code int, reason string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closeSentAt.IsZero() {
+		return false
+	}
+	s.closeSentAt = time.Now()
+	if s.initiator == "" {
+		s.initiator = "client"
+	}
+	if err := s.write(opClose, closePayload(code, reason)); err != nil {
+		s.failLocked(err)
+		return false
+	}
+	p := map[string]interface{}{"code": code}
+	if reason != "" {
+		p["reason"] = reason
+	}
+	s.emit("lifecycle", "close_send", 0, p)
+	return true
+}
+
+// fail records the first connection error.
+func (s *wsSession) fail(err error) {
+	s.mu.Lock()
+	s.failLocked(err)
+	s.mu.Unlock()
+}
+
+func (s *wsSession) failLocked(err error) {
+	if s.readErr == nil {
+		s.readErr = err
+	}
+}
+
+// read handles received frames until the close frame or a connection error.
+func (s *wsSession) read() {
+	defer close(s.done)
+	var msgOp byte
+	var msgSize int64
+	var frames int
+	inMessage := false
+	for {
+		h, err := readHeader(s.br)
+		if err == nil {
+			err = checkHeader(h)
+		}
+		if err == nil && h.op < opClose && (h.op == opContinuation) != inMessage {
+			err = fmt.Errorf("%w: unexpected %s frame", errWSProtocol, opName(h.op))
+		}
+		if err != nil {
+			s.readFailed(err)
+			return
+		}
+
+		if h.op < opClose {
+			if _, err := io.CopyN(io.Discard, s.br, h.length); err != nil {
+				s.readFailed(err)
+				return
+			}
+			if !inMessage {
+				msgOp, msgSize, frames, inMessage = h.op, 0, 0, true
+			}
+			msgSize += h.length
+			frames++
+			if h.fin {
+				inMessage = false
+				s.gotMessage(msgOp, msgSize, frames)
+			}
+			continue
+		}
+
+		data := make([]byte, h.length)
+		if _, err := io.ReadFull(s.br, data); err != nil {
+			s.readFailed(err)
+			return
+		}
+		switch h.op {
+		case opPing:
+			s.emit("lifecycle", "ping_recv", 0, map[string]interface{}{"size": len(data)})
+			if err := s.write(opPong, data); err != nil {
+				s.readFailed(err)
+				return
+			}
+			s.emit("lifecycle", "pong_send", 0, map[string]interface{}{"size": len(data)})
+		case opPong:
+			now := time.Now()
+			s.mu.Lock()
+			p, ok := s.pings[string(data)]
+			delete(s.pings, string(data))
+			s.mu.Unlock()
+			if !ok {
+				s.emit("lifecycle", "pong_recv", 0, map[string]interface{}{"size": len(data), "unsolicited": true})
+				continue
+			}
+			// a late pong is timed from its own ping, not the last one sent
+			rtt := now.Sub(p.sentAt)
+			s.emit("lifecycle", "pong_recv", rtt, map[string]interface{}{"index": p.index, "size": len(data), "rtt_ns": int64(rtt)})
+			select {
+			case s.pongs <- struct{}{}:
+			default:
+			}
+		case opClose:
+			code, reason, err := parseClose(data)
+			if err != nil {
+				s.readFailed(err)
+				return
+			}
+			s.mu.Lock()
+			s.closeRecv, s.closeCode, s.closeReason = true, code, reason
+			sentAt := s.closeSentAt
+			if s.initiator == "" {
+				s.initiator = "server"
+			}
+			s.mu.Unlock()
+			p := map[string]interface{}{"code": code}
+			if reason != "" {
+				p["reason"] = reason
+			}
+			var d time.Duration
+			if !sentAt.IsZero() {
+				d = time.Since(sentAt)
+			} else {
+				// echo the code, as RFC 6455 section 5.5.1 asks
+				echo := code
+				if echo == closeNoStatus {
+					echo = closeNormal
+				}
+				defer s.writeClose(echo, "")
+			}
+			s.emit("lifecycle", "close_recv", d, p)
+			return
+		}
+	}
+}
+
+// gotMessage reports a complete data message with the time since the last
+// message we sent (or since the connection opened).
+func (s *wsSession) gotMessage(op byte, size int64, frames int) {
+	now := time.Now()
+	s.mu.Lock()
+	index := s.received
+	s.received++
+	s.bytesRecv += size
+	since, after := s.opened, -1
+	if !s.lastSend.IsZero() {
+		since, after = s.lastSend, s.sent-1
+	}
+	s.mu.Unlock()
+	p := map[string]interface{}{"index": index, "opcode": opName(op), "size": size, "frames": frames}
+	if after >= 0 {
+		p["after_message"] = after
+		p["latency_ns"] = int64(now.Sub(since))
+	}
+	s.emit("lifecycle", "message_recv", now.Sub(since), p)
+	select {
+	case s.msgs <- struct{}{}:
+	default:
+	}
+}
+
+// readFailed records a read error. Protocol violations are answered with a
+// 1002 close frame.
+func (s *wsSession) readFailed(err error) {
+	s.mu.Lock()
+	closing, shutdown := !s.closeSentAt.IsZero(), s.shutdown
+	s.mu.Unlock()
+	eof := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+	// the server may drop the connection right after our close frame
+	if shutdown || (closing && eof) {
+		return
+	}
+	if eof {
+		err = fmt.Errorf("connection closed without a close frame: %w", err)
+	}
+	s.fail(err)
+	if errors.Is(err, errWSProtocol) {
+		s.writeClose(closeProtocolError, "")
+	}
+}
+
+// finish emits ws_closed and returns the session error: a connection error,
+// the timeout, or an abnormal close code from the server.
+func (s *wsSession) finish(ctx context.Context) error {
+	s.mu.Lock()
+	err := s.readErr
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	p := map[string]interface{}{
+		"clean":             s.closeRecv && !s.closeSentAt.IsZero(),
+		"messages_sent":     s.sent,
+		"messages_received": s.received,
+		"bytes_sent":        s.bytesSent,
+		"bytes_received":    s.bytesRecv,
+	}
+	if s.initiator != "" {
+		p["initiator"] = s.initiator
+	}
+	if s.closeRecv {
+		p["code"] = s.closeCode
+		if s.closeReason != "" {
+			p["reason"] = s.closeReason
+		}
+		if err == nil && s.initiator == "server" && s.closeCode != closeNormal && s.closeCode != closeGoingAway && s.closeCode != closeNoStatus {
+			err = fmt.Errorf("server closed the connection with code %d %s", s.closeCode, s.closeReason)
+		}
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		s.emit("error", "ws_error", time.Since(s.opened), map[string]interface{}{"error": err.Error()})
+	}
+	s.emit("lifecycle", "ws_closed", time.Since(s.opened), p)
+	return err
+}
@@ -0,0 +1,50 @@
+package http
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWSPongRTT(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go io.Copy(io.Discard, server)
+
+	var mu sync.Mutex
+	rtts := map[int]time.Duration{}
+	s := &wsSession{
+		cfg: &traceConfig{}, conn: client, br: bufio.NewReader(client),
+		pings: map[string]wsPing{}, msgs: make(chan struct{}, 1), pongs: make(chan struct{}, 1), done: make(chan struct{}),
+		emit: func(_, stage string, d time.Duration, p map[string]interface{}) {
+			if stage == "pong_recv" {
+				mu.Lock()
+				rtts[p["index"].(int)] = d
+				mu.Unlock()
+			}
+		},
+	}
+	go s.read()
+
+	// the pong of ping 0 arrives after ping 1 was sent
+	s.ping(0)
+	time.Sleep(50 * time.Millisecond)
+	s.ping(1)
+	server.Write([]byte("\x8a\x08tracer-0"))
+	select {
+	case <-s.pongs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no pong received")
+	}
+	server.Close()
+	<-s.done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if rtt := rtts[0]; rtt < 50*time.Millisecond {
+		t.Errorf("rtt of ping 0 = %v, want it timed from its own ping", rtt)
+	}
+}
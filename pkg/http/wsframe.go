@@ -0,0 +1,166 @@
+package http
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// WebSocket opcodes (RFC 6455 section 5.2).
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// Close codes used by the tracer (RFC 6455 section 7.4.1). closeNoStatus
+// is reported when a close frame carries no code; it is never sent.
+const (
+	closeNormal        = 1000
+	closeGoingAway     = 1001
+	closeProtocolError = 1002
+	closeNoStatus      = 1005
+)
+
+// wsGUID is appended to Sec-WebSocket-Key to compute Sec-WebSocket-Accept.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsHeader is the header of a frame received from the server.
+type wsHeader struct {
+	fin    bool
+	rsv    byte
+	op     byte
+	masked bool
+	length int64
+}
+
+// errWSProtocol wraps frames the server must not send.
+var errWSProtocol = errors.New("websocket protocol error")
+
+// readHeader reads a frame header. A mask key is consumed so the stream
+// stays in sync, although servers must not mask (checked by the caller).
+func readHeader(r *bufio.Reader) (wsHeader, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return wsHeader{}, err
+	}
+	h := wsHeader{fin: b[0]&0x80 != 0, rsv: b[0] & 0x70, op: b[0] & 0x0f, masked: b[1]&0x80 != 0, length: int64(b[1] & 0x7f)}
+	switch h.length {
+	case 126:
+		if _, err := io.ReadFull(r, b[:2]); err != nil {
+			return wsHeader{}, err
+		}
+		h.length = int64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err := io.ReadFull(r, b[:8]); err != nil {
+			return wsHeader{}, err
+		}
+		n := binary.BigEndian.Uint64(b[:8])
+		if n > 1<<62 {
+			return wsHeader{}, fmt.Errorf("%w: frame length %d", errWSProtocol, n)
+		}
+		h.length = int64(n)
+	}
+	if h.masked {
+		if _, err := io.ReadFull(r, b[:4]); err != nil {
+			return wsHeader{}, err
+		}
+	}
+	return h, nil
+}
+
+// checkHeader rejects frames a client must fail the connection on: masked
+// frames, reserved bits (no extension is negotiated), unknown opcodes and
+// fragmented or oversized control frames.
+func checkHeader(h wsHeader) error {
+	switch {
+	case h.masked:
+		return fmt.Errorf("%w: masked frame from server", errWSProtocol)
+	case h.rsv != 0:
+		return fmt.Errorf("%w: reserved bits 0x%x set", errWSProtocol, h.rsv>>4)
+	case h.op > opBinary && h.op < opClose, h.op > opPong:
+		return fmt.Errorf("%w: unknown opcode 0x%x", errWSProtocol, h.op)
+	case h.op >= opClose && (!h.fin || h.length > 125):
+		return fmt.Errorf("%w: fragmented or oversized %s frame", errWSProtocol, opName(h.op))
+	}
+	return nil
+}
+
+// writeFrame writes a single unfragmented, masked frame.
+func writeFrame(w io.Writer, op byte, payload []byte) error {
+	n := len(payload)
+	buf := make([]byte, 0, 14+n)
+	buf = append(buf, 0x80|op)
+	switch {
+	case n < 126:
+		buf = append(buf, 0x80|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, 0x80|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, 0x80|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	buf = append(buf, key[:]...)
+	for i, c := range payload {
+		buf = append(buf, c^key[i%4])
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// closePayload encodes a close frame body.
+func closePayload(code int, reason string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return append(b, reason...)
+}
+
+// parseClose decodes a close frame body; an empty body means no status.
+func parseClose(p []byte) (int, string, error) {
+	switch {
+	case len(p) == 0:
+		return closeNoStatus, "", nil
+	case len(p) == 1:
+		return 0, "", fmt.Errorf("%w: 1-byte close payload", errWSProtocol)
+	case !utf8.Valid(p[2:]):
+		return 0, "", fmt.Errorf("%w: close reason is not UTF-8", errWSProtocol)
+	}
+	return int(binary.BigEndian.Uint16(p)), string(p[2:]), nil
+}
+
+// acceptKey is the Sec-WebSocket-Accept value expected for key.
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func opName(op byte) string {
+	switch op {
+	case opContinuation:
+		return "continuation"
+	case opText:
+		return "text"
+	case opBinary:
+		return "binary"
+	case opClose:
+		return "close"
+	case opPing:
+		return "ping"
+	case opPong:
+		return "pong"
+	}
+	return fmt.Sprintf("0x%x", op)
+}
@@ -0,0 +1,610 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mrlm-net/tracer/pkg/event"
+	"github.com/mrlm-net/tracer/pkg/tracecommon"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// Protocol defaults until the peer's SETTINGS say otherwise (RFC 9113
+// section 6.5.2).
+const (
+	initialWindowSize = 65535
+	initialMaxFrame   = 16384
+	maxHeaderListSize = 10 << 20
+)
+
+// streamState tracks the single request stream.
+type streamState struct {
+	id uint32
+	// sent is when the request HEADERS went out and last when the latest
+	// frame of the stream arrived.
+	sent time.Time
+	last time.Time
+	// status is the final (non-1xx) :status.
+	status     string
+	bodySent   bool
+	gotHeaders bool
+	bodyBytes  int64
+	dataFrames int
+}
+
+// clientConn drives one HTTP/2 connection carrying a single request and
+// reports every frame sent and received.
+type clientConn struct {
+	ctx                   context.Context
+	cfg                   *traceConfig
+	conn                  net.Conn
+	br                    *bufio.Reader
+	fr                    *http2.Framer
+	traceID, connID, mode string
+	// start is when the connection was ready for the HTTP/2 exchange; every
+	// frame event carries its offset from it.
+	start time.Time
+
+	// wmu serializes frame writes from the request and the read loop.
+	wmu  sync.Mutex
+	hbuf bytes.Buffer
+	henc *hpack.Encoder
+
+	mu sync.Mutex
+	// sendConn and sendStream are the peer's flow-control windows for the
+	// data we send; peerWindow is its SETTINGS_INITIAL_WINDOW_SIZE.
+	sendConn, sendStream, peerWindow int64
+	peerMaxFrame                     uint32
+	settingsSent                     time.Time
+	// recvConn and recvStream count received flow-controlled bytes not yet
+	// returned with WINDOW_UPDATE.
+	recvConn, recvStream uint32
+	st                   streamState
+	lastFrame            string
+	closing              bool
+
+	windowCh   chan struct{}
+	done       chan struct{}
+	doneOnce   sync.Once
+	doneStage  string
+	doneErr    error
+	readerDone chan struct{}
+}
+
+func newClientConn(ctx context.Context, cfg *traceConfig, conn net.Conn, traceID, connID, mode string) *clientConn {
+	cc := &clientConn{
+		ctx: ctx, cfg: cfg, conn: conn, br: bufio.NewReader(conn),
+		traceID: traceID, connID: connID, mode: mode, start: time.Now(),
+		sendConn: initialWindowSize, sendStream: initialWindowSize, peerWindow: initialWindowSize, peerMaxFrame: initialMaxFrame,
+		windowCh: make(chan struct{}, 1), done: make(chan struct{}), readerDone: make(chan struct{}),
+		st: streamState{id: 1},
+	}
+	cc.fr = http2.NewFramer(conn, cc.br)
+	cc.fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	cc.fr.MaxHeaderListSize = maxHeaderListSize
+	cc.henc = hpack.NewEncoder(&cc.hbuf)
+	return cc
+}
+
+// emit reports a frame-level event. Events are dropped once the connection
+// is being closed so none follow request_end.
+func (cc *clientConn) emit(eventType, stage string, d time.Duration, payload map[string]interface{}) {
+	cc.mu.Lock()
+	closing := cc.closing
+	cc.mu.Unlock()
+	if closing {
+		return
+	}
+	payload["offset_ns"] = int64(time.Since(cc.start))
+	cc.cfg.Emitter.Emit(cc.ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "http2", EventType: eventType, Stage: stage, TraceID: cc.traceID, ConnID: cc.connID, DurationNS: int64(d), Payload: payload})
+}
+
+// finish ends the exchange; the first call wins.
+func (cc *clientConn) finish(stage string, err error) {
+	cc.doneOnce.Do(func() {
+		cc.doneStage, cc.doneErr = stage, err
+		close(cc.done)
+	})
+}
+
+func (cc *clientConn) settings() []http2.Setting {
+	return []http2.Setting{
+		{ID: http2.SettingEnablePush, Val: 0},
+		{ID: http2.SettingInitialWindowSize, Val: cc.cfg.WindowSize},
+		{ID: http2.SettingMaxHeaderListSize, Val: maxHeaderListSize},
+	}
+}
+
+// roundTrip performs the request on stream 1 and waits for the response to
+// end, the stream to be reset, the connection to fail or the trace to time
+// out.
+func (cc *clientConn) roundTrip(u *url.URL) error {
+	method := cc.cfg.Method
+	if method == "" {
+		method = http.MethodGet
+		if len(cc.cfg.Body) > 0 {
+			method = http.MethodPost
+		}
+	}
+
+	if cc.mode == "h2c-upgrade" {
+		if err := cc.upgrade(u, method); err != nil {
+			return err
+		}
+	}
+	if err := cc.writePreface(); err != nil {
+		cc.emit("error", "connection_error", 0, map[string]interface{}{"error": err.Error()})
+		return err
+	}
+	go cc.readLoop()
+
+	// after an upgrade the request was sent as HTTP/1.1 and becomes stream 1
+	if cc.mode != "h2c-upgrade" {
+		if err := cc.writeRequest(u, method); err != nil {
+			cc.finish("stream_error", err)
+		}
+	}
+
+	select {
+	case <-cc.done:
+	case <-cc.ctx.Done():
+		cc.finish("timeout", cc.ctx.Err())
+	}
+	return cc.close()
+}
+
+// close reports how the exchange ended, says goodbye with GOAWAY when the
+// connection is still usable, and stops the read loop.
+func (cc *clientConn) close() error {
+	cc.mu.Lock()
+	st := cc.st
+	payload := map[string]interface{}{
+		"stream_id": st.id, "conn_window": cc.sendConn, "stream_window": cc.sendStream, "last_frame": cc.lastFrame,
+		"body_bytes": st.bodyBytes, "data_frames": st.dataFrames,
+	}
+	if !st.last.IsZero() {
+		payload["since_last_frame_ns"] = int64(time.Since(st.last))
+	}
+	cc.mu.Unlock()
+
+	switch cc.doneStage {
+	case "":
+		payload["status"] = st.status
+		cc.emit("lifecycle", "response_end", time.Since(st.sent), payload)
+	case "timeout":
+		// where the exchange stalled is the useful part of a timeout
+		switch {
+		case st.sent.IsZero():
+			payload["waiting_for"] = "request"
+		case !st.bodySent:
+			payload["waiting_for"] = "request_body"
+		case !st.gotHeaders:
+			payload["waiting_for"] = "response_headers"
+		default:
+			payload["waiting_for"] = "data"
+		}
+		payload["error"] = cc.doneErr.Error()
+		cc.emit("error", "timeout", time.Since(cc.start), payload)
+	default:
+		payload["error"] = cc.doneErr.Error()
+		cc.emit("error", cc.doneStage, time.Since(cc.start), payload)
+	}
+
+	if cc.doneStage != "connection_error" {
+		cc.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		cc.wmu.Lock()
+		err := cc.fr.WriteGoAway(0, http2.ErrCodeNo, nil)
+		cc.wmu.Unlock()
+		if err == nil {
+			cc.emit("lifecycle", "goaway_send", 0, map[string]interface{}{"stream_id": 0, "last_stream_id": 0, "error_code": http2.ErrCodeNo.String()})
+		}
+	}
+	cc.mu.Lock()
+	cc.closing = true
+	cc.mu.Unlock()
+	cc.conn.Close()
+	<-cc.readerDone
+	return cc.doneErr
+}
+
+// upgrade sends the request as HTTP/1.1 with "Upgrade: h2c" and waits for
+// 101 Switching Protocols (RFC 7540 section 3.2).
+func (cc *clientConn) upgrade(u *url.URL, method string) error {
+	var sp []byte
+	for _, s := range cc.settings() {
+		sp = binary.BigEndian.AppendUint16(sp, uint16(s.ID))
+		sp = binary.BigEndian.AppendUint32(sp, s.Val)
+	}
+	req := &http.Request{Method: method, URL: u, Host: u.Host, Header: make(http.Header), ProtoMajor: 1, ProtoMinor: 1}
+	for k, v := range cc.cfg.Headers {
+		req.Header[k] = append([]string(nil), v...)
+	}
+	req.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+	req.Header.Set("Upgrade", "h2c")
+	req.Header.Set("HTTP2-Settings", base64.RawURLEncoding.EncodeToString(sp))
+	if len(cc.cfg.Body) > 0 {
+		req.Body = io.NopCloser(bytes.NewReader(cc.cfg.Body))
+		req.ContentLength = int64(len(cc.cfg.Body))
+	}
+
+	sent := time.Now()
+	if err := req.Write(cc.conn); err != nil {
+		cc.emit("error", "upgrade_error", 0, map[string]interface{}{"error": err.Error()})
+		return err
+	}
+	hdrs := tracecommon.CopyHeaders(req.Header, cc.cfg.RedactRequests, true)
+	cc.emit("lifecycle", "upgrade_request_send", 0, map[string]interface{}{"method": method, "url": u.String(), "headers": hdrs, "body_bytes": len(cc.cfg.Body)})
+
+	resp, err := http.ReadResponse(cc.br, req)
+	if err != nil {
+		cc.emit("error", "upgrade_error", time.Since(sent), map[string]interface{}{"error": err.Error()})
+		return err
+	}
+	cc.emit("lifecycle", "upgrade_response", time.Since(sent), map[string]interface{}{"status": resp.Status, "headers": tracecommon.CopyHeaders(resp.Header, cc.cfg.RedactResponses, false)})
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		err := fmt.Errorf("server declined the h2c upgrade: %s", resp.Status)
+		cc.emit("error", "upgrade_error", time.Since(sent), map[string]interface{}{"status": resp.Status, "error": err.Error()})
+		return err
+	}
+	cc.mu.Lock()
+	cc.st.sent = sent
+	cc.st.bodySent = true
+	cc.mu.Unlock()
+	return nil
+}
+
+// writePreface sends the client connection preface: the magic string, our
+// SETTINGS and, for windows above the default, a connection WINDOW_UPDATE.
+func (cc *clientConn) writePreface() error {
+	settings := cc.settings()
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	if _, err := io.WriteString(cc.conn, http2.ClientPreface); err != nil {
+		return err
+	}
+	cc.mu.Lock()
+	cc.settingsSent = time.Now()
+	cc.mu.Unlock()
+	if err := cc.fr.WriteSettings(settings...); err != nil {
+		return err
+	}
+	cc.emit("lifecycle", "preface_send", 0, map[string]interface{}{"mode": cc.mode, "settings": settingsMap(settings)})
+	if inc := int64(cc.cfg.WindowSize) - initialWindowSize; inc > 0 {
+		if err := cc.fr.WriteWindowUpdate(0, uint32(inc)); err != nil {
+			return err
+		}
+		cc.emit("lifecycle", "window_update_send", 0, map[string]interface{}{"stream_id": 0, "increment": inc})
+	}
+	return nil
+}
+
+// writeRequest sends the request HEADERS (split into CONTINUATION frames
+// when larger than the peer's maximum frame size) and the body.
+func (cc *clientConn) writeRequest(u *url.URL, method string) error {
+	fields := requestHeaders(cc.cfg, u, method)
+	endStream := len(cc.cfg.Body) == 0
+
+	cc.wmu.Lock()
+	cc.hbuf.Reset()
+	for _, f := range fields {
+		cc.henc.WriteField(hpack.HeaderField{Name: f[0], Value: f[1]})
+	}
+	block := cc.hbuf.Bytes()
+	cc.mu.Lock()
+	max := int(cc.peerMaxFrame)
+	cc.st.sent = time.Now()
+	cc.st.bodySent = endStream
+	cc.mu.Unlock()
+	first := block
+	if len(first) > max {
+		first = block[:max]
+	}
+	err := cc.fr.WriteHeaders(http2.HeadersFrameParam{StreamID: cc.st.id, BlockFragment: first, EndStream: endStream, EndHeaders: len(first) == len(block)})
+	for rest := block[len(first):]; err == nil && len(rest) > 0; {
+		n := min(len(rest), max)
+		err = cc.fr.WriteContinuation(cc.st.id, n == len(rest), rest[:n])
+		rest = rest[n:]
+	}
+	size := len(block)
+	cc.wmu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	shown := make(map[string][]string, len(fields))
+	for _, f := range fields {
+		v := f[1]
+		if cc.cfg.RedactRequests && tracecommon.SensitiveHeader(f[0], true) {
+			v = "REDACTED"
+		}
+		shown[f[0]] = append(shown[f[0]], v)
+	}
+	cc.emit("lifecycle", "headers_send", 0, map[string]interface{}{"stream_id": cc.st.id, "end_stream": endStream, "headers": shown, "header_block_bytes": size})
+
+	for data := cc.cfg.Body; len(data) > 0; {
+		n, err := cc.awaitWindow(len(data))
+		if err != nil {
+			return err
+		}
+		end := n == len(data)
+		cc.wmu.Lock()
+		err = cc.fr.WriteData(cc.st.id, end, data[:n])
+		cc.wmu.Unlock()
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+		cc.mu.Lock()
+		cw, sw := cc.sendConn, cc.sendStream
+		cc.st.bodySent = end
+		cc.mu.Unlock()
+		cc.emit("lifecycle", "data_send", 0, map[string]interface{}{"stream_id": cc.st.id, "length": n, "end_stream": end, "conn_window": cw, "stream_window": sw})
+	}
+	return nil
+}
+
+// awaitWindow reserves up to want bytes of send window, waiting for
+// WINDOW_UPDATE (or SETTINGS) when the connection or stream window is
+// exhausted. The wait is reported as flow_control_blocked and
+// flow_control_resumed.
+func (cc *clientConn) awaitWindow(want int) (int, error) {
+	var blocked time.Time
+	for {
+		cc.mu.Lock()
+		n := min(int64(want), cc.sendConn, cc.sendStream, int64(cc.peerMaxFrame))
+		cw, sw := cc.sendConn, cc.sendStream
+		if n > 0 {
+			cc.sendConn -= n
+			cc.sendStream -= n
+		}
+		cc.mu.Unlock()
+		if n > 0 {
+			if !blocked.IsZero() {
+				cc.emit("lifecycle", "flow_control_resumed", time.Since(blocked), map[string]interface{}{"stream_id": cc.st.id, "conn_window": cw, "stream_window": sw})
+			}
+			return int(n), nil
+		}
+		if blocked.IsZero() {
+			blocked = time.Now()
+			by := "stream"
+			switch {
+			case cw <= 0 && sw <= 0:
+				by = "connection and stream"
+			case cw <= 0:
+				by = "connection"
+			}
+			cc.emit("lifecycle", "flow_control_blocked", 0, map[string]interface{}{"stream_id": cc.st.id, "pending_bytes": want, "conn_window": cw, "stream_window": sw, "blocked_by": by})
+		}
+		select {
+		case <-cc.windowCh:
+		case <-cc.done:
+			return 0, errors.New("stream ended while waiting for send window")
+		case <-cc.ctx.Done():
+			return 0, cc.ctx.Err()
+		}
+	}
+}
+
+// readLoop reads and reports frames until the connection fails or is closed.
+func (cc *clientConn) readLoop() {
+	defer close(cc.readerDone)
+	for {
+		f, err := cc.fr.ReadFrame()
+		if err != nil {
+			// the trace deadline unblocks the read by expiring the conn
+			if cc.ctx.Err() != nil {
+				cc.finish("timeout", cc.ctx.Err())
+				return
+			}
+			if errors.Is(err, io.EOF) {
+				err = errors.New("connection closed by server")
+			}
+			cc.finish("connection_error", err)
+			return
+		}
+		cc.handle(f)
+	}
+}
+
+// handle reports one received frame and performs the client's part of the
+// protocol: ACKs, flow-control accounting and stream completion.
+func (cc *clientConn) handle(f http2.Frame) {
+	h := f.Header()
+	now := time.Now()
+	payload := map[string]interface{}{"stream_id": h.StreamID, "length": h.Length, "flags": frameFlags(h)}
+
+	cc.mu.Lock()
+	cc.lastFrame = h.Type.String()
+	var sinceSent time.Duration
+	if h.StreamID == cc.st.id {
+		if !cc.st.last.IsZero() {
+			payload["gap_ns"] = int64(now.Sub(cc.st.last))
+		}
+		cc.st.last = now
+		if !cc.st.sent.IsZero() {
+			sinceSent = now.Sub(cc.st.sent)
+		}
+	}
+	cc.mu.Unlock()
+
+	switch f := f.(type) {
+	case *http2.SettingsFrame:
+		if f.IsAck() {
+			cc.mu.Lock()
+			rtt := now.Sub(cc.settingsSent)
+			cc.mu.Unlock()
+			cc.emit("lifecycle", "settings_ack_recv", rtt, payload)
+			return
+		}
+		settings := map[string]uint32{}
+		cc.mu.Lock()
+		f.ForeachSetting(func(s http2.Setting) error {
+			settings[s.ID.String()] = s.Val
+			switch s.ID {
+			case http2.SettingInitialWindowSize:
+				// applies to open streams as a delta (RFC 9113 section 6.9.2)
+				cc.sendStream += int64(s.Val) - cc.peerWindow
+				cc.peerWindow = int64(s.Val)
+			case http2.SettingMaxFrameSize:
+				cc.peerMaxFrame = s.Val
+			}
+			return nil
+		})
+		cc.mu.Unlock()
+		cc.signalWindow()
+		payload["settings"] = settings
+		cc.emit("lifecycle", "settings_recv", 0, payload)
+		cc.wmu.Lock()
+		err := cc.fr.WriteSettingsAck()
+		cc.wmu.Unlock()
+		if err == nil {
+			cc.emit("lifecycle", "settings_ack_send", 0, map[string]interface{}{"stream_id": 0})
+		}
+
+	case *http2.MetaHeadersFrame:
+		status := f.PseudoValue("status")
+		payload["end_stream"] = f.StreamEnded()
+		payload["headers"] = fieldMap(f.RegularFields(), cc.cfg.RedactResponses)
+		if f.Truncated {
+			payload["truncated"] = true
+		}
+		cc.mu.Lock()
+		trailers := cc.st.gotHeaders
+		switch {
+		case trailers:
+			payload["trailers"] = true
+		case strings.HasPrefix(status, "1"):
+			payload["informational"] = true
+		default:
+			cc.st.gotHeaders, cc.st.status = true, status
+		}
+		cc.mu.Unlock()
+		if status != "" {
+			payload["status"] = status
+		}
+		cc.emit("lifecycle", "headers_recv", sinceSent, payload)
+		if f.StreamEnded() {
+			cc.endStream()
+		}
+
+	case *http2.DataFrame:
+		n := len(f.Data())
+		cc.mu.Lock()
+		cc.st.bodyBytes += int64(n)
+		cc.st.dataFrames++
+		// padding counts against flow control too
+		cc.recvConn += h.Length
+		cc.recvStream += h.Length
+		connInc, streamInc := uint32(0), uint32(0)
+		if cc.recvConn >= cc.cfg.WindowSize/2 {
+			connInc, cc.recvConn = cc.recvConn, 0
+		}
+		if cc.recvStream >= cc.cfg.WindowSize/2 && !f.StreamEnded() {
+			streamInc, cc.recvStream = cc.recvStream, 0
+		}
+		cc.mu.Unlock()
+		payload["data_bytes"] = n
+		payload["end_stream"] = f.StreamEnded()
+		cc.emit("lifecycle", "data_recv", sinceSent, payload)
+		cc.windowUpdate(0, connInc)
+		cc.windowUpdate(h.StreamID, streamInc)
+		if f.StreamEnded() {
+			cc.endStream()
+		}
+
+	case *http2.WindowUpdateFrame:
+		cc.mu.Lock()
+		var window int64
+		if h.StreamID == 0 {
+			cc.sendConn += int64(f.Increment)
+			window = cc.sendConn
+		} else {
+			cc.sendStream += int64(f.Increment)
+			window = cc.sendStream
+		}
+		cc.mu.Unlock()
+		cc.signalWindow()
+		payload["increment"] = f.Increment
+		payload["window"] = window
+		cc.emit("lifecycle", "window_update_recv", 0, payload)
+
+	case *http2.PingFrame:
+		payload["data"] = fmt.Sprintf("%x", f.Data)
+		if f.IsAck() {
+			cc.emit("lifecycle", "ping_ack_recv", 0, payload)
+			return
+		}
+		cc.emit("lifecycle", "ping_recv", 0, payload)
+		cc.wmu.Lock()
+		err := cc.fr.WritePing(true, f.Data)
+		cc.wmu.Unlock()
+		if err == nil {
+			cc.emit("lifecycle", "ping_ack_send", 0, map[string]interface{}{"stream_id": 0, "data": payload["data"]})
+		}
+
+	case *http2.RSTStreamFrame:
+		payload["error_code"] = f.ErrCode.String()
+		cc.emit("lifecycle", "rst_stream_recv", sinceSent, payload)
+		if h.StreamID == cc.st.id {
+			cc.finish("stream_error", fmt.Errorf("stream %d reset by server: %s", h.StreamID, f.ErrCode))
+		}
+
+	case *http2.GoAwayFrame:
+		payload["last_stream_id"] = f.LastStreamID
+		payload["error_code"] = f.ErrCode.String()
+		if d := f.DebugData(); len(d) > 0 {
+			payload["debug_data"] = string(d)
+		}
+		cc.emit("lifecycle", "goaway_recv", 0, payload)
+		// streams above last_stream_id were not processed and never will be
+		if f.LastStreamID < cc.st.id || f.ErrCode != http2.ErrCodeNo {
+			cc.finish("connection_error", fmt.Errorf("server sent GOAWAY: %s (last stream %d)", f.ErrCode, f.LastStreamID))
+		}
+
+	case *http2.PushPromiseFrame:
+		payload["promise_id"] = f.PromiseID
+		cc.emit("lifecycle", "push_promise_recv", 0, payload)
+
+	default:
+		payload["type"] = h.Type.String()
+		cc.emit("lifecycle", "frame_recv", 0, payload)
+	}
+}
+
+// endStream marks the response complete.
+func (cc *clientConn) endStream() { cc.finish("", nil) }
+
+// windowUpdate returns inc bytes of receive window for streamID (0: the
+// connection).
+func (cc *clientConn) windowUpdate(streamID, inc uint32) {
+	if inc == 0 {
+		return
+	}
+	cc.wmu.Lock()
+	err := cc.fr.WriteWindowUpdate(streamID, inc)
+	cc.wmu.Unlock()
+	if err == nil {
+		cc.emit("lifecycle", "window_update_send", 0, map[string]interface{}{"stream_id": streamID, "increment": inc})
+	}
+}
+
+func (cc *clientConn) signalWindow() {
+	select {
+	case cc.windowCh <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,53 @@
+package http2
+
+import (
+	"github.com/mrlm-net/tracer/pkg/tracecommon"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// flagNames lists the defined flags per frame type (RFC 9113 section 6).
+var flagNames = map[http2.FrameType][]struct {
+	flag http2.Flags
+	name string
+}{
+	http2.FrameData:         {{http2.FlagDataEndStream, "END_STREAM"}, {http2.FlagDataPadded, "PADDED"}},
+	http2.FrameHeaders:      {{http2.FlagHeadersEndStream, "END_STREAM"}, {http2.FlagHeadersEndHeaders, "END_HEADERS"}, {http2.FlagHeadersPadded, "PADDED"}, {http2.FlagHeadersPriority, "PRIORITY"}},
+	http2.FrameSettings:     {{http2.FlagSettingsAck, "ACK"}},
+	http2.FramePing:         {{http2.FlagPingAck, "ACK"}},
+	http2.FrameContinuation: {{http2.FlagContinuationEndHeaders, "END_HEADERS"}},
+	http2.FramePushPromise:  {{http2.FlagPushPromiseEndHeaders, "END_HEADERS"}, {http2.FlagPushPromisePadded, "PADDED"}},
+}
+
+// frameFlags names the flags set on a frame.
+func frameFlags(h http2.FrameHeader) []string {
+	out := []string{}
+	for _, f := range flagNames[h.Type] {
+		if h.Flags.Has(f.flag) {
+			out = append(out, f.name)
+		}
+	}
+	return out
+}
+
+func settingsMap(ss []http2.Setting) map[string]uint32 {
+	m := make(map[string]uint32, len(ss))
+	for _, s := range ss {
+		m[s.ID.String()] = s.Val
+	}
+	return m
+}
+
+// fieldMap renders decoded header fields, redacting set-cookie when redact
+// is set.
+func fieldMap(fields []hpack.HeaderField, redact bool) map[string][]string {
+	m := make(map[string][]string, len(fields))
+	for _, f := range fields {
+		v := f.Value
+		if redact && tracecommon.SensitiveHeader(f.Name, false) {
+			v = "REDACTED"
+		}
+		m[f.Name] = append(m[f.Name], v)
+	}
+	return m
+}
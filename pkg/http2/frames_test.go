@@ -0,0 +1,47 @@
+package http2
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestFrameFlags(t *testing.T) {
+	tests := []struct {
+		hdr  http2.FrameHeader
+		want []string
+	}{
+		{http2.FrameHeader{Type: http2.FrameData, Flags: http2.FlagDataEndStream}, []string{"END_STREAM"}},
+		{http2.FrameHeader{Type: http2.FrameHeaders, Flags: http2.FlagHeadersEndStream | http2.FlagHeadersEndHeaders}, []string{"END_STREAM", "END_HEADERS"}},
+		{http2.FrameHeader{Type: http2.FrameSettings, Flags: http2.FlagSettingsAck}, []string{"ACK"}},
+		// the same bit means different things per frame type
+		{http2.FrameHeader{Type: http2.FramePing, Flags: 0x1}, []string{"ACK"}},
+		{http2.FrameHeader{Type: http2.FrameWindowUpdate, Flags: 0x1}, []string{}},
+		{http2.FrameHeader{Type: http2.FrameData}, []string{}},
+	}
+	for _, tt := range tests {
+		if got := frameFlags(tt.hdr); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("frameFlags(%v %#x) = %v, want %v", tt.hdr.Type, tt.hdr.Flags, got, tt.want)
+		}
+	}
+}
+
+func TestSettingsMap(t *testing.T) {
+	got := settingsMap([]http2.Setting{{ID: http2.SettingInitialWindowSize, Val: 16384}, {ID: http2.SettingMaxFrameSize, Val: 1 << 20}})
+	want := map[string]uint32{"INITIAL_WINDOW_SIZE": 16384, "MAX_FRAME_SIZE": 1 << 20}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("settingsMap = %v, want %v", got, want)
+	}
+}
+
+func TestFieldMap(t *testing.T) {
+	fields := []hpack.HeaderField{{Name: "content-type", Value: "text/plain"}, {Name: "set-cookie", Value: "a=1"}, {Name: "set-cookie", Value: "b=2"}}
+	if got, want := fieldMap(fields, true), map[string][]string{"content-type": {"text/plain"}, "set-cookie": {"REDACTED", "REDACTED"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("fieldMap redacted = %v, want %v", got, want)
+	}
+	if got, want := fieldMap(fields, false), map[string][]string{"content-type": {"text/plain"}, "set-cookie": {"a=1", "b=2"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("fieldMap = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,278 @@
+package http2
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mrlm-net/tracer/pkg/event"
+	"github.com/mrlm-net/tracer/pkg/netutil"
+	"github.com/mrlm-net/tracer/pkg/tlsinfo"
+	"github.com/mrlm-net/tracer/pkg/tracecommon"
+)
+
+// Default receive window advertised for the stream and the connection.
+const defaultWindowSize = 4 << 20
+
+// MaxWindowSize is the largest flow-control window HTTP/2 allows (RFC 9113
+// section 6.9.1).
+const MaxWindowSize = 1<<31 - 1
+
+// CheckWindowSize rejects a receive window outside 1..MaxWindowSize.
+func CheckWindowSize(n uint64) error {
+	if n == 0 || n > MaxWindowSize {
+		return fmt.Errorf("invalid HTTP/2 window size %d, expected 1 to %d", n, MaxWindowSize)
+	}
+	return nil
+}
+
+type Option func(*traceConfig)
+
+type traceConfig struct {
+	Emitter event.Emitter
+	Dry     bool
+	Timeout time.Duration
+	Method  string
+	Body    []byte
+	Headers http.Header
+	IPPref  string
+	// Resolver selects the DNS server and static overrides used to dial.
+	Resolver *netutil.Resolver
+	// TLS configures https:// targets; ALPN is always h2.
+	TLS *tlsinfo.Config
+	// Upgrade negotiates h2c with an HTTP/1.1 Upgrade request instead of
+	// prior knowledge (http:// targets only).
+	Upgrade bool
+	// WindowSize is the receive window advertised for the stream and the
+	// connection; small values make the WINDOW_UPDATE exchange visible.
+	WindowSize      uint32
+	RedactRequests  bool
+	RedactResponses bool
+}
+
+// WithEmitter sets a custom emitter.
+func WithEmitter(e event.Emitter) Option { return func(c *traceConfig) { c.Emitter = e } }
+
+// WithDryRun enables dry-run mode.
+func WithDryRun(d bool) Option { return func(c *traceConfig) { c.Dry = d } }
+
+// WithTimeout bounds the whole trace, from dialing to the end of the stream.
+func WithTimeout(d time.Duration) Option { return func(c *traceConfig) { c.Timeout = d } }
+
+// WithMethod sets the request method (default GET, or POST with a body).
+func WithMethod(m string) Option { return func(c *traceConfig) { c.Method = m } }
+
+// WithBodyString sets the request body, sent in DATA frames.
+func WithBodyString(s string) Option { return func(c *traceConfig) { c.Body = []byte(s) } }
+
+// WithHeaders sets extra request headers.
+func WithHeaders(h http.Header) Option { return func(c *traceConfig) { c.Headers = h } }
+
+// WithIPPreference sets IP family preference: "v4", "v6" or ""/"auto".
+func WithIPPreference(p string) Option { return func(c *traceConfig) { c.IPPref = p } }
+
+// WithResolver sets the resolver used to dial (custom DNS server, DoT, DoH
+// or --resolve style overrides); nil uses the system resolver.
+func WithResolver(r *netutil.Resolver) Option { return func(c *traceConfig) { c.Resolver = r } }
+
+// WithTLSConfig sets the TLS client configuration for https:// targets. The
+// ALPN list is replaced with h2.
+func WithTLSConfig(c tlsinfo.Config) Option { return func(cfg *traceConfig) { cfg.TLS = &c } }
+
+// WithUpgrade negotiates h2c for http:// targets with an HTTP/1.1
+// "Upgrade: h2c" request instead of sending the preface directly.
+func WithUpgrade(v bool) Option { return func(c *traceConfig) { c.Upgrade = v } }
+
+// WithWindowSize sets the receive window advertised for the stream and the
+// connection (default 4 MiB, minimum 65535 for the connection). TraceURL
+// fails when n is outside 1..MaxWindowSize.
+func WithWindowSize(n uint32) Option { return func(c *traceConfig) { c.WindowSize = n } }
+
+// WithRedactRequests controls redaction of request headers (authorization, cookie).
+func WithRedactRequests(v bool) Option { return func(c *traceConfig) { c.RedactRequests = v } }
+
+// WithRedactResponses controls redaction of response headers (set-cookie).
+func WithRedactResponses(v bool) Option { return func(c *traceConfig) { c.RedactResponses = v } }
+
+// TraceURL sends one request to targetURL over HTTP/2 and emits an event for
+// every frame sent and received: the connection preface, the SETTINGS
+// exchange, HEADERS and DATA per stream, WINDOW_UPDATE, PING, RST_STREAM and
+// GOAWAY. https:// targets require h2 via ALPN; http:// targets use h2c with
+// prior knowledge, or the HTTP/1.1 Upgrade mechanism with WithUpgrade.
+func TraceURL(ctx context.Context, targetURL string, opts ...Option) error {
+	cfg := &traceConfig{Timeout: 30 * time.Second, WindowSize: defaultWindowSize, RedactRequests: true, RedactResponses: true}
+	for _, o := range opts {
+		o(cfg)
+	}
+
+	if cfg.Emitter == nil {
+		cfg.Emitter = event.NewStdoutEmitter(os.Stdout, true, true)
+	}
+
+	traceID := tracecommon.StartRequest(ctx, cfg.Emitter, "http2", targetURL)
+	if cfg.Dry {
+		tracecommon.EmitDryRun(ctx, cfg.Emitter, "http2", traceID)
+		return nil
+	}
+
+	u, err := url.Parse(targetURL)
+	if err == nil && u.Scheme != "http" && u.Scheme != "https" {
+		err = fmt.Errorf("unsupported scheme %q (want http or https)", u.Scheme)
+	}
+	if err == nil && cfg.Upgrade && u.Scheme == "https" {
+		err = errors.New("the h2c upgrade needs an http:// URL; https:// negotiates h2 with ALPN")
+	}
+	if err == nil {
+		err = CheckWindowSize(uint64(cfg.WindowSize))
+	}
+	if err != nil {
+		tracecommon.EmitError(ctx, cfg.Emitter, "http2", "request_new", traceID, err)
+		return err
+	}
+	mode := "h2"
+	switch {
+	case u.Scheme == "http" && cfg.Upgrade:
+		mode = "h2c-upgrade"
+	case u.Scheme == "http":
+		mode = "h2c"
+	}
+
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+
+	conn, connID, err := dial(ctx, cfg, u, traceID)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if u.Scheme == "https" {
+		if conn, err = handshake(ctx, conn, u.Hostname(), cfg, traceID, connID); err != nil {
+			return err
+		}
+	}
+
+	cc := newClientConn(ctx, cfg, conn, traceID, connID, mode)
+	// a stalled peer must not outlive the trace
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+	err = cc.roundTrip(u)
+	tracecommon.EmitLifecycle(ctx, cfg.Emitter, "http2", "request_end", traceID, connID, 0, nil, nil)
+	return err
+}
+
+// dial connects to the URL's host with Happy Eyeballs and emits
+// connect_start/connect_done.
+func dial(ctx context.Context, cfg *traceConfig, u *url.URL, traceID string) (net.Conn, string, error) {
+	defPort := "80"
+	if u.Scheme == "https" {
+		defPort = "443"
+	}
+	host, port, _, _, _, zone, err := netutil.ParseAddr(u.Host, defPort)
+	if err != nil {
+		tracecommon.EmitError(ctx, cfg.Emitter, "http2", "resolve_error", traceID, err)
+		return nil, "", err
+	}
+	if zone != "" {
+		host += "%" + zone
+	}
+
+	start := time.Now()
+	cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "http2", EventType: "lifecycle", Stage: "connect_start", TraceID: traceID, Payload: map[string]interface{}{"addr": net.JoinHostPort(host, port)}})
+	dnsStart, dnsDone := tracecommon.DNSHooks(ctx, cfg.Emitter, "http2", traceID)
+	res, err := netutil.Dial(ctx, host, port, netutil.DialOptions{
+		Network:    "tcp",
+		Prefer:     cfg.IPPref,
+		OnDNSStart: dnsStart,
+		OnDNSDone:  dnsDone,
+		Resolver:   cfg.Resolver,
+		OnAttempt: func(a netutil.DialAttempt) {
+			tracecommon.EmitDialAttempt(ctx, cfg.Emitter, "http2", traceID, a)
+		},
+	})
+	if err != nil {
+		// resolution failures were already reported as dns_error
+		if !netutil.IsDNSError(err) {
+			tracecommon.EmitError(ctx, cfg.Emitter, "http2", "connect_error", traceID, err)
+		}
+		return nil, "", err
+	}
+	connID := uuid.NewString()
+	tags := tracecommon.BuildTags(res.IP, res.Resolved, res.Family)
+	tracecommon.EmitLifecycle(ctx, cfg.Emitter, "http2", "connect_done", traceID, connID, int64(time.Since(start)), tags, map[string]interface{}{"remote": res.Conn.RemoteAddr().String(), "local": res.Conn.LocalAddr().String()})
+	return res.Conn, connID, nil
+}
+
+// handshake runs the TLS handshake offering only h2 and fails unless the
+// server selects it.
+func handshake(ctx context.Context, conn net.Conn, host string, cfg *traceConfig, traceID, connID string) (net.Conn, error) {
+	var tcfg tlsinfo.Config
+	if cfg.TLS != nil {
+		tcfg = *cfg.TLS
+	}
+	tcfg.ALPN = []string{"h2"}
+	tc, err := tcfg.Build(host)
+	if err != nil {
+		tracecommon.EmitError(ctx, cfg.Emitter, "http2", "tls_config_error", traceID, err)
+		return nil, err
+	}
+	start := map[string]interface{}{"alpn_offered": tc.NextProtos}
+	if net.ParseIP(tc.ServerName) == nil {
+		start["server_name"] = tc.ServerName
+	}
+	tracecommon.EmitLifecycle(ctx, cfg.Emitter, "http2", "tls_handshake_start", traceID, connID, 0, nil, start)
+
+	began := time.Now()
+	tlsConn := tls.Client(conn, tc)
+	herr := tlsConn.HandshakeContext(ctx)
+	name := tc.ServerName
+	if name == "" {
+		name = host
+	}
+	payload := tlsinfo.Describe(tlsConn.ConnectionState(), herr, tlsinfo.Options{Host: name, ALPN: tc.NextProtos, Roots: tc.RootCAs})
+	tracecommon.EmitLifecycle(ctx, cfg.Emitter, "http2", "tls_handshake_done", traceID, connID, int64(time.Since(began)), nil, payload)
+	if herr != nil {
+		tracecommon.EmitError(ctx, cfg.Emitter, "http2", "tls_error", traceID, herr)
+		return nil, herr
+	}
+	if p := tlsConn.ConnectionState().NegotiatedProtocol; p != "h2" {
+		if p == "" {
+			p = "none"
+		}
+		err := fmt.Errorf("server did not negotiate h2 via ALPN (selected %s)", p)
+		tracecommon.EmitError(ctx, cfg.Emitter, "http2", "alpn_error", traceID, err)
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// requestHeaders builds the header list of the request: pseudo-headers
+// first, then the extra headers lower-cased, without connection-specific
+// fields HTTP/2 forbids.
+func requestHeaders(cfg *traceConfig, u *url.URL, method string) [][2]string {
+	h := [][2]string{{":method", method}, {":scheme", u.Scheme}, {":authority", u.Host}, {":path", u.RequestURI()}}
+	for k, vs := range cfg.Headers {
+		lk := strings.ToLower(k)
+		switch lk {
+		case "host", "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade", "te":
+			continue
+		}
+		for _, v := range vs {
+			h = append(h, [2]string{lk, v})
+		}
+	}
+	if len(cfg.Body) > 0 {
+		h = append(h, [2]string{"content-length", fmt.Sprint(len(cfg.Body))})
+	}
+	return h
+}
@@ -0,0 +1,86 @@
+package http2
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mrlm-net/tracer/pkg/event"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestCheckWindowSize(t *testing.T) {
+	for _, n := range []uint64{1, 65535, MaxWindowSize} {
+		if err := CheckWindowSize(n); err != nil {
+			t.Errorf("CheckWindowSize(%d): %v", n, err)
+		}
+	}
+	for _, n := range []uint64{0, MaxWindowSize + 1, 1 << 32} {
+		if err := CheckWindowSize(n); err == nil {
+			t.Errorf("CheckWindowSize(%d) accepted", n)
+		}
+	}
+}
+
+func TestTraceURLH2C(t *testing.T) {
+	const size = 100000
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+		w.Write([]byte(strings.Repeat("x", size)))
+	}), &http2.Server{}))
+	defer srv.Close()
+
+	be := event.NewBufferingEmitter()
+	err := TraceURL(context.Background(), srv.URL, WithEmitter(be), WithWindowSize(16384), WithHeaders(http.Header{"Authorization": {"Bearer secret"}}))
+	if err != nil {
+		t.Fatalf("TraceURL: %v", err)
+	}
+
+	counts := map[string]int{}
+	var body int
+	for _, e := range be.Events() {
+		counts[e.Stage]++
+		switch e.Stage {
+		case "preface_send":
+			if mode := e.Payload["mode"]; mode != "h2c" {
+				t.Errorf("preface_send mode = %v, want h2c", mode)
+			}
+		case "headers_send":
+			if h := e.Payload["headers"].(map[string][]string); h["authorization"][0] != "REDACTED" {
+				t.Errorf("headers_send authorization = %v, want REDACTED", h["authorization"])
+			}
+		case "headers_recv":
+			if h := e.Payload["headers"].(map[string][]string); h["set-cookie"][0] != "REDACTED" {
+				t.Errorf("headers_recv set-cookie = %v, want REDACTED", h["set-cookie"])
+			}
+		case "data_recv":
+			body += e.Payload["data_bytes"].(int)
+		case "response_end":
+			if n, _ := e.Payload["body_bytes"].(int64); n != size {
+				t.Errorf("response_end body_bytes = %v, want %d", n, size)
+			}
+		}
+	}
+	if body != size {
+		t.Errorf("data_recv carried %d bytes, want %d", body, size)
+	}
+	// a 16 KiB window has to be replenished for every DATA frame
+	for _, stage := range []string{"settings_recv", "settings_ack_send", "settings_ack_recv", "headers_recv", "window_update_send", "response_end", "request_end"} {
+		if counts[stage] == 0 {
+			t.Errorf("no %s event", stage)
+		}
+	}
+	if counts["window_update_send"] < 2 {
+		t.Errorf("window_update_send = %d, want the small window replenished", counts["window_update_send"])
+	}
+}
+
+func TestTraceURLRejectsWindowSize(t *testing.T) {
+	be := event.NewBufferingEmitter()
+	if err := TraceURL(context.Background(), "http://127.0.0.1:1/", WithEmitter(be), WithWindowSize(MaxWindowSize+1)); err == nil {
+		t.Fatal("TraceURL accepted a window larger than 2^31-1")
+	}
+}
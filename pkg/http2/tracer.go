@@ -0,0 +1,62 @@
+package http2
+
+import (
+	"context"
+
+	"github.com/mrlm-net/tracer/pkg/tracer"
+)
+
+func init() {
+	tracer.Register("http2", newTracer)
+}
+
+// TracerSettings are the http2 tracer's own options: Upgrade negotiates h2c
+// for http:// targets with an HTTP/1.1 Upgrade instead of prior knowledge,
+// and Window is the receive window advertised (0: the default).
+type TracerSettings struct {
+	Upgrade bool
+	Window  uint32
+}
+
+// Settings is the key of TracerSettings in tracer.Options.
+var Settings = tracer.NewKey[TracerSettings]("http2")
+
+// sharedOptions converts shared tracer options into TraceURL options.
+func sharedOptions(o tracer.Options) []Option {
+	s, _ := Settings.Get(o)
+	opts := []Option{WithEmitter(o.Emitter), WithDryRun(o.DryRun), WithIPPreference(o.IPPref), WithUpgrade(s.Upgrade)}
+	if o.Timeout > 0 {
+		opts = append(opts, WithTimeout(o.Timeout))
+	}
+	if o.Resolver != nil {
+		opts = append(opts, WithResolver(o.Resolver))
+	}
+	if o.Method != "" {
+		opts = append(opts, WithMethod(o.Method))
+	}
+	if len(o.Headers) > 0 {
+		opts = append(opts, WithHeaders(o.Headers))
+	}
+	if o.Data != "" {
+		opts = append(opts, WithBodyString(o.Data))
+	}
+	if o.TLS != nil {
+		opts = append(opts, WithTLSConfig(*o.TLS))
+	}
+	if s.Window > 0 {
+		opts = append(opts, WithWindowSize(s.Window))
+	}
+	opts = append(opts, WithRedactRequests(o.RedactRequests), WithRedactResponses(o.RedactResponses))
+	return opts
+}
+
+func newTracer(o tracer.Options) (tracer.Tracer, error) {
+	if s, _ := Settings.Get(o); s.Window > 0 {
+		if err := CheckWindowSize(uint64(s.Window)); err != nil {
+			return nil, err
+		}
+	}
+	return tracer.Func(func(ctx context.Context, target string) error {
+		return TraceURL(ctx, target, sharedOptions(o)...)
+	}), nil
+}
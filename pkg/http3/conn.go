@@ -0,0 +1,469 @@
+package http3
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mrlm-net/tracer/pkg/event"
+	"github.com/mrlm-net/tracer/pkg/tlsinfo"
+	"github.com/mrlm-net/tracer/pkg/tracecommon"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/qlog"
+	"github.com/quic-go/quic-go/qlogwriter"
+)
+
+// H3_NO_ERROR, used to close the connection once the trace is done.
+const h3NoError = 0x100
+
+// quicConn runs one QUIC connection and turns the qlog events quic-go
+// records for it into trace events. It is its own qlogwriter.Trace: quic-go
+// asks for a new trace when Version Negotiation restarts the dial, so the
+// per-attempt state is reset in tracer.
+type quicConn struct {
+	cfg     *traceConfig
+	traceID string
+	connID  string
+	addr    *net.UDPAddr
+	tls     *tls.Config
+	// warmup only handshakes and waits for a session ticket; early resumes
+	// the ticket with 0-RTT.
+	warmup bool
+	early  bool
+
+	ctx   context.Context
+	start time.Time
+
+	mu          sync.Mutex
+	closing     bool
+	initialAt   time.Time
+	sentInitial bool
+	recvInitial bool
+	initials    int
+	zeroRTT     int
+	peerParams  map[string]interface{}
+}
+
+// run dials, optionally migrates, sends the request to u (nil for the
+// warm-up connection) and closes the connection.
+func (c *quicConn) run(ctx context.Context, u *url.URL) error {
+	c.ctx = ctx
+	c.connID = uuid.NewString()
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		c.emit("error", "connect_error", 0, map[string]interface{}{"error": err.Error()})
+		return err
+	}
+	defer pc.Close()
+	tr := &quic.Transport{Conn: pc}
+	defer tr.Close()
+
+	offered := c.cfg.Versions
+	if len(offered) == 0 {
+		offered = quic.SupportedVersions()
+	}
+	c.emit("lifecycle", "connect_start", 0, map[string]interface{}{
+		"addr": c.addr.String(), "local": pc.LocalAddr().String(), "versions": versionStrings(offered), "warmup": c.warmup, "zero_rtt": c.early,
+	})
+
+	qconf := &quic.Config{Versions: c.cfg.Versions, Tracer: c.tracer}
+	c.start = time.Now()
+	var conn *quic.Conn
+	if c.early {
+		conn, err = tr.DialEarly(ctx, c.addr, c.tls, qconf)
+	} else {
+		conn, err = tr.Dial(ctx, c.addr, c.tls, qconf)
+	}
+	if err != nil {
+		payload := tlsinfo.Describe(tls.ConnectionState{}, err, c.tlsOptions())
+		payload["error"] = err.Error()
+		c.emit("error", "handshake_error", time.Since(c.start), payload)
+		return err
+	}
+	// with 0-RTT the dial returns before the handshake completes, so the
+	// request can be sent first
+	handshook := make(chan struct{})
+	go func() {
+		defer close(handshook)
+		select {
+		case <-conn.HandshakeComplete():
+			c.handshakeDone(conn)
+		case <-conn.Context().Done():
+		}
+	}()
+	defer func() { <-handshook }()
+	defer c.close(conn)
+	if !c.early {
+		<-handshook
+	}
+
+	if c.warmup {
+		c.awaitTicket(ctx)
+		return nil
+	}
+	if c.cfg.Migrate {
+		<-handshook
+		if closePath := c.migrate(ctx, conn); closePath != nil {
+			// the connection may now use the new path; close it first
+			defer func() {
+				c.close(conn)
+				closePath()
+			}()
+		}
+	}
+	return c.request(ctx, conn, u)
+}
+
+// handshakeDone reports the negotiated TLS and QUIC parameters.
+func (c *quicConn) handshakeDone(conn *quic.Conn) {
+	state := conn.ConnectionState()
+	payload := tlsinfo.Describe(state.TLS, nil, c.tlsOptions())
+	c.mu.Lock()
+	payload["quic_version"] = state.Version.String()
+	payload["used_0rtt"] = state.Used0RTT
+	payload["datagrams"] = state.SupportsDatagrams.Remote
+	payload["initial_packets_sent"] = c.initials
+	if c.peerParams != nil {
+		payload["transport_parameters"] = c.peerParams
+	}
+	zeroRTT := c.zeroRTT
+	c.mu.Unlock()
+	payload["local"] = conn.LocalAddr().String()
+	payload["remote"] = conn.RemoteAddr().String()
+	c.emit("lifecycle", "handshake_done", time.Since(c.start), payload)
+	if c.early {
+		c.emit("lifecycle", "zero_rtt", time.Since(c.start), map[string]interface{}{
+			"attempted": zeroRTT > 0, "accepted": state.Used0RTT, "packets_sent": zeroRTT,
+		})
+	}
+}
+
+// awaitTicket waits briefly for the NewSessionTicket the server sends after
+// the handshake; without one the next connection cannot use 0-RTT.
+func (c *quicConn) awaitTicket(ctx context.Context) {
+	cache, _ := c.tls.ClientSessionCache.(*ticketCache)
+	began := time.Now()
+	select {
+	case <-cache.stored:
+		c.emit("lifecycle", "session_ticket", time.Since(began), map[string]interface{}{"received": true})
+	case <-time.After(2 * time.Second):
+		c.emit("alert", "session_ticket", time.Since(began), map[string]interface{}{"received": false, "error": "no session ticket within 2s; the next connection uses a full handshake"})
+	case <-ctx.Done():
+	}
+}
+
+// migrate moves the connection to a new local UDP socket: the new path is
+// validated with PATH_CHALLENGE/PATH_RESPONSE, then used for all further
+// packets. A failed migration is reported and the old path kept. The
+// returned function closes the new transport and its socket.
+func (c *quicConn) migrate(ctx context.Context, conn *quic.Conn) func() {
+	from := conn.LocalAddr().String()
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		c.emit("error", "migration_error", 0, map[string]interface{}{"from": from, "error": err.Error()})
+		return nil
+	}
+	tr := &quic.Transport{Conn: pc}
+	// a Transport does not close a net.PacketConn it was given
+	closePath := func() {
+		tr.Close()
+		pc.Close()
+	}
+	to := pc.LocalAddr().String()
+	began := time.Now()
+	c.emit("lifecycle", "migration_start", 0, map[string]interface{}{"from": from, "to": to})
+	fail := func(step string, err error) func() {
+		c.emit("error", "migration_error", time.Since(began), map[string]interface{}{"from": from, "to": to, "step": step, "error": err.Error()})
+		return closePath
+	}
+	path, err := conn.AddPath(tr)
+	if err != nil {
+		return fail("add_path", err)
+	}
+	if err := path.Probe(ctx); err != nil {
+		return fail("probe", err)
+	}
+	c.emit("lifecycle", "path_validated", time.Since(began), map[string]interface{}{"local": to, "remote": conn.RemoteAddr().String()})
+	if err := path.Switch(); err != nil {
+		return fail("switch", err)
+	}
+	c.emit("lifecycle", "migration_done", time.Since(began), map[string]interface{}{"from": from, "to": to, "remote": conn.RemoteAddr().String()})
+	return closePath
+}
+
+// request sends the request on a new HTTP/3 client connection and reads the
+// whole response. A request rejected with 0-RTT is resent once the
+// handshake completes (zero_rtt then reports accepted false).
+func (c *quicConn) request(ctx context.Context, conn *quic.Conn, u *url.URL) error {
+	method := c.cfg.Method
+	if method == "" {
+		method = http.MethodGet
+		if len(c.cfg.Body) > 0 {
+			method = http.MethodPost
+		}
+	}
+	send := method
+	if c.early {
+		switch method {
+		case http.MethodGet:
+			send = http3.MethodGet0RTT
+		case http.MethodHead:
+			send = http3.MethodHead0RTT
+		}
+	}
+
+	cc := (&http3.Transport{}).NewClientConn(conn)
+	sent, resp, err := c.roundTrip(ctx, cc, conn, method, send, u, false)
+	if errors.Is(err, quic.Err0RTTRejected) {
+		if conn, err = conn.NextConnection(ctx); err == nil {
+			cc = (&http3.Transport{}).NewClientConn(conn)
+			sent, resp, err = c.roundTrip(ctx, cc, conn, method, method, u, true)
+		}
+	}
+	if err != nil {
+		c.emit("error", "request_error", time.Since(sent), map[string]interface{}{"error": err.Error()})
+		return err
+	}
+	defer resp.Body.Close()
+	c.emit("lifecycle", "response_headers", time.Since(sent), map[string]interface{}{
+		"status": resp.Status, "proto": resp.Proto, "headers": tracecommon.CopyHeaders(resp.Header, c.cfg.RedactResponses, false),
+	})
+
+	began := time.Now()
+	n, rerr := io.Copy(io.Discard, resp.Body)
+	payload := map[string]interface{}{"status": resp.Status, "body_bytes": n, "transfer_ns": int64(time.Since(began))}
+	if rerr != nil {
+		payload["read_error"] = rerr.Error()
+	}
+	st := conn.ConnectionStats()
+	payload["rtt_ns"] = int64(st.SmoothedRTT)
+	payload["min_rtt_ns"] = int64(st.MinRTT)
+	payload["packets_sent"] = st.PacketsSent
+	payload["packets_received"] = st.PacketsReceived
+	payload["packets_lost"] = st.PacketsLost
+	payload["bytes_sent"] = st.BytesSent
+	payload["bytes_received"] = st.BytesReceived
+	select {
+	case <-cc.ReceivedSettings():
+		s := cc.Settings()
+		payload["h3_settings"] = map[string]interface{}{"datagrams": s.EnableDatagrams, "extended_connect": s.EnableExtendedConnect, "other": s.Other}
+	default:
+	}
+	c.emit("lifecycle", "response_end", time.Since(sent), payload)
+	if rerr != nil {
+		return rerr
+	}
+	return nil
+}
+
+// roundTrip emits request_send and performs one request. send is the method
+// given to quic-go, which marks GET and HEAD requests allowed in 0-RTT.
+func (c *quicConn) roundTrip(ctx context.Context, cc *http3.ClientConn, conn *quic.Conn, method, send string, u *url.URL, retry bool) (time.Time, *http.Response, error) {
+	var body io.Reader
+	if len(c.cfg.Body) > 0 {
+		body = bytes.NewReader(c.cfg.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, send, u.String(), body)
+	if err != nil {
+		return time.Now(), nil, err
+	}
+	for k, vs := range c.cfg.Headers {
+		req.Header[k] = append([]string(nil), vs...)
+	}
+	early := false
+	select {
+	case <-conn.HandshakeComplete():
+	default:
+		early = send != method
+	}
+	payload := map[string]interface{}{"method": method, "url": u.String(), "headers": tracecommon.CopyHeaders(req.Header, c.cfg.RedactRequests, true), "early_data": early}
+	if len(c.cfg.Body) > 0 {
+		payload["body_size"] = len(c.cfg.Body)
+	}
+	if retry {
+		payload["retry"] = true
+	}
+	c.emit("lifecycle", "request_send", 0, payload)
+	sent := time.Now()
+	resp, err := cc.RoundTrip(req)
+	return sent, resp, err
+}
+
+// close closes the connection with H3_NO_ERROR; the resulting local close
+// is not reported.
+func (c *quicConn) close(conn *quic.Conn) {
+	c.mu.Lock()
+	c.closing = true
+	c.mu.Unlock()
+	conn.CloseWithError(h3NoError, "")
+}
+
+func (c *quicConn) tlsOptions() tlsinfo.Options {
+	return tlsinfo.Options{Host: c.tls.ServerName, ALPN: c.tls.NextProtos, Roots: c.tls.RootCAs}
+}
+
+func (c *quicConn) emit(kind, stage string, d time.Duration, payload map[string]interface{}) {
+	c.cfg.Emitter.Emit(c.ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "http3", EventType: kind, Stage: stage, TraceID: c.traceID, ConnID: c.connID, DurationNS: int64(d), Payload: payload})
+}
+
+// tracer is the quic.Config Tracer hook, called once per dial attempt.
+func (c *quicConn) tracer(context.Context, bool, quic.ConnectionID) qlogwriter.Trace {
+	c.mu.Lock()
+	c.sentInitial, c.recvInitial = false, false
+	c.mu.Unlock()
+	return c
+}
+
+func (c *quicConn) AddProducer() qlogwriter.Recorder { return recorder{c} }
+
+func (c *quicConn) SupportsSchemas(schema string) bool { return schema == qlog.EventSchema }
+
+// recorder receives the qlog events of the connection.
+type recorder struct{ c *quicConn }
+
+func (r recorder) Close() error { return nil }
+
+func (r recorder) RecordEvent(e qlogwriter.Event) {
+	c := r.c
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	emit := func(kind, stage string, d time.Duration, payload map[string]interface{}) {
+		c.mu.Unlock()
+		c.emit(kind, stage, d, payload)
+		c.mu.Lock()
+	}
+	switch ev := e.(type) {
+	case qlog.PacketSent:
+		switch ev.Header.PacketType {
+		case qlog.PacketTypeInitial:
+			c.initials++
+			if !c.sentInitial {
+				c.sentInitial = true
+				c.initialAt = now
+				p := headerPayload(ev.Header, ev.Raw)
+				p["token"] = ev.Header.Token != nil
+				emit("lifecycle", "initial_sent", now.Sub(c.start), p)
+			}
+		case qlog.PacketType0RTT:
+			c.zeroRTT++
+			if c.zeroRTT == 1 {
+				emit("lifecycle", "zero_rtt_sent", now.Sub(c.start), headerPayload(ev.Header, ev.Raw))
+			}
+		}
+	case qlog.PacketReceived:
+		switch ev.Header.PacketType {
+		case qlog.PacketTypeInitial:
+			if !c.recvInitial {
+				c.recvInitial = true
+				emit("lifecycle", "initial_recv", now.Sub(c.initialAt), headerPayload(ev.Header, ev.Raw))
+			}
+		case qlog.PacketTypeRetry:
+			p := headerPayload(ev.Header, ev.Raw)
+			if ev.Header.Token != nil {
+				p["token_bytes"] = len(ev.Header.Token.Raw)
+			}
+			emit("lifecycle", "retry_recv", now.Sub(c.initialAt), p)
+		case qlog.PacketType1RTT:
+			for _, f := range ev.Frames {
+				if _, ok := f.Frame.(*qlog.HandshakeDoneFrame); ok {
+					emit("lifecycle", "handshake_confirmed", now.Sub(c.start), map[string]interface{}{"packet_bytes": ev.Raw.Length})
+				}
+			}
+		}
+	case qlog.VersionNegotiationReceived:
+		offered := c.cfg.Versions
+		if len(offered) == 0 {
+			offered = quic.SupportedVersions()
+		}
+		emit("lifecycle", "version_negotiation", now.Sub(c.initialAt), map[string]interface{}{
+			"offered": versionStrings(offered), "server_versions": versionStrings(ev.SupportedVersions),
+		})
+	case qlog.ParametersSet:
+		if ev.Initiator == qlog.InitiatorRemote && !ev.Restore {
+			c.peerParams = map[string]interface{}{
+				"max_idle_timeout_ms":                 ev.MaxIdleTimeout.Milliseconds(),
+				"max_udp_payload_size":                ev.MaxUDPPayloadSize,
+				"initial_max_data":                    ev.InitialMaxData,
+				"initial_max_stream_data_bidi_local":  ev.InitialMaxStreamDataBidiLocal,
+				"initial_max_stream_data_bidi_remote": ev.InitialMaxStreamDataBidiRemote,
+				"initial_max_stream_data_uni":         ev.InitialMaxStreamDataUni,
+				"initial_max_streams_bidi":            ev.InitialMaxStreamsBidi,
+				"initial_max_streams_uni":             ev.InitialMaxStreamsUni,
+				"active_connection_id_limit":          ev.ActiveConnectionIDLimit,
+				"disable_active_migration":            ev.DisableActiveMigration,
+				"max_datagram_frame_size":             ev.MaxDatagramFrameSize,
+				"preferred_address":                   ev.PreferredAddress != nil,
+			}
+		}
+	case qlog.ConnectionClosed:
+		if c.closing && ev.Initiator == qlog.InitiatorLocal {
+			return
+		}
+		p := map[string]interface{}{"initiator": string(ev.Initiator)}
+		if ev.ConnectionError != nil {
+			p["transport_error"] = ev.ConnectionError.String()
+		}
+		if ev.ApplicationError != nil {
+			p["application_error"] = uint64(*ev.ApplicationError)
+		}
+		if ev.Reason != "" {
+			p["reason"] = ev.Reason
+		}
+		if ev.Trigger != "" {
+			p["trigger"] = string(ev.Trigger)
+		}
+		emit("lifecycle", "connection_closed", now.Sub(c.start), p)
+	}
+}
+
+// headerPayload describes a long-header packet.
+func headerPayload(h qlog.PacketHeader, raw qlog.RawInfo) map[string]interface{} {
+	p := map[string]interface{}{"packet_bytes": raw.Length, "packet_number": int64(h.PacketNumber)}
+	if h.Version != 0 {
+		p["version"] = h.Version.String()
+	}
+	if h.DestConnectionID.Len() > 0 {
+		p["dcid"] = h.DestConnectionID.String()
+	}
+	if h.SrcConnectionID.Len() > 0 {
+		p["scid"] = h.SrcConnectionID.String()
+	}
+	return p
+}
+
+func versionStrings(vs []quic.Version) []string {
+	out := make([]string, 0, len(vs))
+	for _, v := range vs {
+		out = append(out, v.String())
+	}
+	return out
+}
+
+// ticketCache is a single-entry session cache that signals when the server's
+// session ticket has been stored.
+type ticketCache struct {
+	tls.ClientSessionCache
+	once   sync.Once
+	stored chan struct{}
+}
+
+func newTicketCache() *ticketCache {
+	return &ticketCache{ClientSessionCache: tls.NewLRUClientSessionCache(1), stored: make(chan struct{})}
+}
+
+func (t *ticketCache) Put(key string, cs *tls.ClientSessionState) {
+	t.ClientSessionCache.Put(key, cs)
+	if cs != nil {
+		t.once.Do(func() { close(t.stored) })
+	}
+}
@@ -0,0 +1,332 @@
+package http3
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrlm-net/tracer/pkg/event"
+	"github.com/mrlm-net/tracer/pkg/netutil"
+	"github.com/mrlm-net/tracer/pkg/tlsinfo"
+	"github.com/mrlm-net/tracer/pkg/tracecommon"
+	"github.com/quic-go/quic-go"
+)
+
+type Option func(*traceConfig)
+
+type traceConfig struct {
+	Emitter event.Emitter
+	Dry     bool
+	Timeout time.Duration
+	Method  string
+	Body    []byte
+	Headers http.Header
+	IPPref  string
+	// Resolver selects the DNS server and static overrides used to dial.
+	Resolver *netutil.Resolver
+	// TLS configures the QUIC handshake; ALPN is always h3.
+	TLS *tlsinfo.Config
+	// Versions are the QUIC versions offered, most preferred first; empty
+	// uses the quic-go defaults (v1, v2).
+	Versions []quic.Version
+	// AltSvc discovers the HTTP/3 endpoint from the Alt-Svc header of an
+	// HTTP/1.1 or HTTP/2 request to the same URL first.
+	AltSvc bool
+	// ZeroRTT makes a first connection to obtain a session ticket, then
+	// resumes with 0-RTT and sends the request as early data.
+	ZeroRTT bool
+	// Migrate moves the connection to a new local UDP socket after the
+	// handshake, before the request is sent.
+	Migrate         bool
+	RedactRequests  bool
+	RedactResponses bool
+}
+
+// WithEmitter sets a custom emitter.
+func WithEmitter(e event.Emitter) Option { return func(c *traceConfig) { c.Emitter = e } }
+
+// WithDryRun enables dry-run mode.
+func WithDryRun(d bool) Option { return func(c *traceConfig) { c.Dry = d } }
+
+// WithTimeout bounds the whole trace, including Alt-Svc discovery and the
+// 0-RTT warm-up connection.
+func WithTimeout(d time.Duration) Option { return func(c *traceConfig) { c.Timeout = d } }
+
+// WithMethod sets the request method (default GET, or POST with a body).
+func WithMethod(m string) Option { return func(c *traceConfig) { c.Method = m } }
+
+// WithBodyString sets the request body.
+func WithBodyString(s string) Option { return func(c *traceConfig) { c.Body = []byte(s) } }
+
+// WithHeaders sets extra request headers.
+func WithHeaders(h http.Header) Option { return func(c *traceConfig) { c.Headers = h } }
+
+// WithIPPreference sets IP family preference: "v4", "v6" or ""/"auto".
+func WithIPPreference(p string) Option { return func(c *traceConfig) { c.IPPref = p } }
+
+// WithResolver sets the resolver used to dial (custom DNS server, DoT, DoH
+// or --resolve style overrides); nil uses the system resolver.
+func WithResolver(r *netutil.Resolver) Option { return func(c *traceConfig) { c.Resolver = r } }
+
+// WithTLSConfig sets the TLS client configuration of the QUIC handshake. The
+// ALPN list is replaced with h3.
+func WithTLSConfig(c tlsinfo.Config) Option { return func(cfg *traceConfig) { cfg.TLS = &c } }
+
+// WithVersions sets the QUIC versions to offer, most preferred first. A
+// version the server does not support makes it answer with a Version
+// Negotiation packet.
+func WithVersions(v ...quic.Version) Option { return func(c *traceConfig) { c.Versions = v } }
+
+// WithAltSvc discovers the HTTP/3 endpoint from the Alt-Svc header of an
+// HTTP/1.1 or HTTP/2 request, as a browser would.
+func WithAltSvc(v bool) Option { return func(c *traceConfig) { c.AltSvc = v } }
+
+// WithZeroRTT resumes a session from a warm-up connection and sends the
+// request in 0-RTT packets (GET and HEAD only).
+func WithZeroRTT(v bool) Option { return func(c *traceConfig) { c.ZeroRTT = v } }
+
+// WithMigration migrates the connection to a new local address after the
+// handshake.
+func WithMigration(v bool) Option { return func(c *traceConfig) { c.Migrate = v } }
+
+// WithRedactRequests controls redaction of request headers (authorization, cookie).
+func WithRedactRequests(v bool) Option { return func(c *traceConfig) { c.RedactRequests = v } }
+
+// WithRedactResponses controls redaction of response headers (set-cookie).
+func WithRedactResponses(v bool) Option { return func(c *traceConfig) { c.RedactResponses = v } }
+
+// ParseVersion parses a QUIC version: "v1", "v2" or the hex number of
+// either, such as 0x6b3343cf. Other versions are rejected because the QUIC
+// stack cannot offer them.
+func ParseVersion(s string) (quic.Version, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "v1", "1":
+		return quic.Version1, nil
+	case "v2", "2":
+		return quic.Version2, nil
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 0, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid QUIC version %q (want v1, v2 or a hex number)", s)
+	}
+	if v := quic.Version(n); slices.Contains(quic.SupportedVersions(), v) {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unsupported QUIC version %q (only v1 and v2 can be offered)", s)
+}
+
+// TraceURL sends one request to targetURL over HTTP/3 and emits QUIC
+// lifecycle events: the first Initial packet in each direction, Version
+// Negotiation and Retry, handshake completion and confirmation, 0-RTT use,
+// connection migration and the connection close.
+func TraceURL(ctx context.Context, targetURL string, opts ...Option) error {
+	cfg := &traceConfig{Timeout: 30 * time.Second, RedactRequests: true, RedactResponses: true}
+	for _, o := range opts {
+		o(cfg)
+	}
+
+	if cfg.Emitter == nil {
+		cfg.Emitter = event.NewStdoutEmitter(os.Stdout, true, true)
+	}
+
+	traceID := tracecommon.StartRequest(ctx, cfg.Emitter, "http3", targetURL)
+	if cfg.Dry {
+		tracecommon.EmitDryRun(ctx, cfg.Emitter, "http3", traceID)
+		return nil
+	}
+
+	u, err := url.Parse(targetURL)
+	if err == nil && u.Scheme != "https" {
+		err = fmt.Errorf("unsupported scheme %q (HTTP/3 needs https)", u.Scheme)
+	}
+	if err != nil {
+		tracecommon.EmitError(ctx, cfg.Emitter, "http3", "request_new", traceID, err)
+		return err
+	}
+
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+
+	var tcfg tlsinfo.Config
+	if cfg.TLS != nil {
+		tcfg = *cfg.TLS
+	}
+	tcfg.ALPN = []string{"h3"}
+	tc, err := tcfg.Build(u.Hostname())
+	if err != nil {
+		tracecommon.EmitError(ctx, cfg.Emitter, "http3", "tls_config_error", traceID, err)
+		return err
+	}
+
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "443"
+	}
+	if cfg.AltSvc {
+		if host, port, err = discover(ctx, cfg, u, tc, traceID); err != nil {
+			return err
+		}
+	}
+	ip, err := resolve(ctx, cfg, host, port, traceID)
+	if err != nil {
+		return err
+	}
+	addr := &net.UDPAddr{IP: ip, Port: atoiPort(port)}
+
+	if cfg.ZeroRTT {
+		tc.ClientSessionCache = newTicketCache()
+		warm := &quicConn{cfg: cfg, traceID: traceID, addr: addr, tls: tc, warmup: true}
+		if err := warm.run(ctx, nil); err != nil {
+			tracecommon.EmitLifecycle(ctx, cfg.Emitter, "http3", "request_end", traceID, "", 0, nil, nil)
+			return err
+		}
+	}
+	qc := &quicConn{cfg: cfg, traceID: traceID, addr: addr, tls: tc, early: cfg.ZeroRTT}
+	err = qc.run(ctx, u)
+	tracecommon.EmitLifecycle(ctx, cfg.Emitter, "http3", "request_end", traceID, qc.connID, 0, nil, nil)
+	return err
+}
+
+// resolve picks the address to send the Initial to: the first one of the
+// preferred family. QUIC has no Happy Eyeballs fallback here, so the choice
+// is visible in connect_start.
+func resolve(ctx context.Context, cfg *traceConfig, host, port, traceID string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+	dnsStart, dnsDone := tracecommon.DNSHooks(ctx, cfg.Emitter, "http3", traceID)
+	dnsStart(host)
+	ips, dr := cfg.Resolver.LookupIP(ctx, host, port)
+	dnsDone(dr)
+	if dr.Err != nil {
+		return nil, dr.Err
+	}
+	order := netutil.SortAddrs(ips, cfg.IPPref)
+	if len(order) == 0 {
+		err := fmt.Errorf("no addresses for %s", host)
+		tracecommon.EmitError(ctx, cfg.Emitter, "http3", "connect_error", traceID, err)
+		return nil, err
+	}
+	return order[0], nil
+}
+
+// altService is one alternative of an Alt-Svc header (RFC 7838).
+type altService struct {
+	Protocol string
+	Host     string
+	Port     string
+	MaxAge   int
+	Persist  bool
+}
+
+// parseAltSvc parses an Alt-Svc field value. Malformed alternatives are
+// skipped; "clear" yields none.
+func parseAltSvc(v string) []altService {
+	var out []altService
+	for _, alt := range strings.Split(v, ",") {
+		parts := strings.Split(alt, ";")
+		proto, authority, ok := strings.Cut(strings.TrimSpace(parts[0]), "=")
+		if !ok {
+			continue
+		}
+		host, port, err := net.SplitHostPort(strings.Trim(authority, `"`))
+		if err != nil {
+			continue
+		}
+		s := altService{Protocol: proto, Host: host, Port: port, MaxAge: 86400}
+		for _, p := range parts[1:] {
+			k, val, _ := strings.Cut(strings.TrimSpace(p), "=")
+			val = strings.Trim(val, `"`)
+			switch k {
+			case "ma":
+				if n, err := strconv.Atoi(val); err == nil {
+					s.MaxAge = n
+				}
+			case "persist":
+				s.Persist = val == "1"
+			}
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// discover sends the request over HTTP/1.1 or HTTP/2 and returns the
+// endpoint of the first h3 alternative in its Alt-Svc header. An empty
+// alternative host means the origin's host.
+func discover(ctx context.Context, cfg *traceConfig, u *url.URL, tc *tls.Config, traceID string) (string, string, error) {
+	hc := tc.Clone()
+	hc.NextProtos = []string{"h2", "http/1.1"}
+	tr := &http.Transport{
+		TLSClientConfig:   hc,
+		ForceAttemptHTTP2: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			res, err := netutil.Dial(ctx, host, port, netutil.DialOptions{Network: network, Prefer: cfg.IPPref, Resolver: cfg.Resolver})
+			if err != nil {
+				return nil, err
+			}
+			return res.Conn, nil
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		tracecommon.EmitError(ctx, cfg.Emitter, "http3", "alt_svc_error", traceID, err)
+		return "", "", err
+	}
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		tracecommon.EmitError(ctx, cfg.Emitter, "http3", "alt_svc_error", traceID, err)
+		return "", "", err
+	}
+	resp.Body.Close()
+
+	raw := resp.Header.Values("Alt-Svc")
+	var services []map[string]interface{}
+	var selected *altService
+	for _, v := range raw {
+		for _, s := range parseAltSvc(v) {
+			services = append(services, map[string]interface{}{"protocol": s.Protocol, "host": s.Host, "port": s.Port, "max_age": s.MaxAge, "persist": s.Persist})
+			if selected == nil && s.Protocol == "h3" {
+				selected = &s
+			}
+		}
+	}
+	payload := map[string]interface{}{"url": u.String(), "proto": resp.Proto, "status": resp.Status, "alt_svc": raw, "services": services}
+	if selected == nil {
+		err := errors.New("no h3 alternative in the Alt-Svc header")
+		payload["error"] = err.Error()
+		cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "http3", EventType: "error", Stage: "alt_svc_error", TraceID: traceID, DurationNS: int64(time.Since(start)), Payload: payload})
+		return "", "", err
+	}
+	host := selected.Host
+	if host == "" {
+		host = u.Hostname()
+	}
+	payload["selected"] = net.JoinHostPort(host, selected.Port)
+	tracecommon.EmitLifecycle(ctx, cfg.Emitter, "http3", "alt_svc", traceID, "", int64(time.Since(start)), nil, payload)
+	return host, selected.Port, nil
+}
+
+func atoiPort(p string) int {
+	n, _ := strconv.Atoi(p)
+	return n
+}
@@ -0,0 +1,109 @@
+package http3
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrlm-net/tracer/pkg/event"
+	"github.com/mrlm-net/tracer/pkg/tlsinfo"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    quic.Version
+		wantErr bool
+	}{
+		{in: "v1", want: quic.Version1},
+		{in: " V2 ", want: quic.Version2},
+		{in: "1", want: quic.Version1},
+		{in: "0x1", want: quic.Version1},
+		{in: "0x6b3343cf", want: quic.Version2},
+		// draft-29 and reserved versions cannot be offered
+		{in: "0xff00001d", wantErr: true},
+		{in: "0x1a2a3a4a", wantErr: true},
+		{in: "0", wantErr: true},
+		{in: "v3", wantErr: true},
+		{in: "0x100000000", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseVersion(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseVersion(%q) = %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseVersion(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+// serveH3 starts an HTTP/3 server on a loopback UDP port and returns its URL
+// and a CA file trusting its certificate.
+func serveH3(t *testing.T, h http.Handler) (string, string) {
+	t.Helper()
+	ts := httptest.NewTLSServer(h)
+	t.Cleanup(ts.Close)
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := quic.ListenAddrEarly("127.0.0.1:0", http3.ConfigureTLSConfig(&tls.Config{Certificates: ts.TLS.Certificates}), &quic.Config{})
+	if err != nil {
+		t.Skipf("listen: %v", err)
+	}
+	srv := &http3.Server{Handler: h}
+	go srv.ServeListener(ln)
+	t.Cleanup(func() { srv.Close() })
+	return "https://" + ln.Addr().String() + "/", ca
+}
+
+func TestTraceURLMigration(t *testing.T) {
+	url, ca := serveH3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+		io.WriteString(w, "hello "+r.Proto)
+	}))
+
+	be := event.NewBufferingEmitter()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := TraceURL(ctx, url, WithEmitter(be), WithTLSConfig(tlsinfo.Config{CAFile: ca}), WithMigration(true), WithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("TraceURL: %v", err)
+	}
+
+	seen := map[string]bool{}
+	for _, e := range be.Events() {
+		if e.EventType == "error" {
+			t.Errorf("error event %s: %v", e.Stage, e.Payload)
+		}
+		seen[e.Stage] = true
+		switch e.Stage {
+		case "handshake_done":
+			if v := e.Payload["quic_version"]; v != quic.Version1.String() {
+				t.Errorf("handshake_done quic_version = %v, want %v", v, quic.Version1)
+			}
+		case "response_headers":
+			if h := e.Payload["headers"].(map[string][]string); h["Set-Cookie"][0] != "REDACTED" {
+				t.Errorf("response_headers Set-Cookie = %v, want REDACTED", h["Set-Cookie"])
+			}
+		}
+	}
+	for _, stage := range []string{"connect_start", "initial_sent", "initial_recv", "handshake_done", "migration_start", "path_validated", "migration_done", "response_headers", "response_end", "request_end"} {
+		if !seen[stage] {
+			t.Errorf("no %s event", stage)
+		}
+	}
+}
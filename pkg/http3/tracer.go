@@ -0,0 +1,70 @@
+package http3
+
+import (
+	"context"
+
+	"github.com/mrlm-net/tracer/pkg/tracer"
+	"github.com/quic-go/quic-go"
+)
+
+func init() {
+	tracer.Register("http3", newTracer)
+}
+
+// TracerSettings are the http3 tracer's own options: Alt-Svc discovery,
+// 0-RTT resumption, connection migration after the handshake and the QUIC
+// versions offered ("v1", "v2" or hex), most preferred first.
+type TracerSettings struct {
+	AltSvc   bool
+	ZeroRTT  bool
+	Migrate  bool
+	Versions []string
+}
+
+// Settings is the key of TracerSettings in tracer.Options.
+var Settings = tracer.NewKey[TracerSettings]("http3")
+
+// sharedOptions converts shared tracer options into TraceURL options.
+func sharedOptions(o tracer.Options, versions []quic.Version) []Option {
+	s, _ := Settings.Get(o)
+	opts := []Option{WithEmitter(o.Emitter), WithDryRun(o.DryRun), WithIPPreference(o.IPPref), WithAltSvc(s.AltSvc), WithZeroRTT(s.ZeroRTT), WithMigration(s.Migrate)}
+	if o.Timeout > 0 {
+		opts = append(opts, WithTimeout(o.Timeout))
+	}
+	if o.Resolver != nil {
+		opts = append(opts, WithResolver(o.Resolver))
+	}
+	if o.Method != "" {
+		opts = append(opts, WithMethod(o.Method))
+	}
+	if len(o.Headers) > 0 {
+		opts = append(opts, WithHeaders(o.Headers))
+	}
+	if o.Data != "" {
+		opts = append(opts, WithBodyString(o.Data))
+	}
+	if o.TLS != nil {
+		opts = append(opts, WithTLSConfig(*o.TLS))
+	}
+	if len(versions) > 0 {
+		opts = append(opts, WithVersions(versions...))
+	}
+	opts = append(opts, WithRedactRequests(o.RedactRequests), WithRedactResponses(o.RedactResponses))
+	return opts
+}
+
+// newTracer rejects unknown QUIC versions before any trace starts.
+func newTracer(o tracer.Options) (tracer.Tracer, error) {
+	var versions []quic.Version
+	settings, _ := Settings.Get(o)
+	for _, s := range settings.Versions {
+		v, err := ParseVersion(s)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return tracer.Func(func(ctx context.Context, target string) error {
+		return TraceURL(ctx, target, sharedOptions(o, versions)...)
+	}), nil
+}
@@ -0,0 +1,103 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrlm-net/tracer/pkg/event"
+)
+
+func TestParseThreshold(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Threshold
+		wantErr bool
+	}{
+		{in: "tls_handshake_done > 200ms", want: Threshold{Stage: "tls_handshake_done", Op: ">", Duration: 200 * time.Millisecond}},
+		{in: "total>=1s", want: Threshold{Stage: "total", Op: ">=", Duration: time.Second}},
+		{in: "first_byte=50ms", want: Threshold{Stage: "first_byte", Op: "==", Duration: 50 * time.Millisecond}},
+		{in: "status!=200", want: Threshold{Stage: "status", Op: "!=", Status: 200}},
+		{in: "status != 2xx", want: Threshold{Stage: "status", Op: "!=", Status: 2, StatusClass: true}},
+		// stages are not checked against a list; Watch reports those that never occur
+		{in: "alt_svc > 200ms", want: Threshold{Stage: "alt_svc", Op: ">", Duration: 200 * time.Millisecond}},
+		{in: "tls_handshake>200ms", want: Threshold{Stage: "tls_handshake", Op: ">", Duration: 200 * time.Millisecond}},
+		{in: "connect_done>fast", wantErr: true},
+		{in: "status==ok", wantErr: true},
+		{in: "total>", wantErr: true},
+		{in: ">1s", wantErr: true},
+		{in: "total 1s", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseThreshold(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseThreshold(%q) = %+v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseThreshold(%q): %v", tt.in, err)
+			continue
+		}
+		got.Raw = ""
+		if got != tt.want {
+			t.Errorf("ParseThreshold(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestWatchLastCheckFailed(t *testing.T) {
+	results := []error{nil, nil, errors.New("refused")}
+	check := 0
+	run := func(ctx context.Context, em event.Emitter) error {
+		err := results[check]
+		check++
+		return err
+	}
+	err := Watch(context.Background(), run, WithEmitter(event.NewBufferingEmitter()), WithInterval(time.Millisecond), WithChecks(len(results)))
+	if !errors.Is(err, ErrLastCheckFailed) {
+		t.Fatalf("Watch = %v, want ErrLastCheckFailed", err)
+	}
+
+	results, check = []error{errors.New("refused"), nil}, 0
+	if err := Watch(context.Background(), run, WithEmitter(event.NewBufferingEmitter()), WithInterval(time.Millisecond), WithChecks(len(results))); err != nil {
+		t.Fatalf("Watch after recovery = %v, want nil", err)
+	}
+}
+
+func TestWatchUnmatchedThreshold(t *testing.T) {
+	run := func(ctx context.Context, em event.Emitter) error {
+		em.Emit(ctx, event.Event{EventType: "lifecycle", Stage: "alt_svc", DurationNS: int64(300 * time.Millisecond)})
+		return nil
+	}
+	var rules []Threshold
+	for _, s := range []string{"alt_svc>200ms", "tls_handshake>200ms"} {
+		r, err := ParseThreshold(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+	be := event.NewBufferingEmitter()
+	err := Watch(context.Background(), run, WithEmitter(be), WithInterval(time.Millisecond), WithChecks(2), WithMaxFailures(0), WithThresholds(rules...))
+	if !errors.Is(err, ErrLastCheckFailed) {
+		t.Errorf("Watch = %v, want ErrLastCheckFailed", err)
+	}
+	var alerts []string
+	for _, e := range be.Events() {
+		if e.EventType == "alert" {
+			alerts = append(alerts, e.Stage+" "+e.Payload["rule"].(string))
+		}
+	}
+	want := []string{
+		"threshold_unmatched tls_handshake>200ms",
+		"threshold_violated alt_svc>200ms",
+		"threshold_violated alt_svc>200ms",
+	}
+	if strings.Join(alerts, "\n") != strings.Join(want, "\n") {
+		t.Errorf("alerts:\n%s\nwant:\n%s", strings.Join(alerts, "\n"), strings.Join(want, "\n"))
+	}
+}
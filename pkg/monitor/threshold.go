@@ -0,0 +1,152 @@
+package monitor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrlm-net/tracer/pkg/bench"
+	"github.com/mrlm-net/tracer/pkg/event"
+)
+
+// operators in match order; two-character operators must precede their prefixes.
+var operators = []string{">=", "<=", "!=", "==", ">", "<", "="}
+
+// Threshold is a single check rule describing a failure condition, such as
+// "tls_handshake_done > 200ms" or "status != 200".
+type Threshold struct {
+	// Raw is the rule as written by the user.
+	Raw string
+	// Stage is a lifecycle stage name (e.g. connect_done), a bench stage alias
+	// (dns, connect, tls, first_byte, total) or "status".
+	Stage string
+	Op    string
+	// Duration is the limit for stage rules.
+	Duration time.Duration
+	// Status is the expected HTTP status code for status rules. When
+	// StatusClass is true only the class (Status/100, e.g. 2 for "2xx") is compared.
+	Status      int
+	StatusClass bool
+}
+
+// ParseThreshold parses a rule of the form "<stage><op><value>". Whitespace
+// around the operator is optional. Any stage name is accepted, since tracers
+// may emit stages of their own; Watch reports rules whose stage never occurs.
+func ParseThreshold(s string) (Threshold, error) {
+	raw := strings.TrimSpace(s)
+	for _, op := range operators {
+		i := strings.Index(raw, op)
+		if i <= 0 {
+			continue
+		}
+		t := Threshold{Raw: raw, Stage: strings.TrimSpace(raw[:i]), Op: op}
+		if op == "=" {
+			t.Op = "=="
+		}
+		val := strings.TrimSpace(raw[i+len(op):])
+		if val == "" {
+			return Threshold{}, fmt.Errorf("threshold %q: missing value", s)
+		}
+		if t.Stage == "status" {
+			if len(val) == 3 && strings.HasSuffix(strings.ToLower(val), "xx") {
+				c, err := strconv.Atoi(val[:1])
+				if err != nil {
+					return Threshold{}, fmt.Errorf("threshold %q: invalid status class %q", s, val)
+				}
+				t.Status, t.StatusClass = c, true
+				return t, nil
+			}
+			code, err := strconv.Atoi(val)
+			if err != nil {
+				return Threshold{}, fmt.Errorf("threshold %q: invalid status %q", s, val)
+			}
+			t.Status = code
+			return t, nil
+		}
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return Threshold{}, fmt.Errorf("threshold %q: invalid duration %q", s, val)
+		}
+		t.Duration = d
+		return t, nil
+	}
+	return Threshold{}, fmt.Errorf("threshold %q: expected <stage><op><value> with op one of > >= < <= == !=", s)
+}
+
+// Evaluate checks the rule against the events of one trace and its wall-clock
+// duration. found is false when the trace has no value for the rule (e.g. no
+// TLS stage on a plain HTTP URL); such rules are not considered violated.
+func (t Threshold) Evaluate(events []event.Event, total time.Duration) (violated bool, observed string, found bool) {
+	if t.Stage == "status" {
+		code, ok := statusCode(events)
+		if !ok {
+			return false, "", false
+		}
+		got := code
+		if t.StatusClass {
+			got = code / 100
+		}
+		return compare(int64(got), t.Op, int64(t.Status)), strconv.Itoa(code), true
+	}
+
+	d, ok := stageDuration(events, t.Stage, total)
+	if !ok {
+		return false, "", false
+	}
+	return compare(int64(d), t.Op, int64(t.Duration)), d.String(), true
+}
+
+// compare reports whether "got op want" holds.
+func compare(got int64, op string, want int64) bool {
+	switch op {
+	case ">":
+		return got > want
+	case ">=":
+		return got >= want
+	case "<":
+		return got < want
+	case "<=":
+		return got <= want
+	case "==":
+		return got == want
+	case "!=":
+		return got != want
+	}
+	return false
+}
+
+// stageDuration returns the duration of the first lifecycle event for stage,
+// resolving bench aliases (dns, connect, ...) and "total".
+func stageDuration(events []event.Event, stage string, total time.Duration) (time.Duration, bool) {
+	if stage == "total" {
+		return total, true
+	}
+	if ev, ok := bench.StageEvents[stage]; ok {
+		stage = ev
+	}
+	for _, e := range events {
+		if e.EventType == "lifecycle" && e.Stage == stage && e.DurationNS > 0 {
+			return time.Duration(e.DurationNS), true
+		}
+	}
+	return 0, false
+}
+
+// statusCode extracts the final HTTP status code from response events.
+func statusCode(events []event.Event) (int, bool) {
+	code, found := 0, false
+	for _, e := range events {
+		if e.Stage != "response_end" && e.Stage != "response_headers" {
+			continue
+		}
+		s, ok := e.Payload["status"].(string)
+		if !ok || len(s) < 3 {
+			continue
+		}
+		if c, err := strconv.Atoi(s[:3]); err == nil {
+			code, found = c, true
+		}
+	}
+	return code, found
+}
@@ -0,0 +1,168 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mrlm-net/tracer/pkg/bench"
+	"github.com/mrlm-net/tracer/pkg/event"
+)
+
+// ErrMaxFailures is returned by Watch after MaxFailures consecutive failed checks.
+var ErrMaxFailures = errors.New("maximum consecutive failures reached")
+
+// ErrLastCheckFailed is returned by Watch when it stops after Checks checks
+// and the last one failed.
+var ErrLastCheckFailed = errors.New("last check failed")
+
+type Option func(*watchConfig)
+
+type watchConfig struct {
+	Emitter     event.Emitter
+	Interval    time.Duration
+	Thresholds  []Threshold
+	MaxFailures int
+	// Checks limits the number of checks; 0 runs until ctx is cancelled.
+	Checks int
+	// ForwardEvents passes each check's trace events to Emitter.
+	ForwardEvents bool
+}
+
+// WithEmitter sets the emitter receiving check and alert events.
+func WithEmitter(e event.Emitter) Option { return func(c *watchConfig) { c.Emitter = e } }
+
+// WithInterval sets the delay between check starts (default 10s).
+func WithInterval(d time.Duration) Option { return func(c *watchConfig) { c.Interval = d } }
+
+// WithThresholds sets the rules evaluated after every check.
+func WithThresholds(t ...Threshold) Option {
+	return func(c *watchConfig) { c.Thresholds = append(c.Thresholds, t...) }
+}
+
+// WithMaxFailures sets how many consecutive failed checks end the watch with
+// ErrMaxFailures (default 3; 0 never gives up).
+func WithMaxFailures(n int) Option { return func(c *watchConfig) { c.MaxFailures = n } }
+
+// WithChecks limits the number of checks (default 0: unlimited).
+func WithChecks(n int) Option { return func(c *watchConfig) { c.Checks = n } }
+
+// WithForwardEvents forwards every trace event of each check to the emitter.
+func WithForwardEvents(v bool) Option { return func(c *watchConfig) { c.ForwardEvents = v } }
+
+// Watch runs run every Interval and evaluates the configured thresholds. A
+// check fails when the trace returns an error or any threshold is violated;
+// each failure emits an "alert" event. Watch returns ErrMaxFailures after
+// MaxFailures consecutive failures, or ctx.Err() when cancelled. After Checks
+// checks it returns ErrLastCheckFailed when the last check failed, else nil.
+func Watch(ctx context.Context, run bench.RunFunc, opts ...Option) error {
+	cfg := &watchConfig{Interval: 10 * time.Second, MaxFailures: 3}
+	for _, o := range opts {
+		o(cfg)
+	}
+	if cfg.Emitter == nil {
+		cfg.Emitter = event.NewStdoutEmitter(os.Stdout, true, true)
+	}
+
+	watchID := uuid.NewString()
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	consecutive := 0
+	// rules whose stage or status occurred in a check, or that were reported
+	// as unmatched
+	matched := make([]bool, len(cfg.Thresholds))
+	for check := 1; cfg.Checks == 0 || check <= cfg.Checks; check++ {
+		if check > 1 {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		be := event.NewBufferingEmitter()
+		start := time.Now()
+		err := run(ctx, be)
+		total := time.Since(start)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		events := be.Events()
+		protocol := ""
+		if len(events) > 0 {
+			protocol = events[0].Protocol
+		}
+		if cfg.ForwardEvents {
+			for _, e := range events {
+				cfg.Emitter.Emit(ctx, e)
+			}
+		}
+
+		var violations, unmatched []map[string]interface{}
+		for i, t := range cfg.Thresholds {
+			violated, observed, found := t.Evaluate(events, total)
+			if found && violated {
+				violations = append(violations, map[string]interface{}{"rule": t.Raw, "observed": observed})
+			}
+			// a misspelt stage or one this tracer does not emit is reported
+			// once, after the first successful trace without it
+			if !matched[i] && (found || err == nil) {
+				matched[i] = true
+				if !found {
+					unmatched = append(unmatched, map[string]interface{}{"rule": t.Raw, "stage": t.Stage})
+				}
+			}
+		}
+		ok := err == nil && len(violations) == 0
+		if ok {
+			if consecutive > 0 {
+				emitAlert(ctx, cfg.Emitter, protocol, "recovered", watchID, map[string]interface{}{"check": check, "after_failures": consecutive})
+			}
+			consecutive = 0
+		} else {
+			consecutive++
+		}
+
+		payload := map[string]interface{}{"check": check, "ok": ok, "consecutive_failures": consecutive}
+		for _, stage := range bench.Stages {
+			if d, found := stageDuration(events, stage, total); found {
+				payload[stage+"_ns"] = int64(d)
+			}
+		}
+		if code, found := statusCode(events); found {
+			payload["status"] = code
+		}
+		cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: protocol, EventType: "metric", Stage: "check", TraceID: watchID, DurationNS: int64(total), Payload: payload})
+
+		for _, u := range unmatched {
+			u["check"] = check
+			emitAlert(ctx, cfg.Emitter, protocol, "threshold_unmatched", watchID, u)
+		}
+		if err != nil {
+			emitAlert(ctx, cfg.Emitter, protocol, "trace_failed", watchID, map[string]interface{}{"check": check, "error": err.Error(), "consecutive_failures": consecutive})
+		}
+		for _, v := range violations {
+			v["check"] = check
+			v["consecutive_failures"] = consecutive
+			emitAlert(ctx, cfg.Emitter, protocol, "threshold_violated", watchID, v)
+		}
+
+		if cfg.MaxFailures > 0 && consecutive >= cfg.MaxFailures {
+			emitAlert(ctx, cfg.Emitter, protocol, "max_failures", watchID, map[string]interface{}{"check": check, "consecutive_failures": consecutive})
+			return fmt.Errorf("%w (%d)", ErrMaxFailures, consecutive)
+		}
+	}
+	if consecutive > 0 {
+		return fmt.Errorf("%w (%d consecutive failures)", ErrLastCheckFailed, consecutive)
+	}
+	return nil
+}
+
+func emitAlert(ctx context.Context, em event.Emitter, protocol, stage, watchID string, payload map[string]interface{}) {
+	em.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: protocol, EventType: "alert", Stage: stage, TraceID: watchID, Payload: payload})
+}
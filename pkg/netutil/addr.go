@@ -2,7 +2,9 @@ package netutil
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"net/url"
 	"strings"
 	"time"
 )
@@ -65,84 +67,43 @@ func IsIPv6(ip net.IP) bool {
 	return ip.To4() == nil
 }
 
-// ResolveAndDial resolves host (if hostname) and attempts to dial in family-preferred order.
-// networkBase is "tcp" or "udp". prefer can be "v4", "v6" or ""/"auto".
-// Returns established connection, chosen IP, list of resolved IPs, chosen family ("v4"/"v6"), or error.
+// ResolveAndDial resolves host (if hostname) and dials it with Happy Eyeballs
+// (see Dial). networkBase is "tcp" or "udp". prefer can be "v4", "v6" or
+// ""/"auto". Returns established connection, chosen IP, list of resolved IPs,
+// chosen family ("v4"/"v6"), or error; a *DialError lists every failed attempt.
 func ResolveAndDial(ctx context.Context, networkBase, host, port, prefer string, timeout time.Duration) (net.Conn, net.IP, []net.IP, string, error) {
-	// If host is an IP literal, dial directly with appropriate family.
-	if ip := net.ParseIP(host); ip != nil {
-		var network string
-		family := "v4"
-		if IsIPv4(ip) {
-			network = networkBase + "4"
-			family = "v4"
-		} else {
-			network = networkBase + "6"
-			family = "v6"
-		}
-		d := &net.Dialer{Timeout: timeout}
-		conn, err := d.DialContext(ctx, network, net.JoinHostPort(host, port))
-		return conn, ip, nil, family, err
-	}
-
-	// Otherwise resolve via DNS
-	var resolved []net.IP
-	// Use the default resolver
-	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	res, err := Dial(ctx, host, port, DialOptions{Network: networkBase, Prefer: prefer, Timeout: timeout})
 	if err != nil {
 		return nil, nil, nil, "", err
 	}
-	resolved = append(resolved, ips...)
-
-	// Partition addresses
-	var v4s, v6s []net.IP
-	for _, ip := range resolved {
-		if IsIPv4(ip) {
-			v4s = append(v4s, ip)
-		} else {
-			v6s = append(v6s, ip)
-		}
-	}
-
-	order := make([]net.IP, 0, len(resolved))
-	pref := strings.ToLower(prefer)
-	if pref == "v6" {
-		order = append(order, v6s...)
-		order = append(order, v4s...)
-	} else if pref == "v4" {
-		order = append(order, v4s...)
-		order = append(order, v6s...)
-	} else {
-		// default: use returned order (platform resolver ordering)
-		order = append(order, resolved...)
-	}
-
-	// Dial attempts: keep per-attempt timeout small to avoid long serial waits.
-	perAttempt := 5 * time.Second
-	if timeout > 0 && timeout < perAttempt {
-		perAttempt = timeout
-	}
+	return res.Conn, res.IP, res.Resolved, res.Family, nil
+}
 
-	for _, ip := range order {
-		var network string
-		family := "v4"
-		if IsIPv4(ip) {
-			network = networkBase + "4"
-			family = "v4"
-		} else {
-			network = networkBase + "6"
-			family = "v6"
+// TargetToAddr normalizes a target (URL or host:port) into host:port for tcp/udp.
+// For URLs without an explicit port the port is inferred from http/https schemes.
+// tracerType is only used to produce a descriptive error message.
+func TargetToAddr(target, tracerType string) (string, error) {
+	addr := target
+	if strings.Contains(target, "://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return "", fmt.Errorf("invalid target %q: %w", target, err)
 		}
-		addr := net.JoinHostPort(ip.String(), port)
-		d := &net.Dialer{Timeout: perAttempt}
-		cctx, cancel := context.WithTimeout(ctx, perAttempt)
-		conn, derr := d.DialContext(cctx, network, addr)
-		cancel()
-		if derr == nil {
-			return conn, ip, resolved, family, nil
+		host := u.Hostname()
+		port := u.Port()
+		if port == "" {
+			switch u.Scheme {
+			case "http":
+				port = "80"
+			case "https":
+				port = "443"
+			default:
+				return "", fmt.Errorf("no port in target %q and unknown scheme %q", target, u.Scheme)
+			}
 		}
-		// otherwise try next
+		addr = net.JoinHostPort(host, port)
+	} else if !strings.Contains(target, ":") {
+		return "", fmt.Errorf("%s tracer target must be host:port or a URL with scheme", tracerType)
 	}
-
-	return nil, nil, resolved, "", context.DeadlineExceeded
+	return addr, nil
 }
@@ -0,0 +1,287 @@
+package netutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// DefaultAttemptDelay is the Happy Eyeballs "connection attempt delay"
+// recommended by RFC 8305 section 5.
+const DefaultAttemptDelay = 250 * time.Millisecond
+
+// DialAttempt describes one connection attempt made by Dial.
+type DialAttempt struct {
+	// Index is the position of the address in the attempt order.
+	Index   int
+	IP      net.IP
+	Family  string
+	Network string
+	Addr    string
+	Start   time.Time
+	// Duration is the time from starting the attempt until it finished.
+	Duration time.Duration
+	Err      error
+	// Won is true for the attempt whose connection was returned.
+	Won bool
+	// Canceled is true when the attempt was abandoned because another
+	// attempt won or the overall dial was cancelled.
+	Canceled bool
+}
+
+// DialOptions configure Dial.
+type DialOptions struct {
+	// Network is "tcp" or "udp".
+	Network string
+	// Prefer is the IP family tried first: "v4", "v6" or ""/"auto" (the
+	// family of the first resolved address).
+	Prefer string
+	// Timeout bounds the whole dial including every attempt (0: no limit
+	// besides ctx).
+	Timeout time.Duration
+	// AttemptDelay is how long an attempt runs before the next address is
+	// raced against it (default DefaultAttemptDelay).
+	AttemptDelay time.Duration
+	// OnAttempt, if set, is called from Dial's goroutine as each attempt
+	// finishes, including cancelled losers.
+	OnAttempt func(DialAttempt)
+	// OnDNSStart and OnDNSDone, if set, are called around hostname
+	// resolution; they are not called for IP literals.
+	OnDNSStart func(host string)
+	OnDNSDone  func(DNSResult)
+	// Resolver selects the DNS server and static overrides; nil uses the
+	// system resolver.
+	Resolver *Resolver
+}
+
+// DialResult is a successful Dial.
+type DialResult struct {
+	Conn net.Conn
+	// IP and Family identify the winning address.
+	IP     net.IP
+	Family string
+	// Resolved lists the addresses returned by DNS (nil for IP literals).
+	Resolved []net.IP
+	Attempts []DialAttempt
+}
+
+// DialError is returned when every attempt failed. It lists each attempt so
+// callers can see which addresses were tried and why they failed.
+type DialError struct {
+	Host     string
+	Attempts []DialAttempt
+	// Err is set when dialing stopped before any attempt finished, e.g.
+	// because resolution returned no addresses.
+	Err error
+}
+
+func (e *DialError) Error() string {
+	if len(e.Attempts) == 0 {
+		return fmt.Sprintf("dial %s: %v", e.Host, e.Err)
+	}
+	parts := make([]string, 0, len(e.Attempts))
+	for _, a := range e.Attempts {
+		parts = append(parts, fmt.Sprintf("%s (%s): %v", a.Addr, a.Family, a.Err))
+	}
+	return fmt.Sprintf("dial %s: all %d attempts failed: %s", e.Host, len(e.Attempts), strings.Join(parts, "; "))
+}
+
+// Unwrap returns the underlying attempt errors so errors.Is can match
+// context.DeadlineExceeded, syscall.ECONNREFUSED and the like.
+func (e *DialError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Attempts)+1)
+	if e.Err != nil {
+		errs = append(errs, e.Err)
+	}
+	for _, a := range e.Attempts {
+		errs = append(errs, a.Err)
+	}
+	return errs
+}
+
+// Dial connects to host:port. Hostnames are resolved and dialed with Happy
+// Eyeballs v2 (RFC 8305): addresses are interleaved by family, a new attempt
+// is started every AttemptDelay or as soon as the previous one fails, the
+// first connection wins and the remaining attempts are cancelled. Resolution
+// failures are returned as *net.DNSError (see IsDNSError and DNSErrorKind).
+func Dial(ctx context.Context, host, port string, o DialOptions) (*DialResult, error) {
+	if o.Network == "" {
+		o.Network = "tcp"
+	}
+	if o.AttemptDelay <= 0 {
+		o.AttemptDelay = DefaultAttemptDelay
+	}
+	if o.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.Timeout)
+		defer cancel()
+	}
+
+	// IPv6 link-local literals may carry a zone (fe80::1%en0)
+	ipStr, zone, _ := strings.Cut(host, "%")
+	var resolved, order []net.IP
+	if ip := net.ParseIP(ipStr); ip != nil {
+		order = []net.IP{ip}
+	} else {
+		if o.OnDNSStart != nil {
+			o.OnDNSStart(host)
+		}
+		ips, dr := o.Resolver.LookupIP(ctx, host, port)
+		if o.OnDNSDone != nil {
+			o.OnDNSDone(dr)
+		}
+		if dr.Err != nil {
+			return nil, dr.Err
+		}
+		resolved = ips
+		order = SortAddrs(ips, o.Prefer)
+	}
+	if len(order) == 0 {
+		return nil, &DialError{Host: host, Err: errors.New("no addresses")}
+	}
+
+	res, err := race(ctx, order, zone, port, o)
+	if err != nil {
+		if de, ok := err.(*DialError); ok {
+			de.Host = host
+		}
+		return nil, err
+	}
+	res.Resolved = resolved
+	return res, nil
+}
+
+// SortAddrs orders addresses for Happy Eyeballs: families alternate,
+// starting with the preferred one ("v4", "v6", or the family of the first
+// address for ""/"auto"), keeping the resolver order within each family.
+func SortAddrs(ips []net.IP, prefer string) []net.IP {
+	var v4s, v6s []net.IP
+	for _, ip := range ips {
+		if IsIPv4(ip) {
+			v4s = append(v4s, ip)
+		} else {
+			v6s = append(v6s, ip)
+		}
+	}
+	first, second := v6s, v4s
+	switch strings.ToLower(prefer) {
+	case "v4":
+		first, second = v4s, v6s
+	case "v6":
+	default:
+		if len(ips) > 0 && IsIPv4(ips[0]) {
+			first, second = v4s, v6s
+		}
+	}
+	out := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+type attemptResult struct {
+	attempt DialAttempt
+	conn    net.Conn
+}
+
+// race runs the staggered connection attempts over order.
+func race(ctx context.Context, order []net.IP, zone, port string, o DialOptions) (*DialResult, error) {
+	dctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan attemptResult, len(order))
+	start := func(i int) {
+		ip := order[i]
+		host := ip.String()
+		if zone != "" {
+			host += "%" + zone
+		}
+		a := DialAttempt{Index: i, IP: ip, Family: "v4", Network: o.Network + "4", Addr: net.JoinHostPort(host, port), Start: time.Now()}
+		if !IsIPv4(ip) {
+			a.Family, a.Network = "v6", o.Network+"6"
+		}
+		go func() {
+			var d net.Dialer
+			conn, err := d.DialContext(dctx, a.Network, a.Addr)
+			a.Duration = time.Since(a.Start)
+			a.Err = err
+			results <- attemptResult{attempt: a, conn: conn}
+		}()
+	}
+
+	var attempts []DialAttempt
+	record := func(a DialAttempt) {
+		attempts = append(attempts, a)
+		if o.OnAttempt != nil {
+			o.OnAttempt(a)
+		}
+	}
+
+	next, inflight := 0, 0
+	startNext := func() {
+		start(next)
+		next++
+		inflight++
+	}
+	startNext()
+	timer := time.NewTimer(o.AttemptDelay)
+	defer timer.Stop()
+
+	var winner *attemptResult
+	for inflight > 0 {
+		select {
+		case r := <-results:
+			inflight--
+			if r.attempt.Err == nil && winner == nil {
+				r.attempt.Won = true
+				winner = &r
+				record(r.attempt)
+				// cancel the losers and wait for them so every attempt is reported
+				cancel()
+				continue
+			}
+			if r.conn != nil {
+				// a loser connected after the winner; drop it
+				r.conn.Close()
+				r.attempt.Err = context.Canceled
+			}
+			if winner != nil || ctx.Err() != nil {
+				r.attempt.Canceled = true
+			}
+			record(r.attempt)
+			if winner == nil && next < len(order) && ctx.Err() == nil {
+				startNext()
+				resetTimer(timer, o.AttemptDelay)
+			}
+		case <-timer.C:
+			if winner == nil && next < len(order) {
+				startNext()
+				timer.Reset(o.AttemptDelay)
+			}
+		}
+	}
+
+	if winner == nil {
+		return nil, &DialError{Attempts: attempts}
+	}
+	return &DialResult{Conn: winner.conn, IP: winner.attempt.IP, Family: winner.attempt.Family, Attempts: attempts}, nil
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
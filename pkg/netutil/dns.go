@@ -0,0 +1,100 @@
+package netutil
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// DNSResult describes one hostname resolution performed by Dial.
+type DNSResult struct {
+	Host string
+	// IPv4 and IPv6 hold the returned A and AAAA records.
+	IPv4 []net.IP
+	IPv6 []net.IP
+	// Resolver names the resolver used ("system") and Servers the
+	// nameservers it is configured with, when known.
+	Resolver string
+	Servers  []string
+	Start    time.Time
+	Duration time.Duration
+	Err      error
+}
+
+// Addrs returns the A and AAAA records in resolver order.
+func (r DNSResult) Addrs() []net.IP {
+	return append(append([]net.IP{}, r.IPv4...), r.IPv6...)
+}
+
+// DNSErrorKind classifies a resolution error as "nxdomain", "timeout",
+// "servfail", "temporary" or "error". It returns "" for nil.
+func DNSErrorKind(err error) string {
+	if err == nil {
+		return ""
+	}
+	var de *net.DNSError
+	if !errors.As(err, &de) {
+		var ne net.Error
+		if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+			return "timeout"
+		}
+		return "error"
+	}
+	switch {
+	case de.IsNotFound:
+		return "nxdomain"
+	case de.IsTimeout:
+		return "timeout"
+	// the Go resolver reports SERVFAIL and REFUSED as "server misbehaving"
+	case strings.Contains(de.Err, "server misbehaving"):
+		return "servfail"
+	case de.IsTemporary:
+		return "temporary"
+	}
+	return "error"
+}
+
+// IsDNSError reports whether err came from hostname resolution.
+func IsDNSError(err error) bool {
+	var de *net.DNSError
+	return errors.As(err, &de)
+}
+
+// lookupIP resolves host with the system resolver and describes the result.
+func lookupIP(ctx context.Context, host string) ([]net.IP, DNSResult) {
+	r := DNSResult{Host: host, Resolver: "system", Servers: SystemNameservers(), Start: time.Now()}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	r.Duration = time.Since(r.Start)
+	r.Err = err
+	for _, ip := range ips {
+		if IsIPv4(ip) {
+			r.IPv4 = append(r.IPv4, ip)
+		} else {
+			r.IPv6 = append(r.IPv6, ip)
+		}
+	}
+	return ips, r
+}
+
+// SystemNameservers returns the nameservers listed in /etc/resolv.conf, or
+// nil where that file does not exist (e.g. Windows).
+func SystemNameservers() []string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var servers []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
@@ -0,0 +1,234 @@
+package netutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSServer is a DNS server together with the transport used to reach it.
+type DNSServer struct {
+	// Transport is "udp", "tcp", "dot" (DNS over TLS) or "doh" (DNS over HTTPS).
+	Transport string
+	// Addr is host:port for udp/tcp/dot and the query URL for doh.
+	Addr string
+	// TLS overrides the client TLS configuration for dot and doh.
+	TLS *tls.Config
+	// Timeout bounds a single exchange (default 5s).
+	Timeout time.Duration
+}
+
+// ParseDNSServer parses a server specification:
+//
+//	1.1.1.1, 1.1.1.1:53, udp://1.1.1.1  plain DNS over UDP (port 53)
+//	tcp://1.1.1.1:53                     plain DNS over TCP
+//	tls://1.1.1.1, dot://dns.google      DNS over TLS (port 853)
+//	https://dns.google/dns-query         DNS over HTTPS
+func ParseDNSServer(s string) (DNSServer, error) {
+	if s == "" {
+		return DNSServer{}, errors.New("empty DNS server")
+	}
+	scheme, rest, ok := strings.Cut(s, "://")
+	if !ok {
+		scheme, rest = "udp", s
+	}
+	switch strings.ToLower(scheme) {
+	case "https":
+		if _, err := url.Parse(s); err != nil {
+			return DNSServer{}, fmt.Errorf("invalid DoH URL %q: %w", s, err)
+		}
+		return DNSServer{Transport: "doh", Addr: s}, nil
+	case "udp", "tcp":
+		return DNSServer{Transport: strings.ToLower(scheme), Addr: withDefaultPort(rest, "53")}, nil
+	case "tls", "dot":
+		return DNSServer{Transport: "dot", Addr: withDefaultPort(rest, "853")}, nil
+	}
+	return DNSServer{}, fmt.Errorf("unsupported DNS server scheme %q (want udp, tcp, tls or https)", scheme)
+}
+
+func withDefaultPort(hostport, port string) string {
+	_, _, joined, _, _, _, _ := ParseAddr(strings.TrimSuffix(hostport, "/"), port)
+	return joined
+}
+
+// String returns the server in the form accepted by ParseDNSServer.
+func (s DNSServer) String() string {
+	switch s.Transport {
+	case "doh":
+		return s.Addr
+	case "dot":
+		return "tls://" + s.Addr
+	}
+	return s.Transport + "://" + s.Addr
+}
+
+// Exchange sends a wire-format DNS query and returns the wire-format
+// response. For udp, datagrams whose ID does not match the query are ignored.
+func (s DNSServer) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	switch s.Transport {
+	case "udp":
+		return s.exchangeUDP(ctx, query)
+	case "tcp", "dot":
+		return s.exchangeStream(ctx, query)
+	case "doh":
+		return s.exchangeHTTPS(ctx, query)
+	}
+	return nil, fmt.Errorf("unsupported DNS transport %q", s.Transport)
+}
+
+func (s DNSServer) exchangeUDP(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// ignore stray datagrams that do not answer this query
+		if n >= 2 && len(query) >= 2 && bytes.Equal(buf[:2], query[:2]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+func (s DNSServer) exchangeStream(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.Transport == "dot" {
+		tc := s.TLS
+		if tc == nil {
+			host, _, _ := net.SplitHostPort(s.Addr)
+			tc = &tls.Config{ServerName: host}
+		}
+		tlsConn := tls.Client(conn, tc)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// exchangeHTTPS implements RFC 8484 with POST and application/dns-message.
+func (s DNSServer) exchangeHTTPS(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Addr, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	client := http.DefaultClient
+	if s.TLS != nil {
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.TLSClientConfig = s.TLS
+		client = &http.Client{Transport: tr}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+	return body, nil
+}
+
+// NewQuery builds a recursive query for name and type with an EDNS0 OPT
+// record advertising a 1232-byte UDP payload. It returns the packed message
+// and its ID.
+func NewQuery(name string, t dnsmessage.Type) ([]byte, uint16, error) {
+	return newQuery(name, t, true)
+}
+
+// NewIterativeQuery is NewQuery with the RD (recursion desired) flag clear,
+// as sent when walking the delegation chain.
+func NewIterativeQuery(name string, t dnsmessage.Type) ([]byte, uint16, error) {
+	return newQuery(name, t, false)
+}
+
+func newQuery(name string, t dnsmessage.Type, rd bool) ([]byte, uint16, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	id := uint16(rand.Uint32())
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: rd})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: n, Type: t, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, 0, err
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, 0, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(1232, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, 0, err
+	}
+	if err := b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, 0, err
+	}
+	msg, err := b.Finish()
+	return msg, id, err
+}
@@ -0,0 +1,566 @@
+package netutil
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// ProxyDirect disables proxying, including proxies from the environment.
+const ProxyDirect = "direct"
+
+// ParseProxy parses a proxy URL: http://, https://, socks5:// (target
+// resolved locally) or socks5h:// (target resolved by the proxy), with
+// optional user:password. A bare host:port is treated as an HTTP proxy.
+func ParseProxy(s string) (*url.URL, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (want http, https, socks5 or socks5h)", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy URL %q has no host", s)
+	}
+	return u, nil
+}
+
+// ProxyFor returns the proxy to reach addr (host:port) through, or nil to
+// connect directly: proxy is a URL as accepted by ParseProxy ("" and
+// ProxyDirect mean none) and noProxy lists the hosts that bypass it in
+// NO_PROXY syntax ("" reads NO_PROXY from the environment). As for HTTP,
+// localhost and loopback addresses are never proxied.
+func ProxyFor(proxy, noProxy, addr string) (*url.URL, error) {
+	if proxy == "" || proxy == ProxyDirect {
+		return nil, nil
+	}
+	u, err := ParseProxy(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if noProxy == "" {
+		if noProxy = os.Getenv("NO_PROXY"); noProxy == "" {
+			noProxy = os.Getenv("no_proxy")
+		}
+	}
+	c := &httpproxy.Config{HTTPSProxy: u.String(), NoProxy: noProxy}
+	return c.ProxyFunc()(&url.URL{Scheme: "https", Host: addr})
+}
+
+// IsSOCKS reports whether u is a socks5 or socks5h proxy URL.
+func IsSOCKS(u *url.URL) bool { return u.Scheme == "socks5" || u.Scheme == "socks5h" }
+
+// ProxyAddr returns the proxy's host:port, using the scheme's default port
+// (80, 443 or 1080) when u has none.
+func ProxyAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// ProxyStep describes one step of a proxy negotiation. Name is the event
+// stage reporting it: "proxy_dial", "proxy_tls", "proxy_connect_response"
+// (HTTP CONNECT), "socks_greeting", "socks_auth", "socks_connect" or
+// "socks_udp_associate".
+type ProxyStep struct {
+	Name string
+	// Proxy is the proxy URL with the password masked.
+	Proxy    string
+	Target   string
+	Start    time.Time
+	Duration time.Duration
+	// Addr and Remote are the proxy address dialed and the peer address of
+	// the connection (proxy_dial).
+	Addr   string
+	Remote string
+	// Method is the SOCKS authentication method the server selected.
+	Method string
+	// Reply is the SOCKS reply and BoundAddr the address the server
+	// reported; for UDP ASSOCIATE it is the relay datagrams are sent to.
+	Reply     string
+	BoundAddr string
+	// Status and Header are the HTTP CONNECT response.
+	Status string
+	Header http.Header
+	Err    error
+}
+
+// ProxyDialer connects to targets through an HTTP(S) proxy with CONNECT or
+// a SOCKS5 proxy (CONNECT for "tcp", UDP ASSOCIATE for "udp"), reporting
+// each negotiation step.
+type ProxyDialer struct {
+	URL *url.URL
+	// Options configure the connection to the proxy itself (Happy Eyeballs,
+	// DNS hooks, resolver). For socks5 URLs the same resolver and hooks
+	// resolve the target locally.
+	Options DialOptions
+	// TLS is the client configuration for https proxies; nil verifies the
+	// proxy host against the system roots.
+	TLS *tls.Config
+	// OnStep, if set, is called as each step finishes.
+	OnStep func(ProxyStep)
+}
+
+// DialContext connects to addr (host:port) through the proxy. network is
+// "tcp" or "udp"; UDP requires a SOCKS5 proxy and returns a connection whose
+// datagrams are relayed by the proxy.
+func (d *ProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if strings.HasPrefix(network, "udp") && !IsSOCKS(d.URL) {
+		return nil, fmt.Errorf("UDP needs a SOCKS5 proxy, not %s", d.URL.Scheme)
+	}
+	if d.Options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Options.Timeout)
+		defer cancel()
+	}
+	target := addr
+	if d.URL.Scheme == "socks5" {
+		var err error
+		if target, err = d.resolveTarget(ctx, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// the proxy negotiation is bounded by ctx
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	var out net.Conn
+	switch {
+	case IsSOCKS(d.URL) && strings.HasPrefix(network, "udp"):
+		out, err = d.socksUDP(ctx, conn, target)
+	case IsSOCKS(d.URL):
+		_, err = d.socks(conn, socksConnect, target)
+		out = conn
+	default:
+		out, err = d.httpConnect(conn, target)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return out, nil
+}
+
+func (d *ProxyDialer) step(s ProxyStep) {
+	s.Proxy = d.URL.Redacted()
+	s.Duration = time.Since(s.Start)
+	if d.OnStep != nil {
+		d.OnStep(s)
+	}
+}
+
+// resolveTarget resolves the host of addr for socks5 proxies.
+func (d *ProxyDialer) resolveTarget(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return addr, err
+	}
+	if d.Options.OnDNSStart != nil {
+		d.Options.OnDNSStart(host)
+	}
+	ips, dr := d.Options.Resolver.LookupIP(ctx, host, port)
+	if d.Options.OnDNSDone != nil {
+		d.Options.OnDNSDone(dr)
+	}
+	if dr.Err != nil {
+		return "", dr.Err
+	}
+	if len(ips) == 0 {
+		return "", &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return net.JoinHostPort(SortAddrs(ips, d.Options.Prefer)[0].String(), port), nil
+}
+
+// dialProxy connects to the proxy, adding TLS for https proxies.
+func (d *ProxyDialer) dialProxy(ctx context.Context) (net.Conn, error) {
+	addr := ProxyAddr(d.URL)
+	s := ProxyStep{Name: "proxy_dial", Addr: addr, Start: time.Now()}
+	o := d.Options
+	o.Network = "tcp"
+	host, port, _ := net.SplitHostPort(addr)
+	res, err := Dial(ctx, host, port, o)
+	if err != nil {
+		// resolution failures are reported through the DNS hooks
+		if !IsDNSError(err) {
+			s.Err = err
+			d.step(s)
+		}
+		return nil, err
+	}
+	s.Remote = res.Conn.RemoteAddr().String()
+	d.step(s)
+	if d.URL.Scheme != "https" {
+		return res.Conn, nil
+	}
+
+	ts := ProxyStep{Name: "proxy_tls", Addr: addr, Start: time.Now()}
+	tc := d.TLS
+	if tc == nil {
+		tc = &tls.Config{ServerName: host}
+	}
+	tlsConn := tls.Client(res.Conn, tc)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		res.Conn.Close()
+		ts.Err = err
+		d.step(ts)
+		return nil, err
+	}
+	d.step(ts)
+	return tlsConn, nil
+}
+
+// httpConnect opens a tunnel with an HTTP CONNECT request.
+func (d *ProxyDialer) httpConnect(conn net.Conn, target string) (net.Conn, error) {
+	s := ProxyStep{Name: "proxy_connect_response", Target: target, Start: time.Now()}
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: target}, Host: target, Header: make(http.Header)}
+	if u := d.URL.User; u != nil {
+		pw, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pw)))
+	}
+	if err := req.Write(conn); err != nil {
+		s.Err = err
+		d.step(s)
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		s.Err = err
+		d.step(s)
+		return nil, err
+	}
+	resp.Body.Close()
+	s.Status, s.Header = resp.Status, resp.Header
+	if resp.StatusCode != http.StatusOK {
+		s.Err = fmt.Errorf("proxy CONNECT %s: %s", target, resp.Status)
+		d.step(s)
+		return nil, s.Err
+	}
+	d.step(s)
+	// bytes the proxy sent after its response belong to the tunnel
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// CloseWrite half-closes the tunnel when the underlying connection can.
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("connection does not support half-close")
+}
+
+const (
+	socksConnect      = 1
+	socksUDPAssociate = 3
+)
+
+var socksReplies = []string{
+	"succeeded",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+func socksReply(code byte) string {
+	if int(code) < len(socksReplies) {
+		return socksReplies[code]
+	}
+	return "unknown reply " + strconv.Itoa(int(code))
+}
+
+// socks runs the RFC 1928 greeting, the RFC 1929 username/password
+// authentication when the URL has credentials, and one request for target.
+// It returns the bound address from the reply.
+func (d *ProxyDialer) socks(conn net.Conn, cmd byte, target string) (string, error) {
+	s := ProxyStep{Name: "socks_greeting", Start: time.Now()}
+	methods := []byte{0x00}
+	if d.URL.User != nil {
+		methods = append(methods, 0x02)
+	}
+	if _, err := conn.Write(append([]byte{5, byte(len(methods))}, methods...)); err != nil {
+		s.Err = err
+		d.step(s)
+		return "", err
+	}
+	var sel [2]byte
+	if _, err := io.ReadFull(conn, sel[:]); err != nil {
+		s.Err = err
+		d.step(s)
+		return "", err
+	}
+	switch sel[1] {
+	case 0x00:
+		s.Method = "none"
+	case 0x02:
+		s.Method = "username/password"
+	default:
+		s.Method = "no acceptable methods"
+		s.Err = errors.New("SOCKS server accepted none of the offered authentication methods")
+	}
+	if sel[0] != 5 {
+		s.Err = fmt.Errorf("unexpected SOCKS version %d", sel[0])
+	}
+	d.step(s)
+	if s.Err != nil {
+		return "", s.Err
+	}
+
+	if sel[1] == 0x02 {
+		s = ProxyStep{Name: "socks_auth", Method: "username/password", Start: time.Now()}
+		user := d.URL.User.Username()
+		pw, _ := d.URL.User.Password()
+		b := []byte{1, byte(len(user))}
+		b = append(b, user...)
+		b = append(b, byte(len(pw)))
+		b = append(b, pw...)
+		var st [2]byte
+		_, s.Err = conn.Write(b)
+		if s.Err == nil {
+			_, s.Err = io.ReadFull(conn, st[:])
+		}
+		if s.Err == nil && st[1] != 0 {
+			s.Err = errors.New("SOCKS username/password authentication failed")
+		}
+		d.step(s)
+		if s.Err != nil {
+			return "", s.Err
+		}
+	}
+
+	s = ProxyStep{Name: "socks_connect", Target: target, Start: time.Now()}
+	reqAddr := target
+	if cmd == socksUDPAssociate {
+		// the client's datagram source is not known before it sends one
+		s.Name, reqAddr = "socks_udp_associate", "0.0.0.0:0"
+	}
+	req, err := socksAddr(reqAddr)
+	if err != nil {
+		s.Err = err
+		d.step(s)
+		return "", err
+	}
+	if _, err := conn.Write(append([]byte{5, cmd, 0}, req...)); err != nil {
+		s.Err = err
+		d.step(s)
+		return "", err
+	}
+	var hdr [3]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		s.Err = err
+		d.step(s)
+		return "", err
+	}
+	s.Reply = socksReply(hdr[1])
+	bound, err := readSocksAddr(conn)
+	if err != nil {
+		s.Err = err
+	} else if hdr[1] != 0 {
+		s.Err = fmt.Errorf("SOCKS request for %s failed: %s", target, s.Reply)
+	}
+	s.BoundAddr = bound
+	d.step(s)
+	return bound, s.Err
+}
+
+// socksAddr encodes host:port as a SOCKS address (ATYP, address, port).
+func socksAddr(hostport string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	var b []byte
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append([]byte{1}, ip4...)
+		} else {
+			b = append([]byte{4}, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name %q too long for SOCKS", host)
+		}
+		b = append([]byte{3, byte(len(host))}, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// readSocksAddr reads a SOCKS address from r and returns it as host:port.
+func readSocksAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case 1, 4:
+		ip := make([]byte, 4)
+		if atyp[0] == 4 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unknown SOCKS address type %d", atyp[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socksUDP sets up a UDP ASSOCIATE and returns a connection that wraps each
+// datagram in the RFC 1928 UDP request header for the relay.
+func (d *ProxyDialer) socksUDP(ctx context.Context, ctrl net.Conn, target string) (net.Conn, error) {
+	header, err := socksAddr(target)
+	if err != nil {
+		return nil, err
+	}
+	bound, err := d.socks(ctrl, socksUDPAssociate, target)
+	if err != nil {
+		return nil, err
+	}
+	// servers may answer with an unspecified address meaning "my address"
+	relay := bound
+	if h, p, err := net.SplitHostPort(bound); err == nil {
+		if ip := net.ParseIP(h); ip == nil || ip.IsUnspecified() {
+			ph, _, _ := net.SplitHostPort(ctrl.RemoteAddr().String())
+			relay = net.JoinHostPort(ph, p)
+		}
+	}
+	var nd net.Dialer
+	pc, err := nd.DialContext(ctx, "udp", relay)
+	if err != nil {
+		return nil, err
+	}
+	return &socksUDPConn{Conn: pc, ctrl: ctrl, header: append([]byte{0, 0, 0}, header...), target: target}, nil
+}
+
+// socksUDPConn is a datagram connection through a SOCKS5 UDP relay. The
+// TCP control connection must stay open for the association to live.
+type socksUDPConn struct {
+	net.Conn
+	ctrl   net.Conn
+	header []byte
+	target string
+}
+
+func (c *socksUDPConn) Write(p []byte) (int, error) {
+	if _, err := c.Conn.Write(append(append([]byte{}, c.header...), p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *socksUDPConn) Read(p []byte) (int, error) {
+	buf := make([]byte, len(p)+262)
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		// RSV(2) FRAG(1) then the source address; fragments are not supported
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := &byteReader{b: buf[3:n]}
+		if _, err := readSocksAddr(r); err != nil {
+			continue
+		}
+		return copy(p, r.b), nil
+	}
+}
+
+// RemoteAddr reports the target rather than the relay.
+func (c *socksUDPConn) RemoteAddr() net.Addr { return proxiedAddr{"udp", c.target} }
+
+func (c *socksUDPConn) Close() error {
+	c.ctrl.Close()
+	return c.Conn.Close()
+}
+
+type byteReader struct{ b []byte }
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+// proxiedAddr is the address of a target reached through a proxy.
+type proxiedAddr struct{ network, addr string }
+
+func (a proxiedAddr) Network() string { return a.network }
+func (a proxiedAddr) String() string  { return a.addr }
@@ -0,0 +1,238 @@
+package netutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Override is a static host to address mapping in curl --resolve form.
+type Override struct {
+	Host string
+	// Port restricts the override to one port; "*" or "" matches any.
+	Port  string
+	Addrs []net.IP
+}
+
+// ParseOverride parses "host:port:addr[,addr...]" as accepted by curl
+// --resolve. IPv6 addresses may be bracketed and port may be "*".
+func ParseOverride(s string) (Override, error) {
+	host, rest, ok1 := strings.Cut(s, ":")
+	port, addrs, ok2 := strings.Cut(rest, ":")
+	if !ok1 || !ok2 || host == "" || addrs == "" {
+		return Override{}, fmt.Errorf("invalid resolve override %q, expected host:port:addr[,addr...]", s)
+	}
+	o := Override{Host: strings.ToLower(host), Port: port}
+	for _, a := range strings.Split(addrs, ",") {
+		a = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(a), "["), "]")
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return Override{}, fmt.Errorf("invalid address %q in resolve override %q", a, s)
+		}
+		o.Addrs = append(o.Addrs, ip)
+	}
+	return o, nil
+}
+
+func (o Override) matches(host, port string) bool {
+	return strings.EqualFold(o.Host, strings.TrimSuffix(host, ".")) && (o.Port == "" || o.Port == "*" || o.Port == port)
+}
+
+// Resolver configures hostname resolution for Dial. A nil Resolver, or one
+// without Server, uses the system resolver.
+type Resolver struct {
+	// Server sends queries to a specific DNS server instead of the system
+	// resolver.
+	Server *DNSServer
+	// Overrides are consulted first and bypass DNS entirely.
+	Overrides []Override
+}
+
+// LookupIP resolves host for a connection to port and describes the result.
+func (r *Resolver) LookupIP(ctx context.Context, host, port string) ([]net.IP, DNSResult) {
+	if r != nil {
+		for _, o := range r.Overrides {
+			if o.matches(host, port) {
+				res := DNSResult{Host: host, Resolver: "override", Start: time.Now()}
+				for _, ip := range o.Addrs {
+					if IsIPv4(ip) {
+						res.IPv4 = append(res.IPv4, ip)
+					} else {
+						res.IPv6 = append(res.IPv6, ip)
+					}
+				}
+				return o.Addrs, res
+			}
+		}
+	}
+	if r == nil || r.Server == nil {
+		return lookupIP(ctx, host)
+	}
+	return lookupServer(ctx, *r.Server, host)
+}
+
+// lookupServer queries A and AAAA records from srv in parallel.
+func lookupServer(ctx context.Context, srv DNSServer, host string) ([]net.IP, DNSResult) {
+	// keep the DNS server's own connections out of any httptrace hooks
+	ctx = withoutValues{ctx}
+	res := DNSResult{Host: host, Resolver: srv.Transport, Servers: []string{srv.String()}, Start: time.Now()}
+	type answer struct {
+		ips []net.IP
+		err error
+	}
+	ch := make(chan answer, 2)
+	for _, t := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		go func() {
+			ips, err := queryAddrs(ctx, srv, host, t)
+			ch <- answer{ips, err}
+		}()
+	}
+	var errs []error
+	for range 2 {
+		a := <-ch
+		if a.err != nil {
+			errs = append(errs, a.err)
+			continue
+		}
+		for _, ip := range a.ips {
+			if IsIPv4(ip) {
+				res.IPv4 = append(res.IPv4, ip)
+			} else {
+				res.IPv6 = append(res.IPv6, ip)
+			}
+		}
+	}
+	res.Duration = time.Since(res.Start)
+	ips := res.Addrs()
+	// like the system resolver, one family failing is fine if the other answered
+	if len(ips) == 0 {
+		if len(errs) > 0 {
+			res.Err = dnsError(host, srv, errs[0])
+		} else {
+			res.Err = &net.DNSError{Err: "no such host", Name: host, Server: srv.String(), IsNotFound: true}
+		}
+	}
+	return ips, res
+}
+
+// queryAddrs sends one A or AAAA query, retrying over TCP when a UDP
+// response is truncated.
+func queryAddrs(ctx context.Context, srv DNSServer, host string, t dnsmessage.Type) ([]net.IP, error) {
+	msg, err := Query(ctx, srv, host, t)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, rr := range msg.Answers {
+		switch b := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(b.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(b.AAAA[:]))
+		}
+	}
+	return ips, nil
+}
+
+// Query sends a recursive query to srv and returns the parsed response. A
+// truncated UDP response is retried over TCP. Responses with an RCODE other
+// than NOERROR are returned as *RCodeError.
+func Query(ctx context.Context, srv DNSServer, name string, t dnsmessage.Type) (*dnsmessage.Message, error) {
+	return query(ctx, srv, name, t, true)
+}
+
+// QueryIterative is Query with the RD flag clear, for asking authoritative
+// servers directly.
+func QueryIterative(ctx context.Context, srv DNSServer, name string, t dnsmessage.Type) (*dnsmessage.Message, error) {
+	return query(ctx, srv, name, t, false)
+}
+
+func query(ctx context.Context, srv DNSServer, name string, t dnsmessage.Type, rd bool) (*dnsmessage.Message, error) {
+	msg, _, err := exchangeQuery(ctx, srv, name, t, rd)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Header.Truncated && srv.Transport == "udp" {
+		srv.Transport = "tcp"
+		if msg, _, err = exchangeQuery(ctx, srv, name, t, rd); err != nil {
+			return nil, err
+		}
+	}
+	if msg.Header.RCode != dnsmessage.RCodeSuccess {
+		return msg, &RCodeError{RCode: msg.Header.RCode}
+	}
+	return msg, nil
+}
+
+func exchangeQuery(ctx context.Context, srv DNSServer, name string, t dnsmessage.Type, rd bool) (*dnsmessage.Message, []byte, error) {
+	q, id, err := newQuery(name, t, rd)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err := srv.Exchange(ctx, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(raw); err != nil {
+		return nil, raw, fmt.Errorf("invalid DNS response: %w", err)
+	}
+	if msg.Header.ID != id {
+		return nil, raw, errors.New("DNS response ID does not match query")
+	}
+	return &msg, raw, nil
+}
+
+// RCodeError reports a DNS response with a non-success RCODE.
+type RCodeError struct {
+	RCode dnsmessage.RCode
+}
+
+func (e *RCodeError) Error() string { return "dns: server returned " + RCodeName(e.RCode) }
+
+// RCodeName returns the conventional mnemonic for rc, e.g. "NXDOMAIN".
+func RCodeName(rc dnsmessage.RCode) string {
+	switch rc {
+	case dnsmessage.RCodeSuccess:
+		return "NOERROR"
+	case dnsmessage.RCodeFormatError:
+		return "FORMERR"
+	case dnsmessage.RCodeServerFailure:
+		return "SERVFAIL"
+	case dnsmessage.RCodeNameError:
+		return "NXDOMAIN"
+	case dnsmessage.RCodeNotImplemented:
+		return "NOTIMP"
+	case dnsmessage.RCodeRefused:
+		return "REFUSED"
+	}
+	return fmt.Sprintf("RCODE%d", int(rc))
+}
+
+// dnsError converts a query failure into a *net.DNSError so DNSErrorKind
+// classifies custom-server failures like system resolver ones.
+func dnsError(host string, srv DNSServer, err error) error {
+	de := &net.DNSError{Err: err.Error(), Name: host, Server: srv.String()}
+	var re *RCodeError
+	var ne net.Error
+	switch {
+	case errors.As(err, &re) && re.RCode == dnsmessage.RCodeNameError:
+		de.Err, de.IsNotFound = "no such host", true
+	case errors.As(err, &re):
+		de.Err = "server misbehaving (" + RCodeName(re.RCode) + ")"
+		de.IsTemporary = re.RCode == dnsmessage.RCodeServerFailure
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		de.Err, de.IsTimeout, de.IsTemporary = "i/o timeout", true, true
+	}
+	return de
+}
+
+// withoutValues keeps ctx's deadline and cancellation but hides its values.
+type withoutValues struct{ context.Context }
+
+func (withoutValues) Value(key any) any { return nil }
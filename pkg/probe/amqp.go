@@ -0,0 +1,215 @@
+package probe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// amqpHeader is the protocol header of AMQP 0-9-1.
+const amqpHeader = "AMQP\x00\x00\x09\x01"
+
+// probeAMQP sends the AMQP 0-9-1 protocol header and reads Connection.Start,
+// which carries the broker's properties and the SASL mechanisms it offers.
+// Brokers that do not speak 0-9-1 answer with the header of the version
+// they support, which is reported instead.
+func probeAMQP(c *conn) (map[string]interface{}, error) {
+	began := time.Now()
+	if err := c.writeString(amqpHeader); err != nil {
+		return nil, err
+	}
+	peek, err := c.r.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+	if string(peek) == "AMQP" {
+		var hdr [8]byte
+		if err := c.readFull(hdr[:]); err != nil {
+			return nil, err
+		}
+		version := amqpVersion(hdr[4:])
+		c.emit("amqp_version_mismatch", time.Since(began), map[string]interface{}{"supported": version})
+		return map[string]interface{}{"supported_version": version}, nil
+	}
+
+	// frame: type, channel, size, payload, frame-end
+	var hdr [7]byte
+	if err := c.readFull(hdr[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[3:])
+	if hdr[0] != 1 || size < 4 || size > 1<<20 {
+		return nil, fmt.Errorf("expected a method frame, got %s", short(hdr[:]))
+	}
+	frame := make([]byte, size+1)
+	if err := c.readFull(frame); err != nil {
+		return nil, err
+	}
+	if frame[size] != 0xce {
+		return nil, fmt.Errorf("invalid frame end %#x", frame[size])
+	}
+	class, method := binary.BigEndian.Uint16(frame), binary.BigEndian.Uint16(frame[2:])
+	if class != 10 || method != 10 {
+		return nil, fmt.Errorf("expected Connection.Start, got method %d.%d", class, method)
+	}
+	r := &amqpReader{b: frame[4:size]}
+	major, minor := r.octet(), r.octet()
+	props := r.table()
+	mechanisms := strings.Fields(r.longString())
+	locales := strings.Fields(r.longString())
+	if r.err != nil {
+		return nil, fmt.Errorf("Connection.Start: %w", r.err)
+	}
+
+	payload := map[string]interface{}{"version": fmt.Sprintf("%d-%d", major, minor), "mechanisms": mechanisms, "locales": locales}
+	for _, k := range []string{"product", "version", "platform", "cluster_name", "capabilities"} {
+		if v, ok := props[k]; ok {
+			payload["server_"+k] = v
+		}
+	}
+	c.emit("amqp_start", time.Since(began), payload)
+
+	summary := map[string]interface{}{"auth_methods": mechanisms}
+	if v, ok := props["version"].(string); ok {
+		summary["server_version"] = v
+		if p, ok := props["product"].(string); ok {
+			summary["server_version"] = p + " " + v
+		}
+	}
+	return summary, nil
+}
+
+// amqpVersion names the protocol of an AMQP header's last four bytes.
+func amqpVersion(b []byte) string {
+	switch {
+	case b[0] == 0 && b[1] == 0:
+		return fmt.Sprintf("0-%d-%d", b[2], b[3])
+	case b[0] == 1 && b[1] == 1:
+		// pre-0-9-1 headers: class 1, instance 1, then the version
+		return fmt.Sprintf("%d-%d", b[2], b[3])
+	default:
+		// AMQP 1.0 uses the first byte as a protocol id (0, 2 TLS, 3 SASL)
+		return fmt.Sprintf("%d.%d.%d (protocol id %d)", b[1], b[2], b[3], b[0])
+	}
+}
+
+// amqpReader decodes the fields of a method frame; the first error sticks.
+type amqpReader struct {
+	b   []byte
+	err error
+}
+
+func (r *amqpReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.b) < n {
+		r.err = fmt.Errorf("truncated field")
+		return nil
+	}
+	p := r.b[:n]
+	r.b = r.b[n:]
+	return p
+}
+
+func (r *amqpReader) octet() byte {
+	if p := r.next(1); p != nil {
+		return p[0]
+	}
+	return 0
+}
+
+func (r *amqpReader) u16() uint16 {
+	if p := r.next(2); p != nil {
+		return binary.BigEndian.Uint16(p)
+	}
+	return 0
+}
+
+func (r *amqpReader) u32() uint32 {
+	if p := r.next(4); p != nil {
+		return binary.BigEndian.Uint32(p)
+	}
+	return 0
+}
+
+func (r *amqpReader) u64() uint64 {
+	if p := r.next(8); p != nil {
+		return binary.BigEndian.Uint64(p)
+	}
+	return 0
+}
+
+func (r *amqpReader) shortString() string { return string(r.next(int(r.octet()))) }
+
+func (r *amqpReader) longString() string { return string(r.next(int(r.u32()))) }
+
+// table decodes a field table.
+func (r *amqpReader) table() map[string]interface{} {
+	sub := &amqpReader{b: r.next(int(r.u32()))}
+	t := map[string]interface{}{}
+	for r.err == nil && sub.err == nil && len(sub.b) > 0 {
+		k := sub.shortString()
+		t[k] = sub.value()
+	}
+	if r.err == nil {
+		r.err = sub.err
+	}
+	return t
+}
+
+// value decodes a field value, using the type tags RabbitMQ and Qpid send.
+func (r *amqpReader) value() interface{} {
+	switch tag := r.octet(); tag {
+	case 't':
+		return r.octet() != 0
+	case 'b':
+		return int8(r.octet())
+	case 'B':
+		return r.octet()
+	case 's':
+		return int16(r.u16())
+	case 'u':
+		return r.u16()
+	case 'I':
+		return int32(r.u32())
+	case 'i':
+		return r.u32()
+	case 'l':
+		return int64(r.u64())
+	case 'f':
+		return math.Float32frombits(r.u32())
+	case 'd':
+		return math.Float64frombits(r.u64())
+	case 'D':
+		scale := r.octet()
+		return fmt.Sprintf("%de-%d", int32(r.u32()), scale)
+	case 'S':
+		return r.longString()
+	case 'x':
+		return fmt.Sprintf("%x", r.next(int(r.u32())))
+	case 'A':
+		sub := &amqpReader{b: r.next(int(r.u32()))}
+		var a []interface{}
+		for r.err == nil && sub.err == nil && len(sub.b) > 0 {
+			a = append(a, sub.value())
+		}
+		if r.err == nil {
+			r.err = sub.err
+		}
+		return a
+	case 'T':
+		return time.Unix(int64(r.u64()), 0).UTC().Format(time.RFC3339)
+	case 'F':
+		return r.table()
+	case 'V':
+		return nil
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("unknown field type %q", tag)
+		}
+		return nil
+	}
+}
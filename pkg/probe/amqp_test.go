@@ -0,0 +1,101 @@
+package probe
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAMQPValue(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want interface{}
+		err  string
+	}{
+		{name: "boolean", in: "t\x01", want: true},
+		{name: "signed octet", in: "b\xff", want: int8(-1)},
+		{name: "short", in: "s\xff\xfe", want: int16(-2)},
+		{name: "long", in: "I\x00\x00\x01\x00", want: int32(256)},
+		{name: "long long", in: "l\x00\x00\x00\x00\x00\x00\x00\x07", want: int64(7)},
+		{name: "decimal", in: "D\x02\x00\x00\x01\x2c", want: "300e-2"},
+		{name: "long string", in: "S" + amqpLongString("RabbitMQ"), want: "RabbitMQ"},
+		{name: "byte array", in: "x" + amqpLongString("\x01\xff"), want: "01ff"},
+		{name: "array", in: "A" + amqpLongString("t\x01S"+amqpLongString("a")), want: []interface{}{true, "a"}},
+		{name: "timestamp", in: "T\x00\x00\x00\x00\x00\x00\x00\x3c", want: "1970-01-01T00:01:00Z"},
+		{name: "table", in: "F" + amqpLongString("\x01kt\x00"), want: map[string]interface{}{"k": false}},
+		{name: "void", in: "V", want: nil},
+		{name: "empty", in: "", err: "truncated field"},
+		{name: "truncated long", in: "I\x00\x01", err: "truncated field"},
+		{name: "truncated long string", in: "S\x00\x00\x00\x09abc", err: "truncated field"},
+		{name: "huge long string", in: "S\xff\xff\xff\xff", err: "truncated field"},
+		{name: "truncated array element", in: "A" + amqpLongString("S\x00\x00\x00\x05ab"), err: "truncated field"},
+		{name: "unknown type", in: "?", err: `unknown field type '?'`},
+		{name: "unknown type in a table", in: "F" + amqpLongString("\x01k?"), err: `unknown field type '?'`},
+	}
+	for _, tt := range tests {
+		r := &amqpReader{b: []byte(tt.in)}
+		got := r.value()
+		if tt.err != "" {
+			if r.err == nil || !strings.Contains(r.err.Error(), tt.err) {
+				t.Errorf("%s: err = %v, want %q", tt.name, r.err, tt.err)
+			}
+			continue
+		}
+		if r.err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: value = %#v, %v; want %#v", tt.name, got, r.err, tt.want)
+		}
+	}
+}
+
+func TestAMQPVersion(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "\x00\x00\x09\x01", want: "0-9-1"},
+		{in: "\x01\x01\x00\x09", want: "0-9"},
+		{in: "\x00\x01\x00\x00", want: "1.0.0 (protocol id 0)"},
+		{in: "\x03\x01\x00\x00", want: "1.0.0 (protocol id 3)"},
+	}
+	for _, tt := range tests {
+		if got := amqpVersion([]byte(tt.in)); got != tt.want {
+			t.Errorf("amqpVersion(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestProbeAMQPFrames(t *testing.T) {
+	start := amqpStart("\x07productS"+amqpLongString("RabbitMQ"), "PLAIN")
+	tests := []struct {
+		name  string
+		reply []byte
+		err   string
+	}{
+		{name: "connection start", reply: start},
+		{name: "bad frame end", reply: append(start[:len(start)-1:len(start)-1], 0), err: "invalid frame end"},
+		{name: "truncated frame", reply: start[:20], err: "EOF"},
+		{name: "heartbeat frame", reply: []byte{8, 0, 0, 0, 0, 0, 0, 0xce}, err: "expected a method frame"},
+		{name: "huge frame", reply: []byte{1, 0, 0, 0x7f, 0xff, 0xff, 0xff}, err: "expected a method frame"},
+		{name: "other method", reply: []byte{1, 0, 0, 0, 0, 0, 4, 0, 10, 0, 50, 0xce}, err: "expected Connection.Start, got method 10.50"},
+		{name: "truncated method", reply: []byte{1, 0, 0, 0, 0, 0, 6, 0, 10, 0, 10, 0, 9, 0xce}, err: "Connection.Start: truncated field"},
+		{name: "http", reply: []byte("HTTP/1.1 400 Bad Request\r\n"), err: "expected a method frame"},
+	}
+	for _, tt := range tests {
+		addr := serveProbe(t, writeAfter(8, tt.reply))
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, _, err := runProbe(ctx, "amqp", addr, false)
+		cancel()
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
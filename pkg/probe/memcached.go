@@ -0,0 +1,26 @@
+package probe
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// probeMemcached asks the server for its version with the text protocol.
+func probeMemcached(c *conn) (map[string]interface{}, error) {
+	began := time.Now()
+	if err := c.writeString("version\r\n"); err != nil {
+		return nil, err
+	}
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	version, ok := strings.CutPrefix(line, "VERSION ")
+	if !ok {
+		// ERROR, CLIENT_ERROR or SERVER_ERROR, or not memcached at all
+		return nil, fmt.Errorf("unexpected reply to version: %s", short([]byte(line)))
+	}
+	c.emit("memcached_version", time.Since(began), map[string]interface{}{"version": version})
+	return map[string]interface{}{"server_version": version}, nil
+}
@@ -0,0 +1,63 @@
+package probe
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// mqttReturnCodes are the CONNACK return codes of MQTT 3.1.1.
+var mqttReturnCodes = []string{
+	"accepted",
+	"unacceptable protocol version",
+	"identifier rejected",
+	"server unavailable",
+	"bad user name or password",
+	"not authorized",
+}
+
+// probeMQTT connects as an anonymous MQTT 3.1.1 client with a clean session
+// and reports the broker's CONNACK. Brokers that require credentials refuse
+// the connection, which the probe reports rather than fails on.
+func probeMQTT(c *conn) (map[string]interface{}, error) {
+	id := make([]byte, 6)
+	_, _ = rand.Read(id)
+	clientID := "tracer-" + hex.EncodeToString(id)
+
+	// variable header: protocol name, level 4, clean session, keep alive 30s
+	body := []byte{0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 30, 0, byte(len(clientID))}
+	body = append(body, clientID...)
+	// the body is shorter than 128 bytes, so its length is a single byte
+	pkt := append([]byte{0x10, byte(len(body))}, body...)
+
+	began := time.Now()
+	if _, err := c.Write(pkt); err != nil {
+		return nil, err
+	}
+	var ack [4]byte
+	if err := c.readFull(ack[:]); err != nil {
+		return nil, err
+	}
+	if ack[0] != 0x20 || ack[1] != 2 {
+		return nil, fmt.Errorf("expected CONNACK, got %s", short(ack[:]))
+	}
+	code := int(ack[3])
+	reason := fmt.Sprintf("unknown (%d)", code)
+	if code < len(mqttReturnCodes) {
+		reason = mqttReturnCodes[code]
+	}
+	// 4 and 5: the broker wants credentials
+	authRequired := code == 4 || code == 5
+	c.emit("mqtt_connack", time.Since(began), map[string]interface{}{
+		"client_id":       clientID,
+		"session_present": ack[2]&1 != 0,
+		"return_code":     code,
+		"reason":          reason,
+		"auth_required":   authRequired,
+	})
+	if code == 0 {
+		_, _ = c.Write([]byte{0xe0, 0}) // DISCONNECT
+	}
+	return map[string]interface{}{"accepted": code == 0, "return_code": code, "auth_required": authRequired}, nil
+}
@@ -0,0 +1,105 @@
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// MySQL capability flags reported by the probe.
+const (
+	mysqlClientSSL        = 0x00000800
+	mysqlClientPluginAuth = 0x00080000
+)
+
+// probeMySQL reads the initial handshake the server sends on connect, which
+// carries its version, capabilities and default authentication plugin.
+// MariaDB speaks the same protocol.
+func probeMySQL(c *conn) (map[string]interface{}, error) {
+	began := time.Now()
+	pkt, err := c.mysqlPacket()
+	if err != nil {
+		return nil, err
+	}
+	if len(pkt) == 0 {
+		return nil, fmt.Errorf("empty handshake packet")
+	}
+	if pkt[0] == 0xff {
+		// refused before the handshake, e.g. "Host is not allowed to
+		// connect" or too many connections
+		code, msg := mysqlError(pkt)
+		c.emit("mysql_error", time.Since(began), map[string]interface{}{"code": code, "message": msg})
+		return map[string]interface{}{"error_code": code, "error": msg}, nil
+	}
+	if pkt[0] != 10 {
+		return nil, fmt.Errorf("unsupported handshake protocol version %d", pkt[0])
+	}
+
+	version, rest, ok := bytes.Cut(pkt[1:], []byte{0})
+	// connection id, 8 bytes of auth data, filler, lower capabilities
+	if !ok || len(rest) < 15 {
+		return nil, fmt.Errorf("truncated handshake packet")
+	}
+	payload := map[string]interface{}{"protocol_version": 10, "server_version": string(version), "connection_id": binary.LittleEndian.Uint32(rest)}
+	caps := uint32(binary.LittleEndian.Uint16(rest[13:]))
+	rest = rest[15:]
+	var plugin string
+	// character set, status, upper capabilities, auth data length and ten
+	// reserved bytes
+	if len(rest) >= 16 {
+		payload["charset"] = rest[0]
+		caps |= uint32(binary.LittleEndian.Uint16(rest[3:])) << 16
+		authLen := int(rest[5])
+		rest = rest[16:]
+		// the rest of the auth data, at least 13 bytes
+		n := max(13, authLen-8)
+		if caps&mysqlClientPluginAuth != 0 && len(rest) >= n {
+			name, _, _ := bytes.Cut(rest[n:], []byte{0})
+			plugin = string(name)
+		}
+	}
+	payload["capabilities"] = fmt.Sprintf("0x%08x", caps)
+	payload["ssl"] = caps&mysqlClientSSL != 0
+	if plugin != "" {
+		payload["auth_plugin"] = plugin
+	}
+	c.emit("mysql_handshake", time.Since(began), payload)
+
+	summary := map[string]interface{}{"server_version": string(version), "ssl": caps&mysqlClientSSL != 0}
+	if plugin != "" {
+		summary["auth_methods"] = []string{plugin}
+	}
+	return summary, nil
+}
+
+// mysqlError parses an ERR packet.
+func mysqlError(pkt []byte) (int, string) {
+	if len(pkt) < 3 {
+		return 0, ""
+	}
+	code := int(binary.LittleEndian.Uint16(pkt[1:]))
+	msg := pkt[3:]
+	// '#' and the SQL state, when present
+	if len(msg) >= 6 && msg[0] == '#' {
+		msg = msg[6:]
+	}
+	return code, string(msg)
+}
+
+// mysqlPacket reads one packet and returns its payload.
+func (c *conn) mysqlPacket() ([]byte, error) {
+	var hdr [4]byte
+	if err := c.readFull(hdr[:]); err != nil {
+		return nil, err
+	}
+	n := int(hdr[0]) | int(hdr[1])<<8 | int(hdr[2])<<16
+	if n > 1<<16 {
+		return nil, fmt.Errorf("not a MySQL packet: %s", short(hdr[:]))
+	}
+	pkt := make([]byte, n)
+	if err := c.readFull(pkt); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
@@ -0,0 +1,71 @@
+package probe
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestProbeMySQL(t *testing.T) {
+	full := mysqlHandshake("10.11.6-MariaDB", "mysql_native_password")
+	tests := []struct {
+		name    string
+		in      []byte
+		summary map[string]string
+		err     string
+	}{
+		{
+			name:    "handshake",
+			in:      mysqlPacketBytes(full),
+			summary: map[string]string{"server_version": "10.11.6-MariaDB", "ssl": "true", "auth_methods": "[mysql_native_password]"},
+		},
+		{
+			// servers before 4.1 stop after the lower capabilities
+			name:    "short handshake",
+			in:      mysqlPacketBytes(full[:1+len("10.11.6-MariaDB\x00")+15]),
+			summary: map[string]string{"server_version": "10.11.6-MariaDB", "ssl": "true", "auth_methods": "<nil>"},
+		},
+		{
+			name:    "handshake cut in the auth data",
+			in:      mysqlPacketBytes(full[:len(full)-len("mysql_native_password\x00")-5]),
+			summary: map[string]string{"server_version": "10.11.6-MariaDB", "auth_methods": "<nil>"},
+		},
+		{
+			name:    "error packet",
+			in:      mysqlPacketBytes([]byte("\xff\x10\x04#08004Too many connections")),
+			summary: map[string]string{"error_code": "1040", "error": "Too many connections"},
+		},
+		{
+			name:    "error packet without SQL state",
+			in:      mysqlPacketBytes([]byte("\xff\x6a\x04Host is blocked")),
+			summary: map[string]string{"error_code": "1130", "error": "Host is blocked"},
+		},
+		{name: "short error packet", in: mysqlPacketBytes([]byte("\xff\x01")), summary: map[string]string{"error_code": "0", "error": ""}},
+		{name: "empty packet", in: mysqlPacketBytes(nil), err: "empty handshake packet"},
+		{name: "protocol 9", in: mysqlPacketBytes([]byte("\x093.22\x00")), err: "unsupported handshake protocol version 9"},
+		{name: "no version terminator", in: mysqlPacketBytes([]byte("\x0a8.0.36")), err: "truncated handshake packet"},
+		{name: "truncated handshake", in: mysqlPacketBytes(full[:20]), err: "truncated handshake packet"},
+		{name: "truncated packet", in: mysqlPacketBytes(full)[:30], err: "EOF"},
+		{name: "eof", in: nil, err: "EOF"},
+		{name: "too long", in: []byte("\xff\xff\xff\x00"), err: "not a MySQL packet"},
+		{name: "http", in: []byte("HTTP/1.1 400 Bad Request\r\n"), err: "not a MySQL packet"},
+	}
+	for _, tt := range tests {
+		summary, err := probeMySQL(readerConn(string(tt.in)))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		for k, want := range tt.summary {
+			if got := fmt.Sprint(summary[k]); got != want {
+				t.Errorf("%s: %s = %s, want %s", tt.name, k, got, want)
+			}
+		}
+	}
+}
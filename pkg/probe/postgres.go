@@ -0,0 +1,172 @@
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// postgresUser is the user (and database) named in the startup message.
+// Servers answer with the authentication they require before checking that
+// the user exists.
+const postgresUser = "tracer"
+
+// probePostgres asks for TLS with an SSLRequest, sends a startup message and
+// reports the authentication the server asks for. Servers that trust the
+// client report their parameters, including server_version.
+func probePostgres(c *conn) (map[string]interface{}, error) {
+	summary := map[string]interface{}{}
+	if !c.tls {
+		began := time.Now()
+		// length, then the SSLRequest code 1234.5679
+		if _, err := c.Write([]byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}); err != nil {
+			return nil, err
+		}
+		answer, err := c.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if answer != 'S' && answer != 'N' {
+			return nil, fmt.Errorf("unexpected answer to SSLRequest: %q", answer)
+		}
+		c.emit("postgres_ssl", time.Since(began), map[string]interface{}{"supported": answer == 'S'})
+		summary["ssl"] = answer == 'S'
+		if answer == 'S' {
+			if !c.canStartTLS() {
+				return nil, fmt.Errorf("server accepted SSLRequest but TLS is not available")
+			}
+			if err := c.startTLS(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	summary["tls"] = c.tls
+
+	began := time.Now()
+	var startup bytes.Buffer
+	startup.Write([]byte{0, 0, 0, 0, 0, 3, 0, 0}) // length, protocol 3.0
+	for _, kv := range []string{"user", postgresUser, "database", postgresUser, "application_name", "tracer"} {
+		startup.WriteString(kv)
+		startup.WriteByte(0)
+	}
+	startup.WriteByte(0)
+	msg := startup.Bytes()
+	binary.BigEndian.PutUint32(msg, uint32(len(msg)))
+	if _, err := c.Write(msg); err != nil {
+		return nil, err
+	}
+	// Terminate, once we are done
+	defer c.Write([]byte{'X', 0, 0, 0, 4})
+
+	params := map[string]interface{}{}
+	for {
+		typ, body, err := c.postgresMessage()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case 'R':
+			if len(body) < 4 {
+				return nil, fmt.Errorf("truncated authentication request")
+			}
+			method, mechanisms := postgresAuth(binary.BigEndian.Uint32(body), body[4:])
+			if method == "ok" {
+				// trusted: the parameters and ReadyForQuery follow
+				continue
+			}
+			payload := map[string]interface{}{"method": method}
+			summary["auth_method"] = method
+			summary["auth_methods"] = []string{method}
+			if len(mechanisms) > 0 {
+				payload["mechanisms"] = mechanisms
+				summary["auth_methods"] = mechanisms
+			}
+			c.emit("postgres_auth", time.Since(began), payload)
+			return summary, nil
+		case 'E':
+			// the server is up but refuses us (pg_hba.conf, too many
+			// connections, ...), which is still an answer
+			fields := postgresFields(body)
+			payload := map[string]interface{}{"severity": fields['V'], "code": fields['C'], "message": fields['M']}
+			if payload["severity"] == "" {
+				payload["severity"] = fields['S']
+			}
+			c.emit("postgres_error", time.Since(began), payload)
+			summary["error_code"] = fields['C']
+			summary["error"] = fields['M']
+			return summary, nil
+		case 'S':
+			name, value, _ := strings.Cut(strings.TrimSuffix(string(body), "\x00"), "\x00")
+			params[name] = value
+		case 'Z':
+			c.emit("postgres_auth", time.Since(began), map[string]interface{}{"method": "trust"})
+			c.emit("postgres_params", time.Since(began), params)
+			summary["auth_method"] = "trust"
+			if v, ok := params["server_version"]; ok {
+				summary["server_version"] = v
+			}
+			return summary, nil
+		}
+		// BackendKeyData, notices and NegotiateProtocolVersion are skipped
+	}
+}
+
+// postgresAuth names the authentication requested by an Authentication
+// message and, for SASL, the mechanisms offered.
+func postgresAuth(code uint32, rest []byte) (string, []string) {
+	switch code {
+	case 0:
+		return "ok", nil
+	case 2:
+		return "kerberos_v5", nil
+	case 3:
+		return "password", nil
+	case 5:
+		return "md5", nil
+	case 7:
+		return "gss", nil
+	case 9:
+		return "sspi", nil
+	case 10:
+		var mechanisms []string
+		for _, m := range bytes.Split(rest, []byte{0}) {
+			if len(m) > 0 {
+				mechanisms = append(mechanisms, string(m))
+			}
+		}
+		return "sasl", mechanisms
+	default:
+		return fmt.Sprintf("unknown(%d)", code), nil
+	}
+}
+
+// postgresFields parses the fields of an ErrorResponse or NoticeResponse.
+func postgresFields(body []byte) map[byte]string {
+	fields := map[byte]string{}
+	for len(body) > 1 && body[0] != 0 {
+		k := body[0]
+		v, rest, _ := bytes.Cut(body[1:], []byte{0})
+		fields[k] = string(v)
+		body = rest
+	}
+	return fields
+}
+
+// postgresMessage reads one backend message.
+func (c *conn) postgresMessage() (byte, []byte, error) {
+	var hdr [5]byte
+	if err := c.readFull(hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n < 4 || n > 1<<20 {
+		return 0, nil, fmt.Errorf("not a PostgreSQL message: %s", short(hdr[:]))
+	}
+	body := make([]byte, n-4)
+	if err := c.readFull(body); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], body, nil
+}
@@ -0,0 +1,81 @@
+package probe
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPostgresMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		typ  byte
+		body string
+		err  string
+	}{
+		{name: "message", in: string(postgresMsg('Z', "I")), typ: 'Z', body: "I"},
+		{name: "empty body", in: "N\x00\x00\x00\x04", typ: 'N', body: ""},
+		{name: "eof", in: "", err: "EOF"},
+		{name: "truncated header", in: "R\x00\x00", err: "EOF"},
+		{name: "truncated body", in: "R\x00\x00\x00\x08\x00\x00", err: "EOF"},
+		{name: "length below the header", in: "R\x00\x00\x00\x03", err: "not a PostgreSQL message"},
+		{name: "too long", in: "R\x7f\xff\xff\xff", err: "not a PostgreSQL message"},
+		{name: "http", in: "HTTP/1.1 400 Bad Request\r\n", err: "not a PostgreSQL message"},
+	}
+	for _, tt := range tests {
+		typ, body, err := readerConn(tt.in).postgresMessage()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || typ != tt.typ || string(body) != tt.body {
+			t.Errorf("%s: postgresMessage = %q, %q, %v; want %q, %q", tt.name, typ, body, err, tt.typ, tt.body)
+		}
+	}
+}
+
+func TestPostgresAuth(t *testing.T) {
+	tests := []struct {
+		code       uint32
+		rest       string
+		method     string
+		mechanisms []string
+	}{
+		{code: 0, method: "ok"},
+		{code: 3, method: "password"},
+		{code: 5, rest: "salt", method: "md5"},
+		{code: 10, rest: "SCRAM-SHA-256-PLUS\x00SCRAM-SHA-256\x00\x00", method: "sasl", mechanisms: []string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256"}},
+		// a list cut short still names the complete mechanisms
+		{code: 10, rest: "SCRAM-SHA-256", method: "sasl", mechanisms: []string{"SCRAM-SHA-256"}},
+		{code: 10, method: "sasl"},
+		{code: 42, method: "unknown(42)"},
+	}
+	for _, tt := range tests {
+		method, mechanisms := postgresAuth(tt.code, []byte(tt.rest))
+		if method != tt.method || !reflect.DeepEqual(mechanisms, tt.mechanisms) {
+			t.Errorf("postgresAuth(%d, %q) = %s, %q; want %s, %q", tt.code, tt.rest, method, mechanisms, tt.method, tt.mechanisms)
+		}
+	}
+}
+
+func TestPostgresFields(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[byte]string
+	}{
+		{in: "SFATAL\x00C28000\x00Mno entry\x00\x00", want: map[byte]string{'S': "FATAL", 'C': "28000", 'M': "no entry"}},
+		{in: "", want: map[byte]string{}},
+		{in: "\x00", want: map[byte]string{}},
+		// a field cut short keeps what was sent
+		{in: "SERR\x00Mhalf", want: map[byte]string{'S': "ERR", 'M': "half"}},
+		{in: "M", want: map[byte]string{}},
+	}
+	for _, tt := range tests {
+		if got := postgresFields([]byte(tt.in)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("postgresFields(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
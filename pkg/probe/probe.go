@@ -0,0 +1,176 @@
+// Package probe performs the opening handshake of common TCP services
+// (Redis, PostgreSQL, MySQL, SMTP, SSH, memcached, MQTT, AMQP) on a
+// connection opened by the tcp or tls tracer, and reports what the server
+// tells about itself: its version, the authentication methods it offers and
+// whether it supports TLS.
+package probe
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Env is what a probe needs from the tracer running it.
+type Env struct {
+	// Conn is the open connection; a TLS connection for the tls tracer.
+	Conn net.Conn
+	// TLS is set when Conn is already a TLS connection.
+	TLS bool
+	// Emit reports an event on the trace; kind is "lifecycle" or "error".
+	Emit func(kind, stage string, d time.Duration, payload map[string]interface{})
+	// StartTLS runs a TLS client handshake over conn for protocols that
+	// negotiate TLS in-band (SMTP STARTTLS, the PostgreSQL SSLRequest). Nil
+	// leaves such servers in plaintext.
+	StartTLS func(conn net.Conn) (net.Conn, error)
+	// Timeout bounds the whole handshake (0: no limit).
+	Timeout time.Duration
+}
+
+// probe runs the handshake on c and returns the summary reported by
+// probe_done.
+type probe struct {
+	port string
+	run  func(c *conn) (map[string]interface{}, error)
+}
+
+var probes = map[string]probe{
+	"amqp":      {"5672", probeAMQP},
+	"memcached": {"11211", probeMemcached},
+	"mqtt":      {"1883", probeMQTT},
+	"mysql":     {"3306", probeMySQL},
+	"postgres":  {"5432", probePostgres},
+	"redis":     {"6379", probeRedis},
+	"smtp":      {"25", probeSMTP},
+	"ssh":       {"22", probeSSH},
+}
+
+// Names returns the available probes, sorted.
+func Names() []string {
+	names := make([]string, 0, len(probes))
+	for name := range probes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Check returns an error if there is no probe called name.
+func Check(name string) error {
+	if _, ok := probes[name]; !ok {
+		return fmt.Errorf("unknown probe %q (available: %s)", name, strings.Join(Names(), ", "))
+	}
+	return nil
+}
+
+// DefaultPort returns the well-known port of the named probe's service.
+func DefaultPort(name string) string { return probes[name].port }
+
+// Run performs the named probe's handshake on env.Conn. The events of each
+// exchange are prefixed with the probe name (redis_ping, smtp_ehlo, ...);
+// the summary follows as probe_done, or probe_error when the server did not
+// answer as expected.
+func Run(ctx context.Context, name string, env Env) error {
+	p, ok := probes[name]
+	if !ok {
+		return Check(name)
+	}
+	if env.Timeout > 0 {
+		_ = env.Conn.SetDeadline(time.Now().Add(env.Timeout))
+	}
+	c := &conn{env: env, Conn: env.Conn, r: bufio.NewReader(env.Conn), tls: env.TLS}
+	// unblock the handshake when the trace is cancelled; closing the
+	// underlying connection also ends a TLS upgrade running on it
+	stop := context.AfterFunc(ctx, func() { env.Conn.Close() })
+	defer stop()
+
+	start := time.Now()
+	summary, err := p.run(c)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		env.Emit("error", "probe_error", time.Since(start), map[string]interface{}{"probe": name, "error": err.Error()})
+		return fmt.Errorf("%s probe: %w", name, err)
+	}
+	summary["probe"] = name
+	env.Emit("lifecycle", "probe_done", time.Since(start), summary)
+	return nil
+}
+
+// conn is the connection a probe talks on. Reads go through r, which is
+// replaced along with Conn when the connection is upgraded to TLS.
+type conn struct {
+	env Env
+	net.Conn
+	r   *bufio.Reader
+	tls bool
+}
+
+func (c *conn) emit(stage string, d time.Duration, payload map[string]interface{}) {
+	c.env.Emit("lifecycle", stage, d, payload)
+}
+
+// canStartTLS reports whether an in-band TLS upgrade is possible.
+func (c *conn) canStartTLS() bool { return !c.tls && c.env.StartTLS != nil }
+
+// startTLS upgrades the connection; the tracer reports the handshake.
+func (c *conn) startTLS() error {
+	if c.r.Buffered() > 0 {
+		// data sent before the handshake could be injected by anyone on
+		// the path (CVE-2011-0411 and similar)
+		return fmt.Errorf("server sent %d unexpected bytes before the TLS handshake", c.r.Buffered())
+	}
+	tc, err := c.env.StartTLS(c.Conn)
+	if err != nil {
+		return err
+	}
+	c.Conn, c.r, c.tls = tc, bufio.NewReader(tc), true
+	return nil
+}
+
+// maxLine bounds the text lines read from servers.
+const maxLine = 64 << 10
+
+// readLine reads a CRLF- or LF-terminated line without its terminator.
+func (c *conn) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, more, err := c.r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxLine {
+			return "", fmt.Errorf("line longer than %d bytes", maxLine)
+		}
+		if !more {
+			return string(line), nil
+		}
+	}
+}
+
+// readFull reads exactly len(b) bytes.
+func (c *conn) readFull(b []byte) error {
+	_, err := io.ReadFull(c.r, b)
+	return err
+}
+
+// writeString writes s in full.
+func (c *conn) writeString(s string) error {
+	_, err := c.Write([]byte(s))
+	return err
+}
+
+// short quotes at most 80 bytes of unexpected data for error messages.
+func short(b []byte) string {
+	if len(b) > 80 {
+		return fmt.Sprintf("%q…", b[:80])
+	}
+	return fmt.Sprintf("%q", b)
+}
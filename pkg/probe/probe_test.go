@@ -0,0 +1,490 @@
+package probe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveProbe accepts connections on a loopback port and runs h on each until
+// the test ends.
+func serveProbe(t *testing.T, h func(net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				h(c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// serverTLS returns a TLS configuration with a throwaway certificate for the
+// fake servers that upgrade in-band.
+func serverTLS(t *testing.T) *tls.Config {
+	t.Helper()
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(ts.Close)
+	return &tls.Config{Certificates: ts.TLS.Certificates}
+}
+
+// runProbe runs the named probe against addr and returns the stages of its
+// events in order, with the payload of the last event of each stage.
+func runProbe(ctx context.Context, name, addr string, startTLS bool) ([]string, map[string]map[string]interface{}, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	var stages []string
+	payloads := map[string]map[string]interface{}{}
+	env := Env{
+		Conn: conn,
+		Emit: func(_, stage string, _ time.Duration, payload map[string]interface{}) {
+			stages = append(stages, stage)
+			payloads[stage] = payload
+		},
+		Timeout: 5 * time.Second,
+	}
+	if startTLS {
+		env.StartTLS = func(conn net.Conn) (net.Conn, error) {
+			tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+			return tc, tc.Handshake()
+		}
+	}
+	err = Run(ctx, name, env)
+	return stages, payloads, err
+}
+
+// readerConn returns a conn that reads data, for testing the parsers that
+// only read.
+func readerConn(data string) *conn {
+	return &conn{
+		env: Env{Emit: func(string, string, time.Duration, map[string]interface{}) {}},
+		r:   bufio.NewReader(strings.NewReader(data)),
+	}
+}
+
+func redisServer(reply func(args []string) string) func(net.Conn) {
+	return func(c net.Conn) {
+		r := bufio.NewReader(c)
+		for {
+			var n int
+			if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+				return
+			}
+			args := make([]string, n)
+			for i := range args {
+				var size int
+				if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+					return
+				}
+				b := make([]byte, size+2)
+				if _, err := io.ReadFull(r, b); err != nil {
+					return
+				}
+				args[i] = string(b[:size])
+			}
+			c.Write([]byte(reply(args)))
+		}
+	}
+}
+
+func redisOpen(args []string) string {
+	if strings.ToUpper(args[0]) == "PING" {
+		return "+PONG\r\n"
+	}
+	info := "# Server\r\nredis_version:7.2.4\r\nredis_mode:standalone\r\nos:Linux\r\n"
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(info), info)
+}
+
+func smtpServer(srvTLS *tls.Config) func(net.Conn) {
+	return func(c net.Conn) {
+		var conn net.Conn = c
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("220 mx.example.test ESMTP\r\n"))
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd, _, _ := strings.Cut(strings.TrimSpace(line), " "); cmd {
+			case "EHLO":
+				if conn != c {
+					conn.Write([]byte("250-mx.example.test\r\n250-AUTH PLAIN login\r\n250-AUTH=LOGIN\r\n250 SIZE 1024\r\n"))
+				} else {
+					conn.Write([]byte("250-mx.example.test\r\n250-STARTTLS\r\n250 SIZE 1024\r\n"))
+				}
+			case "STARTTLS":
+				conn.Write([]byte("220 Ready to start TLS\r\n"))
+				tc := tls.Server(c, srvTLS)
+				if tc.Handshake() != nil {
+					return
+				}
+				conn, r = tc, bufio.NewReader(tc)
+			case "QUIT":
+				conn.Write([]byte("221 Bye\r\n"))
+				return
+			}
+		}
+	}
+}
+
+func sshServer(c net.Conn) {
+	c.Write([]byte("banner line\r\nSSH-2.0-OpenSSH_9.6 Ubuntu\r\n"))
+	c.Write(sshPacketBytes(kexInit("curve25519-sha256", "ssh-ed25519,rsa-sha2-512", "aes256-gcm@openssh.com", "hmac-sha2-256", "none")))
+	io.Copy(io.Discard, c)
+}
+
+// kexInit builds a KEXINIT payload offering the given algorithms in both
+// directions.
+func kexInit(kex, hostKey, cipher, mac, compression string) []byte {
+	var p bytes.Buffer
+	p.WriteByte(20)
+	p.Write(make([]byte, 16))
+	for _, l := range []string{kex, hostKey, cipher, cipher, mac, mac, compression, compression, "", ""} {
+		binary.Write(&p, binary.BigEndian, uint32(len(l)))
+		p.WriteString(l)
+	}
+	p.Write([]byte{0, 0, 0, 0, 0})
+	return p.Bytes()
+}
+
+// sshPacketBytes frames payload as an unencrypted binary packet.
+func sshPacketBytes(payload []byte) []byte {
+	pad := 8 - (len(payload)+5)%8
+	if pad < 4 {
+		pad += 8
+	}
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+pad+1))
+	b = append(b, byte(pad))
+	b = append(b, payload...)
+	return append(b, make([]byte, pad)...)
+}
+
+func postgresMsg(typ byte, body string) []byte {
+	b := []byte{typ}
+	b = binary.BigEndian.AppendUint32(b, uint32(len(body)+4))
+	return append(b, body...)
+}
+
+// postgresServer answers the SSLRequest, upgrading when srvTLS is set, reads
+// the startup message and sends reply.
+func postgresServer(srvTLS *tls.Config, reply ...[]byte) func(net.Conn) {
+	return func(c net.Conn) {
+		var conn net.Conn = c
+		var hdr [8]byte
+		if _, err := io.ReadFull(c, hdr[:]); err != nil || binary.BigEndian.Uint32(hdr[4:]) != 80877103 {
+			return
+		}
+		if srvTLS != nil {
+			c.Write([]byte("S"))
+			tc := tls.Server(c, srvTLS)
+			if tc.Handshake() != nil {
+				return
+			}
+			conn = tc
+		} else {
+			c.Write([]byte("N"))
+		}
+		if _, err := io.ReadFull(conn, hdr[:4]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, binary.BigEndian.Uint32(hdr[:4])-4)); err != nil {
+			return
+		}
+		conn.Write(bytes.Join(reply, nil))
+		io.Copy(io.Discard, conn)
+	}
+}
+
+func mysqlPacketBytes(payload []byte) []byte {
+	return append([]byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), 0}, payload...)
+}
+
+// mysqlHandshake builds a protocol 10 handshake with every capability set.
+func mysqlHandshake(version, plugin string) []byte {
+	var p bytes.Buffer
+	p.WriteByte(10)
+	p.WriteString(version + "\x00")
+	binary.Write(&p, binary.LittleEndian, uint32(42))
+	p.WriteString("abcdefgh\x00")
+	binary.Write(&p, binary.LittleEndian, uint16(0xffff))
+	p.WriteByte(255)
+	binary.Write(&p, binary.LittleEndian, uint16(2))
+	binary.Write(&p, binary.LittleEndian, uint16(0xffff))
+	p.WriteByte(21)
+	p.Write(make([]byte, 10))
+	p.WriteString("ijklmnopqrst\x00")
+	p.WriteString(plugin + "\x00")
+	return p.Bytes()
+}
+
+func amqpLongString(s string) string {
+	return string(binary.BigEndian.AppendUint32(nil, uint32(len(s)))) + s
+}
+
+// amqpStart builds a Connection.Start frame from an encoded field table.
+func amqpStart(table, mechanisms string) []byte {
+	m := "\x00\x0a\x00\x0a\x00\x09" + amqpLongString(table) + amqpLongString(mechanisms) + amqpLongString("en_US")
+	f := binary.BigEndian.AppendUint32([]byte{1, 0, 0}, uint32(len(m)))
+	return append(append(f, m...), 0xce)
+}
+
+// writeAfter reads n bytes, then sends reply, closes its side of the
+// connection and waits for the client to close it.
+func writeAfter(n int, reply []byte) func(net.Conn) {
+	return func(c net.Conn) {
+		if _, err := io.ReadFull(c, make([]byte, n)); err != nil {
+			return
+		}
+		c.Write(reply)
+		c.(*net.TCPConn).CloseWrite()
+		io.Copy(io.Discard, c)
+	}
+}
+
+// answerLines answers every line read with reply.
+func answerLines(reply string) func(net.Conn) {
+	return func(c net.Conn) {
+		r := bufio.NewReader(c)
+		for {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+			c.Write([]byte(reply))
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	srvTLS := serverTLS(t)
+	rabbit := "\x07productS" + amqpLongString("RabbitMQ") + "\x07versionS" + amqpLongString("3.13.0") +
+		"\x0ccapabilitiesF" + amqpLongString("\x12publisher_confirmst\x01")
+	tests := []struct {
+		name     string
+		probe    string
+		serve    func(net.Conn)
+		startTLS bool
+		stages   []string
+		summary  map[string]string
+		err      string
+	}{
+		{
+			name:    "redis",
+			probe:   "redis",
+			serve:   redisServer(redisOpen),
+			stages:  []string{"redis_ping", "redis_info", "probe_done"},
+			summary: map[string]string{"auth_required": "false", "server_version": "7.2.4", "mode": "standalone"},
+		},
+		{
+			name:    "redis with requirepass",
+			probe:   "redis",
+			serve:   redisServer(func([]string) string { return "-NOAUTH Authentication required.\r\n" }),
+			stages:  []string{"redis_ping", "probe_done"},
+			summary: map[string]string{"auth_required": "true"},
+		},
+		{
+			name:   "redis garbage",
+			probe:  "redis",
+			serve:  redisServer(func([]string) string { return "hello\r\n" }),
+			stages: []string{"probe_error"},
+			err:    "not a Redis reply",
+		},
+		{
+			name:    "memcached",
+			probe:   "memcached",
+			serve:   answerLines("VERSION 1.6.21\r\n"),
+			stages:  []string{"memcached_version", "probe_done"},
+			summary: map[string]string{"server_version": "1.6.21"},
+		},
+		{
+			name:     "smtp with STARTTLS",
+			probe:    "smtp",
+			serve:    smtpServer(srvTLS),
+			startTLS: true,
+			stages:   []string{"smtp_greeting", "smtp_ehlo", "smtp_starttls", "smtp_ehlo", "probe_done"},
+			summary:  map[string]string{"starttls": "true", "tls": "true", "auth_methods": "[PLAIN LOGIN]"},
+		},
+		{
+			name:    "smtp without TLS",
+			probe:   "smtp",
+			serve:   smtpServer(srvTLS),
+			stages:  []string{"smtp_greeting", "smtp_ehlo", "probe_done"},
+			summary: map[string]string{"starttls": "true", "tls": "false", "auth_methods": "<nil>"},
+		},
+		{
+			name:    "ssh",
+			probe:   "ssh",
+			serve:   sshServer,
+			stages:  []string{"ssh_ident", "ssh_kexinit", "probe_done"},
+			summary: map[string]string{"server_version": "OpenSSH_9.6", "proto_version": "2.0", "host_key_algorithms": "[ssh-ed25519 rsa-sha2-512]"},
+		},
+		{
+			name:     "postgres with SSL and SCRAM",
+			probe:    "postgres",
+			serve:    postgresServer(srvTLS, postgresMsg('R', "\x00\x00\x00\x0aSCRAM-SHA-256-PLUS\x00SCRAM-SHA-256\x00\x00")),
+			startTLS: true,
+			stages:   []string{"postgres_ssl", "postgres_auth", "probe_done"},
+			summary:  map[string]string{"ssl": "true", "tls": "true", "auth_method": "sasl", "auth_methods": "[SCRAM-SHA-256-PLUS SCRAM-SHA-256]"},
+		},
+		{
+			name:  "postgres trust",
+			probe: "postgres",
+			serve: postgresServer(nil,
+				postgresMsg('R', "\x00\x00\x00\x00"),
+				postgresMsg('S', "server_version\x0016.2\x00"),
+				postgresMsg('K', "\x00\x00\x00\x01\x00\x00\x00\x02"),
+				postgresMsg('Z', "I")),
+			stages:  []string{"postgres_ssl", "postgres_auth", "postgres_params", "probe_done"},
+			summary: map[string]string{"ssl": "false", "auth_method": "trust", "server_version": "16.2"},
+		},
+		{
+			name:    "postgres refusing the client",
+			probe:   "postgres",
+			serve:   postgresServer(nil, postgresMsg('E', "SFATAL\x00VFATAL\x00C28000\x00Mno pg_hba.conf entry\x00\x00")),
+			stages:  []string{"postgres_ssl", "postgres_error", "probe_done"},
+			summary: map[string]string{"error_code": "28000", "error": "no pg_hba.conf entry"},
+		},
+		{
+			name:   "postgres SSL without StartTLS",
+			probe:  "postgres",
+			serve:  writeAfter(8, []byte("S")),
+			stages: []string{"postgres_ssl", "probe_error"},
+			err:    "TLS is not available",
+		},
+		{
+			name:    "mysql",
+			probe:   "mysql",
+			serve:   writeAfter(0, mysqlPacketBytes(mysqlHandshake("8.0.36", "caching_sha2_password"))),
+			stages:  []string{"mysql_handshake", "probe_done"},
+			summary: map[string]string{"server_version": "8.0.36", "ssl": "true", "auth_methods": "[caching_sha2_password]"},
+		},
+		{
+			name:    "mysql refusing the host",
+			probe:   "mysql",
+			serve:   writeAfter(0, mysqlPacketBytes([]byte("\xff\x6a\x04#HY000Host is not allowed"))),
+			stages:  []string{"mysql_error", "probe_done"},
+			summary: map[string]string{"error_code": "1130", "error": "Host is not allowed"},
+		},
+		{
+			name:    "mqtt",
+			probe:   "mqtt",
+			serve:   writeAfter(2, []byte{0x20, 2, 0, 0}),
+			stages:  []string{"mqtt_connack", "probe_done"},
+			summary: map[string]string{"accepted": "true", "auth_required": "false"},
+		},
+		{
+			name:    "mqtt requiring credentials",
+			probe:   "mqtt",
+			serve:   writeAfter(2, []byte{0x20, 2, 0, 5}),
+			stages:  []string{"mqtt_connack", "probe_done"},
+			summary: map[string]string{"accepted": "false", "return_code": "5", "auth_required": "true"},
+		},
+		{
+			name:    "amqp",
+			probe:   "amqp",
+			serve:   writeAfter(8, amqpStart(rabbit, "AMQPLAIN PLAIN")),
+			stages:  []string{"amqp_start", "probe_done"},
+			summary: map[string]string{"server_version": "RabbitMQ 3.13.0", "auth_methods": "[AMQPLAIN PLAIN]"},
+		},
+		{
+			name:    "amqp 1.0 broker",
+			probe:   "amqp",
+			serve:   writeAfter(8, []byte("AMQP\x03\x01\x00\x00")),
+			stages:  []string{"amqp_version_mismatch", "probe_done"},
+			summary: map[string]string{"supported_version": "1.0.0 (protocol id 3)"},
+		},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		stages, payloads, err := runProbe(ctx, tt.probe, serveProbe(t, tt.serve), tt.startTLS)
+		cancel()
+		if got := strings.Join(stages, " "); got != strings.Join(tt.stages, " ") {
+			t.Errorf("%s: stages %s, want %s", tt.name, got, strings.Join(tt.stages, " "))
+		}
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		for k, want := range tt.summary {
+			if got := fmt.Sprint(payloads["probe_done"][k]); got != want {
+				t.Errorf("%s: %s = %s, want %s", tt.name, k, got, want)
+			}
+		}
+	}
+}
+
+func TestRunCancelDuringStartTLS(t *testing.T) {
+	srvTLS := serverTLS(t)
+	tests := []struct {
+		name      string
+		handshake bool
+	}{
+		// the server never answers the ClientHello
+		{name: "during the handshake"},
+		// the server goes quiet once the connection is upgraded
+		{name: "after the handshake", handshake: true},
+	}
+	for _, tt := range tests {
+		addr := serveProbe(t, func(c net.Conn) {
+			r := bufio.NewReader(c)
+			c.Write([]byte("220 mx.example.test ESMTP\r\n"))
+			r.ReadString('\n')
+			c.Write([]byte("250-mx.example.test\r\n250 STARTTLS\r\n"))
+			r.ReadString('\n')
+			c.Write([]byte("220 Ready to start TLS\r\n"))
+			if tt.handshake {
+				tc := tls.Server(c, srvTLS)
+				if tc.Handshake() != nil {
+					return
+				}
+				r = bufio.NewReader(tc)
+			}
+			io.Copy(io.Discard, r)
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(200*time.Millisecond, cancel)
+		done := make(chan error, 1)
+		go func() {
+			_, _, err := runProbe(ctx, "smtp", addr, true)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("%s: Run = %v, want context.Canceled", tt.name, err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%s: Run did not return after the context was cancelled", tt.name)
+		}
+	}
+}
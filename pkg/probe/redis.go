@@ -0,0 +1,143 @@
+package probe
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// probeRedis sends PING and, when the server does not require a password,
+// INFO server for its version.
+func probeRedis(c *conn) (map[string]interface{}, error) {
+	began := time.Now()
+	reply, isErr, err := c.redisCommand("PING")
+	if err != nil {
+		return nil, err
+	}
+	// NOAUTH from servers with requirepass, WRONGPASS/ACL errors from
+	// servers whose default user is disabled
+	authRequired := isErr && (strings.HasPrefix(reply, "NOAUTH") || strings.HasPrefix(reply, "WRONGPASS") || strings.HasPrefix(reply, "NOPERM"))
+	if isErr && !authRequired {
+		return nil, fmt.Errorf("PING: %s", reply)
+	}
+	c.emit("redis_ping", time.Since(began), map[string]interface{}{"reply": reply, "auth_required": authRequired})
+	summary := map[string]interface{}{"auth_required": authRequired}
+	if authRequired {
+		return summary, nil
+	}
+
+	began = time.Now()
+	reply, isErr, err = c.redisCommand("INFO", "server")
+	if err != nil {
+		return nil, err
+	}
+	if isErr {
+		// INFO may be renamed or denied by ACLs; PING was enough
+		c.emit("redis_info", time.Since(began), map[string]interface{}{"error": reply})
+		return summary, nil
+	}
+	info := map[string]string{}
+	for _, line := range strings.Split(reply, "\n") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(line), ":"); ok && !strings.HasPrefix(k, "#") {
+			info[k] = v
+		}
+	}
+	payload := map[string]interface{}{}
+	for _, k := range []string{"redis_version", "server_name", "valkey_version", "redis_mode", "os", "arch_bits", "uptime_in_seconds"} {
+		if v, ok := info[k]; ok {
+			payload[k] = v
+		}
+	}
+	c.emit("redis_info", time.Since(began), payload)
+	if v := info["redis_version"]; v != "" {
+		summary["server_version"] = v
+	}
+	if v := info["valkey_version"]; v != "" {
+		summary["server_version"] = "valkey " + v
+	}
+	if v := info["redis_mode"]; v != "" {
+		summary["mode"] = v
+	}
+	return summary, nil
+}
+
+// redisCommand sends a command as a RESP array and reads the reply. Error
+// replies are returned as the reply with isErr set.
+func (c *conn) redisCommand(args ...string) (reply string, isErr bool, err error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if err := c.writeString(b.String()); err != nil {
+		return "", false, err
+	}
+	return c.readRESP(0)
+}
+
+// maxRESPElems and maxRESPDepth bound the aggregates readRESP accepts.
+const (
+	maxRESPElems = 16 << 20
+	maxRESPDepth = 32
+)
+
+// readRESP reads one RESP2 or RESP3 reply nested depth aggregates deep.
+// Aggregates are flattened into their elements joined by spaces, which is
+// all a probe needs.
+func (c *conn) readRESP(depth int) (string, bool, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return "", false, err
+	}
+	if line == "" {
+		return "", false, fmt.Errorf("not a Redis reply: empty line")
+	}
+	switch body := line[1:]; line[0] {
+	case '+', ':', ',', '#', '_':
+		return body, false, nil
+	case '-':
+		return body, true, nil
+	case '$', '=', '!':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return "", false, fmt.Errorf("not a Redis reply: %s", short([]byte(line)))
+		}
+		if n < 0 {
+			return "", false, nil
+		}
+		if n > 16<<20 {
+			return "", false, fmt.Errorf("bulk reply of %d bytes", n)
+		}
+		buf := make([]byte, n+2)
+		if err := c.readFull(buf); err != nil {
+			return "", false, err
+		}
+		return string(buf[:n]), line[0] == '!', nil
+	case '*', '%', '~', '>':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return "", false, fmt.Errorf("not a Redis reply: %s", short([]byte(line)))
+		}
+		if n < -1 || n > maxRESPElems || line[0] == '%' && n > maxRESPElems/2 {
+			return "", false, fmt.Errorf("aggregate reply of %d elements", n)
+		}
+		if depth >= maxRESPDepth {
+			return "", false, fmt.Errorf("aggregate replies nested more than %d deep", maxRESPDepth)
+		}
+		if line[0] == '%' {
+			n *= 2
+		}
+		var elems []string
+		for i := 0; i < n; i++ {
+			e, _, err := c.readRESP(depth + 1)
+			if err != nil {
+				return "", false, err
+			}
+			elems = append(elems, e)
+		}
+		return strings.Join(elems, " "), false, nil
+	default:
+		return "", false, fmt.Errorf("not a Redis reply: %s", short([]byte(line)))
+	}
+}
@@ -0,0 +1,53 @@
+package probe
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadRESP(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		want  string
+		isErr bool
+		err   string
+	}{
+		{name: "simple string", in: "+PONG\r\n", want: "PONG"},
+		{name: "error", in: "-NOAUTH Authentication required.\r\n", want: "NOAUTH Authentication required.", isErr: true},
+		{name: "integer", in: ":42\r\n", want: "42"},
+		{name: "bulk string", in: "$5\r\nhello\r\n", want: "hello"},
+		{name: "null bulk string", in: "$-1\r\n", want: ""},
+		{name: "bulk error", in: "!3\r\nERR\r\n", want: "ERR", isErr: true},
+		{name: "array", in: "*3\r\n$1\r\na\r\n:1\r\n+b\r\n", want: "a 1 b"},
+		{name: "null array", in: "*-1\r\n", want: ""},
+		{name: "map", in: "%2\r\n+k1\r\n:1\r\n+k2\r\n:2\r\n", want: "k1 1 k2 2"},
+		{name: "nested", in: "*2\r\n*1\r\n+a\r\n~1\r\n+b\r\n", want: "a b"},
+		{name: "deepest nesting", in: strings.Repeat("*1\r\n", maxRESPDepth) + "+a\r\n", want: "a"},
+		{name: "eof", in: "", err: "EOF"},
+		{name: "empty line", in: "\r\n", err: "empty line"},
+		{name: "garbage", in: "hello\r\n", err: "not a Redis reply"},
+		{name: "garbage length", in: "$abc\r\n", err: "not a Redis reply"},
+		{name: "garbage count", in: "*abc\r\n", err: "not a Redis reply"},
+		{name: "truncated bulk string", in: "$5\r\nhel", err: "EOF"},
+		{name: "truncated array", in: "*2\r\n+a\r\n", err: "EOF"},
+		{name: "huge bulk string", in: "$16777217\r\n", err: "bulk reply of 16777217 bytes"},
+		{name: "huge array", in: "*16777217\r\n", err: "aggregate reply of 16777217 elements"},
+		{name: "huge map", in: "%8388609\r\n", err: "aggregate reply of 8388609 elements"},
+		{name: "overflowing map", in: "%9223372036854775807\r\n", err: "aggregate reply"},
+		{name: "negative count", in: "*-2\r\n", err: "aggregate reply of -2 elements"},
+		{name: "too deep", in: strings.Repeat("*1\r\n", maxRESPDepth+1) + "+a\r\n", err: "nested more than"},
+	}
+	for _, tt := range tests {
+		got, isErr, err := readerConn(tt.in).readRESP(0)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want || isErr != tt.isErr {
+			t.Errorf("%s: readRESP = %q, %v, %v; want %q, %v", tt.name, got, isErr, err, tt.want, tt.isErr)
+		}
+	}
+}
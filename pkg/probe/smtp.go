@@ -0,0 +1,163 @@
+package probe
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// probeSMTP reads the greeting, lists the EHLO extensions and, when the
+// server offers STARTTLS, upgrades the connection and lists them again, since
+// servers commonly only offer AUTH over TLS.
+func probeSMTP(c *conn) (map[string]interface{}, error) {
+	began := time.Now()
+	code, lines, err := c.smtpReply()
+	if err != nil {
+		return nil, err
+	}
+	if code != 220 {
+		return nil, fmt.Errorf("greeting: %d %s", code, strings.Join(lines, " "))
+	}
+	banner := lines[0]
+	c.emit("smtp_greeting", time.Since(began), map[string]interface{}{"code": code, "banner": banner})
+	summary := map[string]interface{}{"banner": banner}
+
+	ext, err := c.smtpEHLO()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ext["STARTTLS"]; ok {
+		summary["starttls"] = true
+		if c.canStartTLS() {
+			began = time.Now()
+			if err := c.writeString("STARTTLS\r\n"); err != nil {
+				return nil, err
+			}
+			code, lines, err := c.smtpReply()
+			if err != nil {
+				return nil, err
+			}
+			c.emit("smtp_starttls", time.Since(began), map[string]interface{}{"code": code, "text": strings.Join(lines, " ")})
+			if code != 220 {
+				return nil, fmt.Errorf("STARTTLS: %d %s", code, strings.Join(lines, " "))
+			}
+			if err := c.startTLS(); err != nil {
+				return nil, err
+			}
+			// the extensions offered before TLS no longer apply (RFC 3207)
+			if ext, err = c.smtpEHLO(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	summary["tls"] = c.tls
+	if methods := strings.Fields(ext["AUTH"]); len(methods) > 0 {
+		summary["auth_methods"] = methods
+	}
+
+	// be polite; the reply does not matter
+	if c.writeString("QUIT\r\n") == nil {
+		_, _, _ = c.smtpReply()
+	}
+	return summary, nil
+}
+
+// smtpEHLO sends EHLO and returns the extensions offered, keyed by their
+// upper-cased keyword.
+func (c *conn) smtpEHLO() (map[string]string, error) {
+	began := time.Now()
+	if err := c.writeString("EHLO " + c.heloName() + "\r\n"); err != nil {
+		return nil, err
+	}
+	code, lines, err := c.smtpReply()
+	if err != nil {
+		return nil, err
+	}
+	if code != 250 {
+		return nil, fmt.Errorf("EHLO: %d %s", code, strings.Join(lines, " "))
+	}
+	ext := map[string]string{}
+	var names []string
+	for _, line := range lines[1:] {
+		k, v, _ := strings.Cut(line, " ")
+		k = strings.ToUpper(k)
+		// some servers still announce AUTH=LOGIN for old Outlook clients
+		if rest, ok := strings.CutPrefix(k, "AUTH="); ok {
+			k, v = "AUTH", rest+" "+v
+		}
+		if _, seen := ext[k]; !seen {
+			names = append(names, k)
+		}
+		ext[k] = strings.TrimSpace(ext[k] + " " + v)
+	}
+	ext["AUTH"] = strings.Join(authMethods(ext["AUTH"]), " ")
+	payload := map[string]interface{}{"code": code, "domain": lines[0], "extensions": names, "tls": c.tls}
+	if ext["AUTH"] != "" {
+		payload["auth_methods"] = strings.Fields(ext["AUTH"])
+	}
+	if size := ext["SIZE"]; size != "" {
+		payload["size"] = size
+	}
+	c.emit("smtp_ehlo", time.Since(began), payload)
+	return ext, nil
+}
+
+// authMethods returns the SASL mechanisms of the AUTH extension, upper-cased
+// and without duplicates.
+func authMethods(s string) []string {
+	var methods []string
+	for _, m := range strings.Fields(strings.ToUpper(s)) {
+		if !slices.Contains(methods, m) {
+			methods = append(methods, m)
+		}
+	}
+	return methods
+}
+
+// heloName is the address literal of the local end, which RFC 5321 allows
+// when the client has no meaningful domain name.
+func (c *conn) heloName() string {
+	if a, ok := c.LocalAddr().(*net.TCPAddr); ok {
+		if a.IP.To4() != nil {
+			return "[" + a.IP.String() + "]"
+		}
+		return "[IPv6:" + a.IP.String() + "]"
+	}
+	return "localhost"
+}
+
+// smtpReply reads a possibly multi-line reply and returns its code and the
+// text of each line.
+func (c *conn) smtpReply() (int, []string, error) {
+	var lines []string
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(line) < 3 {
+			return 0, nil, fmt.Errorf("not an SMTP reply: %s", short([]byte(line)))
+		}
+		code, err := strconv.Atoi(line[:3])
+		if err != nil || code < 200 || code > 599 {
+			return 0, nil, fmt.Errorf("not an SMTP reply: %s", short([]byte(line)))
+		}
+		text := ""
+		if len(line) > 4 {
+			text = line[4:]
+		}
+		lines = append(lines, text)
+		if len(line) == 3 || line[3] == ' ' {
+			return code, lines, nil
+		}
+		if line[3] != '-' {
+			return 0, nil, fmt.Errorf("not an SMTP reply: %s", short([]byte(line)))
+		}
+		if len(lines) > 100 {
+			return 0, nil, fmt.Errorf("SMTP reply longer than 100 lines")
+		}
+	}
+}
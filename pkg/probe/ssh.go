@@ -0,0 +1,111 @@
+package probe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sshIdent is the identification string the probe sends (RFC 4253 4.2).
+const sshIdent = "SSH-2.0-tracer"
+
+// probeSSH exchanges identification strings and reads the server's KEXINIT,
+// which lists the algorithms it supports. The key exchange itself is not
+// run.
+func probeSSH(c *conn) (map[string]interface{}, error) {
+	began := time.Now()
+	if err := c.writeString(sshIdent + "\r\n"); err != nil {
+		return nil, err
+	}
+	// servers may send other lines before their identification
+	var ident string
+	var preamble int
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(line, "SSH-") {
+			ident = line
+			break
+		}
+		if preamble++; preamble > 20 {
+			return nil, fmt.Errorf("no SSH identification string: %s", short([]byte(line)))
+		}
+	}
+	// SSH-protoversion-softwareversion SP comments
+	rest, comments, _ := strings.Cut(ident[len("SSH-"):], " ")
+	protoVersion, software, ok := strings.Cut(rest, "-")
+	if !ok {
+		return nil, fmt.Errorf("malformed SSH identification string: %s", short([]byte(ident)))
+	}
+	payload := map[string]interface{}{"ident": ident, "proto_version": protoVersion, "software": software}
+	if comments != "" {
+		payload["comments"] = comments
+	}
+	if preamble > 0 {
+		payload["preamble_lines"] = preamble
+	}
+	c.emit("ssh_ident", time.Since(began), payload)
+	summary := map[string]interface{}{"server_version": software, "proto_version": protoVersion}
+	if protoVersion != "2.0" && protoVersion != "1.99" {
+		// SSH-1 servers do not send a KEXINIT
+		return summary, nil
+	}
+
+	began = time.Now()
+	msg, err := c.sshPacket()
+	if err != nil {
+		return nil, err
+	}
+	const msgKexInit = 20
+	if len(msg) == 0 || msg[0] != msgKexInit {
+		return nil, fmt.Errorf("expected KEXINIT, got %s", short(msg))
+	}
+	if len(msg) < 17 {
+		return nil, fmt.Errorf("truncated KEXINIT")
+	}
+	// type, 16-byte cookie, then ten name-lists
+	lists := make([][]string, 10)
+	b := msg[17:]
+	for i := range lists {
+		if len(b) < 4 || uint32(len(b)-4) < binary.BigEndian.Uint32(b) {
+			return nil, fmt.Errorf("truncated KEXINIT")
+		}
+		n := binary.BigEndian.Uint32(b)
+		if n > 0 {
+			lists[i] = strings.Split(string(b[4:4+n]), ",")
+		}
+		b = b[4+n:]
+	}
+	c.emit("ssh_kexinit", time.Since(began), map[string]interface{}{
+		"kex_algorithms":      lists[0],
+		"host_key_algorithms": lists[1],
+		// client-to-server; servers rarely differ per direction
+		"ciphers":     lists[2],
+		"macs":        lists[4],
+		"compression": lists[6],
+	})
+	summary["host_key_algorithms"] = lists[1]
+	return summary, nil
+}
+
+// sshPacket reads an unencrypted binary packet and returns its payload.
+func (c *conn) sshPacket() ([]byte, error) {
+	var hdr [5]byte
+	if err := c.readFull(hdr[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(hdr[:4])
+	padding := uint32(hdr[4])
+	// RFC 4253 6.1: implementations must handle packets of 35000 bytes
+	if length > 35000 || padding+1 > length {
+		return nil, fmt.Errorf("invalid SSH packet length %d", length)
+	}
+	buf := make([]byte, length-1)
+	if err := c.readFull(buf); err != nil {
+		return nil, err
+	}
+	return buf[:length-1-padding], nil
+}
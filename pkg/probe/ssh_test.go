@@ -0,0 +1,85 @@
+package probe
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSHPacket(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+		err  string
+	}{
+		{name: "payload", in: string(sshPacketBytes([]byte("hello"))), want: "hello"},
+		{name: "empty payload", in: "\x00\x00\x00\x05\x04\x00\x00\x00\x00", want: ""},
+		{name: "eof", in: "", err: "EOF"},
+		{name: "truncated header", in: "\x00\x00\x00", err: "EOF"},
+		{name: "truncated packet", in: "\x00\x00\x00\x10\x04abc", err: "EOF"},
+		{name: "zero length", in: "\x00\x00\x00\x00\x00", err: "invalid SSH packet length 0"},
+		{name: "padding longer than the packet", in: "\x00\x00\x00\x04\x08\x00\x00\x00", err: "invalid SSH packet length 4"},
+		{name: "too long", in: "\x00\x01\x00\x00\x04", err: "invalid SSH packet length 65536"},
+		{name: "identification line", in: "SSH-2.0-OpenSSH\r\n", err: "invalid SSH packet length"},
+	}
+	for _, tt := range tests {
+		got, err := readerConn(tt.in).sshPacket()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: sshPacket = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestProbeSSHReplies(t *testing.T) {
+	kex := kexInit("curve25519-sha256", "ssh-ed25519", "aes128-ctr", "hmac-sha2-256", "none")
+	tests := []struct {
+		name  string
+		reply string
+		want  string
+		err   string
+	}{
+		{name: "kexinit", reply: "SSH-2.0-OpenSSH_9.6\r\n" + string(sshPacketBytes(kex)), want: "[ssh-ed25519]"},
+		{name: "ssh-1 server", reply: "SSH-1.5-OldSSH\r\n", want: "<nil>"},
+		{name: "truncated kexinit", reply: "SSH-2.0-x\r\n" + string(sshPacketBytes(kex[:40])), err: "truncated KEXINIT"},
+		{name: "kexinit without cookie", reply: "SSH-2.0-x\r\n" + string(sshPacketBytes([]byte{20, 1, 2})), err: "truncated KEXINIT"},
+		{name: "name-list past the end", reply: "SSH-2.0-x\r\n" + string(sshPacketBytes(append(kex[:17:17], 0xff, 0xff, 0xff, 0xff))), err: "truncated KEXINIT"},
+		{name: "other message", reply: "SSH-2.0-x\r\n" + string(sshPacketBytes([]byte{1, 0, 0, 0, 0})), err: "expected KEXINIT"},
+		{name: "malformed identification", reply: "SSH-2.0\r\n", err: "malformed SSH identification string"},
+		{name: "not ssh", reply: strings.Repeat("HTTP/1.1 400 Bad Request\r\n", 21), err: "no SSH identification string"},
+		{name: "closed", reply: "", err: "EOF"},
+	}
+	for _, tt := range tests {
+		addr := serveProbe(t, func(c net.Conn) {
+			io.WriteString(c, tt.reply)
+			c.(*net.TCPConn).CloseWrite()
+			io.Copy(io.Discard, c)
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, payloads, err := runProbe(ctx, "ssh", addr, false)
+		cancel()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := fmt.Sprint(payloads["probe_done"]["host_key_algorithms"]); got != tt.want {
+			t.Errorf("%s: host_key_algorithms = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package tcp
 
 import (
 	"context"
+	"crypto/tls"
 	"io"
 	"net"
 	"os"
@@ -10,7 +11,9 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/mrlm-net/tracer/pkg/event"
+	"github.com/mrlm-net/tracer/pkg/expect"
 	"github.com/mrlm-net/tracer/pkg/netutil"
+	"github.com/mrlm-net/tracer/pkg/tlsinfo"
 	"github.com/mrlm-net/tracer/pkg/tracecommon"
 )
 
@@ -22,6 +25,41 @@ type traceConfig struct {
 	Timeout time.Duration
 	Data    io.Reader
 	IPPref  string
+	// Resolver selects the DNS server and static overrides used to dial.
+	Resolver *netutil.Resolver
+	// TLS enables a TLS handshake after connecting; nil keeps plain TCP.
+	TLS *tlsinfo.Config
+	// Proxy is the proxy URL (http, https, socks5, socks5h) connections are
+	// tunnelled through; "" and netutil.ProxyDirect connect directly.
+	Proxy string
+	// NoProxy lists the hosts that bypass Proxy; "" reads NO_PROXY.
+	NoProxy string
+	// Stream keeps reading after the payload until the peer closes the
+	// connection, IdleTimeout passes without data, MaxBytes have been read
+	// or Timeout passes, reporting every chunk.
+	Stream      bool
+	IdleTimeout time.Duration
+	MaxBytes    int64
+	// HalfClose shuts down the write side after the payload.
+	HalfClose bool
+	// Input is sent as it is read, until its EOF half-closes the connection;
+	// it implies Stream without the overall Timeout.
+	Input io.Reader
+	// Output receives the data read from the connection.
+	Output io.Writer
+	// Script runs send/expect steps after Data instead of reading the
+	// response.
+	Script *expect.Script
+	// Probe names the protocol handshake run on the connection (see
+	// pkg/probe); it replaces Data and the response read.
+	Probe string
+	// StartTLS configures the handshake of probes that upgrade the
+	// connection in-band (SMTP STARTTLS, PostgreSQL SSLRequest); nil uses
+	// the defaults. It is not used over TLS.
+	StartTLS *tlsinfo.Config
+	// RedactResponses reports the data script steps match or receive only
+	// by its length.
+	RedactResponses bool
 }
 
 // WithEmitter sets a custom emitter.
@@ -42,9 +80,70 @@ func WithDataString(s string) Option { return func(c *traceConfig) { c.Data = st
 // WithIPPreference sets IP family preference: "v4", "v6" or ""/"auto".
 func WithIPPreference(p string) Option { return func(c *traceConfig) { c.IPPref = p } }
 
-// TraceAddr opens a TCP connection to addr (host:port) and emits events.
+// WithResolver sets the resolver used to dial (custom DNS server, DoT, DoH
+// or --resolve style overrides); nil uses the system resolver.
+func WithResolver(r *netutil.Resolver) Option { return func(c *traceConfig) { c.Resolver = r } }
+
+// WithTLS performs a TLS handshake over the dialed connection using c. Events
+// are then reported with protocol "tls" and data is sent over TLS.
+func WithTLS(c *tlsinfo.Config) Option { return func(cfg *traceConfig) { cfg.TLS = c } }
+
+// WithProxy tunnels the connection through a proxy: HTTP CONNECT for
+// http:// and https:// proxies, SOCKS5 CONNECT for socks5:// and socks5h://.
+func WithProxy(p string) Option { return func(c *traceConfig) { c.Proxy = p } }
+
+// WithNoProxy sets the hosts that bypass the proxy, in NO_PROXY syntax.
+func WithNoProxy(s string) Option { return func(c *traceConfig) { c.NoProxy = s } }
+
+// WithStream keeps reading after the payload until the peer closes the
+// connection, the idle timeout passes without data, maxBytes have been read
+// (0: no limit) or the timeout passes, and reports every chunk received.
+func WithStream(v bool) Option { return func(c *traceConfig) { c.Stream = v } }
+
+// WithIdleTimeout sets how long a stream may go without data (default 5s).
+func WithIdleTimeout(d time.Duration) Option { return func(c *traceConfig) { c.IdleTimeout = d } }
+
+// WithMaxBytes stops a stream once n bytes have been read; 0 is unlimited.
+// It also bounds the data a script step reads without a match (default
+// 1 MiB).
+func WithMaxBytes(n int64) Option { return func(c *traceConfig) { c.MaxBytes = n } }
+
+// WithHalfClose shuts down the write side of the connection once the payload
+// was sent (a FIN, or a close_notify alert over TLS).
+func WithHalfClose(v bool) Option { return func(c *traceConfig) { c.HalfClose = v } }
+
+// WithInput makes the trace interactive: r is sent as it is read while the
+// connection is streamed, and its EOF half-closes the connection. The
+// session ends when the peer closes it, the idle timeout passes after the
+// input ended, or ctx is cancelled.
+func WithInput(r io.Reader) Option { return func(c *traceConfig) { c.Input = r } }
+
+// WithOutput copies the data received on the connection to w.
+func WithOutput(w io.Writer) Option { return func(c *traceConfig) { c.Output = w } }
+
+// WithScript runs the send/expect steps of s after the payload, emitting a
+// step event for each, and fails the trace at the first expectation that is
+// not met. It replaces the response read and the stream.
+func WithScript(s *expect.Script) Option { return func(c *traceConfig) { c.Script = s } }
+
+// WithProbe runs the named protocol probe (see pkg/probe) once connected,
+// instead of sending the payload. Its events, including the probe_done
+// summary, are reported on the trace.
+func WithProbe(name string) Option { return func(c *traceConfig) { c.Probe = name } }
+
+// WithStartTLS sets the TLS configuration of in-band upgrades by probes.
+func WithStartTLS(t *tlsinfo.Config) Option { return func(c *traceConfig) { c.StartTLS = t } }
+
+// WithRedactResponses controls redaction of the data script steps match or
+// receive, which is then reported only by its length.
+func WithRedactResponses(v bool) Option { return func(c *traceConfig) { c.RedactResponses = v } }
+
+// TraceAddr opens a TCP connection to addr (host:port), optionally performs a
+// TLS handshake, and emits events. The payload is answered by a single read
+// of up to 1 KiB unless WithStream, WithInput, WithScript or WithProbe is
+// used.
 func TraceAddr(ctx context.Context, addr string, opts ...Option) error {
-	cfg := &traceConfig{Timeout: 30 * time.Second}
+	cfg := &traceConfig{Timeout: 30 * time.Second, IdleTimeout: 5 * time.Second, RedactResponses: true}
 	for _, o := range opts {
 		o(cfg)
 	}
@@ -52,70 +151,138 @@ func TraceAddr(ctx context.Context, addr string, opts ...Option) error {
 	if cfg.Emitter == nil {
 		cfg.Emitter = event.NewStdoutEmitter(os.Stdout, true, true)
 	}
+	proto := "tcp"
+	if cfg.TLS != nil {
+		proto = "tls"
+	}
 
-	traceID := tracecommon.StartRequest(ctx, cfg.Emitter, "tcp", addr)
+	traceID := tracecommon.StartRequest(ctx, cfg.Emitter, proto, addr)
 	if cfg.Dry {
-		tracecommon.EmitDryRun(ctx, cfg.Emitter, "tcp", traceID)
+		tracecommon.EmitDryRun(ctx, cfg.Emitter, proto, traceID)
 		return nil
 	}
 
 	start := time.Now()
-	cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "tcp", EventType: "lifecycle", Stage: "connect_start", TraceID: traceID, Payload: map[string]interface{}{"addr": addr}})
+	cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: proto, EventType: "lifecycle", Stage: "connect_start", TraceID: traceID, Payload: map[string]interface{}{"addr": addr}})
 
 	// Parse and dial with IP-family awareness
-	host, port, joinAddr, ip, isIP, _, perr := netutil.ParseAddr(addr, "80")
+	host, port, _, _, _, zone, perr := netutil.ParseAddr(addr, "80")
 	if perr != nil {
-		tracecommon.EmitError(ctx, cfg.Emitter, "tcp", "resolve_error", traceID, perr)
+		tracecommon.EmitError(ctx, cfg.Emitter, proto, "resolve_error", traceID, perr)
 		return perr
 	}
 
+	proxyURL, err := netutil.ProxyFor(cfg.Proxy, cfg.NoProxy, net.JoinHostPort(host, port))
+	if err != nil {
+		tracecommon.EmitError(ctx, cfg.Emitter, proto, "proxy_config", traceID, err)
+		return err
+	}
+
+	// hostnames are dialed with Happy Eyeballs; every attempt is reported
+	dialHost := host
+	if zone != "" {
+		dialHost += "%" + zone
+	}
+	dnsStart, dnsDone := tracecommon.DNSHooks(ctx, cfg.Emitter, proto, traceID)
+	dialOpts := netutil.DialOptions{
+		Network:    "tcp",
+		Prefer:     cfg.IPPref,
+		Timeout:    cfg.Timeout,
+		OnDNSStart: dnsStart,
+		OnDNSDone:  dnsDone,
+		Resolver:   cfg.Resolver,
+		OnAttempt: func(a netutil.DialAttempt) {
+			tracecommon.EmitDialAttempt(ctx, cfg.Emitter, proto, traceID, a)
+		},
+	}
+
 	var conn net.Conn
-	var chosenIP net.IP
-	var resolved []net.IP
-	var fam string
-	var derr error
-
-	if isIP {
-		// direct dial using explicit family when IP literal provided
-		if netutil.IsIPv4(ip) {
-			conn, derr = (&net.Dialer{Timeout: cfg.Timeout}).DialContext(ctx, "tcp4", joinAddr)
-			fam = "v4"
-		} else {
-			conn, derr = (&net.Dialer{Timeout: cfg.Timeout}).DialContext(ctx, "tcp6", joinAddr)
-			fam = "v6"
+	var tags map[string]string
+	var connPayload map[string]interface{}
+	if proxyURL != nil {
+		d := &netutil.ProxyDialer{URL: proxyURL, Options: dialOpts}
+		conn, err = tracecommon.DialProxy(ctx, cfg.Emitter, proto, traceID, d, "tcp", net.JoinHostPort(dialHost, port))
+		if err == nil {
+			// the peer is the proxy; the target is only known by name
+			connPayload = map[string]interface{}{"remote": net.JoinHostPort(dialHost, port), "local": conn.LocalAddr().String(), "proxy": proxyURL.Redacted(), "proxy_remote": conn.RemoteAddr().String()}
 		}
-		chosenIP = ip
 	} else {
-		conn, chosenIP, resolved, fam, derr = netutil.ResolveAndDial(ctx, "tcp", host, port, cfg.IPPref, cfg.Timeout)
+		var res *netutil.DialResult
+		if res, err = netutil.Dial(ctx, dialHost, port, dialOpts); err == nil {
+			conn = res.Conn
+			// add ip family metadata if available
+			tags = tracecommon.BuildTags(res.IP, res.Resolved, res.Family)
+			connPayload = map[string]interface{}{"remote": conn.RemoteAddr().String(), "local": conn.LocalAddr().String()}
+		}
 	}
-
-	if derr != nil {
-		tracecommon.EmitError(ctx, cfg.Emitter, "tcp", "connect_error", traceID, derr)
-		return derr
+	if err != nil {
+		// resolution failures were already reported as dns_error
+		if !netutil.IsDNSError(err) {
+			tracecommon.EmitError(ctx, cfg.Emitter, proto, "connect_error", traceID, err)
+		}
+		return err
 	}
 	defer conn.Close()
 
 	connID := uuid.NewString()
-	// add ip family metadata if available
-	tags := tracecommon.BuildTags(chosenIP, resolved, fam)
-	tracecommon.EmitLifecycle(ctx, cfg.Emitter, "tcp", "connect_done", traceID, connID, int64(time.Since(start)), tags, map[string]interface{}{"remote": conn.RemoteAddr().String(), "local": conn.LocalAddr().String()})
-
-	// send data if provided
-	if cfg.Data != nil {
-
-		n, _ := io.Copy(conn, cfg.Data)
-		tracecommon.EmitLifecycle(ctx, cfg.Emitter, "tcp", "data_send", traceID, connID, 0, nil, map[string]interface{}{"bytes_sent": n})
-
-		// attempt to read a small response
-		buf := make([]byte, 1024)
-		_ = conn.SetReadDeadline(time.Now().Add(cfg.Timeout))
-		nr, _ := conn.Read(buf)
-		if nr > 0 {
-			tracecommon.EmitLifecycle(ctx, cfg.Emitter, "tcp", "data_recv", traceID, connID, 0, nil, map[string]interface{}{"bytes_recv": nr})
+	tracecommon.EmitLifecycle(ctx, cfg.Emitter, proto, "connect_done", traceID, connID, int64(time.Since(start)), tags, connPayload)
+
+	if cfg.TLS != nil {
+		tlsConn, err := handshake(ctx, conn, host, cfg, traceID, connID)
+		if err != nil {
+			return err
 		}
+		conn = tlsConn
+	}
+
+	s := &session{ctx: ctx, cfg: cfg, conn: conn, host: host, proto: proto, traceID: traceID, connID: connID}
+	err = s.run()
+
+	tracecommon.EmitLifecycle(ctx, cfg.Emitter, proto, "request_end", traceID, connID, 0, nil, nil)
+
+	return err
+}
+
+// handshake runs the TLS client handshake over conn and emits
+// tls_handshake_start/done with the same inspection fields as the HTTP tracer.
+func handshake(ctx context.Context, conn net.Conn, host string, cfg *traceConfig, traceID, connID string) (net.Conn, error) {
+	tc, err := cfg.TLS.Build(host)
+	if err != nil {
+		tracecommon.EmitError(ctx, cfg.Emitter, "tls", "tls_config_error", traceID, err)
+		return nil, err
 	}
+	start := map[string]interface{}{"alpn_offered": tc.NextProtos}
+	// IP literals are never sent as SNI
+	if net.ParseIP(tc.ServerName) == nil {
+		start["server_name"] = tc.ServerName
+	}
+	tracecommon.EmitLifecycle(ctx, cfg.Emitter, "tls", "tls_handshake_start", traceID, connID, 0, nil, start)
 
-	tracecommon.EmitLifecycle(ctx, cfg.Emitter, "tcp", "request_end", traceID, connID, 0, nil, nil)
+	hctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	began := time.Now()
+	tlsConn := tls.Client(conn, tc)
+	herr := tlsConn.HandshakeContext(hctx)
 
-	return nil
+	// verify against the name actually checked by the handshake; IP literal
+	// targets have no SNI but are still matched against IP SANs
+	name := tc.ServerName
+	if name == "" {
+		name = host
+	}
+	payload := tlsinfo.Describe(tlsConn.ConnectionState(), herr, tlsinfo.Options{Host: name, ALPN: tc.NextProtos, Roots: tc.RootCAs})
+	payload["err"] = errorString(herr)
+	tracecommon.EmitLifecycle(ctx, cfg.Emitter, "tls", "tls_handshake_done", traceID, connID, int64(time.Since(began)), nil, payload)
+	if herr != nil {
+		tracecommon.EmitError(ctx, cfg.Emitter, "tls", "tls_error", traceID, herr)
+		return nil, herr
+	}
+	return tlsConn, nil
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
 }
@@ -0,0 +1,30 @@
+package tcp
+
+import (
+	"net"
+
+	"github.com/mrlm-net/tracer/pkg/probe"
+	"github.com/mrlm-net/tracer/pkg/tlsinfo"
+)
+
+// runProbe runs the configured protocol probe on the connection, within the
+// trace timeout. In-band TLS upgrades are traced like the handshake of the
+// tls tracer.
+func (s *session) runProbe() error {
+	env := probe.Env{
+		Conn:    s.conn,
+		TLS:     s.proto == "tls",
+		Emit:    s.emitEvent,
+		Timeout: s.cfg.Timeout,
+	}
+	if !env.TLS {
+		env.StartTLS = func(conn net.Conn) (net.Conn, error) {
+			cfg := *s.cfg
+			if cfg.TLS = cfg.StartTLS; cfg.TLS == nil {
+				cfg.TLS = &tlsinfo.Config{}
+			}
+			return handshake(s.ctx, conn, s.host, &cfg, s.traceID, s.connID)
+		}
+	}
+	return probe.Run(s.ctx, s.cfg.Probe, env)
+}
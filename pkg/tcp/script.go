@@ -0,0 +1,115 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/mrlm-net/tracer/pkg/expect"
+)
+
+// maxUnmatched bounds the data a script keeps while waiting for a match
+// when MaxBytes is not set.
+const maxUnmatched = 1 << 20
+
+// runScript sends the payload, then runs the script's steps in order,
+// reporting each as a step event, and stops at the first that fails. Data
+// received before a match is kept for the next expectation, up to MaxBytes
+// or maxUnmatched.
+func (s *session) runScript() error {
+	stop := context.AfterFunc(s.ctx, func() { s.conn.Close() })
+	defer stop()
+	if s.cfg.Data != nil {
+		if err := s.sendData(); err != nil {
+			return err
+		}
+	}
+
+	var (
+		pending []byte
+		// closed is why no more data can arrive; it only fails the steps
+		// whose expectation is not met by the data already received
+		closed error
+	)
+	limit := maxUnmatched
+	if s.cfg.MaxBytes > 0 {
+		limit = int(s.cfg.MaxBytes)
+	}
+	buf := make([]byte, 32<<10)
+	for i := range s.cfg.Script.Steps {
+		st := &s.cfg.Script.Steps[i]
+		r := expect.Result{Index: i + 1, Step: st, Redact: s.cfg.RedactResponses}
+		began := time.Now()
+		if len(st.Send) > 0 {
+			n, err := s.conn.Write(st.Send)
+			r.BytesSent = n
+			s.sent(int64(n), began)
+			if err != nil {
+				r.Err = s.connError(err)
+			}
+		}
+		sent := time.Now()
+		if r.Err == nil && st.Expect != nil {
+			timeout := st.Timeout
+			if timeout == 0 {
+				timeout = s.cfg.Timeout
+			}
+			_ = s.conn.SetReadDeadline(sent.Add(timeout))
+			for {
+				if loc := st.Expect.FindIndex(pending); loc != nil {
+					r.Match = pending[loc[0]:loc[1]]
+					pending = pending[loc[1]:]
+					r.Wait = time.Since(sent)
+					break
+				}
+				if closed != nil {
+					r.Err, r.Unmatched = closed, pending
+					r.Wait = time.Since(sent)
+					break
+				}
+				if len(pending) >= limit {
+					r.Err, r.Unmatched = fmt.Errorf("no match in %d bytes", limit), pending
+					r.Wait = time.Since(sent)
+					break
+				}
+				n, err := s.conn.Read(buf[:min(len(buf), limit-len(pending))])
+				pending = append(pending, buf[:n]...)
+				r.BytesRecv += n
+				var ne net.Error
+				switch {
+				case err == nil:
+				case s.ctx.Err() == nil && errors.As(err, &ne) && ne.Timeout():
+					// a timeout only ends this step
+					r.Err, r.Unmatched = fmt.Errorf("no match within %s", timeout), pending
+					r.Wait = time.Since(sent)
+				default:
+					closed = s.connError(err)
+				}
+				if r.Err != nil {
+					break
+				}
+			}
+		}
+
+		if r.Err != nil {
+			s.emitError("step", time.Since(began), r.Payload())
+			return r.Failure()
+		}
+		s.emit("step", time.Since(began), r.Payload())
+	}
+	return nil
+}
+
+// connError describes why the connection can no longer be used.
+func (s *session) connError(err error) error {
+	switch {
+	case s.ctx.Err() != nil:
+		return s.ctx.Err()
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return errors.New("connection closed by the peer")
+	}
+	return err
+}
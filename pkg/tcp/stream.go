@@ -0,0 +1,377 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mrlm-net/tracer/pkg/event"
+)
+
+// session is the data phase of a trace: what is sent and received once the
+// connection (and TLS handshake) is up.
+type session struct {
+	ctx     context.Context
+	cfg     *traceConfig
+	conn    net.Conn
+	host    string
+	proto   string
+	traceID string
+	connID  string
+
+	// mu guards the fields below and read deadline updates, so the end of
+	// the input and the reader agree on when the idle timeout starts.
+	mu        sync.Mutex
+	inputDone bool
+	firstSend time.Time
+	sends     int
+	bytesSent int64
+	// halfClosed is set once our side of the connection was shut down.
+	halfClosed bool
+	// ended is set after stream_end; the input goroutine may outlive the
+	// session, and its events are dropped.
+	ended bool
+}
+
+func (s *session) emit(stage string, d time.Duration, payload map[string]interface{}) {
+	s.emitEvent("lifecycle", stage, d, payload)
+}
+
+func (s *session) emitError(stage string, d time.Duration, payload map[string]interface{}) {
+	s.emitEvent("error", stage, d, payload)
+}
+
+func (s *session) emitEvent(kind, stage string, d time.Duration, payload map[string]interface{}) {
+	s.mu.Lock()
+	ended := s.ended
+	s.mu.Unlock()
+	if ended {
+		return
+	}
+	s.cfg.Emitter.Emit(s.ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: s.proto, EventType: kind, Stage: stage, TraceID: s.traceID, ConnID: s.connID, DurationNS: int64(d), Payload: payload})
+}
+
+// run sends the payload and reads the response: a single read by default,
+// every chunk until the connection ends in stream mode, or a session fed
+// from the input in interactive mode. A script or a probe replaces all of
+// them.
+func (s *session) run() error {
+	if s.cfg.Probe != "" {
+		return s.runProbe()
+	}
+	if s.cfg.Script != nil {
+		return s.runScript()
+	}
+	if s.cfg.Input != nil || s.cfg.Stream {
+		return s.stream()
+	}
+	if s.cfg.Data == nil {
+		return nil
+	}
+	if err := s.sendData(); err != nil {
+		return err
+	}
+	if s.cfg.HalfClose {
+		s.halfClose()
+	}
+
+	// attempt to read a small response
+	buf := make([]byte, 1024)
+	sent := time.Now()
+	_ = s.conn.SetReadDeadline(sent.Add(s.cfg.Timeout))
+	nr, err := s.conn.Read(buf)
+	if nr > 0 {
+		s.emit("data_recv", time.Since(sent), map[string]interface{}{"bytes_recv": nr})
+		s.output(buf[:nr])
+		return nil
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		// many services only answer requests they understand
+		s.emit("read_timeout", time.Since(sent), map[string]interface{}{"timeout_ns": int64(s.cfg.Timeout)})
+		return nil
+	}
+	_, err = s.readEnded(err, 0, time.Since(sent))
+	return err
+}
+
+// sendData writes the configured payload.
+func (s *session) sendData() error {
+	began := time.Now()
+	n, err := io.Copy(s.conn, s.cfg.Data)
+	s.sent(n, began)
+	if err != nil {
+		s.writeFailed(err)
+		return err
+	}
+	s.emit("data_send", time.Since(began), map[string]interface{}{"bytes_sent": n})
+	return nil
+}
+
+// sent records n bytes written, starting at began.
+func (s *session) sent(n int64, began time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.firstSend.IsZero() && n > 0 {
+		s.firstSend = began
+	}
+	s.sends++
+	s.bytesSent += n
+}
+
+// writeFailed reports a failed write; a reset or broken pipe means the peer
+// is gone.
+func (s *session) writeFailed(err error) {
+	s.emitError("write_error", 0, map[string]interface{}{"error": err.Error(), "reset": isReset(err)})
+}
+
+// halfClose shuts down the write side of the connection: a FIN for TCP, a
+// close_notify alert for TLS.
+func (s *session) halfClose() {
+	s.mu.Lock()
+	if s.halfClosed {
+		s.mu.Unlock()
+		return
+	}
+	s.halfClosed = true
+	sent := s.bytesSent
+	s.mu.Unlock()
+
+	cw, ok := s.conn.(interface{ CloseWrite() error })
+	if !ok {
+		s.emitError("half_close_error", 0, map[string]interface{}{"error": "connection does not support half-close"})
+		return
+	}
+	if err := cw.CloseWrite(); err != nil {
+		s.emitError("half_close_error", 0, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	payload := map[string]interface{}{"bytes_sent": sent}
+	if s.proto == "tls" {
+		payload["close_notify"] = true
+	}
+	s.emit("half_close_send", 0, payload)
+}
+
+// output copies received data to the configured writer.
+func (s *session) output(b []byte) {
+	if s.cfg.Output != nil {
+		_, _ = s.cfg.Output.Write(b)
+	}
+}
+
+// stream reads every chunk until the peer closes the connection, the idle
+// timeout passes without data, MaxBytes have been read or the trace times
+// out. In interactive mode the input is sent concurrently and the idle
+// timeout only starts once it ended.
+func (s *session) stream() error {
+	start := time.Now()
+	// interactive sessions last until the peer closes or ctx is cancelled
+	var deadline time.Time
+	if s.cfg.Input == nil && s.cfg.Timeout > 0 {
+		deadline = start.Add(s.cfg.Timeout)
+	}
+	// unblock the read when the trace is cancelled
+	stop := context.AfterFunc(s.ctx, func() { s.conn.Close() })
+	defer stop()
+
+	if s.cfg.Input != nil {
+		go s.pipe()
+	} else {
+		if s.cfg.Data != nil {
+			if err := s.sendData(); err != nil {
+				return err
+			}
+		}
+		if s.cfg.HalfClose {
+			s.halfClose()
+		}
+		s.mu.Lock()
+		s.inputDone = true
+		s.mu.Unlock()
+	}
+
+	buf := make([]byte, 32<<10)
+	var (
+		total        int64
+		chunks       int
+		last         time.Time
+		ttfb, maxGap time.Duration
+		reason       string
+		rerr         error
+	)
+	for {
+		if s.cfg.MaxBytes > 0 && total >= s.cfg.MaxBytes {
+			reason = "max_bytes"
+			break
+		}
+		s.setDeadline(deadline)
+		p := buf
+		if s.cfg.MaxBytes > 0 && s.cfg.MaxBytes-total < int64(len(p)) {
+			p = p[:s.cfg.MaxBytes-total]
+		}
+		n, err := s.conn.Read(p)
+		now := time.Now()
+		if n > 0 {
+			chunks++
+			payload := map[string]interface{}{"index": chunks, "bytes": n, "offset": total}
+			var d time.Duration
+			if chunks == 1 {
+				s.mu.Lock()
+				since := s.firstSend
+				s.mu.Unlock()
+				if since.IsZero() {
+					since = start
+				}
+				ttfb = now.Sub(since)
+				d = ttfb
+				payload["ttfb_ns"] = int64(ttfb)
+			} else {
+				d = now.Sub(last)
+				maxGap = max(maxGap, d)
+				payload["gap_ns"] = int64(d)
+			}
+			total += int64(n)
+			last = now
+			s.emit("data_recv", d, payload)
+			s.output(p[:n])
+		}
+		if err == nil {
+			continue
+		}
+		var ne net.Error
+		switch {
+		case errors.Is(s.ctx.Err(), context.DeadlineExceeded):
+			// a caller's deadline bounds the stream like Timeout does
+			reason = "timeout"
+		case s.ctx.Err() != nil:
+			reason = "canceled"
+			// ending an interactive session is not a failure
+			if s.cfg.Input == nil {
+				rerr = s.ctx.Err()
+			}
+		case errors.As(err, &ne) && ne.Timeout():
+			reason = "idle"
+			if !deadline.IsZero() && !now.Before(deadline) {
+				reason = "timeout"
+			}
+		default:
+			var sinceLast time.Duration
+			if !last.IsZero() {
+				sinceLast = now.Sub(last)
+			}
+			reason, rerr = s.readEnded(err, total, sinceLast)
+		}
+		break
+	}
+
+	s.mu.Lock()
+	payload := map[string]interface{}{"reason": reason, "bytes_recv": total, "bytes_sent": s.bytesSent, "chunks": chunks}
+	s.mu.Unlock()
+	if chunks > 0 {
+		payload["ttfb_ns"] = int64(ttfb)
+	}
+	if chunks > 1 {
+		payload["max_gap_ns"] = int64(maxGap)
+	}
+	s.emit("stream_end", time.Since(start), payload)
+	s.mu.Lock()
+	s.ended = true
+	s.mu.Unlock()
+	return rerr
+}
+
+// readEnded reports how the peer ended the connection: fin_recv for an
+// orderly close, rst_recv for a reset and read_error otherwise. It returns
+// the reason and the error that fails the trace, if any.
+func (s *session) readEnded(err error, total int64, d time.Duration) (string, error) {
+	payload := map[string]interface{}{"bytes_recv": total}
+	switch {
+	case errors.Is(err, io.EOF), s.proto == "tls" && errors.Is(err, io.ErrUnexpectedEOF):
+		// TLS peers should send close_notify before their FIN; without it
+		// the data may have been truncated
+		if s.proto == "tls" {
+			payload["close_notify"] = errors.Is(err, io.EOF)
+		}
+		s.emit("fin_recv", d, payload)
+		return "fin", nil
+	case isReset(err):
+		payload["error"] = err.Error()
+		s.emitError("rst_recv", d, payload)
+		return "rst", err
+	default:
+		payload["error"] = err.Error()
+		s.emitError("read_error", d, payload)
+		return "error", err
+	}
+}
+
+// setDeadline sets the read deadline to the trace deadline or, once the
+// input ended, the idle timeout, whichever comes first.
+func (s *session) setDeadline(deadline time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setDeadlineLocked(deadline)
+}
+
+func (s *session) setDeadlineLocked(deadline time.Time) {
+	if s.inputDone && s.cfg.IdleTimeout > 0 {
+		idle := time.Now().Add(s.cfg.IdleTimeout)
+		if deadline.IsZero() || idle.Before(deadline) {
+			deadline = idle
+		}
+	}
+	_ = s.conn.SetReadDeadline(deadline)
+}
+
+// pipe sends the payload and then the input as it is read, one data_send
+// per read, and half-closes the connection when the input ends. A read
+// blocked on the input is abandoned when the session ends.
+func (s *session) pipe() {
+	defer func() {
+		s.mu.Lock()
+		s.inputDone = true
+		// interactive sessions have no trace deadline
+		s.setDeadlineLocked(time.Time{})
+		s.mu.Unlock()
+	}()
+	if s.cfg.Data != nil {
+		if err := s.sendData(); err != nil {
+			return
+		}
+	}
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := s.cfg.Input.Read(buf)
+		if n > 0 {
+			began := time.Now()
+			w, werr := s.conn.Write(buf[:n])
+			s.sent(int64(w), began)
+			if werr != nil {
+				if s.ctx.Err() == nil {
+					s.writeFailed(werr)
+				}
+				return
+			}
+			s.mu.Lock()
+			index := s.sends
+			s.mu.Unlock()
+			s.emit("data_send", time.Since(began), map[string]interface{}{"index": index, "bytes_sent": w})
+		}
+		if err != nil {
+			if s.ctx.Err() == nil {
+				s.halfClose()
+			}
+			return
+		}
+	}
+}
+
+// isReset reports whether err means the peer reset the connection.
+func isReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
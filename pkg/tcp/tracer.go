@@ -0,0 +1,140 @@
+package tcp
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mrlm-net/tracer/pkg/expect"
+	"github.com/mrlm-net/tracer/pkg/netutil"
+	"github.com/mrlm-net/tracer/pkg/probe"
+	"github.com/mrlm-net/tracer/pkg/tlsinfo"
+	"github.com/mrlm-net/tracer/pkg/tracer"
+)
+
+func init() {
+	tracer.Register("tcp", newTracer)
+	tracer.Register("tls", newTLSTracer)
+}
+
+// TracerSettings are the own options of the tcp and tls tracers.
+type TracerSettings struct {
+	// Stream reads until the peer closes the connection, Idle passes
+	// without data (0: the default) or MaxBytes have been read (0: no
+	// limit); MaxBytes also bounds the data a Script step reads without a
+	// match. HalfClose shuts down the write side once Data was sent.
+	Stream    bool
+	Idle      time.Duration
+	MaxBytes  int64
+	HalfClose bool
+	// Input and Output make the trace interactive: Input is sent as it is
+	// read and the data received is copied to Output.
+	Input  io.Reader
+	Output io.Writer
+	// Script runs send/expect steps after Data.
+	Script *expect.Script
+	// Probe names the protocol handshake (see pkg/probe) run instead of
+	// sending Data.
+	Probe string
+}
+
+// Settings is the key of TracerSettings in tracer.Options.
+var Settings = tracer.NewKey[TracerSettings]("tcp")
+
+// sharedOptions converts shared tracer options into TraceAddr options.
+func sharedOptions(o tracer.Options) []Option {
+	s, _ := Settings.Get(o)
+	opts := []Option{WithEmitter(o.Emitter), WithDryRun(o.DryRun), WithIPPreference(o.IPPref)}
+	if o.Timeout > 0 {
+		opts = append(opts, WithTimeout(o.Timeout))
+	}
+	if o.Resolver != nil {
+		opts = append(opts, WithResolver(o.Resolver))
+	}
+	if o.Proxy != "" || o.NoProxy != "" {
+		opts = append(opts, WithProxy(o.Proxy), WithNoProxy(o.NoProxy))
+	}
+	if s.Script != nil {
+		opts = append(opts, WithScript(s.Script), WithRedactResponses(o.RedactResponses))
+	}
+	if s.Probe != "" {
+		opts = append(opts, WithProbe(s.Probe), WithStartTLS(o.TLS))
+	}
+	opts = append(opts, WithStream(s.Stream), WithMaxBytes(s.MaxBytes), WithHalfClose(s.HalfClose))
+	if s.Idle > 0 {
+		opts = append(opts, WithIdleTimeout(s.Idle))
+	}
+	if s.Input != nil {
+		opts = append(opts, WithInput(s.Input))
+	}
+	if s.Output != nil {
+		opts = append(opts, WithOutput(s.Output))
+	}
+	return opts
+}
+
+// newTracer accepts host:port or a URL target (port inferred for http/https,
+// or from the probe's service).
+func newTracer(o tracer.Options) (tracer.Tracer, error) {
+	if err := validate(o); err != nil {
+		return nil, err
+	}
+	return newAddrTracer("tcp", o), nil
+}
+
+// newTLSTracer is the tcp tracer with a TLS handshake after connecting,
+// configured from o.TLS.
+func newTLSTracer(o tracer.Options) (tracer.Tracer, error) {
+	if err := validate(o); err != nil {
+		return nil, err
+	}
+	if o.TLS == nil {
+		o.TLS = &tlsinfo.Config{}
+	}
+	return newAddrTracer("tls", o), nil
+}
+
+// validate rejects an invalid proxy URL or an unknown probe before any trace
+// starts.
+func validate(o tracer.Options) error {
+	if s, _ := Settings.Get(o); s.Probe != "" {
+		if err := probe.Check(s.Probe); err != nil {
+			return err
+		}
+	}
+	return validateProxy(o.Proxy)
+}
+
+func validateProxy(p string) error {
+	if p == "" || p == netutil.ProxyDirect {
+		return nil
+	}
+	_, err := netutil.ParseProxy(p)
+	return err
+}
+
+func newAddrTracer(name string, o tracer.Options) tracer.Tracer {
+	s, _ := Settings.Get(o)
+	return tracer.Func(func(ctx context.Context, target string) error {
+		// probes know the port of their service
+		if s.Probe != "" && !strings.Contains(target, "://") {
+			if _, _, err := net.SplitHostPort(target); err != nil {
+				target = net.JoinHostPort(strings.Trim(target, "[]"), probe.DefaultPort(s.Probe))
+			}
+		}
+		addr, err := netutil.TargetToAddr(target, name)
+		if err != nil {
+			return err
+		}
+		opts := sharedOptions(o)
+		if name == "tls" {
+			opts = append(opts, WithTLS(o.TLS))
+		}
+		if o.Data != "" {
+			opts = append(opts, WithDataString(o.Data))
+		}
+		return TraceAddr(ctx, addr, opts...)
+	})
+}
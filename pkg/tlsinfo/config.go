@@ -0,0 +1,183 @@
+package tlsinfo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Config is the client TLS configuration shared by the TLS-capable tracers.
+// The zero value verifies against the system roots with Go's default
+// versions and no ALPN.
+type Config struct {
+	// ServerName overrides the SNI and the name verified against the
+	// certificate; it defaults to the target host.
+	ServerName string
+	// ALPN lists the protocols offered in the ClientHello.
+	ALPN []string
+	// MinVersion and MaxVersion bound the negotiated version (0: Go default).
+	MinVersion uint16
+	MaxVersion uint16
+	// CAFile is a PEM bundle used instead of the system roots.
+	CAFile string
+	// CertFile and KeyFile hold a PEM client certificate and key for mTLS.
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify disables chain and hostname verification. Pins are
+	// still enforced.
+	InsecureSkipVerify bool
+	// Pins are SHA-256 hashes of an acceptable certificate or its public key
+	// (SPKI), as hex or "sha256/<base64>". When set, the handshake fails
+	// unless some certificate in the peer chain matches a pin.
+	Pins []string
+}
+
+// IsZero reports whether c leaves every setting at its default.
+func (c Config) IsZero() bool {
+	return c.ServerName == "" && len(c.ALPN) == 0 && c.MinVersion == 0 && c.MaxVersion == 0 &&
+		c.CAFile == "" && c.CertFile == "" && c.KeyFile == "" && !c.InsecureSkipVerify && len(c.Pins) == 0
+}
+
+// Summary describes c for events without secrets: file paths and pins are
+// included, key material is not.
+func (c Config) Summary() map[string]interface{} {
+	m := map[string]interface{}{}
+	if c.ServerName != "" {
+		m["server_name"] = c.ServerName
+	}
+	if len(c.ALPN) > 0 {
+		m["alpn"] = c.ALPN
+	}
+	if c.MinVersion != 0 {
+		m["min_version"] = tls.VersionName(c.MinVersion)
+	}
+	if c.MaxVersion != 0 {
+		m["max_version"] = tls.VersionName(c.MaxVersion)
+	}
+	if c.CAFile != "" {
+		m["ca_file"] = c.CAFile
+	}
+	if c.CertFile != "" {
+		m["client_cert"] = c.CertFile
+	}
+	if c.InsecureSkipVerify {
+		m["insecure_skip_verify"] = true
+	}
+	if len(c.Pins) > 0 {
+		m["pins"] = c.Pins
+	}
+	return m
+}
+
+// Build returns a *tls.Config for connecting to host. host is used as SNI
+// unless ServerName is set; IP literals are never sent as SNI.
+func (c Config) Build(host string) (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName: host,
+		NextProtos: c.ALPN,
+		MinVersion: c.MinVersion,
+		MaxVersion: c.MaxVersion,
+	}
+	if c.ServerName != "" {
+		tc.ServerName = c.ServerName
+	}
+	if c.CAFile != "" {
+		pool, err := LoadCAFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, fmt.Errorf("client certificate and key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	tc.InsecureSkipVerify = c.InsecureSkipVerify
+	if len(c.Pins) > 0 {
+		pins, err := parsePins(c.Pins)
+		if err != nil {
+			return nil, err
+		}
+		tc.VerifyConnection = func(cs tls.ConnectionState) error { return checkPins(cs.PeerCertificates, pins) }
+	}
+	return tc, nil
+}
+
+// parsePins decodes hex or "sha256/<base64>" pins into raw digests.
+func parsePins(in []string) ([][]byte, error) {
+	pins := make([][]byte, 0, len(in))
+	for _, p := range in {
+		var b []byte
+		var err error
+		if rest, ok := strings.CutPrefix(p, "sha256/"); ok {
+			b, err = base64.StdEncoding.DecodeString(rest)
+		} else {
+			b, err = hex.DecodeString(strings.ReplaceAll(p, ":", ""))
+		}
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin %q: want a SHA-256 hash as hex or sha256/<base64>", p)
+		}
+		pins = append(pins, b)
+	}
+	return pins, nil
+}
+
+// checkPins succeeds when any certificate or public key in the chain hashes
+// to one of pins.
+func checkPins(certs []*x509.Certificate, pins [][]byte) error {
+	for _, c := range certs {
+		fp := sha256.Sum256(c.Raw)
+		spki := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+		for _, p := range pins {
+			if bytes.Equal(p, fp[:]) || bytes.Equal(p, spki[:]) {
+				return nil
+			}
+		}
+	}
+	return errors.New("tls: no certificate in the peer chain matches a pinned hash")
+}
+
+// LoadCAFile reads a PEM bundle into a certificate pool.
+func LoadCAFile(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", path)
+	}
+	return pool, nil
+}
+
+// ParseVersion parses "1.0", "1.1", "1.2" or "1.3" (optionally prefixed with
+// "tls") into a tls.Version* constant. The empty string returns 0.
+func ParseVersion(s string) (uint16, error) {
+	v := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "tls")
+	switch strings.TrimSpace(v) {
+	case "":
+		return 0, nil
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("invalid TLS version %q (want 1.0, 1.1, 1.2 or 1.3)", s)
+}
@@ -0,0 +1,180 @@
+// Package tlsinfo builds client TLS configurations for the tracers and turns
+// a TLS connection state into event payload fields: negotiated parameters,
+// the peer certificate chain and an independent chain verification result.
+package tlsinfo
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"math"
+	"time"
+)
+
+// Options describes what the client offered so it can be compared with what
+// was negotiated.
+type Options struct {
+	// Host is the name checked against the leaf certificate. It defaults to
+	// the SNI (ConnectionState.ServerName); set it for IP literal targets,
+	// which are sent without SNI.
+	Host string
+	// ALPN is the list of protocols offered in the ClientHello.
+	ALPN []string
+	// Roots verifies the chain; nil uses the system pool.
+	Roots *x509.CertPool
+	// Now is the reference time for validity checks; zero means time.Now().
+	Now time.Time
+}
+
+// Describe returns payload fields for a tls_handshake_done event. handshakeErr
+// is the handshake result; when it is a certificate verification error the
+// unverified chain is still described.
+func Describe(cs tls.ConnectionState, handshakeErr error, o Options) map[string]interface{} {
+	now := o.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	host := o.Host
+	if host == "" {
+		host = cs.ServerName
+	}
+
+	p := map[string]interface{}{
+		"negotiated_proto": cs.NegotiatedProtocol,
+		"cipher_suite":     cs.CipherSuite,
+		"resumed":          cs.DidResume,
+		"ocsp_stapled":     len(cs.OCSPResponse) > 0,
+		"sct_count":        len(cs.SignedCertificateTimestamps),
+	}
+	if cs.Version != 0 {
+		p["tls_version"] = tls.VersionName(cs.Version)
+	}
+	if cs.CipherSuite != 0 {
+		p["cipher_suite_name"] = tls.CipherSuiteName(cs.CipherSuite)
+	}
+	if cs.ServerName != "" {
+		p["server_name"] = cs.ServerName
+	}
+	if len(o.ALPN) > 0 {
+		p["alpn_offered"] = o.ALPN
+	}
+	if len(cs.OCSPResponse) > 0 {
+		p["ocsp_response_bytes"] = len(cs.OCSPResponse)
+	}
+
+	certs := cs.PeerCertificates
+	var verr *tls.CertificateVerificationError
+	if len(certs) == 0 && errors.As(handshakeErr, &verr) {
+		certs = verr.UnverifiedCertificates
+	}
+	if len(certs) == 0 {
+		return p
+	}
+
+	chain := make([]map[string]interface{}, 0, len(certs))
+	minDays := math.MaxInt
+	for _, c := range certs {
+		d := Certificate(c, now)
+		if days := d["days_to_expiry"].(int); days < minDays {
+			minDays = days
+		}
+		chain = append(chain, d)
+	}
+	p["peer_certificates"] = chain
+	p["min_days_to_expiry"] = minDays
+
+	verified, chains, err := Verify(certs, host, o.Roots, now)
+	p["verified"] = verified
+	if err != nil {
+		p["verify_error"] = err.Error()
+	}
+	if len(chains) > 0 {
+		subjects := make([]string, 0, len(chains[0]))
+		for _, c := range chains[0] {
+			subjects = append(subjects, c.Subject.String())
+		}
+		p["verified_chain"] = subjects
+	}
+	return p
+}
+
+// Verify checks the chain presented by the peer against roots (nil for the
+// system pool) and, when host is set, the leaf's names. It runs
+// independently of the handshake so the result is available even when
+// verification was skipped.
+func Verify(certs []*x509.Certificate, host string, roots *x509.CertPool, now time.Time) (bool, [][]*x509.Certificate, error) {
+	if len(certs) == 0 {
+		return false, nil, errors.New("no peer certificates")
+	}
+	inter := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		inter.AddCert(c)
+	}
+	chains, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: inter,
+		CurrentTime:   now,
+	})
+	return err == nil, chains, err
+}
+
+// Certificate describes a single certificate.
+func Certificate(c *x509.Certificate, now time.Time) map[string]interface{} {
+	fp := sha256.Sum256(c.Raw)
+	spki := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+	keyType, keyBits := publicKey(c)
+	d := map[string]interface{}{
+		"subject":             c.Subject.String(),
+		"issuer":              c.Issuer.String(),
+		"serial":              hex.EncodeToString(c.SerialNumber.Bytes()),
+		"not_before":          c.NotBefore.UTC(),
+		"not_after":           c.NotAfter.UTC(),
+		"days_to_expiry":      int(math.Floor(c.NotAfter.Sub(now).Hours() / 24)),
+		"expired":             now.After(c.NotAfter),
+		"not_yet_valid":       now.Before(c.NotBefore),
+		"is_ca":               c.IsCA,
+		"self_signed":         c.Subject.String() == c.Issuer.String() && c.CheckSignatureFrom(c) == nil,
+		"key_type":            keyType,
+		"signature_algorithm": c.SignatureAlgorithm.String(),
+		"sha256_fingerprint":  hex.EncodeToString(fp[:]),
+		"spki_sha256":         hex.EncodeToString(spki[:]),
+	}
+	if keyBits > 0 {
+		d["key_bits"] = keyBits
+	}
+	if sans := subjectAltNames(c); len(sans) > 0 {
+		d["sans"] = sans
+	}
+	return d
+}
+
+func publicKey(c *x509.Certificate) (string, int) {
+	switch k := c.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "RSA", k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return "ECDSA", k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return "Ed25519", 256
+	}
+	return c.PublicKeyAlgorithm.String(), 0
+}
+
+func subjectAltNames(c *x509.Certificate) []string {
+	var sans []string
+	sans = append(sans, c.DNSNames...)
+	for _, ip := range c.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	sans = append(sans, c.EmailAddresses...)
+	for _, u := range c.URIs {
+		sans = append(sans, u.String())
+	}
+	return sans
+}
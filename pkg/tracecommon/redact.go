@@ -0,0 +1,27 @@
+package tracecommon
+
+import "strings"
+
+// SensitiveHeader reports whether the values of the header or gRPC metadata
+// key name are redacted: Authorization and Cookie in requests, Set-Cookie in
+// responses.
+func SensitiveHeader(name string, req bool) bool {
+	name = strings.ToLower(name)
+	if req {
+		return name == "authorization" || name == "cookie"
+	}
+	return name == "set-cookie"
+}
+
+// CopyHeaders copies h for an event payload, replacing the values of
+// sensitive headers with REDACTED when redact is set.
+func CopyHeaders(h map[string][]string, redact, req bool) map[string][]string {
+	out := make(map[string][]string, len(h))
+	for k, v := range h {
+		if redact && SensitiveHeader(k, req) {
+			v = []string{"REDACTED"}
+		}
+		out[k] = append([]string(nil), v...)
+	}
+	return out
+}
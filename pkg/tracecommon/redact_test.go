@@ -0,0 +1,27 @@
+package tracecommon
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCopyHeaders(t *testing.T) {
+	h := map[string][]string{"Authorization": {"Bearer x"}, "Cookie": {"a=1"}, "Set-Cookie": {"b=2"}, "Accept": {"*/*"}}
+	tests := []struct {
+		redact, req bool
+		want        map[string][]string
+	}{
+		{true, true, map[string][]string{"Authorization": {"REDACTED"}, "Cookie": {"REDACTED"}, "Set-Cookie": {"b=2"}, "Accept": {"*/*"}}},
+		{true, false, map[string][]string{"Authorization": {"Bearer x"}, "Cookie": {"a=1"}, "Set-Cookie": {"REDACTED"}, "Accept": {"*/*"}}},
+		{false, true, h},
+	}
+	for _, tt := range tests {
+		got := CopyHeaders(h, tt.redact, tt.req)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("CopyHeaders(redact=%v, req=%v) = %v, want %v", tt.redact, tt.req, got, tt.want)
+		}
+	}
+	if h["Authorization"][0] != "Bearer x" {
+		t.Error("CopyHeaders modified its input")
+	}
+}
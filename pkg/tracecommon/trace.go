@@ -8,6 +8,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/mrlm-net/tracer/pkg/event"
+	"github.com/mrlm-net/tracer/pkg/netutil"
 )
 
 // StartRequest emits a request_start lifecycle event and returns the traceID.
@@ -69,3 +70,90 @@ func EmitLifecycle(ctx context.Context, emitter event.Emitter, protocol, stage,
 	}
 	emitter.Emit(ctx, e)
 }
+
+// EmitDialAttempt emits a dial_attempt lifecycle event for one Happy Eyeballs
+// connection attempt.
+func EmitDialAttempt(ctx context.Context, emitter event.Emitter, protocol, traceID string, a netutil.DialAttempt) {
+	payload := map[string]interface{}{"index": a.Index, "ip": a.IP.String(), "family": a.Family, "addr": a.Addr, "start": a.Start.UTC(), "won": a.Won, "canceled": a.Canceled}
+	if a.Err != nil {
+		payload["error"] = a.Err.Error()
+	}
+	emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: protocol, EventType: "lifecycle", Stage: "dial_attempt", TraceID: traceID, DurationNS: int64(a.Duration), Payload: payload})
+}
+
+// DNSHooks returns OnDNSStart/OnDNSDone callbacks for netutil.DialOptions that
+// emit dns_start and either dns_done or a dns_error error event.
+func DNSHooks(ctx context.Context, emitter event.Emitter, protocol, traceID string) (func(string), func(netutil.DNSResult)) {
+	start := func(host string) {
+		emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: protocol, EventType: "lifecycle", Stage: "dns_start", TraceID: traceID, Payload: map[string]interface{}{"host": host}})
+	}
+	done := func(r netutil.DNSResult) {
+		payload := map[string]interface{}{"host": r.Host, "resolver": r.Resolver}
+		if len(r.Servers) > 0 {
+			payload["servers"] = r.Servers
+		}
+		if r.Err != nil {
+			payload["error"] = r.Err.Error()
+			payload["error_kind"] = netutil.DNSErrorKind(r.Err)
+			emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: protocol, EventType: "error", Stage: "dns_error", TraceID: traceID, DurationNS: int64(r.Duration), Payload: payload})
+			return
+		}
+		payload["addrs"] = ipStrings(r.Addrs())
+		payload["a"] = ipStrings(r.IPv4)
+		payload["aaaa"] = ipStrings(r.IPv6)
+		emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: protocol, EventType: "lifecycle", Stage: "dns_done", TraceID: traceID, DurationNS: int64(r.Duration), Payload: payload})
+	}
+	return start, done
+}
+
+func ipStrings(ips []net.IP) []string {
+	out := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		out = append(out, ip.String())
+	}
+	return out
+}
+
+// EmitProxyStep emits a proxy negotiation step as a lifecycle event named
+// after the step. A failed step emits a proxy_error error event instead, or
+// after the lifecycle event when the proxy did answer (e.g. a 407 or a SOCKS
+// refusal).
+func EmitProxyStep(ctx context.Context, emitter event.Emitter, protocol, traceID string, s netutil.ProxyStep) {
+	payload := map[string]interface{}{"proxy": s.Proxy}
+	for k, v := range map[string]string{"target": s.Target, "addr": s.Addr, "remote": s.Remote, "method": s.Method, "reply": s.Reply, "bound_addr": s.BoundAddr, "status": s.Status} {
+		if v != "" {
+			payload[k] = v
+		}
+	}
+	if s.Header != nil {
+		payload["headers"] = map[string][]string(s.Header)
+	}
+	if s.Err == nil || s.Status != "" || s.Reply != "" {
+		emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: protocol, EventType: "lifecycle", Stage: s.Name, TraceID: traceID, DurationNS: int64(s.Duration), Payload: payload})
+	}
+	if s.Err != nil {
+		payload = map[string]interface{}{"proxy": s.Proxy, "step": s.Name, "error": s.Err.Error()}
+		if s.Target != "" {
+			payload["target"] = s.Target
+		}
+		emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: protocol, EventType: "error", Stage: "proxy_error", TraceID: traceID, DurationNS: int64(s.Duration), Payload: payload})
+	}
+}
+
+// DialProxy connects to addr through d, reporting each negotiation step with
+// EmitProxyStep and the finished tunnel as tunnel_established. It sets
+// d.OnStep.
+func DialProxy(ctx context.Context, emitter event.Emitter, protocol, traceID string, d *netutil.ProxyDialer, network, addr string) (net.Conn, error) {
+	start := time.Now()
+	d.OnStep = func(s netutil.ProxyStep) { EmitProxyStep(ctx, emitter, protocol, traceID, s) }
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	typ := "connect"
+	if netutil.IsSOCKS(d.URL) {
+		typ = d.URL.Scheme
+	}
+	emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: protocol, EventType: "lifecycle", Stage: "tunnel_established", TraceID: traceID, DurationNS: int64(time.Since(start)), Payload: map[string]interface{}{"proxy": d.URL.Redacted(), "target": addr, "network": network, "type": typ}})
+	return conn, nil
+}
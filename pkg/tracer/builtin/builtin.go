@@ -0,0 +1,15 @@
+// Package builtin registers the protocols shipped with this module (dns,
+// grpc, http, http2, http3, tcp, tls, udp, ws) with the tracer registry. Import it for its side effects:
+//
+//	import _ "github.com/mrlm-net/tracer/pkg/tracer/builtin"
+package builtin
+
+import (
+	_ "github.com/mrlm-net/tracer/pkg/dns"
+	_ "github.com/mrlm-net/tracer/pkg/grpc"
+	_ "github.com/mrlm-net/tracer/pkg/http"
+	_ "github.com/mrlm-net/tracer/pkg/http2"
+	_ "github.com/mrlm-net/tracer/pkg/http3"
+	_ "github.com/mrlm-net/tracer/pkg/tcp"
+	_ "github.com/mrlm-net/tracer/pkg/udp"
+)
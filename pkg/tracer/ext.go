@@ -0,0 +1,38 @@
+package tracer
+
+// Key identifies the settings of one tracer in Options.Ext, so that a tracer
+// registered from another package can take its own options without adding
+// fields to Options. The package implementing the tracer declares the key
+// next to the settings type:
+//
+//	var Settings = tracer.NewKey[TracerSettings]("tcp")
+//
+// and callers pass them with tracer.New("tcp", tcp.Settings.With(...)).
+// Tracers ignore the keys of other tracers, so one option list can serve
+// every protocol.
+type Key[T any] struct {
+	name string
+}
+
+// NewKey returns a new key; each call returns a distinct key, whatever its
+// name.
+func NewKey[T any](name string) *Key[T] { return &Key[T]{name: name} }
+
+// String returns the name the key was created with.
+func (k *Key[T]) String() string { return k.name }
+
+// With returns an Option setting k to v; a later With for k replaces it.
+func (k *Key[T]) With(v T) Option {
+	return func(o *Options) {
+		if o.Ext == nil {
+			o.Ext = make(map[any]any)
+		}
+		o.Ext[k] = v
+	}
+}
+
+// Get returns the value of k in o, and false when it was not set.
+func (k *Key[T]) Get(o Options) (T, bool) {
+	v, ok := o.Ext[k].(T)
+	return v, ok
+}
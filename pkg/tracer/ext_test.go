@@ -0,0 +1,27 @@
+package tracer
+
+import (
+	"context"
+	"testing"
+)
+
+func TestKey(t *testing.T) {
+	type settings struct{ N int }
+	a, b := NewKey[settings]("proto"), NewKey[settings]("proto")
+
+	var got Options
+	Register("key-test", func(o Options) (Tracer, error) {
+		got = o
+		return Func(func(context.Context, string) error { return nil }), nil
+	})
+	if _, err := New("key-test", a.With(settings{N: 1}), a.With(settings{N: 2})); err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := a.Get(got); !ok || s.N != 2 {
+		t.Errorf("a.Get = %+v, %v; want the last value set", s, ok)
+	}
+	// keys with the same name and type are still distinct
+	if s, ok := b.Get(got); ok {
+		t.Errorf("b.Get = %+v, want unset", s)
+	}
+}
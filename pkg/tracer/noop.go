@@ -0,0 +1,31 @@
+package tracer
+
+import (
+	"context"
+	"os"
+
+	"github.com/mrlm-net/tracer/pkg/event"
+	"github.com/mrlm-net/tracer/pkg/tracecommon"
+)
+
+func init() {
+	Register("noop", newNoop)
+}
+
+// newNoop returns a tracer that performs no I/O and only emits request_start
+// and request_end. It is useful to exercise emitters and output formats.
+func newNoop(o Options) (Tracer, error) {
+	em := o.Emitter
+	if em == nil {
+		em = event.NewStdoutEmitter(os.Stdout, true, true)
+	}
+	return Func(func(ctx context.Context, target string) error {
+		traceID := tracecommon.StartRequest(ctx, em, "noop", target)
+		if o.DryRun {
+			tracecommon.EmitDryRun(ctx, em, "noop", traceID)
+			return nil
+		}
+		tracecommon.EmitLifecycle(ctx, em, "noop", "request_end", traceID, "", 0, nil, nil)
+		return nil
+	}), nil
+}
@@ -0,0 +1,179 @@
+package tracer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mrlm-net/tracer/pkg/event"
+	"github.com/mrlm-net/tracer/pkg/netutil"
+	"github.com/mrlm-net/tracer/pkg/tlsinfo"
+)
+
+// Tracer runs a single trace against a target and reports progress through
+// the emitter it was constructed with.
+type Tracer interface {
+	Trace(ctx context.Context, target string) error
+}
+
+// Func adapts an ordinary function to the Tracer interface.
+type Func func(ctx context.Context, target string) error
+
+// Trace calls f(ctx, target).
+func (f Func) Trace(ctx context.Context, target string) error { return f(ctx, target) }
+
+// Options are the settings handed to a tracer Constructor. Shared fields apply
+// to every protocol that uses them; settings of a single tracer are in Ext.
+type Options struct {
+	Emitter event.Emitter
+	// Timeout overrides the protocol default when non-zero.
+	Timeout time.Duration
+	DryRun  bool
+	// IPPref is the IP family preference: "v4", "v6" or ""/"auto".
+	IPPref string
+	// Data is the payload to send (request body for HTTP).
+	Data string
+	// Resolver selects the DNS server and static overrides; nil uses the
+	// system resolver.
+	Resolver *netutil.Resolver
+
+	// HTTP-specific options.
+	Method            string
+	Headers           http.Header
+	InjectTraceHeader bool
+	RedactRequests    bool
+	RedactResponses   bool
+	// CaptureBody is the maximum number of decoded response body bytes to
+	// include in events; 0 disables capture.
+	CaptureBody int64
+	// Proxy is the proxy URL for the http, tcp, tls and udp (SOCKS5 only)
+	// tracers ("" uses the environment for http, "direct" none) and NoProxy
+	// overrides NO_PROXY.
+	Proxy   string
+	NoProxy string
+
+	// TLS configures TLS for protocols that use it (http, http2, http3,
+	// grpc, tls, ws). Plain protocols ignore it.
+	TLS *tlsinfo.Config
+
+	// Ext holds the settings of individual tracers, each under the Key its
+	// package declares (see Key).
+	Ext map[any]any
+}
+
+type Option func(*Options)
+
+// WithEmitter sets the emitter receiving trace events.
+func WithEmitter(e event.Emitter) Option { return func(o *Options) { o.Emitter = e } }
+
+// WithTimeout overrides the protocol default timeout.
+func WithTimeout(d time.Duration) Option { return func(o *Options) { o.Timeout = d } }
+
+// WithDryRun enables dry-run mode.
+func WithDryRun(d bool) Option { return func(o *Options) { o.DryRun = d } }
+
+// WithIPPreference sets IP family preference: "v4", "v6" or ""/"auto".
+func WithIPPreference(p string) Option { return func(o *Options) { o.IPPref = p } }
+
+// WithResolver sets the resolver used to dial.
+func WithResolver(r *netutil.Resolver) Option { return func(o *Options) { o.Resolver = r } }
+
+// WithData sets the payload to send.
+func WithData(s string) Option { return func(o *Options) { o.Data = s } }
+
+// WithMethod sets the HTTP method.
+func WithMethod(m string) Option { return func(o *Options) { o.Method = m } }
+
+// WithHeaders adds HTTP request headers; repeated calls accumulate.
+func WithHeaders(h http.Header) Option {
+	return func(o *Options) {
+		if o.Headers == nil {
+			o.Headers = make(http.Header)
+		}
+		for k, v := range h {
+			for _, vv := range v {
+				o.Headers.Add(k, vv)
+			}
+		}
+	}
+}
+
+// WithInjectTraceHeader controls whether HTTP requests carry X-Trace-Id.
+func WithInjectTraceHeader(v bool) Option { return func(o *Options) { o.InjectTraceHeader = v } }
+
+// WithRedact sets request and response redaction at once.
+func WithRedact(v bool) Option {
+	return func(o *Options) { o.RedactRequests = v; o.RedactResponses = v }
+}
+
+// WithRedactRequests controls redaction of request headers (Authorization, Cookie).
+func WithRedactRequests(v bool) Option { return func(o *Options) { o.RedactRequests = v } }
+
+// WithRedactResponses controls redaction of response headers (Set-Cookie).
+func WithRedactResponses(v bool) Option { return func(o *Options) { o.RedactResponses = v } }
+
+// WithCaptureBody enables HTTP response body capture of up to limit bytes.
+func WithCaptureBody(limit int64) Option { return func(o *Options) { o.CaptureBody = limit } }
+
+// WithProxy sets the proxy (used by the http, tcp, tls and udp tracers) and
+// the NO_PROXY list overriding the environment's.
+func WithProxy(proxy, noProxy string) Option {
+	return func(o *Options) { o.Proxy = proxy; o.NoProxy = noProxy }
+}
+
+// WithTLS sets the client TLS configuration.
+func WithTLS(c tlsinfo.Config) Option { return func(o *Options) { o.TLS = &c } }
+
+// Constructor builds a Tracer for one protocol from shared Options.
+type Constructor func(opts Options) (Tracer, error)
+
+var (
+	mu       sync.RWMutex
+	registry = map[string]Constructor{}
+)
+
+// Register makes a protocol available under name. It is intended to be called
+// from the init function of the package implementing the protocol and panics
+// if name is empty, already registered or ctor is nil.
+func Register(name string, ctor Constructor) {
+	mu.Lock()
+	defer mu.Unlock()
+	if name == "" || ctor == nil {
+		panic("tracer: Register called with empty name or nil constructor")
+	}
+	if _, dup := registry[name]; dup {
+		panic("tracer: Register called twice for protocol " + name)
+	}
+	registry[name] = ctor
+}
+
+// New returns a tracer for the named protocol. Redaction is enabled unless an
+// option turns it off.
+func New(name string, opts ...Option) (Tracer, error) {
+	mu.RLock()
+	ctor, ok := registry[name]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown tracer %q (available: %v)", name, Names())
+	}
+	o := Options{RedactRequests: true, RedactResponses: true}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return ctor(o)
+}
+
+// Names returns the registered protocol names in sorted order.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for n := range registry {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -2,6 +2,7 @@ package udp
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"net"
 	"os"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/mrlm-net/tracer/pkg/event"
+	"github.com/mrlm-net/tracer/pkg/expect"
 	"github.com/mrlm-net/tracer/pkg/netutil"
 	"github.com/mrlm-net/tracer/pkg/tracecommon"
 )
@@ -23,6 +25,19 @@ type traceConfig struct {
 	Data       io.Reader
 	RecvBuffer int
 	IPPref     string
+	// Resolver selects the DNS server and static overrides used to dial.
+	Resolver *netutil.Resolver
+	// Proxy is the SOCKS5 proxy URL (socks5, socks5h) datagrams are relayed
+	// through; "" and netutil.ProxyDirect send them directly.
+	Proxy string
+	// NoProxy lists the hosts that bypass Proxy; "" reads NO_PROXY.
+	NoProxy string
+	// Script runs send/expect steps after Data instead of waiting for one
+	// response.
+	Script *expect.Script
+	// RedactResponses reports the data script steps match or receive only
+	// by its length.
+	RedactResponses bool
 }
 
 // WithEmitter sets a custom emitter.
@@ -46,9 +61,29 @@ func WithRecvBuffer(n int) Option { return func(c *traceConfig) { c.RecvBuffer =
 // WithIPPreference sets IP family preference: "v4", "v6" or ""/"auto".
 func WithIPPreference(p string) Option { return func(c *traceConfig) { c.IPPref = p } }
 
+// WithResolver sets the resolver used to dial (custom DNS server, DoT, DoH
+// or --resolve style overrides); nil uses the system resolver.
+func WithResolver(r *netutil.Resolver) Option { return func(c *traceConfig) { c.Resolver = r } }
+
+// WithProxy relays datagrams through a SOCKS5 proxy (socks5:// or
+// socks5h://) with UDP ASSOCIATE.
+func WithProxy(p string) Option { return func(c *traceConfig) { c.Proxy = p } }
+
+// WithNoProxy sets the hosts that bypass the proxy, in NO_PROXY syntax.
+func WithNoProxy(s string) Option { return func(c *traceConfig) { c.NoProxy = s } }
+
+// WithScript runs the send/expect steps of s after the payload, one
+// datagram per send, emitting a step event for each; the trace fails at the
+// first expectation that is not met.
+func WithScript(s *expect.Script) Option { return func(c *traceConfig) { c.Script = s } }
+
+// WithRedactResponses controls redaction of the data script steps match or
+// receive, which is then reported only by its length.
+func WithRedactResponses(v bool) Option { return func(c *traceConfig) { c.RedactResponses = v } }
+
 // TraceAddr sends a UDP packet to addr (host:port) and optionally waits for a response.
 func TraceAddr(ctx context.Context, addr string, opts ...Option) error {
-	cfg := &traceConfig{Timeout: 5 * time.Second, RecvBuffer: 4096}
+	cfg := &traceConfig{Timeout: 5 * time.Second, RecvBuffer: 4096, RedactResponses: true}
 	for _, o := range opts {
 		o(cfg)
 	}
@@ -64,47 +99,80 @@ func TraceAddr(ctx context.Context, addr string, opts ...Option) error {
 	}
 
 	// Parse and dial with IP-family awareness
-	host, port, joinAddr, ip, isIP, _, perr := netutil.ParseAddr(addr, "80")
+	host, port, _, _, _, zone, perr := netutil.ParseAddr(addr, "80")
 	if perr != nil {
 		cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "udp", EventType: "error", Stage: "resolve_error", TraceID: traceID, Payload: map[string]interface{}{"error": perr.Error()}})
 		return perr
 	}
 
+	proxyURL, err := netutil.ProxyFor(cfg.Proxy, cfg.NoProxy, net.JoinHostPort(host, port))
+	if err == nil && proxyURL != nil && !netutil.IsSOCKS(proxyURL) {
+		err = fmt.Errorf("UDP needs a SOCKS5 proxy, not %s", proxyURL.Scheme)
+	}
+	if err != nil {
+		tracecommon.EmitError(ctx, cfg.Emitter, "udp", "proxy_config", traceID, err)
+		return err
+	}
+
+	// hostnames are dialed with Happy Eyeballs; every attempt is reported
+	dialHost := host
+	if zone != "" {
+		dialHost += "%" + zone
+	}
+	dnsStart, dnsDone := tracecommon.DNSHooks(ctx, cfg.Emitter, "udp", traceID)
+	dialOpts := netutil.DialOptions{
+		Network:    "udp",
+		Prefer:     cfg.IPPref,
+		Timeout:    cfg.Timeout,
+		OnDNSStart: dnsStart,
+		OnDNSDone:  dnsDone,
+		Resolver:   cfg.Resolver,
+		OnAttempt: func(a netutil.DialAttempt) {
+			tracecommon.EmitDialAttempt(ctx, cfg.Emitter, "udp", traceID, a)
+		},
+	}
+
 	var conn net.Conn
-	var chosenIP net.IP
-	var resolved []net.IP
-	var fam string
-	var derr error
-
-	if isIP {
-		if netutil.IsIPv4(ip) {
-			conn, derr = (&net.Dialer{Timeout: cfg.Timeout}).DialContext(ctx, "udp4", joinAddr)
-			fam = "v4"
-		} else {
-			conn, derr = (&net.Dialer{Timeout: cfg.Timeout}).DialContext(ctx, "udp6", joinAddr)
-			fam = "v6"
+	var tags map[string]string
+	var connPayload map[string]interface{}
+	if proxyURL != nil {
+		// the proxy's TCP control connection is dialed with the same options
+		d := &netutil.ProxyDialer{URL: proxyURL, Options: dialOpts}
+		conn, err = tracecommon.DialProxy(ctx, cfg.Emitter, "udp", traceID, d, "udp", net.JoinHostPort(dialHost, port))
+		if err == nil {
+			connPayload = map[string]interface{}{"remote": conn.RemoteAddr().String(), "local": conn.LocalAddr().String(), "proxy": proxyURL.Redacted()}
 		}
-		chosenIP = ip
 	} else {
-		conn, chosenIP, resolved, fam, derr = netutil.ResolveAndDial(ctx, "udp", host, port, cfg.IPPref, cfg.Timeout)
+		var res *netutil.DialResult
+		if res, err = netutil.Dial(ctx, dialHost, port, dialOpts); err == nil {
+			conn = res.Conn
+			tags = tracecommon.BuildTags(res.IP, res.Resolved, res.Family)
+			connPayload = map[string]interface{}{"remote": conn.RemoteAddr().String()}
+		}
 	}
-
-	if derr != nil {
-		tracecommon.EmitError(ctx, cfg.Emitter, "udp", "dial_error", traceID, derr)
-		return derr
+	if err != nil {
+		// resolution failures were already reported as dns_error
+		if !netutil.IsDNSError(err) {
+			tracecommon.EmitError(ctx, cfg.Emitter, "udp", "dial_error", traceID, err)
+		}
+		return err
 	}
 	defer conn.Close()
 
 	connID := uuid.NewString()
-	tags := tracecommon.BuildTags(chosenIP, resolved, fam)
-	tracecommon.EmitLifecycle(ctx, cfg.Emitter, "udp", "connected", traceID, connID, 0, tags, map[string]interface{}{"remote": conn.RemoteAddr().String()})
+	tracecommon.EmitLifecycle(ctx, cfg.Emitter, "udp", "connected", traceID, connID, 0, tags, connPayload)
 
 	// send data
 	if cfg.Data != nil {
 		payload, _ := io.ReadAll(cfg.Data)
 		nn, _ := conn.Write(payload)
 		tracecommon.EmitLifecycle(ctx, cfg.Emitter, "udp", "data_send", traceID, connID, 0, nil, map[string]interface{}{"bytes_sent": nn})
+	}
 
+	var scriptErr error
+	if cfg.Script != nil {
+		scriptErr = runScript(ctx, conn, cfg, traceID, connID)
+	} else if cfg.Data != nil {
 		// wait for response with deadline
 		_ = conn.SetReadDeadline(time.Now().Add(cfg.Timeout))
 		rbuf := make([]byte, cfg.RecvBuffer)
@@ -121,5 +189,5 @@ func TraceAddr(ctx context.Context, addr string, opts ...Option) error {
 
 	cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "udp", EventType: "lifecycle", Stage: "request_end", TraceID: traceID, ConnID: connID})
 
-	return nil
+	return scriptErr
 }
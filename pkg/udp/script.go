@@ -0,0 +1,83 @@
+package udp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mrlm-net/tracer/pkg/event"
+	"github.com/mrlm-net/tracer/pkg/expect"
+)
+
+// runScript runs the script's steps in order on conn, reporting each as a
+// step event, and stops at the first that fails. Every send is one
+// datagram; an expectation is matched against each datagram received until
+// one matches or the step times out.
+func runScript(ctx context.Context, conn net.Conn, cfg *traceConfig, traceID, connID string) error {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	emit := func(kind string, d time.Duration, payload map[string]interface{}) {
+		cfg.Emitter.Emit(ctx, event.Event{Timestamp: time.Now().UTC(), Protocol: "udp", EventType: kind, Stage: "step", TraceID: traceID, ConnID: connID, DurationNS: int64(d), Payload: payload})
+	}
+
+	buf := make([]byte, cfg.RecvBuffer)
+	for i := range cfg.Script.Steps {
+		st := &cfg.Script.Steps[i]
+		r := expect.Result{Index: i + 1, Step: st, Redact: cfg.RedactResponses}
+		began := time.Now()
+		if len(st.Send) > 0 {
+			n, err := conn.Write(st.Send)
+			r.BytesSent = n
+			r.Err = err
+		}
+		sent := time.Now()
+		datagrams := 0
+		if r.Err == nil && st.Expect != nil {
+			timeout := st.Timeout
+			if timeout == 0 {
+				timeout = cfg.Timeout
+			}
+			_ = conn.SetReadDeadline(sent.Add(timeout))
+			for {
+				n, err := conn.Read(buf)
+				if n > 0 {
+					datagrams++
+					r.BytesRecv += n
+					d := buf[:n]
+					if loc := st.Expect.FindIndex(d); loc != nil {
+						r.Match = d[loc[0]:loc[1]]
+						break
+					}
+					r.Unmatched = append(r.Unmatched[:0], d...)
+				}
+				var ne net.Error
+				switch {
+				case err == nil:
+					continue
+				case ctx.Err() != nil:
+					r.Err = ctx.Err()
+				case errors.As(err, &ne) && ne.Timeout():
+					r.Err = fmt.Errorf("no matching datagram within %s", timeout)
+				default:
+					// e.g. ICMP port unreachable
+					r.Err = err
+				}
+				break
+			}
+			r.Wait = time.Since(sent)
+		}
+
+		payload := r.Payload()
+		if st.Expect != nil {
+			payload["datagrams"] = datagrams
+		}
+		if r.Err != nil {
+			emit("error", time.Since(began), payload)
+			return r.Failure()
+		}
+		emit("lifecycle", time.Since(began), payload)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package udp
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mrlm-net/tracer/pkg/expect"
+	"github.com/mrlm-net/tracer/pkg/netutil"
+	"github.com/mrlm-net/tracer/pkg/tracer"
+)
+
+func init() {
+	tracer.Register("udp", newTracer)
+}
+
+// TracerSettings are the udp tracer's own options: Script runs send/expect
+// steps after Data, one datagram per send.
+type TracerSettings struct {
+	Script *expect.Script
+}
+
+// Settings is the key of TracerSettings in tracer.Options.
+var Settings = tracer.NewKey[TracerSettings]("udp")
+
+// sharedOptions converts shared tracer options into TraceAddr options.
+func sharedOptions(o tracer.Options) []Option {
+	s, _ := Settings.Get(o)
+	opts := []Option{WithEmitter(o.Emitter), WithDryRun(o.DryRun), WithIPPreference(o.IPPref)}
+	if o.Timeout > 0 {
+		opts = append(opts, WithTimeout(o.Timeout))
+	}
+	if o.Resolver != nil {
+		opts = append(opts, WithResolver(o.Resolver))
+	}
+	if o.Proxy != "" || o.NoProxy != "" {
+		opts = append(opts, WithProxy(o.Proxy), WithNoProxy(o.NoProxy))
+	}
+	if s.Script != nil {
+		opts = append(opts, WithScript(s.Script), WithRedactResponses(o.RedactResponses))
+	}
+	return opts
+}
+
+// newTracer accepts host:port or a URL target (port inferred for http/https).
+func newTracer(o tracer.Options) (tracer.Tracer, error) {
+	if o.Proxy != "" && o.Proxy != netutil.ProxyDirect {
+		u, err := netutil.ParseProxy(o.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		if !netutil.IsSOCKS(u) {
+			return nil, fmt.Errorf("the udp tracer needs a SOCKS5 proxy, not %s", u.Scheme)
+		}
+	}
+	return tracer.Func(func(ctx context.Context, target string) error {
+		addr, err := netutil.TargetToAddr(target, "udp")
+		if err != nil {
+			return err
+		}
+		opts := sharedOptions(o)
+		if o.Data != "" {
+			opts = append(opts, WithDataString(o.Data))
+		}
+		return TraceAddr(ctx, addr, opts...)
+	}), nil
+}